@@ -0,0 +1,311 @@
+package engines
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/pkg/qmp"
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoints live in their own directory of the VM data directory
+const (
+	CheckpointsDir      = "checkpoints"
+	CheckpointStateFile = "state"
+	checkpointInfoFile  = "checkpoint.json"
+)
+
+// IncomingTimeout bounds the wait for a VM restored from a checkpoint to
+// load its state
+const IncomingTimeout = 2 * time.Minute
+
+// migrateBandwidth lifts the default QEMU migration bandwidth limit, the
+// state is written to a local file
+const migrateBandwidth = 1 << 40
+
+// pollInterval is how often the progress of QEMU jobs is checked
+const pollInterval = 100 * time.Millisecond
+
+// Checkpoint is a saved RAM, device and disk state of a VM
+type Checkpoint struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Disks are the disk images saved with the checkpoint, relative to the
+	// VM data directory
+	Disks []string `json:"disks"`
+	// Size is the space the checkpoint takes on the host, in bytes
+	Size int64 `json:"-"`
+}
+
+// CreateCheckpoint saves the state of the running VM behind the QMP socket
+// into a checkpoint of its data directory, with a copy of the given disks.
+// The guest is paused meanwhile. qemuDataDir is the data directory as QEMU
+// sees it, e.g. /data in a container.
+func CreateCheckpoint(ctx context.Context, socket, dataDir, qemuDataDir, name string,
+	disks []string) (cp Checkpoint, err error) {
+	if !vm.ValidName(name) {
+		return cp, &vm.SpecError{
+			Field: "checkpoint",
+			Value: name,
+			Err:   errors.New("names are made of letters, digits, '-' and '_'"),
+		}
+	}
+
+	dir := filepath.Join(dataDir, CheckpointsDir, name)
+	if _, err := os.Stat(dir); err == nil {
+		return cp, fmt.Errorf("checkpoint %v already exists", name)
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return cp, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	client, err := qmp.Dial(ctx, socket)
+	if err != nil {
+		return cp, err
+	}
+	defer client.Close()
+
+	var status struct {
+		Status string `json:"status"`
+	}
+
+	if err := client.Execute(ctx, "query-status", nil, &status); err != nil {
+		return cp, err
+	}
+
+	if err := client.Execute(ctx, "stop", nil, nil); err != nil {
+		return cp, err
+	}
+
+	// Guests paused beforehand stay paused. The guest resumes even if ctx
+	// has been cancelled meanwhile.
+	if status.Status != "paused" {
+		defer func() {
+			if err := client.Execute(context.Background(), "cont", nil, nil); err != nil {
+				log.Errorf("Couldn't resume the VM after its checkpoint: %v", err)
+			}
+		}()
+	}
+
+	state := filepath.Join(qemuDataDir, CheckpointsDir, name, CheckpointStateFile)
+	if err := migrate(ctx, client, "exec:cat > "+state); err != nil {
+		return cp, fmt.Errorf("saving the VM state: %w", err)
+	}
+
+	// The disks are consistent with the state as long as the guest is paused
+	for _, disk := range disks {
+		dst := filepath.Join(dir, disk)
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+			return cp, err
+		}
+
+		if err := internal.CopyFile(dst, filepath.Join(dataDir, disk)); err != nil {
+			return cp, fmt.Errorf("saving the disk %v: %w", disk, err)
+		}
+	}
+
+	cp = Checkpoint{Name: name, Created: time.Now().UTC(), Disks: disks}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return cp, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, checkpointInfoFile), data, 0640); err != nil {
+		return cp, err
+	}
+
+	cp.Size = internal.DiskUsage(dir)
+
+	return cp, nil
+}
+
+// migrate runs an outgoing migration to uri and waits for its completion
+func migrate(ctx context.Context, client *qmp.Client, uri string) error {
+	params := map[string]interface{}{"max-bandwidth": migrateBandwidth}
+	if err := client.Execute(ctx, "migrate-set-parameters", params, nil); err != nil {
+		return err
+	}
+
+	if err := client.Execute(ctx, "migrate", map[string]interface{}{"uri": uri}, nil); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var info struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		}
+
+		if err := client.Execute(ctx, "query-migrate", nil, &info); err != nil {
+			return err
+		}
+
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("migration %v: %v", info.Status, info.ErrorDesc)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			_ = client.Execute(context.Background(), "migrate_cancel", nil, nil)
+			return ctx.Err()
+		}
+	}
+}
+
+// ListCheckpoints returns the checkpoints of a VM data directory, oldest
+// first
+func ListCheckpoints(dataDir string) ([]Checkpoint, error) {
+	checkpoints := []Checkpoint{}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(dataDir, CheckpointsDir))
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	} else if err != nil {
+		return checkpoints, err
+	}
+
+	for _, dir := range dirs {
+		cp, err := GetCheckpoint(dataDir, dir.Name())
+		if err != nil {
+			log.Warnf("Ignoring the checkpoint %v: %v", dir.Name(), err)
+			continue
+		}
+
+		checkpoints = append(checkpoints, cp)
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Created.Before(checkpoints[j].Created)
+	})
+
+	return checkpoints, nil
+}
+
+// GetCheckpoint returns a checkpoint of a VM data directory
+func GetCheckpoint(dataDir, name string) (Checkpoint, error) {
+	cp := Checkpoint{}
+
+	if !vm.ValidName(name) {
+		return cp, fmt.Errorf("%w: %v", ErrCheckpointNotFound, name)
+	}
+
+	dir := filepath.Join(dataDir, CheckpointsDir, name)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, checkpointInfoFile))
+	if os.IsNotExist(err) {
+		return cp, fmt.Errorf("%w: %v", ErrCheckpointNotFound, name)
+	} else if err != nil {
+		return cp, err
+	}
+
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("malformed checkpoint %v: %w", name, err)
+	}
+
+	cp.Size = internal.DiskUsage(dir)
+
+	return cp, nil
+}
+
+// DeleteCheckpoint removes a checkpoint of a VM data directory
+func DeleteCheckpoint(dataDir, name string) error {
+	if _, err := GetCheckpoint(dataDir, name); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(dataDir, CheckpointsDir, name))
+}
+
+// RestoreDisks puts the disks saved with a checkpoint back in place. The VM
+// must be stopped.
+func RestoreDisks(dataDir string, cp Checkpoint) error {
+	for _, disk := range cp.Disks {
+		src := filepath.Join(dataDir, CheckpointsDir, cp.Name, disk)
+
+		if err := internal.CopyFile(filepath.Join(dataDir, disk), src); err != nil {
+			return fmt.Errorf("restoring the disk %v: %w", disk, err)
+		}
+	}
+
+	return nil
+}
+
+// IncomingURI returns the migration URI QEMU loads the state of a checkpoint
+// from with -incoming
+func IncomingURI(qemuDataDir, name string) string {
+	return "exec:cat " + filepath.Join(qemuDataDir, CheckpointsDir, name, CheckpointStateFile)
+}
+
+// WaitIncoming waits for the VM behind the QMP socket, started with
+// -incoming, to load its checkpoint state and resumes it
+func WaitIncoming(ctx context.Context, socket string) error {
+	ctx, cancel := context.WithTimeout(ctx, IncomingTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var client *qmp.Client
+
+	// QEMU creates its monitor socket once started
+	for client == nil {
+		var err error
+		if client, err = qmp.Dial(ctx, socket); err == nil {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("the VM monitor didn't come up: %w", err)
+		}
+	}
+	defer client.Close()
+
+	for {
+		var status struct {
+			Status string `json:"status"`
+		}
+
+		if err := client.Execute(ctx, "query-status", nil, &status); err != nil {
+			return fmt.Errorf("loading the checkpoint: %w", err)
+		}
+
+		if status.Status != "inmigrate" {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return client.Execute(ctx, "cont", nil, nil)
+}
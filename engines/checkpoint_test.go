@@ -0,0 +1,140 @@
+package engines
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/pkg/qmp/qmptest"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// newMigrationServer returns a QMP server whose migrations write state to
+// the file named by the exec: URI
+func newMigrationServer(t *testing.T, dataDir string) *qmptest.Server {
+	server, err := qmptest.NewServer(filepath.Join(dataDir, "qmp"))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("stop", nil)
+	server.Reply("cont", nil)
+	server.Reply("migrate-set-parameters", nil)
+	server.Reply("query-migrate", map[string]string{"status": "completed"})
+	server.Handle("migrate", func(args json.RawMessage) (interface{}, error) {
+		var migrate struct {
+			URI string `json:"uri"`
+		}
+
+		if err := json.Unmarshal(args, &migrate); err != nil {
+			return nil, err
+		}
+
+		file := strings.TrimPrefix(migrate.URI, "exec:cat > ")
+
+		return nil, ioutil.WriteFile(file, []byte("ram"), 0644)
+	})
+
+	return server
+}
+
+func TestCheckpoint(t *testing.T) {
+	dataDir := t.TempDir()
+	ctx := context.Background()
+	server := newMigrationServer(t, dataDir)
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(dataDir, vm.DisksDir), 0755))
+	disks := []string{"cow_image.qcow2", filepath.Join(vm.DisksDir, "logs.raw")}
+	for _, disk := range disks {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dataDir, disk), []byte("before"), 0644))
+	}
+
+	cp, err := CreateCheckpoint(ctx, server.Socket, dataDir, dataDir, "first", disks)
+	assert.NilError(t, err)
+	assert.Equal(t, cp.Name, "first")
+	assert.Assert(t, cp.Size > 0)
+
+	assert.DeepEqual(t, commandNames(server), []string{"qmp_capabilities", "query-status", "stop",
+		"migrate-set-parameters", "migrate", "query-migrate", "cont"})
+
+	state, err := ioutil.ReadFile(filepath.Join(dataDir, CheckpointsDir, "first", CheckpointStateFile))
+	assert.NilError(t, err)
+	assert.Equal(t, string(state), "ram")
+
+	_, err = CreateCheckpoint(ctx, server.Socket, dataDir, dataDir, "first", disks)
+	assert.Assert(t, is.ErrorContains(err, "checkpoint first already exists"))
+
+	_, err = CreateCheckpoint(ctx, server.Socket, dataDir, dataDir, "../first", disks)
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+
+	// Disks go back to their checkpointed content
+	for _, disk := range disks {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dataDir, disk), []byte("after"), 0644))
+	}
+
+	cp, err = GetCheckpoint(dataDir, "first")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cp.Disks, disks)
+	assert.NilError(t, RestoreDisks(dataDir, cp))
+
+	for _, disk := range disks {
+		data, err := ioutil.ReadFile(filepath.Join(dataDir, disk))
+		assert.NilError(t, err)
+		assert.Equal(t, string(data), "before", disk)
+	}
+
+	checkpoints, err := ListCheckpoints(dataDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(checkpoints), 1)
+	assert.Equal(t, checkpoints[0].Name, "first")
+
+	assert.NilError(t, DeleteCheckpoint(dataDir, "first"))
+
+	err = DeleteCheckpoint(dataDir, "first")
+	assert.Assert(t, errors.Is(err, ErrCheckpointNotFound), "got %v", err)
+
+	checkpoints, err = ListCheckpoints(dataDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(checkpoints), 0)
+}
+
+func TestCheckpointFailure(t *testing.T) {
+	dataDir := t.TempDir()
+	server := newMigrationServer(t, dataDir)
+	server.Reply("query-status", map[string]string{"status": "paused"})
+	server.Reply("query-migrate", map[string]string{"status": "failed", "error-desc": "disk full"})
+
+	_, err := CreateCheckpoint(context.Background(), server.Socket, dataDir, dataDir, "first", nil)
+	assert.Assert(t, is.ErrorContains(err, "saving the VM state: migration failed: disk full"))
+
+	// Guests paused beforehand are left paused
+	assert.Assert(t, !strings.Contains(strings.Join(commandNames(server), " "), "cont"))
+
+	_, err = os.Stat(filepath.Join(dataDir, CheckpointsDir, "first"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestWaitIncoming(t *testing.T) {
+	server := newQMPServer(t, "paused")
+
+	migrating := 2
+	server.Handle("query-status", func(json.RawMessage) (interface{}, error) {
+		if migrating > 0 {
+			migrating--
+			return map[string]string{"status": "inmigrate"}, nil
+		}
+
+		return map[string]string{"status": "paused"}, nil
+	})
+
+	assert.NilError(t, WaitIncoming(context.Background(), server.Socket))
+	assert.DeepEqual(t, commandNames(server),
+		[]string{"qmp_capabilities", "query-status", "query-status", "query-status", "cont"})
+}
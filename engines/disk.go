@@ -0,0 +1,111 @@
+package engines
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+)
+
+// GrowPartCommand grows the guest root partition and filesystem to the size
+// of its disk through the cloud-init growpart and resizefs modules. Cloud
+// images run them on every boot as well.
+const GrowPartCommand = "sudo cloud-init single --name growpart --frequency always && " +
+	"sudo cloud-init single --name resizefs --frequency always"
+
+// OverlayFile is the copy-on-write overlay of the parent image, the root
+// disk of the VM, in the VM data directory of every engine
+const OverlayFile = "cow_image.qcow2"
+
+// DiskSize holds the sizes of a disk image in bytes
+type DiskSize struct {
+	// Virtual is the size of the disk as seen by the guest
+	Virtual int64 `json:"virtual-size"`
+	// Actual is the space the image file takes on the host
+	Actual int64 `json:"actual-size"`
+}
+
+// DiskResize reports the sizes of a disk before and after a resize
+type DiskResize struct {
+	Before DiskSize `json:"before"`
+	After  DiskSize `json:"after"`
+}
+
+// ResizeOptions describes the resize of a VM root disk
+type ResizeOptions struct {
+	// Size is the new virtual size of the disk in bytes
+	Size int64
+	// GrowPart grows the guest root partition over ssh once a running VM
+	// disk has been resized
+	GrowPart bool
+	// User and Key are the ssh credentials GrowPart logs in with
+	User string
+	Key  string
+}
+
+// CheckResize verifies that a disk of the current size can be resized to
+// size. Disks never shrink, that would destroy the guest data.
+func CheckResize(current DiskSize, size int64) error {
+	if size < current.Virtual {
+		return &vm.SpecError{
+			Field: "disk",
+			Value: fmt.Sprint(size),
+			Err:   fmt.Errorf("the disk can't shrink below its current %d bytes", current.Virtual),
+		}
+	}
+
+	return nil
+}
+
+// DeleteOptions tunes the removal of a VM
+type DeleteOptions struct {
+	// StopOptions tunes how the VM is stopped before its removal
+	StopOptions
+	// KeepDisks keeps every data disk, not only the ones flagged with keep
+	KeepDisks bool
+}
+
+// RemoveData deletes a VM data directory. The data disks to keep are left in
+// place, so a new VM with the same name and disks gets them attached again.
+func RemoveData(dataDir string, disks []vm.Disk, opts DeleteOptions) error {
+	keep := map[string]bool{}
+
+	for _, disk := range disks {
+		if disk.Keep || opts.KeepDisks {
+			keep[disk.File()] = true
+		}
+	}
+
+	if len(keep) == 0 {
+		return os.RemoveAll(dataDir)
+	}
+
+	for _, dir := range []string{dataDir, filepath.Join(dataDir, vm.DisksDir)} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			rel, _ := filepath.Rel(dataDir, path)
+
+			if rel == vm.DisksDir || keep[rel] {
+				continue
+			}
+
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for file := range keep {
+		log.Infof("Kept the data disk %v", filepath.Join(dataDir, file))
+	}
+
+	return nil
+}
@@ -1,12 +1,49 @@
 package docker
 
+import (
+	"time"
+
+	"github.com/govm-project/govm/engines"
+)
+
 // Container Images
 const (
 	VMLauncherContainerImage = "docker.io/govm/govm:latest"
 	VNCContainerImage        = "govm/novnc-server"
 )
 
+// The launcher image carries the version of its startvm in a label. Version
+// 2 creates the DATA_DISKS data disks and restores the checkpoint named in
+// /data/incoming, older launchers silently ignore both.
+const (
+	LauncherVersionLabel = "govm.launcher.version"
+	LauncherVersion      = 2
+)
+
 // Default VM Launcher containers' names
 const (
 	VNCServerContainerName = "vm-launcher-novnc-server"
 )
+
+// Files kept in the VM data directory, mounted on /data in the containers
+const (
+	CowImageFile  = engines.OverlayFile
+	QMPSocketFile = "qmp"
+	// IncomingFile names the checkpoint startvm restores on the next start
+	IncomingFile = "incoming"
+)
+
+// execPollInterval is how often Exec checks whether a command has finished
+const execPollInterval = 100 * time.Millisecond
+
+// DefaultRestartPolicy is the restart policy of the VM containers unless
+// the spec sets one
+const DefaultRestartPolicy = "always"
+
+// launcherEnv are the environment variables set by govm for the startvm
+// launcher, as opposed to the user provided container environment
+// nolint: gochecknoglobals
+var launcherEnv = []string{
+	"AUTO_ATTACH", "DEBUG", "KVM_CPU_OPTS", "COW_SIZE",
+	"CLOUD", "CLOUD_INIT_OPTS", "SHARED_DIRS", "DATA_DISKS",
+}
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/pkg/qmp"
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+)
+
+// ResizeDisk grows the copy-on-write disk of a VM, through QMP if the VM is
+// running or with qemu-img in a throwaway launcher container otherwise
+func (e Engine) ResizeDisk(ctx context.Context, namespace, id string,
+	opts engines.ResizeOptions) (resize engines.DiskResize, err error) {
+	container, err := e.inspect(ctx, namespace, id)
+	if err != nil {
+		return resize, err
+	}
+
+	if container.Config == nil || container.Config.Labels["govmType"] != "instance" {
+		return resize, fmt.Errorf("%w: %v is not a GoVM instance", engines.ErrVMNotFound, id)
+	}
+
+	name := container.Config.Labels["vmName"]
+	dataDir := container.Config.Labels["dataDir"]
+	disk := filepath.Join(dataDir, CowImageFile)
+
+	// Non qcow2 parent images are used directly, without an overlay
+	if resize.Before, err = diskSize(disk); os.IsNotExist(err) {
+		return resize, fmt.Errorf("VM %v has no copy-on-write disk to resize", name)
+	} else if err != nil {
+		return resize, err
+	}
+
+	if err := engines.CheckResize(resize.Before, opts.Size); err != nil {
+		return resize, err
+	}
+
+	running := container.State != nil && container.State.Running
+	if running {
+		err = qmp.Command(ctx, filepath.Join(dataDir, QMPSocketFile), "block_resize",
+			map[string]interface{}{"device": "data", "size": opts.Size}, nil)
+		if err != nil {
+			return resize, fmt.Errorf("resizing the disk of the running VM %v: %w", name, err)
+		}
+	} else {
+		err = e.runTool(ctx, dataDir, "qemu-img", "resize", "/data/"+CowImageFile,
+			strconv.FormatInt(opts.Size, 10))
+		if err != nil {
+			return resize, fmt.Errorf("resizing the disk of %v: %w", name, dockerError(err))
+		}
+	}
+
+	if resize.After, err = diskSize(disk); err != nil {
+		return resize, err
+	}
+
+	if !opts.GrowPart {
+		return resize, nil
+	}
+
+	if !running {
+		log.Infof("The partitions of %v will be grown by cloud-init on its next boot", name)
+		return resize, nil
+	}
+
+	out, err := internal.SSHRun(ctx, container.NetworkSettings.IPAddress+":22", opts.User, opts.Key,
+		engines.GrowPartCommand)
+	if err != nil {
+		return resize, fmt.Errorf("growing the partitions of %v: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+
+	return resize, nil
+}
+
+// CreateSnapshot takes an internal snapshot of the copy-on-write disk of a
+// VM, through QMP with its RAM if the VM is running or with qemu-img in a
+// throwaway launcher container otherwise
+func (e Engine) CreateSnapshot(ctx context.Context, namespace, id, name string) (engines.Snapshot, error) {
+	container, snapshots, err := e.snapshots(ctx, namespace, id)
+	if err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	if err := engines.CheckSnapshotName(name, snapshots); err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	dataDir := container.Config.Labels["dataDir"]
+
+	if container.State != nil && container.State.Running {
+		err = engines.SnapshotSave(ctx, filepath.Join(dataDir, QMPSocketFile), name)
+	} else {
+		err = dockerError(e.runTool(ctx, dataDir, "qemu-img", "snapshot", "-c", name, "/data/"+CowImageFile))
+	}
+
+	if err != nil {
+		return engines.Snapshot{}, fmt.Errorf("taking the snapshot %v: %w", name, err)
+	}
+
+	if snapshots, err = engines.ImageSnapshots(filepath.Join(dataDir, CowImageFile)); err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	return engines.FindSnapshot(name, snapshots)
+}
+
+// ListSnapshots lists the snapshots of the copy-on-write disk of a VM,
+// oldest first
+func (e Engine) ListSnapshots(ctx context.Context, namespace, id string) ([]engines.Snapshot, error) {
+	_, snapshots, err := e.snapshots(ctx, namespace, id)
+
+	return snapshots, err
+}
+
+// RevertSnapshot brings the disk of a VM, and its RAM if running and saved
+// with the snapshot, back to a snapshot
+func (e Engine) RevertSnapshot(ctx context.Context, namespace, id, name string) error {
+	return e.snapshot(ctx, namespace, id, name, engines.SnapshotLoad, "-a")
+}
+
+// DeleteSnapshot deletes a snapshot of the disk of a VM
+func (e Engine) DeleteSnapshot(ctx context.Context, namespace, id, name string) error {
+	return e.snapshot(ctx, namespace, id, name, engines.SnapshotDelete, "-d")
+}
+
+// snapshot runs an operation on an existing snapshot, through QMP if the VM
+// is running or with the qemu-img snapshot flag otherwise
+func (e Engine) snapshot(ctx context.Context, namespace, id, name string,
+	online func(context.Context, string, string) error, flag string) error {
+	container, snapshots, err := e.snapshots(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := engines.FindSnapshot(name, snapshots); err != nil {
+		return err
+	}
+
+	dataDir := container.Config.Labels["dataDir"]
+
+	if container.State != nil && container.State.Running {
+		return online(ctx, filepath.Join(dataDir, QMPSocketFile), name)
+	}
+
+	return dockerError(e.runTool(ctx, dataDir, "qemu-img", "snapshot", flag, name, "/data/"+CowImageFile))
+}
+
+// snapshots looks a VM container up and lists the snapshots of its
+// copy-on-write disk
+func (e Engine) snapshots(ctx context.Context, namespace, id string) (types.ContainerJSON, []engines.Snapshot, error) {
+	container, err := e.instance(ctx, namespace, id)
+	if err != nil {
+		return container, nil, err
+	}
+
+	// Non qcow2 parent images are used directly, without an overlay
+	snapshots, err := engines.ImageSnapshots(filepath.Join(container.Config.Labels["dataDir"], CowImageFile))
+	if os.IsNotExist(err) {
+		return container, nil, fmt.Errorf("VM %v has no copy-on-write disk to snapshot",
+			container.Config.Labels["vmName"])
+	}
+
+	return container, snapshots, err
+}
+
+// runTool runs a command of the launcher image with the VM data directory
+// mounted on /data, for the disk operations that need the VM stopped
+func (e Engine) runTool(ctx context.Context, dataDir string, cmd ...string) error {
+	return e.runToolWith(ctx, []string{fmt.Sprintf(vm.DataMount, dataDir)}, nil, cmd...)
+}
+
+// runToolWith runs a command of the launcher image with the given binds,
+// copying its output to out unless nil
+func (e Engine) runToolWith(ctx context.Context, binds []string, out io.Writer, cmd ...string) error {
+	containerConfig := &container.Config{
+		Image:      VMLauncherContainerImage,
+		Entrypoint: cmd[:1],
+		Cmd:        cmd[1:],
+		Labels:     map[string]string{"govmType": "tool"},
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds: binds,
+	}
+
+	return e.docker.Run(ctx, containerConfig, hostConfig, out)
+}
+
+// diskSize returns the sizes of a disk image found in a VM data directory
+func diskSize(disk string) (engines.DiskSize, error) {
+	virtual, actual, err := internal.ImageSize(disk)
+
+	return engines.DiskSize{Virtual: virtual, Actual: actual}, err
+}
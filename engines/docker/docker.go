@@ -2,6 +2,7 @@ package docker
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,37 +10,46 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/govm-project/govm/engines"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/context"
 )
 
 // Docker stands as a docker service client.
 type Docker struct {
-	ctx context.Context
 	*client.Client
 }
 
-// NewDockerClient returns a new Docker service client.
-func NewDockerClient() *Docker {
-	SetAPIVersion()
+// NewDockerClient returns a new Docker service client. It fails with
+// engines.ErrEngineUnavailable when the Docker daemon cannot be reached.
+func NewDockerClient() (*Docker, error) {
+	if err := SetAPIVersion(); err != nil {
+		return nil, fmt.Errorf("%w: %v", engines.ErrEngineUnavailable, err)
+	}
 
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", engines.ErrEngineUnavailable, err)
 	}
 
-	return &Docker{context.Background(), cli}
+	return NewDocker(cli), nil
+}
+
+// NewDocker returns a Docker service client wrapping an existing API client.
+func NewDocker(cli *client.Client) *Docker {
+	return &Docker{cli}
 }
 
 // PullImage pulls image from docker registry
-func (d *Docker) PullImage(image string) error {
-	out, err := d.ImagePull(d.ctx, image, types.ImagePullOptions{})
+func (d *Docker) PullImage(ctx context.Context, image string) error {
+	out, err := d.ImagePull(ctx, image, types.ImagePullOptions{})
 	if err != nil {
 		return err
 	}
@@ -49,45 +59,119 @@ func (d *Docker) PullImage(image string) error {
 	return err
 }
 
-// Exec executes commands inside a running container
-func (d *Docker) Exec(containerName string, execConfig types.ExecConfig) error {
-	resp, err := d.ContainerExecCreate(d.ctx, containerName, execConfig)
+// Exec executes commands inside a running container and waits for them to
+// finish, or for ctx to be done.
+func (d *Docker) Exec(ctx context.Context, containerName string, execConfig types.ExecConfig) error {
+	resp, err := d.ContainerExecCreate(ctx, containerName, execConfig)
 	if err != nil {
 		return err
 	}
 
-	_ = d.ContainerExecStart(d.ctx, resp.ID,
+	_ = d.ContainerExecStart(ctx, resp.ID,
 		types.ExecStartCheck{Detach: true, Tty: false})
 
-	ins, err := d.ContainerExecInspect(d.ctx, resp.ID)
-	for ins.Running || err != nil {
-		ins, err = d.ContainerExecInspect(d.ctx, resp.ID)
-	}
+	ticker := time.NewTicker(execPollInterval)
+	defer ticker.Stop()
 
-	return err
+	for {
+		ins, err := d.ContainerExecInspect(ctx, resp.ID)
+		if err != nil {
+			return err
+		}
+
+		if !ins.Running {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 // Create creates a new docker container
-func (d *Docker) Create(containerConfig *container.Config, hostConfig *container.HostConfig,
+func (d *Docker) Create(ctx context.Context, containerConfig *container.Config, hostConfig *container.HostConfig,
 	networkConfig *network.NetworkingConfig, name string) (string, error) {
-	if !d.ImageExists(containerConfig.Image) {
+	if !d.ImageExists(ctx, containerConfig.Image) {
 		log.Printf("Pulling %v image", containerConfig.Image)
-		err := d.PullImage(containerConfig.Image)
+		err := d.PullImage(ctx, containerConfig.Image)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	resp, err := d.ContainerCreate(d.ctx, containerConfig, hostConfig,
+	resp, err := d.ContainerCreate(ctx, containerConfig, hostConfig,
 		networkConfig, nil, name)
 
 	return resp.ID, err
 }
 
+// Run creates a container, waits for it to exit and removes it. It fails
+// if the container exits with a non zero status. The container output is
+// copied to out unless nil.
+func (d *Docker) Run(ctx context.Context, containerConfig *container.Config,
+	hostConfig *container.HostConfig, out io.Writer) error {
+	id, err := d.Create(ctx, containerConfig, hostConfig, &network.NetworkingConfig{}, "")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// Remove even if ctx has been cancelled meanwhile
+		if err := d.Remove(context.Background(), id); err != nil {
+			log.Warnf("Couldn't remove the container %v: %v", id, err)
+		}
+	}()
+
+	statusCh, errCh := d.ContainerWait(ctx, id, container.WaitConditionNextExit)
+
+	if err := d.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	if out != nil {
+		logs, err := d.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow:     true,
+		})
+		if err != nil {
+			return err
+		}
+		defer logs.Close()
+
+		// The log stream ends with the container
+		copied := make(chan struct{})
+		go func() {
+			defer close(copied)
+			_, _ = stdcopy.StdCopy(out, out, logs)
+		}()
+		defer func() { <-copied }()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case status := <-statusCh:
+		if status.Error != nil {
+			return errors.New(status.Error.Message)
+		}
+
+		if status.StatusCode != 0 {
+			return fmt.Errorf("%v exited with status %d", strings.Join(containerConfig.Entrypoint, " "),
+				status.StatusCode)
+		}
+	}
+
+	return nil
+}
+
 // Start starts a previously created container.
-func (d *Docker) Start(id, name string) error {
+func (d *Docker) Start(ctx context.Context, id, name string) error {
 	if id == "" {
-		container, err := d.Search(name)
+		container, err := d.Search(ctx, name)
 		if err != nil {
 			return err
 		}
@@ -95,13 +179,13 @@ func (d *Docker) Start(id, name string) error {
 		id = container.ID
 	}
 
-	return d.ContainerStart(d.ctx, id, types.ContainerStartOptions{})
+	return d.ContainerStart(ctx, id, types.ContainerStartOptions{})
 }
 
 // Stop stops a previously started container.
-func (d *Docker) Stop(id, name string) error {
+func (d *Docker) Stop(ctx context.Context, id, name string) error {
 	if id == "" {
-		container, err := d.Search(name)
+		container, err := d.Search(ctx, name)
 		if err != nil {
 			return err
 		}
@@ -109,33 +193,32 @@ func (d *Docker) Stop(id, name string) error {
 		id = container.ID
 	}
 
-	return d.ContainerStop(d.ctx, id, nil)
+	return d.ContainerStop(ctx, id, nil)
 }
 
-// Search searches a container from the running docker containers
-func (d *Docker) Search(name string) (types.Container, error) {
-	containers, err := d.ContainerList(d.ctx, types.ContainerListOptions{})
+// Search searches a container from the running docker containers. It fails
+// with engines.ErrVMNotFound when there is no such container.
+func (d *Docker) Search(ctx context.Context, name string) (types.Container, error) {
+	containers, err := d.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
 		return types.Container{}, err
 	}
 
-	err = errors.New("NotFound")
-
 	for _, container := range containers {
 		if container.Names[0] == fmt.Sprintf("/%v", name) {
 			return container, nil
 		}
 	}
 
-	return types.Container{}, err
+	return types.Container{}, fmt.Errorf("%w: no running container %v", engines.ErrVMNotFound, name)
 }
 
 // ImageExists verifies that an image exists in the local docker registry
-func (d *Docker) ImageExists(name string) bool {
+func (d *Docker) ImageExists(ctx context.Context, name string) bool {
 	fltr := filters.NewArgs()
 	fltr.Add("reference", "govm/govm")
 
-	images, err := d.ImageList(d.ctx,
+	images, err := d.ImageList(ctx,
 		types.ImageListOptions{
 			All:     false,
 			Filters: fltr,
@@ -148,14 +231,24 @@ func (d *Docker) ImageExists(name string) bool {
 	return true
 }
 
+// ImageLabels returns the labels of a local image
+func (d *Docker) ImageLabels(ctx context.Context, image string) (map[string]string, error) {
+	ins, _, err := d.ImageInspectWithRaw(ctx, image)
+	if err != nil || ins.Config == nil {
+		return nil, err
+	}
+
+	return ins.Config.Labels, nil
+}
+
 // Inspect inspects and return details about an specific container.
-func (d *Docker) Inspect(id string) (types.ContainerJSON, error) {
-	return d.ContainerInspect(d.ctx, id)
+func (d *Docker) Inspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	return d.ContainerInspect(ctx, id)
 }
 
 // List lists all docker-based VM instances that mee the passed filters
-func (d *Docker) List(args filters.Args) ([]types.Container, error) {
-	return d.ContainerList(context.Background(),
+func (d *Docker) List(ctx context.Context, args filters.Args) ([]types.Container, error) {
+	return d.ContainerList(ctx,
 		types.ContainerListOptions{
 			Quiet:   false,
 			Size:    false,
@@ -169,8 +262,8 @@ func (d *Docker) List(args filters.Args) ([]types.Container, error) {
 }
 
 // Remove wraps the ContainerRemove functionality.
-func (d *Docker) Remove(id string) error {
-	return d.ContainerRemove(context.Background(), id,
+func (d *Docker) Remove(ctx context.Context, id string) error {
+	return d.ContainerRemove(ctx, id,
 		types.ContainerRemoveOptions{
 			RemoveVolumes: false,
 			RemoveLinks:   false,
@@ -181,16 +274,31 @@ func (d *Docker) Remove(id string) error {
 // SetAPIVersion gets local docker server API version.
 // nolint: godox
 // TODO: Investigate how we can replace the exec.Command approach
-func SetAPIVersion() {
+func SetAPIVersion() error {
 	cmd := exec.Command("docker", "version", "--format", "{{.Server.APIVersion}}")
 	cmdOutput := &bytes.Buffer{}
 	cmd.Stdout = cmdOutput
 
 	err := cmd.Run()
 	if err != nil {
-		log.Fatalf("Error getting Docker Server API version: %v", err)
+		return fmt.Errorf("error getting Docker Server API version: %v", err)
 	}
 
 	apiVersion := strings.TrimSpace(cmdOutput.String())
-	_ = os.Setenv("DOCKER_API_VERSION", apiVersion)
+
+	return os.Setenv("DOCKER_API_VERSION", apiVersion)
+}
+
+// dockerError maps the Docker client errors to the engines errors
+func dockerError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case client.IsErrNotFound(err):
+		return fmt.Errorf("%w: %v", engines.ErrVMNotFound, err)
+	case client.IsErrConnectionFailed(err):
+		return fmt.Errorf("%w: %v", engines.ErrEngineUnavailable, err)
+	}
+
+	return err
 }
@@ -1,36 +1,130 @@
 package docker
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/govm-project/govm/engines"
 	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/pkg/qmp"
 	"github.com/govm-project/govm/vm"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 )
 
+// EngineName is the name the docker engine is registered with
+const EngineName = "docker"
+
 // Engine stands an entry point for the docker container services
 // nolint: typecheck
 type Engine struct {
 	docker *Docker
 }
 
+var _ engines.VMEngine = (*Engine)(nil)
+
+// nolint: gochecknoinits
+func init() {
+	engines.Register(EngineName, func(engines.Options) (engines.VMEngine, error) {
+		e := &Engine{}
+		if err := e.Init(); err != nil {
+			return nil, err
+		}
+
+		return e, nil
+	})
+}
+
+// NewEngine returns an Engine using the given docker service client
+func NewEngine(docker *Docker) *Engine {
+	return &Engine{docker: docker}
+}
+
 // Init initializes a the Engine's docker client
 // nolint: typecheck
-func (e *Engine) Init() {
-	e.docker = NewDockerClient()
+func (e *Engine) Init() (err error) {
+	e.docker, err = NewDockerClient()
+
+	return err
+}
+
+// CreateVM creates a new Docker container-based VM instance
+func (e Engine) CreateVM(ctx context.Context, spec vm.Instance) (string, error) {
+	containerName := internal.GenerateContainerName(spec.Namespace, spec.Name)
+	if _, err := e.docker.Inspect(ctx, containerName); err == nil {
+		return "", fmt.Errorf("%w: %v in namespace %v", engines.ErrVMExists, spec.Name, spec.Namespace)
+	} else if !client.IsErrNotFound(err) {
+		return "", dockerError(err)
+	}
+
+	// startvm runs the other parent images directly, without an overlay
+	if format, err := internal.ImageFormat(spec.ParentImage); err == nil && format != engines.FormatQcow2 {
+		log.Warnf("VM %v writes straight into its %v parent image %v, convert it with govm image import",
+			spec.Name, format, spec.ParentImage)
+	}
+
+	// Get an available port for VNC
+	port, err := internal.FindAvailablePort()
+	if err != nil {
+		return "", err
+	}
+
+	containerConfig, hostConfig, networkConfig, err := newContainerConfig(spec, strconv.Itoa(port))
+	if err != nil {
+		return "", err
+	}
+
+	if len(spec.Disks) > 0 {
+		if err := e.checkLauncher(ctx, containerConfig.Image, "data disks"); err != nil {
+			return "", err
+		}
+	}
+
+	id, err := e.docker.Create(ctx, containerConfig, hostConfig, networkConfig, containerName)
+
+	return id, dockerError(err)
+}
+
+// checkLauncher fails unless the launcher image, pulled if missing, ships a
+// startvm implementing feature. Older launchers would silently ignore it.
+func (e Engine) checkLauncher(ctx context.Context, image, feature string) error {
+	if !e.docker.ImageExists(ctx, image) {
+		log.Printf("Pulling %v image", image)
+
+		if err := e.docker.PullImage(ctx, image); err != nil {
+			return dockerError(err)
+		}
+	}
+
+	labels, err := e.docker.ImageLabels(ctx, image)
+	if err != nil {
+		return fmt.Errorf("inspecting the launcher image %v: %w", image, dockerError(err))
+	}
+
+	if version, _ := strconv.Atoi(labels[LauncherVersionLabel]); version < LauncherVersion {
+		return fmt.Errorf("%w: the launcher image %v is too old for %v, rebuild it from the govm Dockerfile",
+			engines.ErrEngineUnavailable, image, feature)
+	}
+
+	return nil
 }
 
-// Create create a new instance
-func (e Engine) Create(spec vm.Instance) (id string, err error) { // nolint: funlen
+// newContainerConfig returns the definition of the container running a VM
+// nolint: funlen
+func newContainerConfig(spec vm.Instance, vncPort string) (*container.Config, *container.HostConfig,
+	*network.NetworkingConfig, error) {
 	vmDataDirectory := spec.Workdir + "/data/" + spec.Name
 	// Default Environment Variables
 	env := []string{
@@ -51,6 +145,7 @@ func (e Engine) Create(spec vm.Instance) (id string, err error) { // nolint: fun
 
 	qemuParams := []string{
 		"-vnc unix:/data/vnc",
+		"-qmp unix:/data/" + QMPSocketFile + ",server=on,wait=off",
 	}
 	if spec.Efi {
 		qemuParams = append(qemuParams, "-bios /OVMF.fd ")
@@ -67,6 +162,8 @@ func (e Engine) Create(spec vm.Instance) (id string, err error) { // nolint: fun
 		fmt.Sprintf(vm.DataMount, vmDataDirectory),
 		fmt.Sprintf(vm.MetadataMount, vmDataDirectory, vm.MedatataFile),
 	}
+	backing := backingBinds(spec.ParentImage)
+	defaultMountBinds = append(defaultMountBinds, backing...)
 	// Append shares to defaultMountBinds if any.
 	// Append guest directory/ies to env (container's environment).
 	if len(spec.Shares) > 0 {
@@ -88,8 +185,31 @@ func (e Engine) Create(spec vm.Instance) (id string, err error) { // nolint: fun
 			fmt.Sprintf(vm.UserDataMount, spec.UserData))
 	}
 
-	// Get an available port for VNC
-	vncPort := strconv.Itoa(internal.FindAvailablePort())
+	// The "startvm" script creates the missing data disks under /data
+	if len(spec.Disks) > 0 {
+		disks := []string{}
+		for _, disk := range spec.Disks {
+			disks = append(disks, fmt.Sprintf("%v:%d:%v:%v", disk.Name, disk.Size, disk.Format, disk.Bus))
+		}
+
+		env = append(env, "DATA_DISKS="+strings.Join(disks, " "))
+	}
+
+	// Keep the spec details the instance is rebuilt from on list/inspect
+	size, err := json.Marshal(spec.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	shares, err := json.Marshal(spec.Shares)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	disks, err := json.Marshal(spec.Disks)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	// Create the Container
 	containerConfig := &container.Config{
@@ -103,15 +223,43 @@ func (e Engine) Create(spec vm.Instance) (id string, err error) { // nolint: fun
 			"namespace":      spec.Namespace,
 			"govmType":       "instance",
 			"vmName":         spec.Name,
+			"image":          spec.ParentImage,
+			"size":           string(size),
 		},
 	}
 
+	if spec.Flavor != "" {
+		containerConfig.Labels["flavor"] = spec.Flavor
+	}
+
+	if len(spec.Shares) > 0 {
+		containerConfig.Labels["shares"] = string(shares)
+	}
+
+	if len(spec.Disks) > 0 {
+		containerConfig.Labels["disks"] = string(disks)
+	}
+
+	// Tell the backing file binds apart from the shares on inspect
+	if len(backing) > 0 {
+		binds, err := json.Marshal(backing)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		containerConfig.Labels["backing"] = string(binds)
+	}
+
 	hostConfig := &container.HostConfig{
 		Privileged:      true,
 		PublishAllPorts: true,
 		Binds:           defaultMountBinds,
 		DNS:             spec.NetOpts.DNS,
-		RestartPolicy:   container.RestartPolicy{Name: "always"},
+		RestartPolicy:   container.RestartPolicy{Name: DefaultRestartPolicy},
+	}
+
+	if spec.RestartPolicy != "" {
+		hostConfig.RestartPolicy.Name = spec.RestartPolicy
 	}
 
 	if spec.NetOpts.IP != "" {
@@ -129,159 +277,359 @@ func (e Engine) Create(spec vm.Instance) (id string, err error) { // nolint: fun
 		},
 	}
 
-	containerName := internal.GenerateContainerName(spec.Namespace, spec.Name)
-	if _, err = e.docker.Search(containerName); err != nil && err.Error() != "NotFound" {
-		return id, err
+	return containerConfig, hostConfig, networkConfig, nil
+}
+
+// StartVM starts a Docker container-based VM instance
+func (e Engine) StartVM(ctx context.Context, namespace, id string) error {
+	container, err := e.inspect(ctx, namespace, id)
+	if err != nil {
+		return err
 	}
 
-	id, err = e.docker.Create(containerConfig, hostConfig, networkConfig, containerName)
+	return e.docker.Start(ctx, container.ID, "")
+}
+
+// StopVM powers a VM off through ACPI and stops its container, right away
+// if the guest doesn't halt in time or opts.Force is set. The container is
+// stopped even after a clean power off so that its restart policy doesn't
+// bring it back.
+func (e Engine) StopVM(ctx context.Context, namespace, id string, opts engines.StopOptions) error {
+	container, err := e.inspect(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
 
-	return id, err
+	e.shutdown(ctx, container, opts)
+
+	return e.docker.Stop(ctx, container.ID, "")
 }
 
-// Start starts a Docker container-based VM instance
-func (e Engine) Start(namespace, id string) error {
-	container, err := e.docker.Inspect(id)
+// shutdown asks the guest of a running VM container to power off, unless
+// opts.Force is set
+func (e Engine) shutdown(ctx context.Context, container types.ContainerJSON, opts engines.StopOptions) {
+	if opts.Force || container.State == nil || !container.State.Running || container.Config == nil {
+		return
+	}
+
+	name := container.Config.Labels["vmName"]
+	dataDir := container.Config.Labels["dataDir"]
+
+	if dataDir == "" {
+		return
+	}
+
+	err := engines.Shutdown(ctx, filepath.Join(dataDir, QMPSocketFile), opts)
+	if err != nil && ctx.Err() == nil {
+		log.Warnf("VM %v didn't power off gracefully, stopping its container: %v", name, err)
+	}
+}
+
+// PauseVM freezes the vCPUs of a running VM through its QMP socket. The
+// container keeps running.
+func (e Engine) PauseVM(ctx context.Context, namespace, id string) error {
+	return e.monitor(ctx, namespace, id, "stop")
+}
+
+// ResumeVM resumes a paused VM
+func (e Engine) ResumeVM(ctx context.Context, namespace, id string) error {
+	return e.monitor(ctx, namespace, id, "cont")
+}
+
+// monitor runs a QMP command without arguments on a running VM
+func (e Engine) monitor(ctx context.Context, namespace, id, command string) error {
+	container, err := e.running(ctx, namespace, id)
 	if err != nil {
-		fullName := internal.GenerateContainerName(namespace, id)
-		container, err = e.docker.Inspect(fullName)
+		return err
+	}
 
-		if err != nil {
-			return err
-		}
+	return qmp.Command(ctx, filepath.Join(container.Config.Labels["dataDir"], QMPSocketFile), command, nil, nil)
+}
+
+// running looks a running VM container up
+func (e Engine) running(ctx context.Context, namespace, id string) (types.ContainerJSON, error) {
+	container, err := e.instance(ctx, namespace, id)
+	if err != nil {
+		return container, err
+	}
+
+	if container.State == nil || !container.State.Running {
+		return container, fmt.Errorf("%w: %v", engines.ErrVMNotRunning, container.Config.Labels["vmName"])
 	}
 
-	return e.docker.Start(container.ID, "")
+	return container, nil
 }
 
-// Stop stops a Docker container-based VM instance
-func (e Engine) Stop(namespace, id string) error {
-	container, err := e.docker.Inspect(id)
+// CreateCheckpoint saves the memory, device and disk state of a running VM
+func (e Engine) CreateCheckpoint(ctx context.Context, namespace, id, name string) (engines.Checkpoint, error) {
+	container, err := e.running(ctx, namespace, id)
 	if err != nil {
-		fullName := internal.GenerateContainerName(namespace, id)
-		container, err = e.docker.Inspect(fullName)
+		return engines.Checkpoint{}, err
+	}
 
-		if err != nil {
-			return err
-		}
+	labels := container.Config.Labels
+	dataDir := labels["dataDir"]
+
+	disks := []string{CowImageFile}
+	for _, disk := range newInstance(container.ID, labels, "", time.Time{}, "").Disks {
+		disks = append(disks, disk.File())
+	}
+
+	return engines.CreateCheckpoint(ctx, filepath.Join(dataDir, QMPSocketFile), dataDir, "/data", name, disks)
+}
+
+// RestoreCheckpoint brings a VM back to a checkpoint. Its container is
+// restarted with QEMU loading the checkpoint state.
+func (e Engine) RestoreCheckpoint(ctx context.Context, namespace, id, name string) (err error) {
+	container, err := e.instance(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	dataDir := container.Config.Labels["dataDir"]
+
+	cp, err := engines.GetCheckpoint(dataDir, name)
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkLauncher(ctx, container.Image, "checkpoint restore"); err != nil {
+		return err
+	}
+
+	// The guest state is about to be thrown away, no need for a clean shutdown
+	if err := e.docker.Stop(ctx, container.ID, ""); err != nil {
+		return err
+	}
+
+	if err := engines.RestoreDisks(dataDir, cp); err != nil {
+		return err
+	}
+
+	// The startvm launcher picks the checkpoint up from this file
+	incoming := filepath.Join(dataDir, IncomingFile)
+	if err := ioutil.WriteFile(incoming, []byte(cp.Name), 0644); err != nil { // nolint: gosec
+		return err
 	}
 
-	return e.docker.Stop(container.ID, "")
+	if err := e.docker.Start(ctx, container.ID, ""); err != nil {
+		_ = os.Remove(incoming)
+		return err
+	}
+
+	return engines.WaitIncoming(ctx, filepath.Join(dataDir, QMPSocketFile))
+}
+
+// ListCheckpoints lists the checkpoints of a VM, oldest first
+func (e Engine) ListCheckpoints(ctx context.Context, namespace, id string) ([]engines.Checkpoint, error) {
+	container, err := e.instance(ctx, namespace, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return engines.ListCheckpoints(container.Config.Labels["dataDir"])
 }
 
-// Save a Docker container-based VM instance
-func (e Engine) Save(namespace, id, outputFile string, stopVM bool) error {
-	fullName := internal.GenerateContainerName(namespace, id)
-	containerObj, err := e.docker.Inspect(fullName)
+// DeleteCheckpoint removes a checkpoint of a VM
+func (e Engine) DeleteCheckpoint(ctx context.Context, namespace, id, name string) error {
+	container, err := e.instance(ctx, namespace, id)
 	if err != nil {
 		return err
 	}
 
-	// Save base image fist into data dir
-	execCmd := []string{}
-	execConfig := types.ExecConfig{
-		AttachStdout: true,
-		Detach:       false,
-		Cmd:          execCmd,
+	return engines.DeleteCheckpoint(container.Config.Labels["dataDir"], name)
+}
+
+// SaveVM flattens the VM disk and its parent image into a standalone image
+// with qemu-img in a throwaway launcher container. The image is verified
+// before it replaces opts.Output.
+func (e Engine) SaveVM(ctx context.Context, namespace, id string, opts engines.SaveOptions) (err error) {
+	container, err := e.instance(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if err := opts.Check(); err != nil {
+		return err
 	}
-	execConfig.Cmd = strings.Split("cp /image/image /data/base_image", " ")
-	err = e.docker.Exec(fullName, execConfig)
+
+	name := container.Config.Labels["vmName"]
+	dataDir := container.Config.Labels["dataDir"]
+
+	image := parentImage(container)
+
+	// Non qcow2 parent images are used directly, without an overlay
+	src, disk := "/data/"+CowImageFile, filepath.Join(dataDir, CowImageFile)
+	if _, err := os.Stat(disk); os.IsNotExist(err) {
+		src, disk = "/image/image", image
+	}
+
+	size, err := diskSize(disk)
 	if err != nil {
-		log.Printf("Couldn't save base image from [%v]", fullName)
+		return err
 	}
 
-	// Stop VM
-	if stopVM {
-		err = e.Stop(namespace, id)
-		if err != nil {
-			log.Printf("Couldn't stop the container [%v]", containerObj.ID)
+	running := container.State != nil && container.State.Running
+	if running && opts.Stop {
+		if err := e.StopVM(ctx, namespace, id, engines.StopOptions{}); err != nil {
 			return err
 		}
+
+		running = false
+
+		defer func() {
+			// Restart even if ctx has been cancelled meanwhile
+			if startErr := e.StartVM(context.Background(), namespace, id); startErr != nil && err == nil {
+				err = fmt.Errorf("starting the VM %v again: %w", name, startErr)
+			}
+		}()
 	}
 
-	// Save VM
-	/// Create a Backup Container
-	baseContainerName := strings.Replace(containerObj.Name, "/", "", -1)
-	backupContainerName := fmt.Sprintf("%v-backup", baseContainerName)
-	_, err = e.docker.Inspect(backupContainerName)
-	if err != nil {
-		containerConfig := &container.Config{
-			Image:    "govm/qemu",
-			Hostname: "backuptest",
-			Cmd:      []string{"sh", "-c", "while true ; do sleep 1; done"},
-			Labels:   map[string]string{},
-		}
-
-		dataDir := containerObj.Config.Labels["dataDir"]
-		currentDir, _ := os.Getwd()
-		mountBinds := []string{
-			fmt.Sprintf(vm.DataMount, dataDir),
-			fmt.Sprintf(vm.DataMount, currentDir) + "-out",
-		}
-		hostConfig := &container.HostConfig{
-			Privileged:      true,
-			PublishAllPorts: true,
-			Binds:           mountBinds,
-		}
-		networkConfig := &network.NetworkingConfig{}
-		backupContainerID, err := e.docker.Create(containerConfig, hostConfig, networkConfig, backupContainerName)
+	partial := opts.PartialOutput()
+	defer func() {
 		if err != nil {
-			log.Printf("Backup Container Error: %v", err)
+			_ = os.Remove(partial)
 		}
-		err = e.Start(namespace, backupContainerID)
-		if err != nil {
-			log.Printf("Backup Container Starting failed: %v", err)
+	}()
+
+	binds := []string{
+		fmt.Sprintf(vm.DataMount, dataDir),
+		fmt.Sprintf(vm.ImageMount, image) + ":ro",
+		filepath.Dir(partial) + ":/out",
+	}
+	binds = append(binds, backingBinds(image)...)
+	out := "/out/" + filepath.Base(partial)
+
+	cmd := append([]string{"qemu-img"}, opts.ConvertArgs(src, out, running)...)
+	if err := e.runToolWith(ctx, binds, engines.ProgressWriter(opts.Progress), cmd...); err != nil {
+		return fmt.Errorf("saving the disk of %v: %w", name, dockerError(err))
+	}
+
+	if opts.Format == engines.FormatQcow2 {
+		if err := e.runToolWith(ctx, binds, nil, "qemu-img", "check", out); err != nil {
+			return fmt.Errorf("checking the saved image: %w", dockerError(err))
 		}
 	}
-	// Exec qemu backup commands
-	cmds := []string{
-		"rm /tmp/*",
-		"cp /data/base_image /data-out/",
-		"cp /data/cow_image.qcow2 /data-out/head.qcow2",
-		"qemu-img rebase -f qcow2 -F qcow2 -p -u -b /data-out/base_image /data-out/head.qcow2",
-		"qemu-img commit -p /data-out/head.qcow2",
-		fmt.Sprintf("mv /data-out/base_image /data-out/%v", outputFile),
-		"rm /data-out/head.qcow2",
+
+	return engines.FinishSave(opts, size.Virtual)
+}
+
+// ImportOverlay makes overlay the root disk of a VM, rebased onto the VM
+// parent image. The overlay file is moved into the VM data directory.
+func (e Engine) ImportOverlay(ctx context.Context, namespace, id, overlay string) error {
+	container, err := e.instance(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	name := container.Config.Labels["vmName"]
+	dataDir := container.Config.Labels["dataDir"]
+
+	// startvm runs the other parent images directly, without an overlay
+	format, err := internal.ImageFormat(parentImage(container))
+	if err != nil {
+		return err
+	}
+
+	if format != engines.FormatQcow2 {
+		return fmt.Errorf("the %v parent image of %v is used without an overlay", format, name)
+	}
+
+	// The current root disk is thrown away, no need for a clean shutdown
+	if err := e.docker.Stop(ctx, container.ID, ""); err != nil {
+		return err
+	}
+
+	if err := os.Rename(overlay, filepath.Join(dataDir, CowImageFile)); err != nil {
+		return err
+	}
+
+	err = e.runTool(ctx, dataDir, "qemu-img", "rebase", "-u", "-F", format, "-b", "/image/image", "/data/"+CowImageFile)
+	if err != nil {
+		return fmt.Errorf("rebasing the disk of %v: %w", name, dockerError(err))
+	}
+
+	return nil
+}
+
+// backingBinds mounts the backing files the parent image of a VM is an
+// overlay of, e.g. for linked clones, where QEMU looks for them: at their
+// host path, or next to the image naming them for relative names
+func backingBinds(image string) []string {
+	chain, err := internal.ImageBackingChain(image)
+	if err != nil {
+		log.Warnf("Couldn't read the backing files of %v: %v", image, err)
 	}
 
-	for _, cmd := range cmds {
-		log.Println(cmd)
-		execConfig.Cmd = strings.Split(cmd, " ")
-		err = e.docker.Exec(backupContainerName, execConfig)
+	binds := []string{}
+	mount := "/image/image"
+
+	for _, backing := range chain {
+		name, err := internal.ImageBackingFile(image)
 		if err != nil {
-			log.Printf("Couldn't execute backup commands on [%v]", backupContainerName)
+			break
 		}
+
+		if filepath.IsAbs(name) {
+			mount = name
+		} else {
+			mount = filepath.Join(filepath.Dir(mount), name)
+		}
+
+		binds = append(binds, backing+":"+mount+":ro")
+		image = backing
 	}
 
-	// Start VM
-	if stopVM {
-		err = e.Start(namespace, id)
-		if err != nil {
-			log.Printf("Couldn't start the container [%v]", containerObj.Name)
-			return err
+	return binds
+}
+
+// backingLabel returns the backing file binds recorded in the labels of a
+// VM container
+func backingLabel(labels map[string]string) map[string]bool {
+	backing := map[string]bool{}
+
+	binds := []string{}
+	if err := json.Unmarshal([]byte(labels["backing"]), &binds); err != nil && labels["backing"] != "" {
+		log.Warnf("Ignoring the backing label of %v: %v", labels["vmName"], err)
+	}
+
+	for _, bind := range binds {
+		backing[bind] = true
+	}
+
+	return backing
+}
+
+// parentImage returns the host path of the parent image of a VM container
+func parentImage(container types.ContainerJSON) string {
+	if container.HostConfig == nil {
+		return ""
+	}
+
+	for _, bind := range container.HostConfig.Binds {
+		if strings.HasSuffix(bind, ":/image/image") {
+			return strings.TrimSuffix(bind, ":/image/image")
 		}
 	}
 
-	// Remove Backup Container
-	govmID := strings.SplitN(backupContainerName, ".", 3)[2]
-	return e.Delete(namespace, govmID)
+	return ""
 }
 
-// List lists  all the Docker container-based VM instances
+// ListVM lists all the Docker container-based VM instances
 // nolint: typecheck
-func (e Engine) List(namespace string, all bool) ([]vm.Instance, error) {
+func (e Engine) ListVM(ctx context.Context, namespace string, all bool) ([]vm.Instance, error) {
 	listArgs := filters.NewArgs()
 	instances := []vm.Instance{}
 
-	listArgs.Add("label", "namespace="+namespace)
+	listArgs.Add("label", "govmType=instance")
 
-	if all {
-		listArgs.Add("label", "govmType=instance")
+	if !all {
+		listArgs.Add("label", "namespace="+namespace)
 	}
 
-	containers, err := e.docker.List(listArgs)
+	containers, err := e.docker.List(ctx, listArgs)
 	if err != nil {
-		return instances, err
+		return instances, dockerError(err)
 	}
 
 	for _, container := range containers {
@@ -291,35 +639,209 @@ func (e Engine) List(namespace string, all bool) ([]vm.Instance, error) {
 			break
 		}
 
-		vncPort, _ := strconv.ParseInt(container.Labels["websockifyPort"], 10, 32)
+		var created time.Time
+		if container.Created > 0 {
+			created = time.Unix(container.Created, 0).UTC()
+		}
 
-		instances = append(instances, vm.Instance{
-			ID:        container.ID[:10],
-			Name:      container.Labels["vmName"],
-			Namespace: namespace,
-			VNCPort:   vncPort,
-			NetOpts:   vm.NetworkingOptions{IP: containerIP},
-		},
-		)
+		ins := newInstance(container.ID, container.Labels, container.State, created, containerIP)
+		ins.Status = guestStatus(ctx, container.Labels, ins.Status)
+		instances = append(instances, ins)
 	}
 
 	return instances, err
 }
 
-// Delete deletes an Instance of GoVM
-func (e Engine) Delete(namespace, id string) error {
-	container, err := e.docker.Inspect(id)
+// InspectVM returns the details of a Docker container-based VM instance
+func (e Engine) InspectVM(ctx context.Context, namespace, id string) (vm.Instance, error) {
+	container, err := e.inspect(ctx, namespace, id)
 	if err != nil {
-		fullName := internal.GenerateContainerName(namespace, id)
-		container, err = e.docker.Inspect(fullName)
+		return vm.Instance{}, err
+	}
 
-		if err != nil {
+	if container.Config == nil || container.Config.Labels["govmType"] != "instance" {
+		return vm.Instance{}, fmt.Errorf("%w: %v is not a GoVM instance", engines.ErrVMNotFound, id)
+	}
+
+	containerIP := ""
+	if settings := container.NetworkSettings; settings != nil {
+		containerIP = settings.IPAddress
+		for _, net := range settings.Networks {
+			if net.IPAddress != "" {
+				containerIP = net.IPAddress
+				break
+			}
+		}
+	}
+
+	state := ""
+	if container.State != nil {
+		state = container.State.Status
+	}
+
+	created, _ := time.Parse(time.RFC3339Nano, container.Created)
+	ins := newInstance(container.ID, container.Config.Labels, state, created, containerIP)
+	ins.Status = guestStatus(ctx, container.Config.Labels, ins.Status)
+
+	if dataDir := container.Config.Labels["dataDir"]; dataDir != "" {
+		ins.Workdir = filepath.Dir(filepath.Dir(dataDir))
+	}
+
+	for _, env := range container.Config.Env {
+		if env == "CLOUD=yes" {
+			ins.Cloud = true
+		}
+
+		if !isLauncherEnv(env) {
+			ins.ContainerEnvVars = append(ins.ContainerEnvVars, env)
+		}
+	}
+
+	for _, param := range container.Config.Cmd {
+		if strings.HasPrefix(param, "-bios") {
+			ins.Efi = true
+		}
+	}
+
+	if container.HostConfig != nil {
+		ins.NetOpts.DNS = container.HostConfig.DNS
+		ins.RestartPolicy = container.HostConfig.RestartPolicy.Name
+		ins.Shares = nil
+		backing := backingLabel(container.Config.Labels)
+
+		for _, bind := range container.HostConfig.Binds {
+			switch {
+			case backing[bind]:
+			case strings.HasSuffix(bind, ":/image/image"):
+				ins.ParentImage = strings.TrimSuffix(bind, ":/image/image")
+			case strings.HasSuffix(bind, ":/cloud-init/openstack/latest/user_data"):
+				ins.UserData = strings.TrimSuffix(bind, ":/cloud-init/openstack/latest/user_data")
+			case strings.HasSuffix(bind, ":/data"),
+				strings.HasSuffix(bind, ":/cloud-init/openstack/latest/"+vm.MedatataFile):
+			default:
+				ins.Shares = append(ins.Shares, bind)
+			}
+		}
+	}
+
+	if settings := container.NetworkSettings; settings != nil {
+		for netID, net := range settings.Networks {
+			ins.NetOpts.NetID = netID
+			ins.NetOpts.MAC = net.MacAddress
+
+			break
+		}
+	}
+
+	return ins, nil
+}
+
+// UpdateVM recreates the container of a VM from a new spec. The data
+// directory, and with it the VM disk and cloud-init data, is preserved.
+// Running VMs are shut down gracefully and started again.
+// If the new container can't be created the previous one is restored.
+func (e Engine) UpdateVM(ctx context.Context, namespace, id string, spec vm.Instance) (err error) {
+	old, err := e.inspect(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if old.Config == nil || old.Config.Labels["govmType"] != "instance" {
+		return fmt.Errorf("%w: %v is not a GoVM instance", engines.ErrVMNotFound, id)
+	}
+
+	// Name and location of a VM can't change
+	spec.Name = old.Config.Labels["vmName"]
+	spec.Namespace = old.Config.Labels["namespace"]
+	spec.Workdir = filepath.Dir(filepath.Dir(old.Config.Labels["dataDir"]))
+
+	containerConfig, hostConfig, networkConfig, err := newContainerConfig(spec, old.Config.Labels["websockifyPort"])
+	if err != nil {
+		return err
+	}
+
+	if len(spec.Disks) > 0 {
+		if err := e.checkLauncher(ctx, containerConfig.Image, "data disks"); err != nil {
 			return err
 		}
 	}
 
+	running := old.State != nil && old.State.Running
+	containerName := strings.TrimPrefix(old.Name, "/")
+
+	// The guest powers off before its container goes away, as on StopVM
+	if running {
+		e.shutdown(ctx, old, engines.StopOptions{})
+
+		if err := e.docker.Stop(ctx, old.ID, ""); err != nil {
+			return dockerError(err)
+		}
+	}
+
+	if err := e.docker.Remove(ctx, old.ID); err != nil {
+		return dockerError(err)
+	}
+
+	newID, err := e.docker.Create(ctx, containerConfig, hostConfig, networkConfig, containerName)
+	if err != nil {
+		log.Warnf("Couldn't create the updated container of %v, restoring it: %v", spec.Name, err)
+
+		// Restore even if ctx has been cancelled meanwhile
+		cleanupCtx := context.Background()
+		oldNetwork := &network.NetworkingConfig{}
+
+		if old.NetworkSettings != nil {
+			oldNetwork.EndpointsConfig = old.NetworkSettings.Networks
+		}
+
+		restoredID, restoreErr := e.docker.Create(cleanupCtx, old.Config, old.HostConfig, oldNetwork, containerName)
+		if restoreErr == nil && running {
+			restoreErr = e.docker.Start(cleanupCtx, restoredID, "")
+		}
+
+		if restoreErr != nil {
+			log.Errorf("Couldn't restore the container of %v: %v", spec.Name, restoreErr)
+		}
+
+		return dockerError(err)
+	}
+
+	if running {
+		return dockerError(e.docker.Start(ctx, newID, ""))
+	}
+
+	return nil
+}
+
+// isLauncherEnv reports whether a container environment variable is set by
+// govm for the startvm launcher
+func isLauncherEnv(env string) bool {
+	key := strings.SplitN(env, "=", 2)[0]
+	for _, launcher := range launcherEnv {
+		if key == launcher {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeleteVM deletes an Instance of GoVM
+func (e Engine) DeleteVM(ctx context.Context, namespace, id string, opts engines.DeleteOptions) error {
+	container, err := e.inspect(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
 	dataPath := container.Config.Labels["dataDir"]
-	defer os.RemoveAll(dataPath)
+	defer func() {
+		disks := newInstance(container.ID, container.Config.Labels, "", time.Time{}, "").Disks
+		if err := engines.RemoveData(dataPath, disks, opts); err != nil {
+			log.Warnf("Couldn't remove the data of %v: %v", id, err)
+		}
+	}()
+
+	e.shutdown(ctx, container, opts.StopOptions)
 
 	pid, err := ioutil.ReadFile(dataPath + "/websockifyPid")
 	if err == nil {
@@ -336,7 +858,101 @@ func (e Engine) Delete(namespace, id string) error {
 		}
 	}
 
-	return e.docker.Remove(container.ID)
+	return e.docker.Remove(ctx, container.ID)
+}
+
+// newInstance rebuilds a VM instance from its container labels and state
+func newInstance(id string, labels map[string]string, state string, created time.Time, ip string) vm.Instance {
+	vncPort, _ := strconv.ParseInt(labels["websockifyPort"], 10, 32)
+
+	ins := vm.Instance{
+		ID:          id[:10],
+		Name:        labels["vmName"],
+		Namespace:   labels["namespace"],
+		ParentImage: labels["image"],
+		Flavor:      labels["flavor"],
+		VNCPort:     vncPort,
+		NetOpts:     vm.NetworkingOptions{IP: ip},
+		Status:      containerStatus(state),
+		Created:     created,
+		Labels:      labels,
+	}
+
+	// Containers created by older govm versions lack these labels
+	if size, ok := labels["size"]; ok {
+		if err := json.Unmarshal([]byte(size), &ins.Size); err != nil {
+			log.Warnf("Ignoring the size label of %v: %v", ins.Name, err)
+		}
+	}
+
+	if shares, ok := labels["shares"]; ok {
+		if err := json.Unmarshal([]byte(shares), &ins.Shares); err != nil {
+			log.Warnf("Ignoring the shares label of %v: %v", ins.Name, err)
+		}
+	}
+
+	if disks, ok := labels["disks"]; ok {
+		if err := json.Unmarshal([]byte(disks), &ins.Disks); err != nil {
+			log.Warnf("Ignoring the disks label of %v: %v", ins.Name, err)
+		}
+	}
+
+	return ins
+}
+
+// containerStatus maps a Docker container state to a VM status
+func containerStatus(state string) vm.Status {
+	switch state {
+	case "created":
+		return vm.StatusCreated
+	case "running":
+		return vm.StatusRunning
+	case "paused":
+		return vm.StatusPaused
+	case "restarting":
+		return vm.StatusRestarting
+	case "exited", "dead":
+		return vm.StatusStopped
+	}
+
+	return vm.StatusUnknown
+}
+
+// guestStatus refines the status of a running container with the run state
+// of the VM it holds
+func guestStatus(ctx context.Context, labels map[string]string, status vm.Status) vm.Status {
+	dataDir := labels["dataDir"]
+	if dataDir == "" {
+		return status
+	}
+
+	return engines.GuestStatus(ctx, filepath.Join(dataDir, QMPSocketFile), status)
+}
+
+// inspect looks a VM container up by ID, or by name within the namespace
+func (e Engine) inspect(ctx context.Context, namespace, id string) (types.ContainerJSON, error) {
+	container, err := e.docker.Inspect(ctx, id)
+	if err != nil {
+		fullName := internal.GenerateContainerName(namespace, id)
+		container, err = e.docker.Inspect(ctx, fullName)
+	}
+
+	return container, dockerError(err)
+}
+
+// instance looks a VM container up, failing for containers govm doesn't
+// run VMs in
+func (e Engine) instance(ctx context.Context, namespace, id string) (types.ContainerJSON, error) {
+	container, err := e.inspect(ctx, namespace, id)
+	if err != nil {
+		return container, err
+	}
+
+	if container.Config == nil || container.Config.Labels["govmType"] != "instance" {
+		return container, fmt.Errorf("%w: %v is not a GoVM instance", engines.ErrVMNotFound, id)
+	}
+
+	return container, nil
 }
 
 // nolint:godox
@@ -0,0 +1,899 @@
+package docker
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/pkg/qmp/qmptest"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/golden"
+)
+
+const testNamespace = "tester"
+
+// newTestSpec returns a checked instance spec whose files live in a
+// temporary working directory
+func newTestSpec(t *testing.T) vm.Instance {
+	workdir := t.TempDir()
+
+	image := filepath.Join(workdir, "image.qcow2")
+	assert.NilError(t, ioutil.WriteFile(image, []byte("image"), 0644))
+
+	key := filepath.Join(workdir, "id_rsa.pub")
+	assert.NilError(t, ioutil.WriteFile(key, []byte("ssh-rsa AAAA test"), 0644))
+
+	userData := filepath.Join(workdir, "user-data")
+	assert.NilError(t, ioutil.WriteFile(userData, []byte("#cloud-config\n"), 0644))
+
+	share := filepath.Join(workdir, "share")
+	assert.NilError(t, os.Mkdir(share, 0755))
+
+	spec := vm.Instance{
+		Name:             "vm",
+		Namespace:        testNamespace,
+		ParentImage:      image,
+		Workdir:          workdir,
+		SSHPublicKeyFile: key,
+		UserData:         userData,
+		Cloud:            true,
+		Efi:              true,
+		Size:             vm.NewSize("haswell", 1, 2, 2, 1, 2048, 20),
+		NetOpts: vm.NetworkingOptions{
+			DNS: []string{"8.8.8.8"},
+		},
+		Shares:           []string{share + ":/mnt/share"},
+		ContainerEnvVars: []string{"http_proxy=http://proxy:3128"},
+		Disks: []vm.Disk{
+			{Name: "scratch", Size: 100, Bus: "scsi"},
+			{Name: "archive", Size: 10, Format: "raw", Keep: true},
+		},
+	}
+	assert.NilError(t, spec.Check())
+
+	return spec
+}
+
+// contract is the part of the container definition the startvm launcher
+// relies on. The golden files under testdata can be regenerated with
+// go test ./engines/docker -test.update-golden
+type contract struct {
+	Name            string
+	Image           string
+	Hostname        string
+	Cmd             []string
+	Env             []string
+	Labels          map[string]string
+	Binds           []string
+	DNS             []string
+	Privileged      bool
+	PublishAllPorts bool
+	RestartPolicy   string
+	Endpoints       map[string]*network.EndpointSettings
+}
+
+// normalize extracts the container contract and replaces the values that
+// change on every run so it can be compared against a golden file
+func normalize(t *testing.T, c *stubContainer, workdir string) string {
+	port := c.Config.Labels["websockifyPort"]
+	_, err := strconv.Atoi(port)
+	assert.NilError(t, err, "websockifyPort label must be a port number")
+
+	out, err := json.MarshalIndent(contract{
+		Name:            c.Name,
+		Image:           c.Config.Image,
+		Hostname:        c.Config.Hostname,
+		Cmd:             c.Config.Cmd,
+		Env:             c.Config.Env,
+		Labels:          c.Config.Labels,
+		Binds:           c.HostConfig.Binds,
+		DNS:             c.HostConfig.DNS,
+		Privileged:      c.HostConfig.Privileged,
+		PublishAllPorts: c.HostConfig.PublishAllPorts,
+		RestartPolicy:   c.HostConfig.RestartPolicy.Name,
+		Endpoints:       c.NetworkingConfig.EndpointsConfig,
+	}, "", "  ")
+	assert.NilError(t, err)
+
+	s := strings.ReplaceAll(string(out), workdir, "$WORKDIR")
+
+	return strings.ReplaceAll(s, `"websockifyPort": "`+port+`"`, `"websockifyPort": "$PORT"`) + "\n"
+}
+
+func TestCreateVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	id, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	c := stub.byName("govm.tester.vm")
+	assert.Assert(t, c != nil)
+	assert.Equal(t, id, c.ID)
+
+	golden.Assert(t, normalize(t, c, spec.Workdir), "create_vm.golden")
+
+	assert.Check(t, is.Contains(stub.calls(), "POST /containers/create"))
+	assert.Check(t, !stub.called("POST /images/create"), "launcher image should not be pulled")
+
+	// The container name is taken, even by a stopped container
+	_, err = engine.CreateVM(ctx, spec)
+	assert.Assert(t, errors.Is(err, engines.ErrVMExists), "got %v", err)
+}
+
+func TestCreateVMPullsLauncherImage(t *testing.T) {
+	stub := newStubDocker()
+	stub.images = nil
+	engine := stub.engine(t)
+	ctx := context.Background()
+
+	_, err := engine.CreateVM(ctx, newTestSpec(t))
+	assert.NilError(t, err)
+
+	assert.Check(t, stub.called("POST /images/create"))
+	assert.DeepEqual(t, stub.images, []string{"govm/govm"})
+}
+
+func TestCreateVMOldLauncher(t *testing.T) {
+	stub := newStubDocker()
+	stub.launcherVersion = ""
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	// Launchers without the version label ignore DATA_DISKS
+	_, err := engine.CreateVM(ctx, spec)
+	assert.Assert(t, errors.Is(err, engines.ErrEngineUnavailable), "got %v", err)
+	assert.Check(t, is.ErrorContains(err, "data disks"))
+	assert.Check(t, !stub.called("POST /containers/create"))
+
+	spec.Disks = nil
+	_, err = engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+}
+
+func TestCreateVMMinimal(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+
+	spec := newTestSpec(t)
+	spec.UserData = ""
+	spec.Cloud = false
+	spec.Efi = false
+	spec.Shares = nil
+	spec.ContainerEnvVars = nil
+	spec.NetOpts.IP = "172.18.0.10"
+	spec.NetOpts.NetID = "govm-net"
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	c := stub.byName("govm.tester.vm")
+	assert.Assert(t, c != nil)
+	golden.Assert(t, normalize(t, c, spec.Workdir), "create_vm_minimal.golden")
+}
+
+func TestCreateVMBackingChain(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	spec := newTestSpec(t)
+
+	// The parent image of a linked clone is an overlay of another image
+	base := spec.ParentImage
+	header := qcow2Header(1 << 30)
+	binary.BigEndian.PutUint64(header[8:], uint64(len(header)))
+	binary.BigEndian.PutUint32(header[16:], uint32(len(base)))
+	spec.ParentImage = filepath.Join(spec.Workdir, "frozen.qcow2")
+	assert.NilError(t, ioutil.WriteFile(spec.ParentImage, append(header, base...), 0444))
+
+	_, err := engine.CreateVM(context.Background(), spec)
+	assert.NilError(t, err)
+
+	c := stub.byName("govm.tester.vm")
+	assert.Check(t, is.Contains(c.HostConfig.Binds, spec.ParentImage+":/image/image"))
+	assert.Check(t, is.Contains(c.HostConfig.Binds, base+":"+base+":ro"))
+
+	// The backing files aren't shares
+	ins, err := engine.InspectVM(context.Background(), testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, ins.ParentImage, spec.ParentImage)
+	assert.DeepEqual(t, ins.Shares, spec.Shares)
+
+	// Relative names are mounted next to the image naming them
+	frozen := filepath.Join(spec.Workdir, "relative.qcow2")
+	binary.BigEndian.PutUint32(header[16:], uint32(len("frozen.qcow2")))
+	assert.NilError(t, ioutil.WriteFile(frozen, append(header, "frozen.qcow2"...), 0444))
+
+	assert.DeepEqual(t, backingBinds(frozen), []string{
+		spec.ParentImage + ":/image/frozen.qcow2:ro",
+		base + ":" + base + ":ro",
+	})
+}
+
+func TestStartStopVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+
+	_, err := engine.CreateVM(ctx, newTestSpec(t))
+	assert.NilError(t, err)
+
+	c := stub.byName("govm.tester.vm")
+
+	// By name within the namespace
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+	assert.Assert(t, c.Running)
+
+	// By container ID
+	assert.NilError(t, engine.StopVM(ctx, testNamespace, c.ID[:10], engines.StopOptions{Force: true}))
+	assert.Assert(t, !c.Running)
+
+	err = engine.StartVM(ctx, "other", "vm")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotFound), "got %v", err)
+	assert.Assert(t, is.ErrorContains(err, "No such container"))
+}
+
+func TestStopVMGraceful(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	server, err := qmptest.NewServer(filepath.Join(spec.Workdir, "data", "vm", QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("system_powerdown", nil)
+	server.ExitOn("system_powerdown")
+
+	assert.NilError(t, engine.StopVM(ctx, testNamespace, "vm", engines.StopOptions{}))
+	assert.Equal(t, server.Commands()[2].Name, "system_powerdown")
+
+	// The container is stopped after the guest powered off
+	assert.Assert(t, !stub.byName("govm.tester.vm").Running)
+	assert.Check(t, is.Contains(stub.calls(), "POST /containers/"+stub.byName("govm.tester.vm").ID+"/stop"))
+
+	// Forced stops and removals don't talk to the guest
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+	assert.NilError(t, engine.DeleteVM(ctx, testNamespace, "vm",
+		engines.DeleteOptions{StopOptions: engines.StopOptions{Force: true}}))
+	assert.Equal(t, len(server.Commands()), 3)
+}
+
+func TestPauseResume(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	err = engine.PauseVM(ctx, testNamespace, "vm")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+
+	server, err := qmptest.NewServer(filepath.Join(spec.Workdir, "data", "vm", QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]interface{}{"status": "paused", "running": false})
+	server.Reply("stop", nil)
+	server.Reply("cont", nil)
+
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+	assert.NilError(t, engine.PauseVM(ctx, testNamespace, "vm"))
+	assert.NilError(t, engine.ResumeVM(ctx, testNamespace, "vm"))
+
+	names := []string{}
+	for _, cmd := range server.Commands() {
+		names = append(names, cmd.Name)
+	}
+	assert.DeepEqual(t, names, []string{"qmp_capabilities", "stop", "qmp_capabilities", "cont"})
+
+	// The container keeps running while the guest is paused
+	assert.Assert(t, stub.byName("govm.tester.vm").Running)
+
+	ins, err := engine.InspectVM(ctx, testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, ins.Status, vm.StatusPaused)
+}
+
+// nolint: funlen
+func TestCheckpoint(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+	dataDir := filepath.Join(spec.Workdir, "data", "vm")
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	_, err = engine.CreateCheckpoint(ctx, testNamespace, "vm", "first")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+
+	// The disks startvm would have created
+	assert.NilError(t, os.MkdirAll(filepath.Join(dataDir, vm.DisksDir), 0755))
+	disks := []string{CowImageFile, "disks/scratch.qcow2", "disks/archive.raw"}
+	for _, disk := range disks {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dataDir, disk), []byte("disk"), 0644))
+	}
+
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("stop", nil)
+	server.Reply("cont", nil)
+	server.Reply("migrate-set-parameters", nil)
+	server.Reply("query-migrate", map[string]string{"status": "completed"})
+	server.Handle("migrate", func(args json.RawMessage) (interface{}, error) {
+		// QEMU sees the data directory as /data
+		if string(args) != `{"uri":"exec:cat \u003e /data/checkpoints/first/state"}` {
+			return nil, fmt.Errorf("unexpected migration %s", args)
+		}
+
+		return nil, ioutil.WriteFile(filepath.Join(dataDir, "checkpoints/first/state"), []byte("ram"), 0644)
+	})
+
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	cp, err := engine.CreateCheckpoint(ctx, testNamespace, "vm", "first")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cp.Disks, disks)
+
+	checkpoints, err := engine.ListCheckpoints(ctx, testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, len(checkpoints), 1)
+
+	// Older launchers ignore the checkpoint to load, the VM is left alone
+	stub.launcherVersion = "1"
+	err = engine.RestoreCheckpoint(ctx, testNamespace, "vm", "first")
+	assert.Assert(t, errors.Is(err, engines.ErrEngineUnavailable), "got %v", err)
+	assert.Check(t, !stub.called("POST /containers/"+stub.byName("govm.tester.vm").ID+"/stop"))
+	stub.launcherVersion = strconv.Itoa(LauncherVersion)
+
+	// The container is restarted with the checkpoint to load
+	assert.NilError(t, engine.RestoreCheckpoint(ctx, testNamespace, "vm", "first"))
+
+	incoming, err := ioutil.ReadFile(filepath.Join(dataDir, IncomingFile))
+	assert.NilError(t, err)
+	assert.Equal(t, string(incoming), "first")
+
+	id := stub.byName("govm.tester.vm").ID
+	assert.Check(t, is.Contains(stub.calls(), "POST /containers/"+id+"/stop"))
+	assert.Assert(t, stub.byName("govm.tester.vm").Running)
+
+	err = engine.RestoreCheckpoint(ctx, testNamespace, "vm", "second")
+	assert.Assert(t, errors.Is(err, engines.ErrCheckpointNotFound), "got %v", err)
+
+	assert.NilError(t, engine.DeleteCheckpoint(ctx, testNamespace, "vm", "first"))
+}
+
+func TestListVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+
+	running := stub.add(&stubContainer{
+		Name:    "govm.tester.one",
+		Running: true,
+		IP:      "172.17.0.2",
+		Config: &container.Config{Labels: map[string]string{
+			"govmType":       "instance",
+			"namespace":      testNamespace,
+			"vmName":         "one",
+			"websockifyPort": "5901",
+		}},
+	})
+	stub.add(&stubContainer{
+		Name: "govm.tester.two",
+		Config: &container.Config{Labels: map[string]string{
+			"govmType":  "instance",
+			"namespace": testNamespace,
+			"vmName":    "two",
+		}},
+	})
+	stub.add(&stubContainer{
+		Name:    "govm.other.three",
+		Running: true,
+		Config: &container.Config{Labels: map[string]string{
+			"govmType":  "instance",
+			"namespace": "other",
+			"vmName":    "three",
+		}},
+	})
+
+	instances, err := engine.ListVM(ctx, testNamespace, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(instances), 2)
+
+	assert.DeepEqual(t, instances[0], vm.Instance{
+		ID:        running.ID[:10],
+		Name:      "one",
+		Namespace: testNamespace,
+		VNCPort:   5901,
+		NetOpts:   vm.NetworkingOptions{IP: "172.17.0.2"},
+		Status:    vm.StatusRunning,
+		Labels:    running.Config.Labels,
+	})
+	assert.Equal(t, instances[1].Name, "two")
+	assert.Equal(t, instances[1].Status, vm.StatusStopped)
+
+	instances, err = engine.ListVM(ctx, testNamespace, true)
+	assert.NilError(t, err)
+	assert.Equal(t, len(instances), 3)
+	assert.Equal(t, instances[2].Namespace, "other")
+}
+
+func TestInspectVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+	spec.Flavor = "small"
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	ins, err := engine.InspectVM(ctx, testNamespace, "vm")
+	assert.NilError(t, err)
+
+	assert.Equal(t, ins.Name, "vm")
+	assert.Equal(t, ins.Namespace, testNamespace)
+	assert.Equal(t, ins.Status, vm.StatusRunning)
+	assert.Equal(t, ins.ParentImage, spec.ParentImage)
+	assert.Equal(t, ins.Flavor, "small")
+	assert.Equal(t, ins.Size, spec.Size)
+	assert.DeepEqual(t, ins.Shares, spec.Shares)
+	assert.DeepEqual(t, ins.Disks, spec.Disks)
+	assert.DeepEqual(t, ins.NetOpts.DNS, spec.NetOpts.DNS)
+	assert.DeepEqual(t, ins.ContainerEnvVars, spec.ContainerEnvVars)
+	assert.Equal(t, ins.UserData, spec.UserData)
+	assert.Equal(t, ins.Workdir, spec.Workdir)
+	assert.Equal(t, ins.RestartPolicy, DefaultRestartPolicy)
+	assert.Assert(t, ins.Cloud && ins.Efi)
+	assert.Assert(t, time.Since(ins.Created) < time.Minute, "created %v", ins.Created)
+
+	// Containers that aren't VMs are not exposed
+	stub.add(&stubContainer{Name: "other", Config: &container.Config{}})
+	_, err = engine.InspectVM(ctx, testNamespace, "other")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotFound), "got %v", err)
+}
+
+func TestUpdateVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	old := stub.byName("govm.tester.vm")
+
+	server, err := qmptest.NewServer(filepath.Join(spec.Workdir, "data", "vm", QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("system_powerdown", nil)
+	server.ExitOn("system_powerdown")
+
+	spec.Size.RAM = 8192
+	spec.ContainerEnvVars = []string{"https_proxy=http://proxy:3128"}
+	spec.NetOpts.DNS = []string{"1.1.1.1"}
+	spec.RestartPolicy = "unless-stopped"
+	assert.NilError(t, engine.UpdateVM(ctx, testNamespace, "vm", spec))
+
+	// The guest powered off and its container stopped before the recreate
+	assert.Equal(t, server.Commands()[2].Name, "system_powerdown")
+	assert.Check(t, is.DeepEqual(updateCalls(stub.calls(), old.ID), []string{
+		"POST /containers/" + old.ID + "/stop",
+		"DELETE /containers/" + old.ID,
+		"POST /containers/create",
+	}))
+
+	c := stub.byName("govm.tester.vm")
+	assert.Assert(t, c.ID != old.ID, "the container should be recreated")
+	assert.Assert(t, c.Running)
+	assert.Equal(t, c.Config.Labels["websockifyPort"], old.Config.Labels["websockifyPort"])
+	assert.Check(t, is.Contains(strings.Join(c.Config.Env, " "), "-m 8192"))
+	assert.Check(t, is.Contains(c.Config.Env, "https_proxy=http://proxy:3128"))
+	assert.DeepEqual(t, c.HostConfig.DNS, []string{"1.1.1.1"})
+	assert.Equal(t, c.HostConfig.RestartPolicy.Name, "unless-stopped")
+
+	// The VM data is kept
+	_, err = os.Stat(filepath.Join(spec.Workdir, "data", "vm", vm.MedatataFile))
+	assert.NilError(t, err)
+
+	err = engine.UpdateVM(ctx, testNamespace, "missing", spec)
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotFound), "got %v", err)
+}
+
+// updateCalls returns the stop, removal and creation requests of calls
+// made on or after the stop of the container id
+func updateCalls(calls []string, id string) []string {
+	filtered := []string{}
+
+	for _, call := range calls {
+		if call == "POST /containers/"+id+"/stop" || len(filtered) > 0 &&
+			(call == "DELETE /containers/"+id || call == "POST /containers/create") {
+			filtered = append(filtered, call)
+		}
+	}
+
+	return filtered
+}
+
+func TestUpdateVMRestore(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	old := stub.byName("govm.tester.vm")
+
+	stub.failCreates = 1
+	spec.Size.RAM = 8192
+	err = engine.UpdateVM(ctx, testNamespace, "vm", spec)
+	assert.Assert(t, is.ErrorContains(err, "injected create failure"))
+
+	// The previous container is back and running
+	c := stub.byName("govm.tester.vm")
+	assert.Assert(t, c != nil)
+	assert.Assert(t, c.Running)
+	assert.DeepEqual(t, c.Config.Env, old.Config.Env)
+}
+
+// qcow2Header returns the header of a qcow2 image of the given virtual size
+func qcow2Header(size int64) []byte {
+	header := make([]byte, 72)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint64(header[24:], uint64(size))
+
+	return header
+}
+
+func TestResizeDisk(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	disk := filepath.Join(spec.Workdir, "data", "vm", CowImageFile)
+
+	// The parent image is used directly until startvm creates the overlay
+	_, err = engine.ResizeDisk(ctx, testNamespace, "vm", engines.ResizeOptions{Size: 30 << 30})
+	assert.Assert(t, is.ErrorContains(err, "has no copy-on-write disk"))
+
+	assert.NilError(t, ioutil.WriteFile(disk, qcow2Header(20<<30), 0644))
+
+	stub.onRun = func(cmd []string) int {
+		size, err := strconv.ParseInt(cmd[len(cmd)-1], 10, 64)
+		if err != nil {
+			return 1
+		}
+
+		if err := ioutil.WriteFile(disk, qcow2Header(size), 0644); err != nil {
+			return 1
+		}
+
+		return 0
+	}
+
+	resize, err := engine.ResizeDisk(ctx, testNamespace, "vm", engines.ResizeOptions{Size: 30 << 30})
+	assert.NilError(t, err)
+	assert.Equal(t, resize.Before.Virtual, int64(20<<30))
+	assert.Equal(t, resize.After.Virtual, int64(30<<30))
+	assert.DeepEqual(t, stub.runs, []string{"qemu-img resize /data/cow_image.qcow2 32212254720"})
+
+	// The tool container is gone
+	assert.Equal(t, len(stub.containers), 1)
+
+	_, err = engine.ResizeDisk(ctx, testNamespace, "vm", engines.ResizeOptions{Size: 10 << 30})
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+
+	stub.onRun = func([]string) int { return 1 }
+	_, err = engine.ResizeDisk(ctx, testNamespace, "vm", engines.ResizeOptions{Size: 40 << 30})
+	assert.Assert(t, is.ErrorContains(err, "qemu-img exited with status 1"))
+
+	// Running VMs are resized through their QMP socket
+	server, err := qmptest.NewServer(filepath.Join(spec.Workdir, "data", "vm", QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Fail("block_resize", "GenericError", "injected")
+
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	_, err = engine.ResizeDisk(ctx, testNamespace, "vm", engines.ResizeOptions{Size: 40 << 30})
+	assert.Assert(t, is.ErrorContains(err, "QMP block_resize: GenericError: injected"))
+
+	commands := server.Commands()
+	assert.Equal(t, len(commands), 2)
+	assert.Equal(t, string(commands[1].Arguments), `{"device":"data","size":42949672960}`)
+	assert.Equal(t, len(stub.runs), 2)
+}
+
+// qcow2Snapshot is an entry of the snapshot table written by qcow2Image
+type qcow2Snapshot struct {
+	name    string
+	date    time.Time
+	vmState int64
+}
+
+// qcow2Image returns a qcow2 image of the given virtual size holding
+// snapshots, laid out like QEMU does for version 3 images
+func qcow2Image(size int64, snapshots ...qcow2Snapshot) []byte {
+	image := qcow2Header(size)
+	binary.BigEndian.PutUint32(image[60:], uint32(len(snapshots)))
+	binary.BigEndian.PutUint64(image[64:], uint64(len(image)))
+
+	for i, snapshot := range snapshots {
+		id := strconv.Itoa(i + 1)
+
+		entry := make([]byte, 56)
+		binary.BigEndian.PutUint16(entry[12:], uint16(len(id)))
+		binary.BigEndian.PutUint16(entry[14:], uint16(len(snapshot.name)))
+		binary.BigEndian.PutUint32(entry[16:], uint32(snapshot.date.Unix()))
+		binary.BigEndian.PutUint32(entry[36:], 16)
+		binary.BigEndian.PutUint64(entry[40:], uint64(snapshot.vmState))
+		binary.BigEndian.PutUint64(entry[48:], uint64(size))
+
+		entry = append(entry, id+snapshot.name...)
+		entry = append(entry, make([]byte, (8-len(entry)%8)%8)...)
+		image = append(image, entry...)
+	}
+
+	return image
+}
+
+// nolint: funlen
+func TestSnapshots(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	_, err = engine.ListSnapshots(ctx, testNamespace, "vm")
+	assert.Assert(t, is.ErrorContains(err, "has no copy-on-write disk"))
+
+	disk := filepath.Join(spec.Workdir, "data", "vm", CowImageFile)
+	created := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	assert.NilError(t, ioutil.WriteFile(disk, qcow2Image(20<<30, qcow2Snapshot{"base", created, 0}), 0644))
+
+	// Stopped VMs are snapshotted with qemu-img in a tool container
+	stub.onRun = func(cmd []string) int {
+		image := qcow2Image(20<<30, qcow2Snapshot{"base", created, 0}, qcow2Snapshot{cmd[3], created, 0})
+		if err := ioutil.WriteFile(disk, image, 0644); err != nil {
+			return 1
+		}
+
+		return 0
+	}
+
+	snapshot, err := engine.CreateSnapshot(ctx, testNamespace, "vm", "before-upgrade")
+	assert.NilError(t, err)
+	assert.Equal(t, snapshot.Name, "before-upgrade")
+	assert.Equal(t, snapshot.Created, created)
+
+	_, err = engine.CreateSnapshot(ctx, testNamespace, "vm", "base")
+	assert.Assert(t, is.ErrorContains(err, "snapshot base already exists"))
+
+	assert.NilError(t, engine.RevertSnapshot(ctx, testNamespace, "vm", "base"))
+	assert.DeepEqual(t, stub.runs, []string{
+		"qemu-img snapshot -c before-upgrade /data/cow_image.qcow2",
+		"qemu-img snapshot -a base /data/cow_image.qcow2",
+	})
+
+	err = engine.DeleteSnapshot(ctx, testNamespace, "vm", "missing")
+	assert.Assert(t, errors.Is(err, engines.ErrSnapshotNotFound), "got %v", err)
+
+	// Running VMs go through QMP, their RAM is saved as well
+	assert.NilError(t, ioutil.WriteFile(disk, qcow2Image(20<<30,
+		qcow2Snapshot{"base", created, 0}, qcow2Snapshot{"live", created, 1 << 30}), 0644))
+
+	server, err := qmptest.NewServer(filepath.Join(spec.Workdir, "data", "vm", QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-block", []interface{}{
+		map[string]interface{}{"device": "data", "inserted": map[string]string{"node-name": "#block100"}},
+	})
+	server.Reply("snapshot-load", nil)
+	server.Reply("job-dismiss", nil)
+	server.Reply("query-jobs", []map[string]string{{"id": "govm-snapshot", "status": "concluded"}})
+
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+	assert.NilError(t, engine.RevertSnapshot(ctx, testNamespace, "vm", "live"))
+	assert.Equal(t, server.Commands()[2].Name, "snapshot-load")
+	assert.Equal(t, len(stub.runs), 2)
+
+	snapshots, err := engine.ListSnapshots(ctx, testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, snapshots, []engines.Snapshot{
+		{Name: "base", Created: created},
+		{Name: "live", Created: created, VMStateSize: 1 << 30},
+	})
+}
+
+func TestImportOverlay(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	overlay := filepath.Join(t.TempDir(), "overlay.qcow2")
+	assert.NilError(t, ioutil.WriteFile(overlay, qcow2Header(20<<30), 0644))
+
+	err = engine.ImportOverlay(ctx, testNamespace, "vm", overlay)
+	assert.Assert(t, is.ErrorContains(err, "the raw parent image of vm is used without an overlay"))
+
+	assert.NilError(t, ioutil.WriteFile(spec.ParentImage, qcow2Header(20<<30), 0644))
+	assert.NilError(t, engine.ImportOverlay(ctx, testNamespace, "vm", overlay))
+	assert.DeepEqual(t, stub.runs, []string{"qemu-img rebase -u -F qcow2 -b /image/image /data/cow_image.qcow2"})
+	assert.Assert(t, !stub.byName("govm.tester.vm").Running)
+
+	_, err = os.Stat(filepath.Join(spec.Workdir, "data", "vm", CowImageFile))
+	assert.NilError(t, err)
+}
+
+func TestDeleteVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+	_, err = os.Stat(dataDir)
+	assert.NilError(t, err)
+
+	// Created by startvm on the first boot
+	assert.NilError(t, os.Mkdir(filepath.Join(dataDir, vm.DisksDir), 0755))
+	for _, disk := range spec.Disks {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dataDir, disk.File()), []byte{}, 0644))
+	}
+
+	assert.NilError(t, engine.DeleteVM(ctx, testNamespace, spec.Name, engines.DeleteOptions{}))
+	assert.Assert(t, stub.byName("govm.tester.vm") == nil)
+
+	// Only the disk to keep is left
+	_, err = os.Stat(filepath.Join(dataDir, "disks", "archive.raw"))
+	assert.NilError(t, err)
+
+	for _, file := range []string{vm.MedatataFile, "disks/scratch.qcow2"} {
+		_, err = os.Stat(filepath.Join(dataDir, file))
+		assert.Assert(t, os.IsNotExist(err), file)
+	}
+}
+
+// nolint: funlen
+func TestSaveVM(t *testing.T) {
+	stub := newStubDocker()
+	engine := stub.engine(t)
+	ctx := context.Background()
+	spec := newTestSpec(t)
+	dir := t.TempDir()
+
+	_, err := engine.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	// qemu-img writes the image to the partial output mounted in /out
+	stub.onRun = func(cmd []string) int {
+		if cmd[1] != "convert" {
+			return 0
+		}
+
+		out := filepath.Join(dir, strings.TrimPrefix(cmd[len(cmd)-1], "/out/"))
+		image := make([]byte, 5)
+		if cmd[4] == engines.FormatQcow2 {
+			image = qcow2Header(20 << 30)
+		}
+
+		if err := ioutil.WriteFile(out, image, 0644); err != nil {
+			return 1
+		}
+
+		return 0
+	}
+	stub.runOutput = "    (0.00/100%)\r    (100.00/100%)\r"
+
+	// The parent image is used directly until startvm creates the overlay
+	reported := []float64{}
+	out := filepath.Join(dir, "out.raw")
+	assert.NilError(t, engine.SaveVM(ctx, testNamespace, "vm", engines.SaveOptions{
+		Output:   out,
+		Format:   engines.FormatRaw,
+		Progress: func(percent float64) { reported = append(reported, percent) },
+	}))
+	assert.DeepEqual(t, reported, []float64{0, 100})
+	assert.DeepEqual(t, stub.runs, []string{"qemu-img convert -p -O raw /image/image /out/.out.raw.partial"})
+
+	// Running VMs are stopped meanwhile on request
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(spec.Workdir, "data", "vm", CowImageFile), qcow2Header(20<<30), 0644))
+	assert.NilError(t, engine.StartVM(ctx, testNamespace, "vm"))
+
+	out = filepath.Join(dir, "out.qcow2")
+	assert.NilError(t, engine.SaveVM(ctx, testNamespace, "vm", engines.SaveOptions{Output: out, Compress: true, Stop: true}))
+	assert.DeepEqual(t, stub.runs[1:], []string{
+		"qemu-img convert -p -O qcow2 -c /data/cow_image.qcow2 /out/.out.qcow2.partial",
+		"qemu-img check /out/.out.qcow2.partial",
+	})
+	assert.Check(t, is.Contains(stub.calls(), "POST /containers/"+stub.byName("govm.tester.vm").ID+"/stop"))
+	assert.Assert(t, stub.byName("govm.tester.vm").Running)
+
+	// Otherwise the disk is read without taking its lock
+	stub.runs = nil
+	assert.NilError(t, engine.SaveVM(ctx, testNamespace, "vm", engines.SaveOptions{Output: out}))
+	assert.Equal(t, stub.runs[0], "qemu-img convert -p -O qcow2 -U /data/cow_image.qcow2 /out/.out.qcow2.partial")
+
+	// The saved image must match the disk
+	err = engine.SaveVM(ctx, testNamespace, "vm", engines.SaveOptions{Output: out, Format: engines.FormatRaw})
+	assert.Assert(t, is.ErrorContains(err, "the saved image is 5 bytes instead of 21474836480"))
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 2)
+
+	// Only the VM container is left
+	assert.Equal(t, len(stub.containers), 1)
+}
+
+func TestSaveVMCancel(t *testing.T) {
+	stub := newStubDocker()
+	stub.hangRun = "qemu-img convert"
+	engine := stub.engine(t)
+
+	_, err := engine.CreateVM(context.Background(), newTestSpec(t))
+	assert.NilError(t, err)
+	assert.NilError(t, engine.StartVM(context.Background(), testNamespace, "vm"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	dir := t.TempDir()
+	err = engine.SaveVM(ctx, testNamespace, "vm", engines.SaveOptions{Output: filepath.Join(dir, "out.img"), Stop: true})
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+
+	// The tool container is removed and the VM started again
+	assert.Equal(t, len(stub.containers), 1)
+	assert.Assert(t, stub.byName("govm.tester.vm").Running)
+}
@@ -0,0 +1,383 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"gotest.tools/assert"
+)
+
+// stubAPIVersion is the Docker Engine API version spoken by the stub
+const stubAPIVersion = "1.41"
+
+// stubContainer is a container known by the stub Docker API server
+type stubContainer struct {
+	ID               string
+	Name             string
+	Config           *container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+	Running          bool
+	IP               string
+	Created          time.Time
+}
+
+// createRequest is the body sent by the client on container creation
+type createRequest struct {
+	*container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+}
+
+// stubDocker is a minimal in-memory stand-in for the Docker Engine API that
+// implements just the endpoints used by the docker engine.
+type stubDocker struct {
+	mu         sync.Mutex
+	nextID     int
+	containers []*stubContainer
+	images     []string
+	execs      map[string][]string
+	execLog    []string
+	requests   []string
+
+	// hangExec makes the exec commands starting with it run forever
+	hangExec string
+	// failCreates makes the next container creations fail
+	failCreates int
+	// runs are the commands of the containers waited for to exit
+	runs []string
+	// onRun runs a waited for container command, returning its exit status
+	onRun func(cmd []string) int
+	// hangRun makes the waited for container commands starting with it run
+	// until the client gives up
+	hangRun string
+	// runOutput is the stdout log of the containers
+	runOutput string
+	// launcherVersion is the govm.launcher.version label of the images
+	launcherVersion string
+}
+
+var stubRoute = regexp.MustCompile(`^/v[0-9.]+(/.*)$`)
+
+func newStubDocker() *stubDocker {
+	return &stubDocker{
+		images:          []string{"govm/govm:latest"},
+		execs:           map[string][]string{},
+		launcherVersion: strconv.Itoa(LauncherVersion),
+	}
+}
+
+// engine starts the stub server and returns an Engine talking to it
+func (s *stubDocker) engine(t *testing.T) *Engine {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")),
+		client.WithHTTPClient(srv.Client()),
+		client.WithVersion(stubAPIVersion),
+	)
+	assert.NilError(t, err)
+
+	return NewEngine(NewDocker(cli))
+}
+
+// add registers an already existing container
+func (s *stubDocker) add(c *stubContainer) *stubContainer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	c.ID = fmt.Sprintf("%064d", s.nextID)
+	s.containers = append(s.containers, c)
+
+	return c
+}
+
+// byName returns the container with the given name, if any
+func (s *stubDocker) byName(name string) *stubContainer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.containers {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// calls returns the API requests received so far as "METHOD /path" strings
+func (s *stubDocker) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+// called reports whether the given "METHOD /path" request was received
+func (s *stubDocker) called(request string) bool {
+	for _, call := range s.calls() {
+		if call == request {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup finds a container by ID, ID prefix or name. Callers must hold s.mu.
+func (s *stubDocker) lookup(ref string) *stubContainer {
+	for _, c := range s.containers {
+		if c.Name == ref || c.ID == ref || (len(ref) >= 10 && strings.HasPrefix(c.ID, ref)) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// nolint: funlen, gocyclo
+func (s *stubDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.Path
+	if m := stubRoute.FindStringSubmatch(path); m != nil {
+		path = m[1]
+	}
+
+	s.requests = append(s.requests, r.Method+" "+path)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && path == "/_ping":
+		w.Header().Set("API-Version", stubAPIVersion)
+		fmt.Fprint(w, "OK")
+
+	case r.Method == http.MethodGet && path == "/images/json":
+		images := []types.ImageSummary{}
+		for _, image := range s.images {
+			images = append(images, types.ImageSummary{ID: image, RepoTags: []string{image}})
+		}
+
+		writeJSON(w, http.StatusOK, images)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		labels := map[string]string{LauncherVersionLabel: s.launcherVersion}
+		writeJSON(w, http.StatusOK, types.ImageInspect{
+			ID:     strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json"),
+			Config: &container.Config{Labels: labels},
+		})
+
+	case r.Method == http.MethodPost && path == "/images/create":
+		s.images = append(s.images, r.URL.Query().Get("fromImage"))
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pulled"})
+
+	case r.Method == http.MethodGet && path == "/containers/json":
+		s.listContainers(w, r)
+
+	case r.Method == http.MethodPost && path == "/containers/create":
+		if s.failCreates > 0 {
+			s.failCreates--
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "injected create failure"})
+
+			return
+		}
+
+		req := createRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.nextID++
+		c := &stubContainer{
+			ID:               fmt.Sprintf("%064d", s.nextID),
+			Name:             r.URL.Query().Get("name"),
+			Config:           req.Config,
+			HostConfig:       req.HostConfig,
+			NetworkingConfig: req.NetworkingConfig,
+			Created:          time.Now().UTC(),
+		}
+		s.containers = append(s.containers, c)
+
+		writeJSON(w, http.StatusCreated, container.ContainerCreateCreatedBody{ID: c.ID})
+
+	case len(parts) == 3 && parts[0] == "containers":
+		c := s.lookup(parts[1])
+		if c == nil {
+			notFound(w, parts[1])
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && parts[2] == "json":
+			writeJSON(w, http.StatusOK, c.inspect())
+		case r.Method == http.MethodPost && parts[2] == "start":
+			c.Running = true
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && parts[2] == "stop":
+			c.Running = false
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && parts[2] == "wait":
+			cmd := append(append([]string{}, c.Config.Entrypoint...), c.Config.Cmd...)
+			s.runs = append(s.runs, strings.Join(cmd, " "))
+
+			if s.hangRun != "" && strings.HasPrefix(strings.Join(cmd, " "), s.hangRun) {
+				s.mu.Unlock()
+				<-r.Context().Done()
+				s.mu.Lock()
+
+				return
+			}
+
+			status := 0
+			if s.onRun != nil {
+				status = s.onRun(cmd)
+			}
+
+			writeJSON(w, http.StatusOK, container.ContainerWaitOKBody{StatusCode: int64(status)})
+		case r.Method == http.MethodGet && parts[2] == "logs":
+			w.WriteHeader(http.StatusOK)
+			_, _ = stdcopy.NewStdWriter(w, stdcopy.Stdout).Write([]byte(s.runOutput))
+		case r.Method == http.MethodPost && parts[2] == "exec":
+			config := types.ExecConfig{}
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			id := fmt.Sprintf("exec%d", len(s.execs))
+			s.execs[id] = config.Cmd
+
+			writeJSON(w, http.StatusCreated, types.IDResponse{ID: id})
+		default:
+			http.NotFound(w, r)
+		}
+
+	case len(parts) == 2 && parts[0] == "containers" && r.Method == http.MethodDelete:
+		for i, c := range s.containers {
+			if c == s.lookup(parts[1]) {
+				s.containers = append(s.containers[:i], s.containers[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+
+				return
+			}
+		}
+
+		notFound(w, parts[1])
+
+	case len(parts) == 3 && parts[0] == "exec":
+		cmd, ok := s.execs[parts[1]]
+		if !ok {
+			notFound(w, parts[1])
+			return
+		}
+
+		switch parts[2] {
+		case "start":
+			s.execLog = append(s.execLog, strings.Join(cmd, " "))
+			w.WriteHeader(http.StatusOK)
+		case "json":
+			running := s.hangExec != "" && strings.HasPrefix(strings.Join(cmd, " "), s.hangExec)
+			writeJSON(w, http.StatusOK, types.ContainerExecInspect{ExecID: parts[1], Running: running})
+		default:
+			http.NotFound(w, r)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listContainers answers GET /containers/json honoring the label filters
+func (s *stubDocker) listContainers(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	all := r.URL.Query().Get("all") == "1"
+	list := []types.Container{}
+
+	for _, c := range s.containers {
+		if !all && !c.Running {
+			continue
+		}
+
+		if !args.MatchKVList("label", c.Config.Labels) {
+			continue
+		}
+
+		state := "exited"
+		if c.Running {
+			state = "running"
+		}
+
+		list = append(list, types.Container{
+			ID:      c.ID,
+			Created: c.Created.Unix(),
+			Names:   []string{"/" + c.Name},
+			Image:   c.Config.Image,
+			Labels:  c.Config.Labels,
+			State:   state,
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {IPAddress: c.IP},
+				},
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// inspect returns the container as reported by GET /containers/{id}/json
+func (c *stubContainer) inspect() types.ContainerJSON {
+	status := "exited"
+	if c.Running {
+		status = "running"
+	}
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         c.ID,
+			Created:    c.Created.Format(time.RFC3339Nano),
+			Name:       "/" + c.Name,
+			Image:      c.Config.Image,
+			State:      &types.ContainerState{Status: status, Running: c.Running},
+			HostConfig: c.HostConfig,
+		},
+		Config: c.Config,
+		NetworkSettings: &types.NetworkSettings{
+			DefaultNetworkSettings: types.DefaultNetworkSettings{IPAddress: c.IP},
+		},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter, ref string) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: " + ref})
+}
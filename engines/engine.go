@@ -1,17 +1,92 @@
 package engines
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
 	"github.com/govm-project/govm/pkg/termutil"
 	"github.com/govm-project/govm/vm"
 )
 
+// DefaultEngine is the engine used when none is selected
+const DefaultEngine = "docker"
+
 // VMEngine stands as an abstraction for VMs management engines
+// Every method honors the cancellation and deadline of the given context.
 type VMEngine interface {
-	CreateVM(spec vm.Instance) (string, error)
-	StartVM(namespace, id string) error
-	StopVM(namespace, id string) error
-	DeleteVM(namespace, id string) error
-	SSHVM(namespace, id, user, key string, term *termutil.Terminal) error
-	ListVM(namespace string, all bool) ([]vm.Instance, error)
-	SaveVM(namespace, id, outputFile string, stopVM bool) error
+	CreateVM(ctx context.Context, spec vm.Instance) (string, error)
+	StartVM(ctx context.Context, namespace, id string) error
+	StopVM(ctx context.Context, namespace, id string, opts StopOptions) error
+	PauseVM(ctx context.Context, namespace, id string) error
+	ResumeVM(ctx context.Context, namespace, id string) error
+	DeleteVM(ctx context.Context, namespace, id string, opts DeleteOptions) error
+	SSHVM(ctx context.Context, namespace, id, user, key string, term *termutil.Terminal) error
+	ListVM(ctx context.Context, namespace string, all bool) ([]vm.Instance, error)
+	InspectVM(ctx context.Context, namespace, id string) (vm.Instance, error)
+	UpdateVM(ctx context.Context, namespace, id string, spec vm.Instance) error
+	ResizeDisk(ctx context.Context, namespace, id string, opts ResizeOptions) (DiskResize, error)
+	SaveVM(ctx context.Context, namespace, id string, opts SaveOptions) error
+	ImportOverlay(ctx context.Context, namespace, id, overlay string) error
+	CreateCheckpoint(ctx context.Context, namespace, id, name string) (Checkpoint, error)
+	RestoreCheckpoint(ctx context.Context, namespace, id, name string) error
+	ListCheckpoints(ctx context.Context, namespace, id string) ([]Checkpoint, error)
+	DeleteCheckpoint(ctx context.Context, namespace, id, name string) error
+	CreateSnapshot(ctx context.Context, namespace, id, name string) (Snapshot, error)
+	ListSnapshots(ctx context.Context, namespace, id string) ([]Snapshot, error)
+	RevertSnapshot(ctx context.Context, namespace, id, name string) error
+	DeleteSnapshot(ctx context.Context, namespace, id, name string) error
+}
+
+// Options holds the settings shared by every engine
+type Options struct {
+	// Workdir is the govm working directory holding the VMs data
+	Workdir string
+}
+
+// Factory builds a ready to use VMEngine
+type Factory func(opts Options) (VMEngine, error)
+
+// nolint: gochecknoglobals
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a VM engine available by the provided name. Registering
+// the same name twice replaces the previous factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[name] = factory
+}
+
+// New creates a new instance of the VM engine registered as name
+func New(name string, opts Options) (VMEngine, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok || factory == nil {
+		return nil, fmt.Errorf("%w: unknown engine %q (available: %v)", ErrEngineUnavailable, name, Names())
+	}
+
+	return factory(opts)
+}
+
+// Names returns the sorted list of registered engine names
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
 }
@@ -0,0 +1,25 @@
+package engines
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRegistry(t *testing.T) {
+	var built int
+
+	Register("test", func(Options) (VMEngine, error) {
+		built++
+		return nil, nil
+	})
+
+	_, err := New("test", Options{})
+	assert.NilError(t, err)
+	assert.Equal(t, built, 1)
+	assert.Check(t, is.Contains(Names(), "test"))
+
+	_, err = New("missing", Options{})
+	assert.Assert(t, is.ErrorContains(err, `unknown engine "missing"`))
+}
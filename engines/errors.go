@@ -0,0 +1,24 @@
+package engines
+
+import "errors"
+
+// Errors returned by every VMEngine implementation. Engines wrap them with
+// details, so check them with errors.Is.
+var (
+	// ErrVMNotFound is returned when the requested VM does not exist
+	ErrVMNotFound = errors.New("VM not found")
+	// ErrVMExists is returned when creating a VM whose name is taken
+	ErrVMExists = errors.New("VM already exists")
+	// ErrVMNotRunning is returned by the operations that need the VM
+	// running, e.g. pausing it
+	ErrVMNotRunning = errors.New("VM not running")
+	// ErrCheckpointNotFound is returned when the requested checkpoint of a
+	// VM does not exist
+	ErrCheckpointNotFound = errors.New("checkpoint not found")
+	// ErrSnapshotNotFound is returned when the requested disk snapshot of a
+	// VM does not exist
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrEngineUnavailable is returned when the engine backend (Docker
+	// daemon, QEMU binaries...) cannot be used
+	ErrEngineUnavailable = errors.New("engine unavailable")
+)
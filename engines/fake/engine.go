@@ -0,0 +1,706 @@
+// Package fake provides an in-memory VMEngine meant for tests. It never
+// touches Docker, QEMU or the host network.
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/pkg/termutil"
+	"github.com/govm-project/govm/vm"
+)
+
+// EngineName is the name tests usually register the fake engine with
+const EngineName = "fake"
+
+// Instance is a VM kept by the fake engine
+type Instance struct {
+	vm.Instance
+	Running bool
+	Paused  bool
+	Saves   []string
+	// Checkpoints are the checkpoints of the instance, oldest first
+	Checkpoints []engines.Checkpoint
+	// Restored are the checkpoints the instance was restored to, in order
+	Restored []string
+	// Snapshots are the disk snapshots of the instance, oldest first
+	Snapshots []engines.Snapshot
+	// Reverted are the snapshots the instance was reverted to, in order
+	Reverted []string
+	// Overlays are the overlays imported as the instance root disk, in order
+	Overlays []string
+}
+
+// Engine is an in-memory VMEngine. Failures can be injected per method with
+// FailOn and Hang.
+type Engine struct {
+	mu        sync.Mutex
+	nextID    int
+	instances map[string]*Instance
+	failures  map[string]error
+	hangs     map[string]bool
+	calls     []string
+	deleted   map[string]engines.DeleteOptions
+	stopped   map[string]engines.StopOptions
+}
+
+var _ engines.VMEngine = (*Engine)(nil)
+
+// New returns an empty fake engine
+func New() *Engine {
+	return &Engine{
+		instances: map[string]*Instance{},
+		failures:  map[string]error{},
+		hangs:     map[string]bool{},
+		deleted:   map[string]engines.DeleteOptions{},
+		stopped:   map[string]engines.StopOptions{},
+	}
+}
+
+// Factory returns an engines.Factory that always hands out e, so tests can
+// inspect the state left by the code under test.
+func (e *Engine) Factory() engines.Factory {
+	return func(engines.Options) (engines.VMEngine, error) {
+		return e, nil
+	}
+}
+
+// FailOn makes every call to method (e.g. "CreateVM") return err. A nil err
+// clears the failure.
+func (e *Engine) FailOn(method string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err == nil {
+		delete(e.failures, method)
+		return
+	}
+
+	e.failures[method] = err
+}
+
+// Hang makes every call to method block until its context is done, to
+// exercise timeouts and cancellation.
+func (e *Engine) Hang(method string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.hangs[method] = true
+}
+
+// Calls returns the engine methods called so far, in order
+func (e *Engine) Calls() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string{}, e.calls...)
+}
+
+// Get returns a copy of the instance stored under namespace and name
+func (e *Engine) Get(namespace, name string) (Instance, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, ok := e.instances[key(namespace, name)]
+	if !ok {
+		return Instance{}, false
+	}
+
+	return *ins, true
+}
+
+// Deleted returns the options the instance stored under namespace and name
+// was deleted with, if it was
+func (e *Engine) Deleted(namespace, name string) (engines.DeleteOptions, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	opts, ok := e.deleted[key(namespace, name)]
+
+	return opts, ok
+}
+
+// Stopped returns the options the instance stored under namespace and name
+// was last stopped with, if it was
+func (e *Engine) Stopped(namespace, name string) (engines.StopOptions, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	opts, ok := e.stopped[key(namespace, name)]
+
+	return opts, ok
+}
+
+// Add stores an instance directly, bypassing CreateVM
+func (e *Engine) Add(ins Instance) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ins.ID == "" {
+		ins.ID = e.newID()
+	}
+
+	e.instances[key(ins.Namespace, ins.Name)] = &ins
+}
+
+// CreateVM stores a new stopped instance
+func (e *Engine) CreateVM(ctx context.Context, spec vm.Instance) (string, error) {
+	if err := e.call(ctx, "CreateVM"); err != nil {
+		return "", err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	k := key(spec.Namespace, spec.Name)
+	if _, ok := e.instances[k]; ok {
+		return "", fmt.Errorf("%w: %v in namespace %v", engines.ErrVMExists, spec.Name, spec.Namespace)
+	}
+
+	spec.ID = e.newID()
+	spec.Created = time.Now().UTC()
+	e.instances[k] = &Instance{Instance: spec}
+
+	return spec.ID, nil
+}
+
+// StartVM marks an instance as running
+func (e *Engine) StartVM(ctx context.Context, namespace, id string) error {
+	if err := e.call(ctx, "StartVM"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	ins.Running = true
+
+	return nil
+}
+
+// StopVM marks an instance as stopped, see Stopped
+func (e *Engine) StopVM(ctx context.Context, namespace, id string, opts engines.StopOptions) error {
+	if err := e.call(ctx, "StopVM"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	ins.Running = false
+	ins.Paused = false
+	e.stopped[key(ins.Namespace, ins.Name)] = opts
+
+	return nil
+}
+
+// PauseVM marks a running instance as paused
+func (e *Engine) PauseVM(ctx context.Context, namespace, id string) error {
+	return e.setPaused(ctx, "PauseVM", namespace, id, true)
+}
+
+// ResumeVM marks a running instance as no longer paused
+func (e *Engine) ResumeVM(ctx context.Context, namespace, id string) error {
+	return e.setPaused(ctx, "ResumeVM", namespace, id, false)
+}
+
+func (e *Engine) setPaused(ctx context.Context, method, namespace, id string, paused bool) error {
+	if err := e.call(ctx, method); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if !ins.Running {
+		return fmt.Errorf("%w: %v", engines.ErrVMNotRunning, ins.Name)
+	}
+
+	ins.Paused = paused
+
+	return nil
+}
+
+// DeleteVM forgets an instance, see Deleted
+func (e *Engine) DeleteVM(ctx context.Context, namespace, id string, opts engines.DeleteOptions) error {
+	if err := e.call(ctx, "DeleteVM"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	delete(e.instances, key(ins.Namespace, ins.Name))
+	e.deleted[key(ins.Namespace, ins.Name)] = opts
+
+	return nil
+}
+
+// SSHVM only checks that the instance exists and is running
+func (e *Engine) SSHVM(ctx context.Context, namespace, id, user, key string, term *termutil.Terminal) error {
+	if err := e.call(ctx, "SSHVM"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if !ins.Running {
+		return fmt.Errorf("VM %v is not running", ins.Name)
+	}
+
+	return nil
+}
+
+// ListVM returns the instances of a namespace, or all of them if all is set,
+// sorted by name
+func (e *Engine) ListVM(ctx context.Context, namespace string, all bool) ([]vm.Instance, error) {
+	instances := []vm.Instance{}
+
+	if err := e.call(ctx, "ListVM"); err != nil {
+		return instances, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, ins := range e.instances {
+		if all || ins.Namespace == namespace {
+			instances = append(instances, ins.instance())
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+
+	return instances, nil
+}
+
+// InspectVM returns an instance with its status
+func (e *Engine) InspectVM(ctx context.Context, namespace, id string) (vm.Instance, error) {
+	if err := e.call(ctx, "InspectVM"); err != nil {
+		return vm.Instance{}, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return vm.Instance{}, err
+	}
+
+	return ins.instance(), nil
+}
+
+// UpdateVM replaces the spec of an instance, keeping its identity and state
+func (e *Engine) UpdateVM(ctx context.Context, namespace, id string, spec vm.Instance) error {
+	if err := e.call(ctx, "UpdateVM"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	spec.ID = ins.ID
+	spec.Name = ins.Name
+	spec.Namespace = ins.Namespace
+	spec.Created = ins.Created
+	ins.Instance = spec
+
+	return nil
+}
+
+// ResizeDisk grows the disk size of an instance spec, the disk is taken as
+// fully allocated
+func (e *Engine) ResizeDisk(ctx context.Context, namespace, id string,
+	opts engines.ResizeOptions) (engines.DiskResize, error) {
+	resize := engines.DiskResize{}
+
+	if err := e.call(ctx, "ResizeDisk"); err != nil {
+		return resize, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return resize, err
+	}
+
+	size := int64(ins.Size.DISK) << 30
+	resize.Before = engines.DiskSize{Virtual: size, Actual: size}
+
+	if err := engines.CheckResize(resize.Before, opts.Size); err != nil {
+		return resize, err
+	}
+
+	ins.Size.DISK = vm.DiskSizeGB(opts.Size)
+	resize.After = engines.DiskSize{Virtual: opts.Size, Actual: opts.Size}
+
+	return resize, nil
+}
+
+// SaveVM writes a placeholder image to the output file and records it, as
+// given
+func (e *Engine) SaveVM(ctx context.Context, namespace, id string, opts engines.SaveOptions) error {
+	if err := e.call(ctx, "SaveVM"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	output := opts.Output
+	if err := opts.Check(); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(opts.Output, []byte("saved "+ins.Name), 0644); err != nil { // nolint: gosec
+		return err
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(100) // nolint: gomnd
+	}
+
+	ins.Saves = append(ins.Saves, output)
+
+	return nil
+}
+
+// ImportOverlay records the overlay imported as the root disk of an
+// instance, see Instance.Overlays. The overlay file is left in place.
+func (e *Engine) ImportOverlay(ctx context.Context, namespace, id, overlay string) error {
+	if err := e.call(ctx, "ImportOverlay"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	ins.Running = false
+	ins.Overlays = append(ins.Overlays, overlay)
+
+	return nil
+}
+
+// CreateCheckpoint records a checkpoint of a running instance
+func (e *Engine) CreateCheckpoint(ctx context.Context, namespace, id, name string) (engines.Checkpoint, error) {
+	if err := e.call(ctx, "CreateCheckpoint"); err != nil {
+		return engines.Checkpoint{}, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return engines.Checkpoint{}, err
+	}
+
+	if !ins.Running {
+		return engines.Checkpoint{}, fmt.Errorf("%w: %v", engines.ErrVMNotRunning, ins.Name)
+	}
+
+	if !vm.ValidName(name) {
+		return engines.Checkpoint{}, &vm.SpecError{Field: "checkpoint", Value: name,
+			Err: errors.New("names are made of letters, digits, '-' and '_'")}
+	}
+
+	if _, ok := ins.checkpoint(name); ok {
+		return engines.Checkpoint{}, fmt.Errorf("checkpoint %v already exists", name)
+	}
+
+	cp := engines.Checkpoint{Name: name, Created: time.Now().UTC(), Size: int64(ins.Size.RAM) << 20}
+	ins.Checkpoints = append(ins.Checkpoints, cp)
+
+	return cp, nil
+}
+
+// RestoreCheckpoint marks an instance as running from one of its
+// checkpoints, see Instance.Restored
+func (e *Engine) RestoreCheckpoint(ctx context.Context, namespace, id, name string) error {
+	if err := e.call(ctx, "RestoreCheckpoint"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ins.checkpoint(name); !ok {
+		return fmt.Errorf("%w: %v", engines.ErrCheckpointNotFound, name)
+	}
+
+	ins.Running = true
+	ins.Paused = false
+	ins.Restored = append(ins.Restored, name)
+
+	return nil
+}
+
+// ListCheckpoints returns the checkpoints of an instance
+func (e *Engine) ListCheckpoints(ctx context.Context, namespace, id string) ([]engines.Checkpoint, error) {
+	if err := e.call(ctx, "ListCheckpoints"); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]engines.Checkpoint{}, ins.Checkpoints...), nil
+}
+
+// DeleteCheckpoint forgets a checkpoint of an instance
+func (e *Engine) DeleteCheckpoint(ctx context.Context, namespace, id, name string) error {
+	if err := e.call(ctx, "DeleteCheckpoint"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	i, ok := ins.checkpoint(name)
+	if !ok {
+		return fmt.Errorf("%w: %v", engines.ErrCheckpointNotFound, name)
+	}
+
+	ins.Checkpoints = append(ins.Checkpoints[:i], ins.Checkpoints[i+1:]...)
+
+	return nil
+}
+
+// CreateSnapshot records a disk snapshot of an instance, with its RAM if
+// running
+func (e *Engine) CreateSnapshot(ctx context.Context, namespace, id, name string) (engines.Snapshot, error) {
+	if err := e.call(ctx, "CreateSnapshot"); err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	if err := engines.CheckSnapshotName(name, ins.Snapshots); err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	snapshot := engines.Snapshot{Name: name, Created: time.Now().UTC()}
+	if ins.Running {
+		snapshot.VMStateSize = int64(ins.Size.RAM) << 20
+	}
+
+	ins.Snapshots = append(ins.Snapshots, snapshot)
+
+	return snapshot, nil
+}
+
+// ListSnapshots returns the disk snapshots of an instance
+func (e *Engine) ListSnapshots(ctx context.Context, namespace, id string) ([]engines.Snapshot, error) {
+	if err := e.call(ctx, "ListSnapshots"); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]engines.Snapshot{}, ins.Snapshots...), nil
+}
+
+// RevertSnapshot records the revert of an instance to a snapshot, see
+// Instance.Reverted
+func (e *Engine) RevertSnapshot(ctx context.Context, namespace, id, name string) error {
+	if err := e.call(ctx, "RevertSnapshot"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := engines.FindSnapshot(name, ins.Snapshots); err != nil {
+		return err
+	}
+
+	ins.Reverted = append(ins.Reverted, name)
+
+	return nil
+}
+
+// DeleteSnapshot forgets a disk snapshot of an instance
+func (e *Engine) DeleteSnapshot(ctx context.Context, namespace, id, name string) error {
+	if err := e.call(ctx, "DeleteSnapshot"); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ins, err := e.find(namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := engines.FindSnapshot(name, ins.Snapshots); err != nil {
+		return err
+	}
+
+	snapshots := []engines.Snapshot{}
+	for _, snapshot := range ins.Snapshots {
+		if snapshot.Name != name {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	ins.Snapshots = snapshots
+
+	return nil
+}
+
+// checkpoint returns the index of a checkpoint of the instance
+func (ins *Instance) checkpoint(name string) (int, bool) {
+	for i, cp := range ins.Checkpoints {
+		if cp.Name == name {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// instance returns the stored instance with its status
+func (ins *Instance) instance() vm.Instance {
+	spec := ins.Instance
+	spec.Status = vm.StatusStopped
+
+	switch {
+	case ins.Running && ins.Paused:
+		spec.Status = vm.StatusPaused
+	case ins.Running:
+		spec.Status = vm.StatusRunning
+	}
+
+	return spec
+}
+
+// call records a method call and returns its injected failure, if any. Hung
+// methods block until ctx is done.
+func (e *Engine) call(ctx context.Context, method string) error {
+	e.mu.Lock()
+	e.calls = append(e.calls, method)
+	err, hang := e.failures[method], e.hangs[method]
+	e.mu.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// find looks an instance up by name or ID. Callers must hold e.mu.
+func (e *Engine) find(namespace, id string) (*Instance, error) {
+	if ins, ok := e.instances[key(namespace, id)]; ok {
+		return ins, nil
+	}
+
+	for _, ins := range e.instances {
+		if ins.Namespace == namespace && ins.ID == id {
+			return ins, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v in namespace %v", engines.ErrVMNotFound, id, namespace)
+}
+
+// newID returns the next sequential instance ID. Callers must hold e.mu.
+func (e *Engine) newID() string {
+	e.nextID++
+
+	return fmt.Sprintf("fake%06d", e.nextID)
+}
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
@@ -0,0 +1,40 @@
+package qemu
+
+import (
+	"time"
+
+	"github.com/govm-project/govm/engines"
+)
+
+// Host binaries used by the engine
+const (
+	DefaultBinary    = "qemu-system-x86_64"
+	DefaultImgBinary = "qemu-img"
+	DefaultISOBinary = "genisoimage"
+	DefaultOVMFPath  = "/usr/share/ovmf/OVMF.fd"
+)
+
+// Environment variables overriding the host binaries
+const (
+	BinaryEnv    = "GOVM_QEMU_BINARY"
+	ImgBinaryEnv = "GOVM_QEMU_IMG_BINARY"
+	ISOBinaryEnv = "GOVM_QEMU_ISO_BINARY"
+	OVMFPathEnv  = "GOVM_QEMU_OVMF"
+)
+
+// Files kept in the VM data directory
+const (
+	StateFile       = "qemu.json"
+	LogFile         = "qemu.log"
+	SerialLogFile   = "serial.log"
+	CowImageFile    = engines.OverlayFile
+	SeedISOFile     = "seed.iso"
+	VNCSocketFile   = "vnc"
+	QMPSocketFile   = "qmp"
+	ConfigDriveDir  = "config-drive"
+	UserDataFile    = "user_data"
+	configDriveData = "openstack/latest"
+)
+
+// DefaultStopTimeout is how long StopVM waits for QEMU to exit after SIGTERM
+const DefaultStopTimeout = 10 * time.Second
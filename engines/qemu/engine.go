@@ -0,0 +1,1016 @@
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/pkg/qmp"
+	"github.com/govm-project/govm/pkg/termutil"
+	"github.com/govm-project/govm/vm"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EngineName is the name the QEMU engine is registered with
+const EngineName = "qemu"
+
+// Engine runs VMs as QEMU processes on the host, without any container
+// runtime involved.
+type Engine struct {
+	workdir string
+
+	// Binary is the QEMU system emulator launched for every VM
+	Binary string
+	// ImgBinary is the qemu-img tool used to manage the disks
+	ImgBinary string
+	// ISOBinary builds the cloud-init config drive
+	ISOBinary string
+	// OVMF is the firmware used for EFI VMs
+	OVMF string
+	// StopTimeout is how long to wait for QEMU to exit before killing it
+	StopTimeout time.Duration
+}
+
+var _ engines.VMEngine = (*Engine)(nil)
+
+// nolint: gochecknoinits
+func init() {
+	engines.Register(EngineName, func(opts engines.Options) (engines.VMEngine, error) {
+		return NewEngine(opts.Workdir), nil
+	})
+}
+
+// NewEngine returns a QEMU engine managing the VMs found in workdir. Host
+// binaries can be overridden through the GOVM_QEMU_* environment variables.
+func NewEngine(workdir string) *Engine {
+	return &Engine{
+		workdir:     workdir,
+		Binary:      envOrDefault(BinaryEnv, DefaultBinary),
+		ImgBinary:   envOrDefault(ImgBinaryEnv, DefaultImgBinary),
+		ISOBinary:   envOrDefault(ISOBinaryEnv, DefaultISOBinary),
+		OVMF:        envOrDefault(OVMFPathEnv, DefaultOVMFPath),
+		StopTimeout: DefaultStopTimeout,
+	}
+}
+
+// CreateVM prepares the disks and the launch arguments of a new VM. The
+// spec is expected to be already validated by vm.Instance.Check.
+func (e *Engine) CreateVM(ctx context.Context, spec vm.Instance) (id string, err error) {
+	// VMs are only looked up in the engine working directory, whatever the
+	// spec one, where Check wrote the cloud-init metadata
+	dataDir := filepath.Join(e.workdir, "data", spec.Name)
+
+	metaDir := dataDir
+	if spec.Workdir != "" {
+		metaDir = filepath.Join(spec.Workdir, "data", spec.Name)
+	}
+
+	spec.Workdir = e.workdir
+
+	if st, err := loadState(dataDir); err == nil {
+		return "", fmt.Errorf("%w: %v in namespace %v", engines.ErrVMExists, st.Name, st.Namespace)
+	}
+
+	// Don't leave half-created disks behind on failure or cancellation
+	created := []string{}
+	for _, file := range []string{CowImageFile, SeedISOFile, ConfigDriveDir, vm.DisksDir} {
+		if _, err := os.Stat(filepath.Join(dataDir, file)); os.IsNotExist(err) {
+			created = append(created, filepath.Join(dataDir, file))
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			for _, file := range created {
+				_ = os.RemoveAll(file)
+			}
+		}
+	}()
+
+	if err := e.createCowImage(ctx, spec, dataDir); err != nil {
+		return "", err
+	}
+
+	if err := e.createDisks(ctx, spec, dataDir); err != nil {
+		return "", err
+	}
+
+	if spec.Cloud {
+		if err := e.createConfigDrive(ctx, spec, dataDir, metaDir); err != nil {
+			return "", err
+		}
+	}
+
+	id, err = newID()
+	if err != nil {
+		return "", err
+	}
+
+	sshPort, err := internal.FindAvailablePort()
+	if err != nil {
+		return "", err
+	}
+
+	st := &State{
+		ID:        id,
+		Name:      spec.Name,
+		Namespace: spec.Namespace,
+		DataDir:   dataDir,
+		SSHPort:   sshPort,
+		VNCSocket: filepath.Join(dataDir, VNCSocketFile),
+		Created:   time.Now().UTC(),
+		Spec:      spec,
+	}
+	st.Args = e.buildArgs(spec, st)
+
+	return id, st.save()
+}
+
+// StartVM launches the QEMU process of a previously created VM. The process
+// is not bound to ctx, it keeps running after govm exits.
+func (e *Engine) StartVM(ctx context.Context, namespace, id string) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if st.running() {
+		return nil
+	}
+
+	return e.launch(st)
+}
+
+// launch starts the QEMU process of a VM, with extra arguments appended to
+// its own
+func (e *Engine) launch(st *State, extra ...string) error {
+	args := append(append([]string{}, st.Args...), extra...)
+
+	logFile, err := os.OpenFile(filepath.Join(st.DataDir, LogFile),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664) // nolint: gosec
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	log.Debugf("Launching %v %v", e.Binary, strings.Join(args, " "))
+
+	cmd := exec.Command(e.Binary, args...) // nolint: gosec
+	cmd.Dir = st.DataDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Detach QEMU from the govm process group so it outlives this command
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("launching %v: %w", e.Binary, binaryError(err))
+	}
+
+	// Reap the process if it exits while govm is still running
+	go func() { _ = cmd.Wait() }()
+
+	st.Pid = cmd.Process.Pid
+
+	return st.save()
+}
+
+// StopVM powers a VM off through ACPI, terminating its QEMU process if the
+// guest doesn't halt in time or opts.Force is set
+func (e *Engine) StopVM(ctx context.Context, namespace, id string, opts engines.StopOptions) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if err := e.stop(ctx, st, opts); err != nil {
+		return err
+	}
+
+	st.Pid = 0
+
+	return st.save()
+}
+
+// PauseVM freezes the vCPUs of a running VM, keeping its memory
+func (e *Engine) PauseVM(ctx context.Context, namespace, id string) error {
+	return e.monitor(ctx, namespace, id, "stop")
+}
+
+// ResumeVM resumes a paused VM
+func (e *Engine) ResumeVM(ctx context.Context, namespace, id string) error {
+	return e.monitor(ctx, namespace, id, "cont")
+}
+
+// monitor runs a QMP command without arguments on a running VM
+func (e *Engine) monitor(ctx context.Context, namespace, id, command string) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if !st.running() {
+		return fmt.Errorf("%w: %v", engines.ErrVMNotRunning, st.Name)
+	}
+
+	return qmp.Command(ctx, filepath.Join(st.DataDir, QMPSocketFile), command, nil, nil)
+}
+
+// DeleteVM stops a VM and removes its data directory
+func (e *Engine) DeleteVM(ctx context.Context, namespace, id string, opts engines.DeleteOptions) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if err := e.stop(ctx, st, opts.StopOptions); err != nil {
+		return err
+	}
+
+	return engines.RemoveData(st.DataDir, st.Spec.Disks, opts)
+}
+
+// SSHVM opens an ssh session through the port forwarded to the guest
+func (e *Engine) SSHVM(ctx context.Context, namespace, id, user, key string, term *termutil.Terminal) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if !st.running() {
+		return fmt.Errorf("%w: %v", engines.ErrVMNotRunning, st.Name)
+	}
+
+	return internal.SSHShell(ctx, fmt.Sprintf("127.0.0.1:%d", st.SSHPort), user, key, term)
+}
+
+// ListVM lists the VMs of a namespace, or of every namespace if all is set
+func (e *Engine) ListVM(ctx context.Context, namespace string, all bool) ([]vm.Instance, error) {
+	instances := []vm.Instance{}
+
+	states, err := e.states(ctx)
+	if err != nil {
+		return instances, err
+	}
+
+	for _, st := range states {
+		if !all && st.Namespace != namespace {
+			continue
+		}
+
+		instances = append(instances, st.guestInstance(ctx))
+	}
+
+	return instances, nil
+}
+
+// InspectVM returns the details of a VM
+func (e *Engine) InspectVM(ctx context.Context, namespace, id string) (vm.Instance, error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return vm.Instance{}, err
+	}
+
+	return st.guestInstance(ctx), nil
+}
+
+// UpdateVM rebuilds the launch arguments of a VM from a new spec, keeping
+// its disks. A running VM is restarted to apply them.
+func (e *Engine) UpdateVM(ctx context.Context, namespace, id string, spec vm.Instance) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	// Name and location of a VM can't change
+	spec.Name = st.Name
+	spec.Namespace = st.Namespace
+	spec.Workdir = st.Spec.Workdir
+
+	running := st.running()
+	if running {
+		if err := e.stop(ctx, st, engines.StopOptions{}); err != nil {
+			return err
+		}
+
+		st.Pid = 0
+	}
+
+	if err := e.createDisks(ctx, spec, st.DataDir); err != nil {
+		return err
+	}
+
+	st.Spec = spec
+	st.Args = e.buildArgs(spec, st)
+
+	if err := st.save(); err != nil {
+		return err
+	}
+
+	if running {
+		return e.StartVM(ctx, namespace, st.Name)
+	}
+
+	return nil
+}
+
+// ResizeDisk grows the copy-on-write disk of a VM, through QMP if the VM is
+// running or qemu-img otherwise
+func (e *Engine) ResizeDisk(ctx context.Context, namespace, id string,
+	opts engines.ResizeOptions) (resize engines.DiskResize, err error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return resize, err
+	}
+
+	disk := filepath.Join(st.DataDir, CowImageFile)
+	running := st.running()
+
+	if resize.Before, err = e.diskSize(ctx, disk, running); err != nil {
+		return resize, err
+	}
+
+	if err := engines.CheckResize(resize.Before, opts.Size); err != nil {
+		return resize, err
+	}
+
+	if running {
+		err = qmp.Command(ctx, filepath.Join(st.DataDir, QMPSocketFile), "block_resize",
+			map[string]interface{}{"device": "data", "size": opts.Size}, nil)
+		if err != nil {
+			return resize, fmt.Errorf("resizing the disk of the running VM %v: %w", st.Name, err)
+		}
+	} else if err := e.run(ctx, e.ImgBinary, "resize", disk, strconv.FormatInt(opts.Size, 10)); err != nil {
+		return resize, err
+	}
+
+	// Keep the spec in line with the disk
+	st.Spec.Size.DISK = vm.DiskSizeGB(opts.Size)
+	if err := st.save(); err != nil {
+		return resize, err
+	}
+
+	if resize.After, err = e.diskSize(ctx, disk, running); err != nil {
+		return resize, err
+	}
+
+	if !opts.GrowPart {
+		return resize, nil
+	}
+
+	if !running {
+		log.Infof("The partitions of %v will be grown by cloud-init on its next boot", st.Name)
+		return resize, nil
+	}
+
+	out, err := internal.SSHRun(ctx, fmt.Sprintf("127.0.0.1:%d", st.SSHPort), opts.User, opts.Key,
+		engines.GrowPartCommand)
+	if err != nil {
+		return resize, fmt.Errorf("growing the partitions of %v: %w: %s", st.Name, err, strings.TrimSpace(string(out)))
+	}
+
+	return resize, nil
+}
+
+// SaveVM flattens the VM disk and its parent image into a standalone image,
+// verified before it replaces opts.Output
+func (e *Engine) SaveVM(ctx context.Context, namespace, id string, opts engines.SaveOptions) (err error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	if err := opts.Check(); err != nil {
+		return err
+	}
+
+	running := st.running()
+	if running && opts.Stop {
+		if err := e.StopVM(ctx, namespace, id, engines.StopOptions{}); err != nil {
+			return err
+		}
+
+		running = false
+
+		defer func() {
+			// Restart even if ctx has been cancelled meanwhile
+			if startErr := e.StartVM(context.Background(), namespace, id); startErr != nil && err == nil {
+				err = fmt.Errorf("starting the VM %v again: %w", st.Name, startErr)
+			}
+		}()
+	}
+
+	disk := filepath.Join(st.DataDir, CowImageFile)
+
+	size, err := e.diskSize(ctx, disk, running)
+	if err != nil {
+		return err
+	}
+
+	partial := opts.PartialOutput()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(partial)
+		}
+	}()
+
+	if err := e.convert(ctx, opts.ConvertArgs(disk, partial, running), opts.Progress); err != nil {
+		return err
+	}
+
+	if opts.Format == engines.FormatQcow2 {
+		if err := e.run(ctx, e.ImgBinary, "check", partial); err != nil {
+			return fmt.Errorf("checking the saved image: %w", err)
+		}
+	}
+
+	return engines.FinishSave(opts, size.Virtual)
+}
+
+// ImportOverlay makes overlay the root disk of a VM, rebased onto the VM
+// parent image. The overlay file is moved into the VM data directory.
+func (e *Engine) ImportOverlay(ctx context.Context, namespace, id, overlay string) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	// The current root disk is thrown away, no need for a clean shutdown
+	if err := e.stop(ctx, st, engines.StopOptions{Force: true}); err != nil {
+		return err
+	}
+
+	format, err := e.imageFormat(ctx, st.Spec.ParentImage)
+	if err != nil {
+		return err
+	}
+
+	disk := filepath.Join(st.DataDir, CowImageFile)
+	if err := os.Rename(overlay, disk); err != nil {
+		return err
+	}
+
+	return e.run(ctx, e.ImgBinary, "rebase", "-u", "-F", format, "-b", st.Spec.ParentImage, disk)
+}
+
+// convert runs qemu-img convert, reporting its progress. The command is
+// killed when ctx is done.
+func (e *Engine) convert(ctx context.Context, args []string, progress func(float64)) error {
+	log.Debugf("Running %v %v", e.ImgBinary, strings.Join(args, " "))
+
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, e.ImgBinary, args...) // nolint: gosec
+	cmd.Stdout = engines.ProgressWriter(progress)
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		return fmt.Errorf("%v convert: %w: %s", e.ImgBinary, binaryError(err), strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// CreateCheckpoint saves the memory, device and disk state of a running VM
+func (e *Engine) CreateCheckpoint(ctx context.Context, namespace, id, name string) (engines.Checkpoint, error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return engines.Checkpoint{}, err
+	}
+
+	if !st.running() {
+		return engines.Checkpoint{}, fmt.Errorf("%w: %v", engines.ErrVMNotRunning, st.Name)
+	}
+
+	disks := []string{CowImageFile}
+	for _, disk := range st.Spec.Disks {
+		disks = append(disks, disk.File())
+	}
+
+	return engines.CreateCheckpoint(ctx, filepath.Join(st.DataDir, QMPSocketFile),
+		st.DataDir, st.DataDir, name, disks)
+}
+
+// RestoreCheckpoint brings a VM back to a checkpoint. The running QEMU
+// process, if any, is replaced by one loading the checkpoint state.
+func (e *Engine) RestoreCheckpoint(ctx context.Context, namespace, id, name string) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	cp, err := engines.GetCheckpoint(st.DataDir, name)
+	if err != nil {
+		return err
+	}
+
+	// The guest state is about to be thrown away, no need for a clean shutdown
+	if err := e.stop(ctx, st, engines.StopOptions{Force: true}); err != nil {
+		return err
+	}
+
+	st.Pid = 0
+	if err := st.save(); err != nil {
+		return err
+	}
+
+	if err := engines.RestoreDisks(st.DataDir, cp); err != nil {
+		return err
+	}
+
+	if err := e.launch(st, "-incoming", engines.IncomingURI(st.DataDir, cp.Name)); err != nil {
+		return err
+	}
+
+	return engines.WaitIncoming(ctx, filepath.Join(st.DataDir, QMPSocketFile))
+}
+
+// ListCheckpoints lists the checkpoints of a VM, oldest first
+func (e *Engine) ListCheckpoints(ctx context.Context, namespace, id string) ([]engines.Checkpoint, error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return engines.ListCheckpoints(st.DataDir)
+}
+
+// DeleteCheckpoint removes a checkpoint of a VM
+func (e *Engine) DeleteCheckpoint(ctx context.Context, namespace, id, name string) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	return engines.DeleteCheckpoint(st.DataDir, name)
+}
+
+// CreateSnapshot takes an internal snapshot of the copy-on-write disk of a
+// VM, through QMP with its RAM if the VM is running or qemu-img otherwise
+func (e *Engine) CreateSnapshot(ctx context.Context, namespace, id, name string) (engines.Snapshot, error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	snapshots, err := e.snapshots(ctx, st)
+	if err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	if err := engines.CheckSnapshotName(name, snapshots); err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	if st.running() {
+		err = engines.SnapshotSave(ctx, filepath.Join(st.DataDir, QMPSocketFile), name)
+	} else {
+		err = e.run(ctx, e.ImgBinary, "snapshot", "-c", name, filepath.Join(st.DataDir, CowImageFile))
+	}
+
+	if err != nil {
+		return engines.Snapshot{}, fmt.Errorf("taking the snapshot %v: %w", name, err)
+	}
+
+	if snapshots, err = e.snapshots(ctx, st); err != nil {
+		return engines.Snapshot{}, err
+	}
+
+	return engines.FindSnapshot(name, snapshots)
+}
+
+// ListSnapshots lists the snapshots of the copy-on-write disk of a VM,
+// oldest first
+func (e *Engine) ListSnapshots(ctx context.Context, namespace, id string) ([]engines.Snapshot, error) {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.snapshots(ctx, st)
+}
+
+// RevertSnapshot brings the disk of a VM, and its RAM if running and saved
+// with the snapshot, back to a snapshot
+func (e *Engine) RevertSnapshot(ctx context.Context, namespace, id, name string) error {
+	return e.snapshot(ctx, namespace, id, name, engines.SnapshotLoad, "-a")
+}
+
+// DeleteSnapshot deletes a snapshot of the disk of a VM
+func (e *Engine) DeleteSnapshot(ctx context.Context, namespace, id, name string) error {
+	return e.snapshot(ctx, namespace, id, name, engines.SnapshotDelete, "-d")
+}
+
+// snapshot runs an operation on an existing snapshot, through QMP if the VM
+// is running or with the qemu-img snapshot flag otherwise
+func (e *Engine) snapshot(ctx context.Context, namespace, id, name string,
+	online func(context.Context, string, string) error, flag string) error {
+	st, err := e.find(ctx, namespace, id)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := e.snapshots(ctx, st)
+	if err != nil {
+		return err
+	}
+
+	if _, err := engines.FindSnapshot(name, snapshots); err != nil {
+		return err
+	}
+
+	if st.running() {
+		return online(ctx, filepath.Join(st.DataDir, QMPSocketFile), name)
+	}
+
+	return e.run(ctx, e.ImgBinary, "snapshot", flag, name, filepath.Join(st.DataDir, CowImageFile))
+}
+
+// snapshots lists the snapshots of the copy-on-write disk of a VM
+func (e *Engine) snapshots(ctx context.Context, st *State) ([]engines.Snapshot, error) {
+	snapshots := []engines.Snapshot{}
+
+	info, err := e.imageInfo(ctx, filepath.Join(st.DataDir, CowImageFile), st.running())
+	if err != nil {
+		return snapshots, err
+	}
+
+	for _, snapshot := range info.Snapshots {
+		snapshots = append(snapshots, engines.Snapshot{
+			Name:        snapshot.Name,
+			Created:     time.Unix(snapshot.DateSec, snapshot.DateNsec).UTC(),
+			VMStateSize: snapshot.VMStateSize,
+		})
+	}
+
+	return snapshots, nil
+}
+
+// find looks a VM up by name or ID prefix within a namespace
+func (e *Engine) find(ctx context.Context, namespace, id string) (*State, error) {
+	states, err := e.states(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range states {
+		if st.Namespace != namespace {
+			continue
+		}
+
+		if st.Name == id || (len(id) >= 6 && strings.HasPrefix(st.ID, id)) {
+			return st, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v in namespace %v", engines.ErrVMNotFound, id, namespace)
+}
+
+// states loads the state of every VM in the working directory
+func (e *Engine) states(ctx context.Context) ([]*State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(e.workdir, "data", "*", StateFile))
+	if err != nil {
+		return nil, err
+	}
+
+	states := []*State{}
+
+	for _, file := range files {
+		st, err := loadState(filepath.Dir(file))
+		if err != nil {
+			log.Warnf("Skipping %v: %v", file, err)
+			continue
+		}
+
+		states = append(states, st)
+	}
+
+	return states, nil
+}
+
+// stop asks the guest to power off, unless opts.Force is set, and then
+// makes sure its QEMU process is gone
+func (e *Engine) stop(ctx context.Context, st *State, opts engines.StopOptions) error {
+	if st.running() && !opts.Force {
+		err := engines.Shutdown(ctx, filepath.Join(st.DataDir, QMPSocketFile), opts)
+		if err != nil && ctx.Err() == nil {
+			log.Warnf("VM %v didn't power off gracefully, terminating it: %v", st.Name, err)
+		}
+	}
+
+	return e.terminate(ctx, st)
+}
+
+// terminate sends SIGTERM to QEMU and SIGKILL if it is still alive after
+// StopTimeout or when ctx is done
+func (e *Engine) terminate(ctx context.Context, st *State) error {
+	if !st.running() {
+		return nil
+	}
+
+	if err := syscall.Kill(st.Pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(e.StopTimeout)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+wait:
+	for st.running() {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			log.Warnf("VM %v did not stop after %v, killing it", st.Name, e.StopTimeout)
+			break wait
+		case <-ctx.Done():
+			log.Warnf("VM %v stop interrupted, killing it", st.Name)
+			break wait
+		}
+	}
+
+	if !st.running() {
+		return nil
+	}
+
+	return syscall.Kill(st.Pid, syscall.SIGKILL)
+}
+
+// createCowImage creates the copy-on-write overlay on top of the parent image
+func (e *Engine) createCowImage(ctx context.Context, spec vm.Instance, dataDir string) error {
+	cowImage := filepath.Join(dataDir, CowImageFile)
+	if _, err := os.Stat(cowImage); err == nil {
+		return nil
+	}
+
+	format, err := e.imageFormat(ctx, spec.ParentImage)
+	if err != nil {
+		return err
+	}
+
+	return e.run(ctx, e.ImgBinary, "create", "-f", "qcow2", "-F", format,
+		"-b", spec.ParentImage, cowImage, fmt.Sprintf("%dG", spec.Size.DISK))
+}
+
+// createDisks creates the blank data disks of a VM. Disks kept from a
+// previous VM with the same name are reused.
+func (e *Engine) createDisks(ctx context.Context, spec vm.Instance, dataDir string) error {
+	for _, disk := range spec.Disks {
+		file := filepath.Join(dataDir, disk.File())
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+			return err
+		}
+
+		err := e.run(ctx, e.ImgBinary, "create", "-f", disk.Format, file, fmt.Sprintf("%dG", disk.Size))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// imageInfo is the part of the qemu-img info output used by the engine
+type imageInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	ActualSize  int64  `json:"actual-size"`
+	Snapshots   []struct {
+		Name        string `json:"name"`
+		VMStateSize int64  `json:"vm-state-size"`
+		DateSec     int64  `json:"date-sec"`
+		DateNsec    int64  `json:"date-nsec"`
+	} `json:"snapshots"`
+}
+
+// imageFormat detects the format of a disk image
+func (e *Engine) imageFormat(ctx context.Context, image string) (string, error) {
+	info, err := e.imageInfo(ctx, image, false)
+	if err != nil {
+		return "", err
+	}
+
+	return info.Format, nil
+}
+
+// diskSize returns the sizes of a disk image. Images in use by a running
+// VM are read without taking their lock.
+func (e *Engine) diskSize(ctx context.Context, image string, inUse bool) (engines.DiskSize, error) {
+	info, err := e.imageInfo(ctx, image, inUse)
+	if err != nil {
+		return engines.DiskSize{}, err
+	}
+
+	return engines.DiskSize{Virtual: info.VirtualSize, Actual: info.ActualSize}, nil
+}
+
+// imageInfo runs qemu-img info on a disk image
+func (e *Engine) imageInfo(ctx context.Context, image string, shared bool) (imageInfo, error) {
+	args := []string{"info", "--output=json"}
+	if shared {
+		args = append(args, "-U")
+	}
+
+	info := imageInfo{}
+
+	out, err := exec.CommandContext(ctx, e.ImgBinary, append(args, image)...).Output() // nolint: gosec
+	if err != nil {
+		return info, fmt.Errorf("%v info %v: %w", e.ImgBinary, image, binaryError(err))
+	}
+
+	if err := json.Unmarshal(out, &info); err != nil {
+		return info, fmt.Errorf("%v info %v: %v", e.ImgBinary, image, err)
+	}
+
+	return info, nil
+}
+
+// createConfigDrive builds the cloud-init config drive ISO of the data
+// directory from the meta data vm.Instance.Check left in metaDir and the
+// user data file
+func (e *Engine) createConfigDrive(ctx context.Context, spec vm.Instance, dataDir, metaDir string) error {
+	driveDir := filepath.Join(dataDir, ConfigDriveDir)
+	dataPath := filepath.Join(driveDir, configDriveData)
+
+	if err := os.MkdirAll(dataPath, 0750); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		filepath.Join(metaDir, vm.MedatataFile): filepath.Join(dataPath, vm.MedatataFile),
+	}
+	if spec.UserData != "" {
+		files[spec.UserData] = filepath.Join(dataPath, UserDataFile)
+	}
+
+	for src, dst := range files {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(dst, data, 0664); err != nil { // nolint: gosec
+			return err
+		}
+	}
+
+	return e.run(ctx, e.ISOBinary, "-o", filepath.Join(dataDir, SeedISOFile),
+		"-V", "config-2", "-r", "-J", driveDir)
+}
+
+// buildArgs returns the QEMU command line for a VM
+func (e *Engine) buildArgs(spec vm.Instance, st *State) []string {
+	args := []string{
+		"-name", spec.Name,
+		"-nodefaults",
+		"-display", "none",
+		"-vga", "std",
+		"-vnc", "unix:" + st.VNCSocket,
+		"-qmp", "unix:" + filepath.Join(st.DataDir, QMPSocketFile) + ",server=on,wait=off",
+		"-serial", "file:" + filepath.Join(st.DataDir, SerialLogFile),
+		"-device", "virtio-balloon-pci,id=balloon0",
+		"-object", "rng-random,filename=/dev/urandom,id=rng0",
+		"-device", "virtio-rng-pci,rng=rng0",
+	}
+
+	if kvmSupport() {
+		args = append(args, "-enable-kvm", "-machine", "accel=kvm,usb=off")
+	} else {
+		args = append(args, "-machine", "usb=off")
+	}
+
+	size := spec.Size
+	if size.CPUModel != "" {
+		args = append(args, "-cpu", size.CPUModel)
+	}
+
+	args = append(args,
+		"-smp", fmt.Sprintf("sockets=%v,cpus=%v,cores=%v,threads=%v,maxcpus=%v",
+			size.Sockets, size.Cpus, size.Cores, size.Threads,
+			size.Sockets*size.Cores*size.Threads),
+		"-m", strconv.Itoa(size.RAM),
+		"-drive", fmt.Sprintf("if=virtio,file=%v,format=qcow2,id=data",
+			filepath.Join(st.DataDir, CowImageFile)),
+	)
+
+	scsi := false
+	for _, disk := range spec.Disks {
+		drive := fmt.Sprintf("file=%v,format=%v,id=disk-%v",
+			filepath.Join(st.DataDir, disk.File()), disk.Format, disk.Name)
+
+		if disk.Bus != "scsi" {
+			args = append(args, "-drive", "if="+disk.Bus+","+drive)
+			continue
+		}
+
+		if !scsi {
+			args = append(args, "-device", "virtio-scsi-pci,id=scsi0")
+			scsi = true
+		}
+
+		args = append(args, "-drive", "if=none,"+drive, "-device", "scsi-hd,drive=disk-"+disk.Name)
+	}
+
+	if spec.Cloud {
+		args = append(args, "-drive", fmt.Sprintf("file=%v,if=virtio,format=raw",
+			filepath.Join(st.DataDir, SeedISOFile)))
+	}
+
+	if spec.Efi {
+		args = append(args, "-bios", e.OVMF)
+	}
+
+	nic := "virtio-net-pci,netdev=net0"
+	if spec.NetOpts.MAC != "" {
+		nic += ",mac=" + spec.NetOpts.MAC
+	}
+
+	args = append(args,
+		"-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp:127.0.0.1:%d-:22", st.SSHPort),
+		"-device", nic,
+	)
+
+	for i, share := range spec.Shares {
+		dirs := strings.Split(share, ":")
+		args = append(args,
+			"-fsdev", fmt.Sprintf("local,id=share%d,path=%v,security_model=passthrough", i, dirs[0]),
+			"-device", fmt.Sprintf("virtio-9p-pci,fsdev=share%d,mount_tag=%v", i, dirs[1]),
+		)
+	}
+
+	return args
+}
+
+// run executes a host command and includes its output in the error. The
+// command is killed when ctx is done.
+func (e *Engine) run(ctx context.Context, name string, args ...string) error {
+	log.Debugf("Running %v %v", name, strings.Join(args, " "))
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput() // nolint: gosec
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		return fmt.Errorf("%v %v: %w: %s", name, args[0], binaryError(err), strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// binaryError flags the errors caused by a missing host binary as
+// engines.ErrEngineUnavailable
+func binaryError(err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %v", engines.ErrEngineUnavailable, err)
+	}
+
+	return err
+}
+
+// kvmSupport reports whether the host exposes KVM to the current user
+func kvmSupport() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+
+	_ = f.Close()
+
+	return true
+}
+
+func envOrDefault(key, value string) string {
+	if env := os.Getenv(key); env != "" {
+		return env
+	}
+
+	return value
+}
@@ -0,0 +1,702 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/pkg/qmp/qmptest"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeQemu writes its arguments then waits to be stopped. They are renamed
+// into place so that tests never read them half written.
+const fakeQemu = `#!/bin/sh
+echo "$@" > "$(dirname "$0")/qemu.args.$$"
+mv "$(dirname "$0")/qemu.args.$$" "$(dirname "$0")/qemu.args"
+trap 'exit 0' TERM
+while :; do sleep 0.1; done
+`
+
+const fakeQemuImg = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/qemu-img.calls"
+case "$1" in
+info) echo "{\"format\": \"raw\", \"virtual-size\": $(cat "$(dirname "$0")/size" 2>/dev/null || echo 10737418240), \"actual-size\": 4096, \"snapshots\": $(cat "$(dirname "$0")/snapshots" 2>/dev/null || echo [])}" ;;
+create) for arg; do file=$last; last=$arg; done; : > "$file" ;;
+resize) echo "$3" > "$(dirname "$0")/size" ;;
+convert)
+	for arg; do last=$arg; done
+	printf '    (0.00/100%%)\r    (50.00/100%%)\r    (100.00/100%%)\r'
+	case "$*" in
+	*"-O qcow2"*) { printf 'QFI\373\000\000\000\003'; head -c 16 /dev/zero; printf '\000\000\000\002\200\000\000\000'; } > "$last" ;;
+	*) truncate -s "$(cat "$(dirname "$0")/size" 2>/dev/null || echo 10737418240)" "$last" ;;
+	esac ;;
+snapshot) [ "$2" = -c ] && echo "[{\"name\": \"$3\", \"vm-state-size\": 0, \"date-sec\": 1790000000, \"date-nsec\": 0}]" > "$(dirname "$0")/snapshots" || : ;;
+esac
+`
+
+const slowQemuImg = `#!/bin/sh
+case "$1" in
+info) echo '{"format": "qcow2"}' ;;
+convert) for arg; do last=$arg; done; : > "$last"; exec sleep 10 ;;
+esac
+`
+
+const fakeISO = `#!/bin/sh
+: > "$2"
+`
+
+func writeScript(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NilError(t, ioutil.WriteFile(path, []byte(content), 0755))
+
+	return path
+}
+
+func newTestEngine(t *testing.T) (*Engine, vm.Instance) {
+	workdir := t.TempDir()
+	binDir := t.TempDir()
+
+	image := filepath.Join(workdir, "parent.img")
+	assert.NilError(t, ioutil.WriteFile(image, []byte("image"), 0644))
+
+	key := filepath.Join(workdir, "id_rsa.pub")
+	assert.NilError(t, ioutil.WriteFile(key, []byte("ssh-rsa AAAA test"), 0644))
+
+	e := NewEngine(workdir)
+	e.Binary = writeScript(t, binDir, "qemu", fakeQemu)
+	e.ImgBinary = writeScript(t, binDir, "qemu-img", fakeQemuImg)
+	e.ISOBinary = writeScript(t, binDir, "genisoimage", fakeISO)
+	e.StopTimeout = 5 * time.Second
+
+	spec := vm.Instance{
+		Name:             "test-vm",
+		Namespace:        "tester",
+		ParentImage:      image,
+		Workdir:          workdir,
+		SSHPublicKeyFile: key,
+		Cloud:            true,
+		Size:             vm.NewSize("qemu64", 1, 1, 1, 1, 1024, 10),
+		Shares:           []string{workdir + ":/mnt/host"},
+	}
+	assert.NilError(t, spec.Check())
+
+	return e, spec
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// nolint: funlen
+func TestLifecycle(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	id, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls),
+		"create -f qcow2 -F raw -b "+spec.ParentImage+" "+dataDir+"/cow_image.qcow2 10G"))
+
+	for _, file := range []string{StateFile, CowImageFile, SeedISOFile,
+		ConfigDriveDir + "/openstack/latest/meta_data.json"} {
+		_, err := os.Stat(filepath.Join(dataDir, file))
+		assert.NilError(t, err, file)
+	}
+
+	_, err = e.CreateVM(ctx, spec)
+	assert.Assert(t, errors.Is(err, engines.ErrVMExists), "got %v", err)
+
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+
+	argsFile := filepath.Join(filepath.Dir(e.Binary), "qemu.args")
+	waitFor(t, func() bool {
+		_, err := os.Stat(argsFile)
+		return err == nil
+	})
+
+	args, err := ioutil.ReadFile(argsFile)
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(args), "-m 1024"))
+	assert.Check(t, is.Contains(string(args), "-smp sockets=1,cpus=1,cores=1,threads=1,maxcpus=1"))
+	assert.Check(t, is.Contains(string(args), "-vnc unix:"+dataDir+"/vnc"))
+	assert.Check(t, is.Contains(string(args), "file="+dataDir+"/seed.iso"))
+	assert.Check(t, is.Contains(string(args), "path="+spec.Workdir+",security_model=passthrough"))
+
+	// A second engine instance stands for another govm invocation
+	other := NewEngine(spec.Workdir)
+	other.StopTimeout = e.StopTimeout
+
+	instances, err := other.ListVM(ctx, spec.Namespace, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(instances), 1)
+	assert.Equal(t, instances[0].ID, id[:10])
+	assert.Equal(t, instances[0].Name, spec.Name)
+	assert.Equal(t, instances[0].Status, vm.StatusRunning)
+	assert.Equal(t, instances[0].ParentImage, spec.ParentImage)
+	assert.Equal(t, instances[0].Size, spec.Size)
+
+	instances, err = other.ListVM(ctx, "someone-else", false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(instances), 0)
+
+	st, err := other.find(ctx, spec.Namespace, id[:10])
+	assert.NilError(t, err)
+	assert.Assert(t, st.running())
+	pid := st.Pid
+
+	assert.NilError(t, other.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{}))
+	waitFor(t, func() bool { return !(&State{Pid: pid}).running() })
+
+	st, err = other.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, st.Pid, 0)
+
+	ins, err := other.InspectVM(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, ins.Status, vm.StatusStopped)
+	assert.DeepEqual(t, ins.Shares, spec.Shares)
+
+	err = other.SSHVM(ctx, spec.Namespace, spec.Name, "user", "key", nil)
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+
+	assert.NilError(t, other.DeleteVM(ctx, spec.Namespace, spec.Name, engines.DeleteOptions{}))
+	_, err = os.Stat(dataDir)
+	assert.Assert(t, os.IsNotExist(err))
+
+	_, err = other.find(ctx, spec.Namespace, spec.Name)
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotFound), "got %v", err)
+}
+
+func TestCreateVMWorkdir(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+
+	// Specs of another working directory, e.g. from compose files
+	spec.Workdir = t.TempDir()
+	spec.SSHPublicKeyFile = filepath.Join(e.workdir, "id_rsa.pub")
+	assert.NilError(t, spec.Check())
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	ins, err := e.InspectVM(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, ins.Workdir, e.workdir)
+
+	list, err := e.ListVM(ctx, spec.Namespace, true)
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 1)
+
+	for _, file := range []string{StateFile, CowImageFile, SeedISOFile} {
+		_, err := os.Stat(filepath.Join(e.workdir, "data", spec.Name, file))
+		assert.NilError(t, err, file)
+	}
+}
+
+func TestUpdateVM(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	pid := st.Pid
+
+	server, err := qmptest.NewServer(filepath.Join(st.DataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("system_powerdown", nil)
+	server.ExitOn("system_powerdown")
+
+	spec.Size.RAM = 4096
+	spec.Shares = nil
+	assert.NilError(t, e.UpdateVM(ctx, spec.Namespace, spec.Name, spec))
+
+	// The guest is powered off before QEMU goes away
+	names := []string{}
+	for _, cmd := range server.Commands() {
+		names = append(names, cmd.Name)
+	}
+
+	assert.DeepEqual(t, names, []string{"qmp_capabilities", "query-status", "system_powerdown"})
+
+	// The VM is restarted with the new arguments
+	st, err = e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Assert(t, st.running())
+	assert.Assert(t, st.Pid != pid)
+	waitFor(t, func() bool { return !(&State{Pid: pid}).running() })
+
+	args := strings.Join(st.Args, " ")
+	assert.Check(t, is.Contains(args, "-m 4096"))
+	assert.Check(t, !strings.Contains(args, "virtio-9p-pci"))
+	assert.Equal(t, st.Spec.Size.RAM, 4096)
+
+	_, err = os.Stat(filepath.Join(st.DataDir, CowImageFile))
+	assert.NilError(t, err)
+
+	assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Force: true}))
+}
+
+func TestDataDisks(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	spec.Disks = []vm.Disk{
+		{Name: "data", Size: 5},
+		{Name: "logs", Size: 1, Format: "raw", Bus: "scsi", Keep: true},
+	}
+	assert.NilError(t, spec.CheckDisks())
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls), "create -f qcow2 "+dataDir+"/disks/data.qcow2 5G"))
+	assert.Check(t, is.Contains(string(calls), "create -f raw "+dataDir+"/disks/logs.raw 1G"))
+
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+
+	args := strings.Join(st.Args, " ")
+	assert.Check(t, is.Contains(args,
+		"-drive if=virtio,file="+dataDir+"/disks/data.qcow2,format=qcow2,id=disk-data"))
+	assert.Check(t, is.Contains(args, "-device virtio-scsi-pci,id=scsi0 "+
+		"-drive if=none,file="+dataDir+"/disks/logs.raw,format=raw,id=disk-logs -device scsi-hd,drive=disk-logs"))
+
+	// Only the disk flagged with keep survives the VM
+	assert.NilError(t, e.DeleteVM(ctx, spec.Namespace, spec.Name, engines.DeleteOptions{}))
+
+	_, err = os.Stat(filepath.Join(dataDir, "disks", "logs.raw"))
+	assert.NilError(t, err)
+
+	for _, file := range []string{StateFile, CowImageFile, "disks/data.qcow2"} {
+		_, err = os.Stat(filepath.Join(dataDir, file))
+		assert.Assert(t, os.IsNotExist(err), file)
+	}
+
+	_, err = e.find(ctx, spec.Namespace, spec.Name)
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotFound), "got %v", err)
+
+	// A VM with the same name gets the kept disk attached again
+	assert.NilError(t, os.Truncate(filepath.Join(dataDir, "disks", "logs.raw"), 42))
+
+	spec.Cloud = false
+	_, err = e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	info, err := os.Stat(filepath.Join(dataDir, "disks", "logs.raw"))
+	assert.NilError(t, err)
+	assert.Equal(t, info.Size(), int64(42))
+}
+
+func TestStopVMGraceful(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "paused"})
+	server.Reply("cont", nil)
+	server.Reply("system_powerdown", nil)
+	server.ExitOn("system_powerdown")
+
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	pid := st.Pid
+
+	assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Timeout: 5 * time.Second}))
+	waitFor(t, func() bool { return !(&State{Pid: pid}).running() })
+
+	names := []string{}
+	for _, cmd := range server.Commands() {
+		names = append(names, cmd.Name)
+	}
+
+	// Paused guests are resumed to handle the ACPI request
+	assert.DeepEqual(t, names, []string{"qmp_capabilities", "query-status", "cont", "system_powerdown"})
+}
+
+func TestPauseResume(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	err = e.PauseVM(ctx, spec.Namespace, spec.Name)
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+
+	status := "running"
+	server.Handle("query-status", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"status": status, "running": status == "running"}, nil
+	})
+	server.Handle("stop", func(json.RawMessage) (interface{}, error) {
+		status = "paused"
+		return nil, nil
+	})
+	server.Handle("cont", func(json.RawMessage) (interface{}, error) {
+		status = "running"
+		return nil, nil
+	})
+
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+	defer func() {
+		assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Force: true}))
+	}()
+
+	assert.NilError(t, e.PauseVM(ctx, spec.Namespace, spec.Name))
+
+	ins, err := e.InspectVM(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, ins.Status, vm.StatusPaused)
+
+	assert.NilError(t, e.ResumeVM(ctx, spec.Namespace, spec.Name))
+
+	instances, err := e.ListVM(ctx, spec.Namespace, false)
+	assert.NilError(t, err)
+	assert.Equal(t, instances[0].Status, vm.StatusRunning)
+}
+
+// nolint: funlen
+func TestCheckpoint(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	spec.Disks = []vm.Disk{{Name: "logs", Size: 1}}
+	assert.NilError(t, spec.CheckDisks())
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	_, err = e.CreateCheckpoint(ctx, spec.Namespace, spec.Name, "first")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("stop", nil)
+	server.Reply("cont", nil)
+	server.Reply("migrate-set-parameters", nil)
+	server.Reply("query-migrate", map[string]string{"status": "completed"})
+	server.Handle("migrate", func(args json.RawMessage) (interface{}, error) {
+		state := filepath.Join(dataDir, "checkpoints", "first", "state")
+		return nil, ioutil.WriteFile(state, []byte("ram"), 0644)
+	})
+
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+	defer func() {
+		assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Force: true}))
+	}()
+
+	cp, err := e.CreateCheckpoint(ctx, spec.Namespace, spec.Name, "first")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cp.Disks, []string{CowImageFile, "disks/logs.qcow2"})
+
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	pid := st.Pid
+
+	// QEMU is relaunched loading the checkpoint state
+	argsFile := filepath.Join(filepath.Dir(e.Binary), "qemu.args")
+	waitFor(t, func() bool {
+		_, err := os.Stat(argsFile)
+		return err == nil
+	})
+	assert.NilError(t, os.Remove(argsFile))
+	assert.NilError(t, e.RestoreCheckpoint(ctx, spec.Namespace, spec.Name, "first"))
+	waitFor(t, func() bool { return !(&State{Pid: pid}).running() })
+
+	waitFor(t, func() bool {
+		_, err := os.Stat(argsFile)
+		return err == nil
+	})
+
+	args, err := ioutil.ReadFile(argsFile)
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(args), "-incoming exec:cat "+dataDir+"/checkpoints/first/state"))
+
+	// Later starts boot normally
+	st, err = e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Assert(t, st.running())
+	assert.Check(t, !strings.Contains(strings.Join(st.Args, " "), "-incoming"))
+
+	checkpoints, err := e.ListCheckpoints(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, len(checkpoints), 1)
+
+	assert.NilError(t, e.DeleteCheckpoint(ctx, spec.Namespace, spec.Name, "first"))
+
+	err = e.RestoreCheckpoint(ctx, spec.Namespace, spec.Name, "first")
+	assert.Assert(t, errors.Is(err, engines.ErrCheckpointNotFound), "got %v", err)
+}
+
+func TestSnapshots(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	// Offline through qemu-img
+	snapshot, err := e.CreateSnapshot(ctx, spec.Namespace, spec.Name, "first")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, snapshot, engines.Snapshot{Name: "first", Created: time.Unix(1790000000, 0).UTC()})
+
+	_, err = e.CreateSnapshot(ctx, spec.Namespace, spec.Name, "first")
+	assert.Assert(t, is.ErrorContains(err, "snapshot first already exists"))
+
+	assert.NilError(t, e.RevertSnapshot(ctx, spec.Namespace, spec.Name, "first"))
+
+	err = e.RevertSnapshot(ctx, spec.Namespace, spec.Name, "second")
+	assert.Assert(t, errors.Is(err, engines.ErrSnapshotNotFound), "got %v", err)
+
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls), "snapshot -c first "+dataDir+"/cow_image.qcow2"))
+	assert.Check(t, is.Contains(string(calls), "snapshot -a first "+dataDir+"/cow_image.qcow2"))
+
+	// Online through QMP
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-block", []interface{}{
+		map[string]interface{}{"device": "data", "inserted": map[string]string{"node-name": "#block100"}},
+	})
+	server.Reply("snapshot-delete", nil)
+	server.Reply("job-dismiss", nil)
+	server.Reply("query-jobs", []map[string]string{{"id": "govm-snapshot", "status": "concluded"}})
+
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+	defer func() {
+		assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Force: true}))
+	}()
+
+	assert.NilError(t, e.DeleteSnapshot(ctx, spec.Namespace, spec.Name, "first"))
+	assert.Equal(t, server.Commands()[2].Name, "snapshot-delete")
+
+	calls, err = ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls), "info --output=json -U "+dataDir+"/cow_image.qcow2"))
+	assert.Check(t, !strings.Contains(string(calls), "snapshot -d"))
+}
+
+// nolint: funlen
+func TestResizeDisk(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	// Offline through qemu-img
+	resize, err := e.ResizeDisk(ctx, spec.Namespace, spec.Name, engines.ResizeOptions{Size: 20 << 30})
+	assert.NilError(t, err)
+	assert.Equal(t, resize.Before.Virtual, int64(10<<30))
+	assert.Equal(t, resize.After.Virtual, int64(20<<30))
+	assert.Equal(t, resize.After.Actual, int64(4096))
+
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls), "resize "+dataDir+"/cow_image.qcow2 21474836480"))
+
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, st.Spec.Size.DISK, 20)
+	assert.Check(t, is.Contains(strings.Join(st.Args, " "), "-qmp unix:"+dataDir+"/qmp,server=on,wait=off"))
+
+	_, err = e.ResizeDisk(ctx, spec.Namespace, spec.Name, engines.ResizeOptions{Size: 5 << 30})
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+
+	// Online through the QMP socket
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("block_resize", nil)
+
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+	defer func() {
+		assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Force: true}))
+	}()
+
+	_, err = e.ResizeDisk(ctx, spec.Namespace, spec.Name, engines.ResizeOptions{Size: 30 << 30})
+	assert.NilError(t, err)
+
+	commands := server.Commands()
+	assert.Equal(t, len(commands), 2)
+	assert.Equal(t, commands[1].Name, "block_resize")
+	assert.Equal(t, string(commands[1].Arguments), `{"device":"data","size":32212254720}`)
+
+	calls, err = ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls), "info --output=json -U "+dataDir+"/cow_image.qcow2"))
+	assert.Check(t, !strings.Contains(string(calls), "resize "+dataDir+"/cow_image.qcow2 32212254720"))
+}
+
+func TestSaveVM(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+
+	reported := []float64{}
+	out := filepath.Join(dir, "backup.qcow2")
+	assert.NilError(t, e.SaveVM(ctx, spec.Namespace, spec.Name, engines.SaveOptions{
+		Output:   out,
+		Compress: true,
+		Progress: func(percent float64) { reported = append(reported, percent) },
+	}))
+	assert.DeepEqual(t, reported, []float64{0, 50, 100})
+
+	out = filepath.Join(dir, "backup.raw")
+	assert.NilError(t, e.SaveVM(ctx, spec.Namespace, spec.Name, engines.SaveOptions{Output: out, Format: engines.FormatRaw}))
+
+	size, _, err := internal.ImageSize(out)
+	assert.NilError(t, err)
+	assert.Equal(t, size, int64(10737418240))
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 2)
+
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	partial := filepath.Join(dir, ".backup.qcow2.partial")
+	assert.Check(t, is.Contains(string(calls), "convert -p -O qcow2 -c "+filepath.Join(spec.Workdir, "data", spec.Name, CowImageFile)+" "+partial))
+	assert.Check(t, is.Contains(string(calls), "check "+partial))
+	assert.Check(t, is.Contains(string(calls), "convert -p -O raw "))
+	assert.Check(t, !strings.Contains(string(calls), "check "+filepath.Join(dir, ".backup.raw.partial")))
+}
+
+func TestSaveVMStop(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+
+	server, err := qmptest.NewServer(filepath.Join(dataDir, QMPSocketFile))
+	assert.NilError(t, err)
+	defer server.Close()
+	server.Reply("query-status", map[string]string{"status": "running"})
+	server.Reply("system_powerdown", nil)
+	server.ExitOn("system_powerdown")
+
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	pid := st.Pid
+
+	out := filepath.Join(t.TempDir(), "backup.qcow2")
+	assert.NilError(t, e.SaveVM(ctx, spec.Namespace, spec.Name, engines.SaveOptions{Output: out, Stop: true}))
+	defer func() {
+		assert.NilError(t, e.StopVM(ctx, spec.Namespace, spec.Name, engines.StopOptions{Force: true}))
+	}()
+
+	// The copy is made offline and the VM started again
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, !strings.Contains(string(calls), " -U "+filepath.Join(dataDir, CowImageFile)))
+
+	st, err = e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Check(t, st.running())
+	assert.Check(t, st.Pid != pid)
+}
+
+func TestSaveVMCancel(t *testing.T) {
+	e, spec := newTestEngine(t)
+
+	_, err := e.CreateVM(context.Background(), spec)
+	assert.NilError(t, err)
+
+	e.ImgBinary = writeScript(t, t.TempDir(), "qemu-img", slowQemuImg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	dir := t.TempDir()
+	err = e.SaveVM(ctx, spec.Namespace, spec.Name, engines.SaveOptions{Output: filepath.Join(dir, "backup.qcow2")})
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+
+	// The half-written output is removed
+	entries, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestImportOverlay(t *testing.T) {
+	e, spec := newTestEngine(t)
+	ctx := context.Background()
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+
+	_, err := e.CreateVM(ctx, spec)
+	assert.NilError(t, err)
+	assert.NilError(t, e.StartVM(ctx, spec.Namespace, spec.Name))
+
+	overlay := filepath.Join(t.TempDir(), "overlay.qcow2")
+	assert.NilError(t, ioutil.WriteFile(overlay, []byte("overlay"), 0644))
+
+	assert.NilError(t, e.ImportOverlay(ctx, spec.Namespace, spec.Name, overlay))
+
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, CowImageFile))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "overlay")
+
+	calls, err := ioutil.ReadFile(filepath.Join(filepath.Dir(e.ImgBinary), "qemu-img.calls"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(calls),
+		"rebase -u -F raw -b "+spec.ParentImage+" "+filepath.Join(dataDir, CowImageFile)))
+
+	// The VM is stopped the hard way
+	st, err := e.find(ctx, spec.Namespace, spec.Name)
+	assert.NilError(t, err)
+	assert.Check(t, !st.running())
+}
@@ -0,0 +1,101 @@
+package qemu
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/vm"
+)
+
+// State is the persisted record of a QEMU process-based VM. It lives in the
+// VM data directory so every govm invocation can manage the same process.
+type State struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	DataDir   string    `json:"data_dir"`
+	Args      []string  `json:"args"`
+	Pid       int       `json:"pid"`
+	SSHPort   int       `json:"ssh_port"`
+	VNCSocket string    `json:"vnc_socket"`
+	Created   time.Time `json:"created"`
+
+	// Spec is the instance spec the VM was created from
+	Spec vm.Instance `json:"spec"`
+}
+
+// loadState reads the state file from a VM data directory
+func loadState(dataDir string) (*State, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, StateFile))
+	if err != nil {
+		return nil, err
+	}
+
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// save writes the state file into the VM data directory
+func (st *State) save() error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(st.DataDir, StateFile), data, 0664) // nolint: gosec
+}
+
+// running reports whether the recorded QEMU process is still alive
+func (st *State) running() bool {
+	if st.Pid <= 0 {
+		return false
+	}
+
+	return syscall.Kill(st.Pid, 0) == nil
+}
+
+// instance returns the VM instance described by the state
+func (st *State) instance() vm.Instance {
+	ins := st.Spec
+	ins.ID = st.ID[:10]
+	ins.Name = st.Name
+	ins.Namespace = st.Namespace
+	ins.Created = st.Created
+	ins.Status = vm.StatusStopped
+
+	if st.running() {
+		ins.Status = vm.StatusRunning
+	}
+
+	return ins
+}
+
+// guestInstance returns the VM instance described by the state, paused if
+// QEMU reports its vCPUs stopped
+func (st *State) guestInstance(ctx context.Context) vm.Instance {
+	ins := st.instance()
+	ins.Status = engines.GuestStatus(ctx, filepath.Join(st.DataDir, QMPSocketFile), ins.Status)
+
+	return ins
+}
+
+// newID returns a random identifier for a new VM
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
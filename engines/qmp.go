@@ -0,0 +1,39 @@
+package engines
+
+import (
+	"context"
+	"time"
+
+	"github.com/govm-project/govm/pkg/qmp"
+	"github.com/govm-project/govm/vm"
+)
+
+// QMPStatusTimeout bounds the status query of a single VM, so that a stuck
+// monitor doesn't hold a whole listing
+const QMPStatusTimeout = 2 * time.Second
+
+// GuestStatus refines the status of a running VM with the run state QEMU
+// reports on its QMP socket. VMs without a reachable monitor, e.g. created by
+// an older govm, keep their status.
+func GuestStatus(ctx context.Context, socket string, status vm.Status) vm.Status {
+	if status != vm.StatusRunning {
+		return status
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, QMPStatusTimeout)
+	defer cancel()
+
+	var reply struct {
+		Status string `json:"status"`
+	}
+
+	if err := qmp.Command(ctx, socket, "query-status", nil, &reply); err != nil {
+		return status
+	}
+
+	if reply.Status == "paused" {
+		return vm.StatusPaused
+	}
+
+	return status
+}
@@ -0,0 +1,162 @@
+package engines
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/vm"
+)
+
+// Disk image formats SaveVM writes
+const (
+	FormatQcow2 = "qcow2"
+	FormatRaw   = "raw"
+)
+
+// partialSuffix marks a saved image until it has been verified
+const partialSuffix = ".partial"
+
+// SaveOptions describes the export of a VM disk, flattened with its parent
+// image into a standalone image
+type SaveOptions struct {
+	// Output is the image file to write
+	Output string
+	// Format is the image format, FormatQcow2 or FormatRaw
+	Format string
+	// Compress compresses the qcow2 image clusters
+	Compress bool
+	// Stop stops a running VM meanwhile, for a consistent copy, and starts
+	// it again afterwards. Running VMs are copied as they are otherwise.
+	Stop bool
+	// Progress is called with the completion percentage of the copy
+	Progress func(percent float64)
+}
+
+// Check validates the options, filling in the defaults. Output becomes an
+// absolute path.
+func (opts *SaveOptions) Check() error {
+	if opts.Output == "" {
+		return &vm.SpecError{Field: "out", Value: opts.Output, Err: errors.New("the output file is required")}
+	}
+
+	if opts.Format == "" {
+		opts.Format = FormatQcow2
+	}
+
+	switch {
+	case opts.Format != FormatQcow2 && opts.Format != FormatRaw:
+		return &vm.SpecError{Field: "format", Value: opts.Format,
+			Err: fmt.Errorf("supported formats are %v and %v", FormatQcow2, FormatRaw)}
+	case opts.Compress && opts.Format != FormatQcow2:
+		return &vm.SpecError{Field: "format", Value: opts.Format,
+			Err: errors.New("only qcow2 images can be compressed")}
+	}
+
+	output, err := filepath.Abs(opts.Output)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(filepath.Dir(output)); err != nil {
+		return fmt.Errorf("output directory: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("output directory: %v is not a directory", filepath.Dir(output))
+	}
+
+	opts.Output = output
+
+	return nil
+}
+
+// PartialOutput is the file the image is written to until it is verified
+func (opts SaveOptions) PartialOutput() string {
+	dir, file := filepath.Split(opts.Output)
+
+	return filepath.Join(dir, "."+file+partialSuffix)
+}
+
+// ConvertArgs returns the qemu-img arguments flattening src into dst.
+// Images in use by a running VM are read without taking their lock.
+func (opts SaveOptions) ConvertArgs(src, dst string, inUse bool) []string {
+	args := []string{"convert", "-p", "-O", opts.Format}
+
+	if opts.Compress {
+		args = append(args, "-c")
+	}
+
+	if inUse {
+		args = append(args, "-U")
+	}
+
+	return append(args, src, dst)
+}
+
+// FinishSave verifies the image written to the partial output against the
+// virtual size of the source disk and moves it in place
+func FinishSave(opts SaveOptions, virtual int64) error {
+	partial := opts.PartialOutput()
+
+	format, err := internal.ImageFormat(partial)
+	if err != nil {
+		return err
+	}
+
+	size, _, err := internal.ImageSize(partial)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case format != opts.Format:
+		return fmt.Errorf("the saved image is %v instead of %v", format, opts.Format)
+	case size != virtual:
+		return fmt.Errorf("the saved image is %d bytes instead of %d", size, virtual)
+	}
+
+	return os.Rename(partial, opts.Output)
+}
+
+// qemuImgProgress matches the progress lines of qemu-img -p
+var qemuImgProgress = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`) // nolint: gochecknoglobals
+
+// ProgressWriter returns a writer parsing the progress qemu-img -p prints
+// and reporting it to progress. A nil progress discards it.
+func ProgressWriter(progress func(percent float64)) io.Writer {
+	return &progressWriter{progress: progress}
+}
+
+type progressWriter struct {
+	progress func(percent float64)
+	line     []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if w.progress == nil {
+		return len(p), nil
+	}
+
+	// qemu-img rewrites its progress line with carriage returns
+	for _, b := range p {
+		if b != '\r' && b != '\n' {
+			w.line = append(w.line, b)
+			continue
+		}
+
+		if m := qemuImgProgress.FindSubmatch(bytes.TrimSpace(w.line)); m != nil {
+			if percent, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+				w.progress(percent)
+			}
+		}
+
+		w.line = w.line[:0]
+	}
+
+	return len(p), nil
+}
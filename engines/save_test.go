@@ -0,0 +1,55 @@
+package engines
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSaveOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := SaveOptions{Output: filepath.Join(dir, "vm.img"), Compress: true}
+	assert.NilError(t, opts.Check())
+	assert.Equal(t, opts.Format, FormatQcow2)
+	assert.Equal(t, opts.PartialOutput(), filepath.Join(dir, ".vm.img.partial"))
+	assert.DeepEqual(t, opts.ConvertArgs("/data/disk", "/out/vm", true),
+		[]string{"convert", "-p", "-O", "qcow2", "-c", "-U", "/data/disk", "/out/vm"})
+
+	opts = SaveOptions{Output: filepath.Join(dir, "missing", "vm.img")}
+	assert.Assert(t, is.ErrorContains(opts.Check(), "output directory"))
+}
+
+func TestFinishSave(t *testing.T) {
+	opts := SaveOptions{Output: filepath.Join(t.TempDir(), "vm.raw"), Format: FormatRaw}
+	assert.NilError(t, ioutil.WriteFile(opts.PartialOutput(), make([]byte, 4096), 0644))
+
+	err := FinishSave(opts, 8192)
+	assert.Assert(t, is.ErrorContains(err, "the saved image is 4096 bytes instead of 8192"))
+
+	assert.NilError(t, FinishSave(opts, 4096))
+
+	_, err = os.Stat(opts.Output)
+	assert.NilError(t, err)
+
+	opts.Format = FormatQcow2
+	assert.NilError(t, ioutil.WriteFile(opts.PartialOutput(), make([]byte, 4096), 0644))
+	assert.Assert(t, is.ErrorContains(FinishSave(opts, 4096), "the saved image is raw instead of qcow2"))
+}
+
+func TestProgressWriter(t *testing.T) {
+	reported := []float64{}
+	w := ProgressWriter(func(percent float64) { reported = append(reported, percent) })
+
+	// Progress lines may be split across writes
+	for _, chunk := range []string{"    (0.00/100%)\r", "    (50.", "25/100%)\r", "    (100.00/100%)\n"} {
+		_, err := w.Write([]byte(chunk))
+		assert.NilError(t, err)
+	}
+
+	assert.DeepEqual(t, reported, []float64{0, 50.25, 100})
+}
@@ -0,0 +1,185 @@
+package engines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/pkg/qmp"
+	"github.com/govm-project/govm/vm"
+)
+
+// SnapshotDevice is the QEMU drive holding the copy-on-write disk of a VM
+const SnapshotDevice = "data"
+
+// snapshotJobID is the ID of the QEMU jobs run for snapshots
+const snapshotJobID = "govm-snapshot"
+
+// Snapshot is a named internal snapshot of the copy-on-write disk of a VM
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// VMStateSize is the size of the RAM and device state saved along with
+	// the disk, zero for snapshots taken while the VM was stopped
+	VMStateSize int64 `json:"vm-state-size"`
+}
+
+// CheckSnapshotName verifies that name can name a new snapshot among the
+// existing ones
+func CheckSnapshotName(name string, snapshots []Snapshot) error {
+	if !vm.ValidName(name) {
+		return &vm.SpecError{
+			Field: "snapshot",
+			Value: name,
+			Err:   errors.New("names are made of letters, digits, '-' and '_'"),
+		}
+	}
+
+	if _, err := FindSnapshot(name, snapshots); err == nil {
+		return fmt.Errorf("snapshot %v already exists", name)
+	}
+
+	return nil
+}
+
+// FindSnapshot looks a snapshot up by name
+func FindSnapshot(name string, snapshots []Snapshot) (Snapshot, error) {
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+
+	return Snapshot{}, fmt.Errorf("%w: %v", ErrSnapshotNotFound, name)
+}
+
+// ImageSnapshots lists the snapshots of a qcow2 disk image
+func ImageSnapshots(disk string) ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+
+	images, err := internal.ImageSnapshots(disk)
+	if err != nil {
+		return snapshots, err
+	}
+
+	for _, image := range images {
+		snapshots = append(snapshots, Snapshot{
+			Name:        image.Name,
+			Created:     image.Date,
+			VMStateSize: image.VMStateSize,
+		})
+	}
+
+	return snapshots, nil
+}
+
+// SnapshotSave snapshots the copy-on-write disk and the RAM of the running
+// VM behind the QMP socket
+func SnapshotSave(ctx context.Context, socket, name string) error {
+	return snapshotJob(ctx, socket, "snapshot-save", name)
+}
+
+// SnapshotLoad reverts the running VM behind the QMP socket to a snapshot
+func SnapshotLoad(ctx context.Context, socket, name string) error {
+	return snapshotJob(ctx, socket, "snapshot-load", name)
+}
+
+// SnapshotDelete deletes a snapshot of the running VM behind the QMP socket
+func SnapshotDelete(ctx context.Context, socket, name string) error {
+	return snapshotJob(ctx, socket, "snapshot-delete", name)
+}
+
+// snapshotJob runs one of the QEMU snapshot jobs on the copy-on-write disk
+// and waits for its completion. QEMU pauses the guest meanwhile.
+func snapshotJob(ctx context.Context, socket, command, name string) error {
+	client, err := qmp.Dial(ctx, socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	node, err := blockNode(ctx, client, SnapshotDevice)
+	if err != nil {
+		return err
+	}
+
+	args := map[string]interface{}{
+		"job-id":  snapshotJobID,
+		"tag":     name,
+		"devices": []string{node},
+	}
+	if command != "snapshot-delete" {
+		args["vmstate"] = node
+	}
+
+	if err := client.Execute(ctx, command, args, nil); err != nil {
+		return err
+	}
+
+	return waitJob(ctx, client, snapshotJobID)
+}
+
+// blockNode returns the name of the block node behind a QEMU drive
+func blockNode(ctx context.Context, client *qmp.Client, device string) (string, error) {
+	var blocks []struct {
+		Device   string `json:"device"`
+		Inserted *struct {
+			NodeName string `json:"node-name"`
+		} `json:"inserted"`
+	}
+
+	if err := client.Execute(ctx, "query-block", nil, &blocks); err != nil {
+		return "", err
+	}
+
+	for _, block := range blocks {
+		if block.Device == device && block.Inserted != nil {
+			return block.Inserted.NodeName, nil
+		}
+	}
+
+	return "", fmt.Errorf("the VM has no %v drive", device)
+}
+
+// waitJob waits for a QEMU job to conclude and dismisses it
+func waitJob(ctx context.Context, client *qmp.Client, id string) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var jobs []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+
+		if err := client.Execute(ctx, "query-jobs", nil, &jobs); err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			if job.ID != id || job.Status != "concluded" {
+				continue
+			}
+
+			if err := client.Execute(ctx, "job-dismiss", map[string]string{"id": id}, nil); err != nil {
+				return err
+			}
+
+			if job.Error != "" {
+				return errors.New(job.Error)
+			}
+
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// The job is left to QEMU, it can't be cancelled halfway
+			return ctx.Err()
+		}
+	}
+}
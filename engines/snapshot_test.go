@@ -0,0 +1,82 @@
+package engines
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/govm-project/govm/pkg/qmp/qmptest"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// newSnapshotServer returns a QMP server running snapshot jobs, which
+// conclude with jobError after a first poll
+func newSnapshotServer(t *testing.T, jobError string) *qmptest.Server {
+	server, err := qmptest.NewServer(filepath.Join(t.TempDir(), "qmp"))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+
+	server.Reply("query-block", []interface{}{
+		map[string]interface{}{"device": "disk-logs", "inserted": map[string]string{"node-name": "#block300"}},
+		map[string]interface{}{"device": "data", "inserted": map[string]string{"node-name": "#block100"}},
+	})
+	server.Reply("job-dismiss", nil)
+
+	for _, command := range []string{"snapshot-save", "snapshot-load", "snapshot-delete"} {
+		server.Reply(command, nil)
+	}
+
+	polls := 0
+	server.Handle("query-jobs", func(json.RawMessage) (interface{}, error) {
+		polls++
+		if polls == 1 {
+			return []map[string]string{{"id": "govm-snapshot", "status": "running"}}, nil
+		}
+
+		return []map[string]string{{"id": "govm-snapshot", "status": "concluded", "error": jobError}}, nil
+	})
+
+	return server
+}
+
+func TestSnapshotSave(t *testing.T) {
+	server := newSnapshotServer(t, "")
+
+	assert.NilError(t, SnapshotSave(context.Background(), server.Socket, "first"))
+
+	commands := server.Commands()
+	assert.DeepEqual(t, commandNames(server), []string{"qmp_capabilities", "query-block", "snapshot-save",
+		"query-jobs", "query-jobs", "job-dismiss"})
+	assert.Equal(t, string(commands[2].Arguments),
+		`{"devices":["#block100"],"job-id":"govm-snapshot","tag":"first","vmstate":"#block100"}`)
+	assert.Equal(t, string(commands[5].Arguments), `{"id":"govm-snapshot"}`)
+}
+
+func TestSnapshotDeleteFailure(t *testing.T) {
+	server := newSnapshotServer(t, "Snapshot 'first' not found")
+
+	err := SnapshotDelete(context.Background(), server.Socket, "first")
+	assert.Assert(t, is.ErrorContains(err, "Snapshot 'first' not found"))
+
+	// Deletions don't involve the VM state
+	assert.Equal(t, string(server.Commands()[2].Arguments),
+		`{"devices":["#block100"],"job-id":"govm-snapshot","tag":"first"}`)
+	assert.Equal(t, commandNames(server)[5], "job-dismiss")
+}
+
+func TestCheckSnapshotName(t *testing.T) {
+	snapshots := []Snapshot{{Name: "first"}}
+
+	assert.NilError(t, CheckSnapshotName("second", snapshots))
+	assert.Assert(t, is.ErrorContains(CheckSnapshotName("first", snapshots), "snapshot first already exists"))
+
+	err := CheckSnapshotName("with space", snapshots)
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+
+	_, err = FindSnapshot("second", snapshots)
+	assert.Assert(t, errors.Is(err, ErrSnapshotNotFound), "got %v", err)
+}
@@ -0,0 +1,72 @@
+package engines
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/govm-project/govm/pkg/qmp"
+)
+
+// DefaultStopTimeout is how long a guest gets to power off on its own
+// before its VM is stopped the hard way
+const DefaultStopTimeout = 60 * time.Second
+
+// StopOptions tunes how a running VM is stopped
+type StopOptions struct {
+	// Timeout is how long the guest gets to power off after the ACPI
+	// powerdown, DefaultStopTimeout when zero
+	Timeout time.Duration
+	// Force skips the ACPI powerdown and stops QEMU right away, at the risk
+	// of corrupting the guest filesystems
+	Force bool
+}
+
+// Shutdown sends an ACPI powerdown to the guest behind a QMP socket and
+// waits for QEMU to exit once the guest has halted. Paused guests are
+// resumed first, they would not handle the request otherwise.
+func Shutdown(ctx context.Context, socket string, opts StopOptions) error {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := qmp.Dial(waitCtx, socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var status struct {
+		Status string `json:"status"`
+	}
+
+	if err := client.Execute(waitCtx, "query-status", nil, &status); err != nil {
+		return err
+	}
+
+	if status.Status == "paused" {
+		if err := client.Execute(waitCtx, "cont", nil, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Execute(waitCtx, "system_powerdown", nil, nil); err != nil {
+		return err
+	}
+
+	// The monitor goes away with QEMU
+	select {
+	case <-client.Done():
+		return nil
+	case <-waitCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("the guest didn't power off within %v", timeout)
+	}
+}
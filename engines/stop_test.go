@@ -0,0 +1,67 @@
+package engines
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/govm-project/govm/pkg/qmp/qmptest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newQMPServer(t *testing.T, status string) *qmptest.Server {
+	server, err := qmptest.NewServer(filepath.Join(t.TempDir(), "qmp"))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+
+	server.Reply("query-status", map[string]string{"status": status})
+	server.Reply("cont", nil)
+	server.Reply("system_powerdown", nil)
+
+	return server
+}
+
+func commandNames(server *qmptest.Server) []string {
+	names := []string{}
+	for _, cmd := range server.Commands() {
+		names = append(names, cmd.Name)
+	}
+
+	return names
+}
+
+func TestShutdown(t *testing.T) {
+	server := newQMPServer(t, "running")
+	server.ExitOn("system_powerdown")
+
+	assert.NilError(t, Shutdown(context.Background(), server.Socket, StopOptions{}))
+	assert.DeepEqual(t, commandNames(server), []string{"qmp_capabilities", "query-status", "system_powerdown"})
+}
+
+func TestShutdownPaused(t *testing.T) {
+	server := newQMPServer(t, "paused")
+	server.ExitOn("system_powerdown")
+
+	assert.NilError(t, Shutdown(context.Background(), server.Socket, StopOptions{}))
+	assert.DeepEqual(t, commandNames(server),
+		[]string{"qmp_capabilities", "query-status", "cont", "system_powerdown"})
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// The guest ignores the ACPI request
+	server := newQMPServer(t, "running")
+
+	start := time.Now()
+	err := Shutdown(context.Background(), server.Socket, StopOptions{Timeout: 100 * time.Millisecond})
+	assert.Assert(t, is.ErrorContains(err, "the guest didn't power off within 100ms"))
+	assert.Assert(t, time.Since(start) < 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = Shutdown(ctx, server.Socket, StopOptions{Timeout: time.Hour})
+	assert.Assert(t, errors.Is(err, context.Canceled), "got %v", err)
+}
@@ -0,0 +1,274 @@
+// Package bundle reads and writes the portable VM archives of govm export
+// and import: a tar stream, zstd or gzip compressed, holding the disks, spec
+// and cloud-init files of a VM along with a manifest of their checksums.
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/govm-project/govm/internal"
+)
+
+const (
+	// ManifestFile is the bundle member describing the others
+	ManifestFile = "manifest.json"
+	// Version is the layout version of the bundles written by this govm
+	Version = 1
+)
+
+// Compressions of the bundles, picked from the file extension on export
+// and from the content on import
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ZstdBinary is the command compressing and decompressing zstd bundles
+var ZstdBinary = "zstd" // nolint: gochecknoglobals
+
+// ErrCorrupt is returned when a bundle doesn't match its manifest
+var ErrCorrupt = errors.New("corrupt bundle")
+
+// Manifest describes the content of a bundle
+type Manifest struct {
+	// Version is the layout version the bundle was written with
+	Version int `json:"version"`
+	// Name, Namespace and Engine identify the exported VM
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Engine    string    `json:"engine"`
+	Created   time.Time `json:"created"`
+	// Spec is the member holding the JSON instance spec
+	Spec string `json:"spec"`
+	// Image is the member holding the root disk, flattened or the parent
+	// image of Overlay
+	Image string `json:"image"`
+	// Overlay is the member holding the copy-on-write overlay of Image, if
+	// the disks were not flattened
+	Overlay string `json:"overlay,omitempty"`
+	// Files holds the SHA-256 checksum of every other member
+	Files map[string]string `json:"files"`
+}
+
+// Compression returns the compression of a bundle written to path
+func Compression(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".zst"), strings.HasSuffix(path, ".tzst"):
+		return CompressionZstd
+	case strings.HasSuffix(path, ".gz"), strings.HasSuffix(path, ".tgz"):
+		return CompressionGzip
+	default:
+		return CompressionNone
+	}
+}
+
+// Writer writes a bundle. Members are streamed to a hidden partial file
+// next to the output, moved in place by Close.
+type Writer struct {
+	ctx   context.Context
+	path  string
+	file  *os.File
+	tar   *tar.Writer
+	files map[string]string
+
+	compressor io.WriteCloser
+	zstd       *exec.Cmd
+	stderr     bytes.Buffer
+	closed     bool
+}
+
+// Create starts writing a bundle to path, compressed as its extension says
+func Create(ctx context.Context, path string) (*Writer, error) {
+	w := &Writer{ctx: ctx, path: path, files: map[string]string{}}
+
+	file, err := os.Create(w.partial())
+	if err != nil {
+		return nil, err
+	}
+
+	w.file = file
+
+	var out io.Writer = file
+
+	switch Compression(path) {
+	case CompressionGzip:
+		w.compressor = gzip.NewWriter(file)
+		out = w.compressor
+	case CompressionZstd:
+		w.zstd = exec.CommandContext(ctx, ZstdBinary, "-q", "-c") // nolint: gosec
+		w.zstd.Stdout = file
+		w.zstd.Stderr = &w.stderr
+
+		if w.compressor, err = w.zstd.StdinPipe(); err == nil {
+			err = w.zstd.Start()
+		}
+
+		if err != nil {
+			w.Abort()
+			return nil, fmt.Errorf("%v: %w", ZstdBinary, err)
+		}
+
+		out = w.compressor
+	}
+
+	w.tar = tar.NewWriter(out)
+
+	return w, nil
+}
+
+func (w *Writer) partial() string {
+	dir, file := filepath.Split(w.path)
+	return filepath.Join(dir, "."+file+".partial")
+}
+
+// Add streams the file src into the bundle as name
+func (w *Writer) Add(name, src string) error {
+	in, err := os.Open(src) // nolint: gosec
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	return w.add(name, info.Size(), in)
+}
+
+// AddData writes data into the bundle as name
+func (w *Writer) AddData(name string, data []byte) error {
+	return w.add(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func (w *Writer) add(name string, size int64, r io.Reader) error {
+	if _, ok := w.files[name]; ok || name == ManifestFile {
+		return fmt.Errorf("duplicate bundle member %v", name)
+	}
+
+	err := w.tar.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now().UTC(),
+		Format:  tar.FormatPAX,
+	})
+	if err != nil {
+		return w.error(err)
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(w.tar, io.TeeReader(internal.ContextReader(w.ctx, r), sum)); err != nil {
+		return w.error(err)
+	}
+
+	w.files[name] = hex.EncodeToString(sum.Sum(nil))
+
+	return nil
+}
+
+// Close writes the manifest, filling in its version and checksums, and
+// moves the bundle in place
+func (w *Writer) Close(manifest Manifest) error {
+	manifest.Version = Version
+	manifest.Files = w.files
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = w.tar.WriteHeader(&tar.Header{
+		Name:    ManifestFile,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now().UTC(),
+	})
+	if err == nil {
+		_, err = w.tar.Write(data)
+	}
+
+	if err == nil {
+		err = w.tar.Close()
+	}
+
+	if err == nil {
+		err = w.finish()
+	}
+
+	if err != nil {
+		w.Abort()
+		return w.error(err)
+	}
+
+	w.closed = true
+
+	return os.Rename(w.partial(), w.path)
+}
+
+// finish flushes the compressor and closes the partial file
+func (w *Writer) finish() error {
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			return err
+		}
+	}
+
+	if w.zstd != nil {
+		if err := w.zstd.Wait(); err != nil {
+			return fmt.Errorf("%v: %w: %s", ZstdBinary, err, strings.TrimSpace(w.stderr.String()))
+		}
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	return w.file.Close()
+}
+
+// error prefers the cancellation of the context to the errors it caused
+func (w *Writer) error(err error) error {
+	if w.ctx.Err() != nil {
+		return w.ctx.Err()
+	}
+
+	return err
+}
+
+// Abort drops an unfinished bundle. It does nothing once Close succeeded.
+func (w *Writer) Abort() {
+	if w.closed {
+		return
+	}
+
+	w.closed = true
+
+	if w.compressor != nil {
+		_ = w.compressor.Close()
+	}
+
+	if w.zstd != nil && w.zstd.Process != nil {
+		_ = w.zstd.Process.Kill()
+		_ = w.zstd.Wait()
+	}
+
+	_ = w.file.Close()
+	_ = os.Remove(w.partial())
+}
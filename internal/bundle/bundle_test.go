@@ -0,0 +1,146 @@
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// writeBundle writes a bundle holding a sparse disk and a spec
+func writeBundle(t *testing.T, path string) Manifest {
+	dir := t.TempDir()
+
+	disk := filepath.Join(dir, "disk.img")
+	assert.NilError(t, ioutil.WriteFile(disk, []byte("boot"), 0644))
+	assert.NilError(t, os.Truncate(disk, 64<<20))
+
+	w, err := Create(context.Background(), path)
+	assert.NilError(t, err)
+	defer w.Abort()
+
+	assert.NilError(t, w.Add("image.img", disk))
+	assert.NilError(t, w.AddData("spec.json", []byte(`{"name": "vm"}`)))
+	assert.NilError(t, w.AddData("disks/data.qcow2", []byte("data")))
+	assert.Assert(t, is.ErrorContains(w.AddData("spec.json", nil), "duplicate bundle member spec.json"))
+
+	manifest := Manifest{Name: "vm", Engine: "qemu", Spec: "spec.json", Image: "image.img"}
+	assert.NilError(t, w.Close(manifest))
+
+	return manifest
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"vm.tar", "vm.tar.gz", "vm.tar.zst"} {
+		t.Run(name, func(t *testing.T) {
+			if Compression(name) == CompressionZstd {
+				if _, err := exec.LookPath(ZstdBinary); err != nil {
+					t.Skip("zstd is not installed")
+				}
+			}
+
+			path := filepath.Join(t.TempDir(), name)
+			writeBundle(t, path)
+
+			// Only the bundle is left
+			entries, err := ioutil.ReadDir(filepath.Dir(path))
+			assert.NilError(t, err)
+			assert.Equal(t, len(entries), 1)
+
+			dir := t.TempDir()
+			manifest, err := Extract(context.Background(), path, dir)
+			assert.NilError(t, err)
+			assert.Equal(t, manifest.Version, Version)
+			assert.Equal(t, manifest.Name, "vm")
+			assert.Equal(t, len(manifest.Files), 3)
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, "disks", "data.qcow2"))
+			assert.NilError(t, err)
+			assert.Equal(t, string(data), "data")
+
+			// The disk stays sparse
+			info, err := os.Stat(filepath.Join(dir, "image.img"))
+			assert.NilError(t, err)
+			assert.Equal(t, info.Size(), int64(64<<20))
+			assert.Assert(t, info.Sys().(*syscall.Stat_t).Blocks*512 < 64<<20)
+		})
+	}
+}
+
+// writeTar writes a raw tar stream with the given members
+func writeTar(t *testing.T, members map[string]string) string {
+	path := filepath.Join(t.TempDir(), "vm.tar")
+
+	file, err := os.Create(path)
+	assert.NilError(t, err)
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	for name, content := range members {
+		assert.NilError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, tw.Close())
+
+	return path
+}
+
+func TestExtractCorrupt(t *testing.T) {
+	// sha256 of "{}"
+	const sum = "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+
+	manifest := `{"version": 1, "spec": "spec.json", "image": "image.img", ` +
+		`"files": {"spec.json": "` + sum + `", "image.img": "` + sum + `"}}`
+
+	tests := []struct {
+		members map[string]string
+		err     string
+	}{
+		{map[string]string{"spec.json": "{}", "image.img": "{}"}, "manifest.json is missing"},
+		{map[string]string{"spec.json": "{}", "image.img": "{ }", ManifestFile: manifest},
+			"checksum mismatch for image.img"},
+		{map[string]string{"spec.json": "{}", ManifestFile: manifest}, "image.img is missing"},
+		{map[string]string{"spec.json": "{}", "image.img": "{}", "extra": "", ManifestFile: manifest},
+			"extra is not in the manifest"},
+		{map[string]string{"../escape": "{}"}, "../escape is outside of the bundle"},
+	}
+
+	for _, tc := range tests {
+		_, err := Extract(context.Background(), writeTar(t, tc.members), t.TempDir())
+		assert.Check(t, errors.Is(err, ErrCorrupt), "got %v", err)
+		assert.Check(t, is.ErrorContains(err, tc.err))
+	}
+
+	_, err := Extract(context.Background(), writeTar(t, map[string]string{
+		"spec.json": "{}", "image.img": "{}", ManifestFile: `{"version": 2}`}), t.TempDir())
+	assert.Assert(t, is.ErrorContains(err, "bundle version 2 is not supported"))
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	path := filepath.Join(t.TempDir(), "vm.tar.gz")
+
+	w, err := Create(ctx, path)
+	assert.NilError(t, err)
+
+	err = w.AddData("spec.json", []byte("{}"))
+	assert.Assert(t, errors.Is(err, context.Canceled), "got %v", err)
+
+	w.Abort()
+
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
@@ -0,0 +1,206 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/govm-project/govm/internal"
+)
+
+// maxManifestSize bounds the manifest read in memory
+const maxManifestSize = 1 << 20
+
+// Compression magic numbers
+const (
+	gzipMagic = "\x1f\x8b"
+	zstdMagic = "\x28\xb5\x2f\xfd"
+)
+
+// Extract unpacks the bundle at path into dir and verifies every member
+// against the manifest. Disk images are written sparse.
+func Extract(ctx context.Context, bundlePath, dir string) (Manifest, error) {
+	manifest := Manifest{}
+
+	file, err := os.Open(bundlePath) // nolint: gosec
+	if err != nil {
+		return manifest, err
+	}
+	defer file.Close()
+
+	in := bufio.NewReader(internal.ContextReader(ctx, file))
+
+	// The compression is sniffed, whatever the file is named
+	magic, _ := in.Peek(len(zstdMagic))
+
+	var stream io.Reader = in
+
+	switch {
+	case bytes.HasPrefix(magic, []byte(gzipMagic)):
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return manifest, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		defer gz.Close()
+
+		stream = gz
+	case bytes.HasPrefix(magic, []byte(zstdMagic)):
+		stderr := &bytes.Buffer{}
+
+		zstd := exec.CommandContext(ctx, ZstdBinary, "-d", "-q", "-c") // nolint: gosec
+		zstd.Stdin = in
+		zstd.Stderr = stderr
+
+		out, err := zstd.StdoutPipe()
+		if err == nil {
+			err = zstd.Start()
+		}
+
+		if err != nil {
+			return manifest, fmt.Errorf("%v: %w", ZstdBinary, err)
+		}
+
+		defer func() {
+			_ = out.Close()
+			_ = zstd.Wait()
+		}()
+
+		stream = out
+	}
+
+	sums, data, err := extract(tar.NewReader(stream), dir)
+	if ctx.Err() != nil {
+		return manifest, ctx.Err()
+	}
+
+	if err != nil {
+		return manifest, err
+	}
+
+	if data == nil {
+		return manifest, fmt.Errorf("%w: %v is missing", ErrCorrupt, ManifestFile)
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("%w: %v: %v", ErrCorrupt, ManifestFile, err)
+	}
+
+	return manifest, manifest.verify(sums)
+}
+
+// extract writes the members of a tar stream into dir, returning their
+// checksums and the manifest
+func extract(tr *tar.Reader, dir string) (map[string]string, []byte, error) {
+	sums := map[string]string{}
+
+	var manifest []byte
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return sums, manifest, nil
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+
+		name := path.Clean(header.Name)
+
+		switch {
+		case header.Typeflag == tar.TypeDir:
+			continue
+		case header.Typeflag != tar.TypeReg:
+			return nil, nil, fmt.Errorf("%w: %v is not a regular file", ErrCorrupt, header.Name)
+		case path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../"):
+			return nil, nil, fmt.Errorf("%w: %v is outside of the bundle", ErrCorrupt, header.Name)
+		case name == ManifestFile:
+			if manifest, err = ioutil.ReadAll(io.LimitReader(tr, maxManifestSize)); err != nil {
+				return nil, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+			}
+
+			continue
+		}
+
+		if sums[name], err = extractFile(tr, filepath.Join(dir, filepath.FromSlash(name)), header.Size); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// extractFile writes a member to dst, returning its checksum
+func extractFile(r io.Reader, dst string, size int64) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	sum := sha256.New()
+
+	written, err := internal.CopySparse(out, io.TeeReader(r, sum))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	if written != size {
+		return "", fmt.Errorf("%w: %v is truncated", ErrCorrupt, filepath.Base(dst))
+	}
+
+	if err := out.Truncate(size); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), out.Close()
+}
+
+// verify checks the extracted members against the manifest
+func (m Manifest) verify(sums map[string]string) error {
+	if m.Version > Version {
+		return fmt.Errorf("bundle version %d is not supported, upgrade govm", m.Version)
+	}
+
+	for _, name := range []string{m.Spec, m.Image} {
+		if _, ok := m.Files[name]; !ok || name == "" {
+			return fmt.Errorf("%w: the manifest lacks the spec or the image", ErrCorrupt)
+		}
+	}
+
+	if _, ok := m.Files[m.Overlay]; m.Overlay != "" && !ok {
+		return fmt.Errorf("%w: the manifest lacks the overlay %v", ErrCorrupt, m.Overlay)
+	}
+
+	for name, sum := range m.Files {
+		switch actual, ok := sums[name]; {
+		case !ok:
+			return fmt.Errorf("%w: %v is missing", ErrCorrupt, name)
+		case actual != sum:
+			return fmt.Errorf("%w: checksum mismatch for %v", ErrCorrupt, name)
+		}
+	}
+
+	for name := range sums {
+		if _, ok := m.Files[name]; !ok {
+			return fmt.Errorf("%w: %v is not in the manifest", ErrCorrupt, name)
+		}
+	}
+
+	return nil
+}
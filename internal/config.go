@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFileName is the name of the govm configuration file
+const ConfigFileName = "config.yml"
+
+// Config holds the user settings read from the govm configuration file
+type Config struct {
+	Engine string `yaml:"engine"`
+	// RequireSigned refuses images not verified by a trusted key
+	RequireSigned bool `yaml:"require-signed"`
+}
+
+// GetDefaultConfigDir returns the directory that holds the govm configuration
+func GetDefaultConfigDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		configDir = filepath.Join(GetUserHomePath(), ".config")
+	}
+
+	return filepath.Join(configDir, "govm")
+}
+
+// GetDefaultConfigFile returns the path of the default configuration file
+func GetDefaultConfigFile() string {
+	return filepath.Join(GetDefaultConfigDir(), ConfigFileName)
+}
+
+// LoadConfig reads the configuration file at path. A missing file is not an
+// error and results in an empty configuration.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+
+	if err != nil {
+		return config, err
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("config file %v: %v", path, err)
+	}
+
+	return config, nil
+}
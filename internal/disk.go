@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// qcow2Magic starts the header of every qcow2 image
+const qcow2Magic = "QFI\xfb"
+
+// qcow2MaxSnapshots is the most snapshots a qcow2 image can hold
+const qcow2MaxSnapshots = 65536
+
+// qcow2MaxBackingFile is the longest backing file name of a qcow2 image
+const qcow2MaxBackingFile = 1023
+
+// qcow2MaxChain is the longest backing chain ImageBackingChain follows
+const qcow2MaxChain = 16
+
+// ImageSize returns the virtual size of a disk image and the space its file
+// takes on the host, both in bytes. The virtual size of qcow2 images is read
+// from their header, any other image is taken as raw.
+func ImageSize(path string) (virtual, actual int64, err error) {
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	virtual, actual = info.Size(), info.Size()
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		actual = st.Blocks * 512 // nolint: gomnd
+	}
+
+	// The virtual size is the big endian uint64 at offset 24
+	header := make([]byte, 32) // nolint: gomnd
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return virtual, actual, nil
+		}
+
+		return 0, 0, err
+	}
+
+	if bytes.Equal(header[:4], []byte(qcow2Magic)) {
+		virtual = int64(binary.BigEndian.Uint64(header[24:]))
+	}
+
+	return virtual, actual, nil
+}
+
+// DiskUsage returns the space a file, or the files of a directory, take on
+// the host. Sparse files only count their allocated blocks.
+func DiskUsage(path string) int64 {
+	var size int64
+
+	_ = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() {
+			size += st.Blocks * 512 // nolint: gomnd
+		}
+
+		return nil
+	})
+
+	return size
+}
+
+// ImageFormat returns qcow2 for qcow2 images and raw for any other image
+func ImageFormat(path string) (string, error) {
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if bytes.Equal(magic, []byte(qcow2Magic)) {
+		return "qcow2", nil
+	}
+
+	return "raw", nil
+}
+
+// ImageBackingFile returns the backing file a qcow2 image is an overlay of,
+// empty for standalone images
+func ImageBackingFile(path string) (string, error) {
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The backing file name offset is the uint64 at offset 8, its size the
+	// uint32 at offset 16
+	header := make([]byte, 20) // nolint: gomnd
+	if _, err := io.ReadFull(f, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	offset := binary.BigEndian.Uint64(header[8:])
+	if !bytes.Equal(header[:4], []byte(qcow2Magic)) || offset == 0 {
+		return "", nil
+	}
+
+	size := binary.BigEndian.Uint32(header[16:])
+	if size > qcow2MaxBackingFile {
+		return "", fmt.Errorf("%v: corrupted header (%d bytes backing file name)", path, size)
+	}
+
+	name := make([]byte, size)
+	if _, err := f.ReadAt(name, int64(offset)); err != nil {
+		return "", fmt.Errorf("%v: reading the backing file name: %w", path, err)
+	}
+
+	return string(name), nil
+}
+
+// ImageBackingChain returns the backing files of a qcow2 image, nearest
+// first. Relative names are resolved against the directory of the image
+// naming them. The chain read so far is returned along with errors.
+func ImageBackingChain(path string) ([]string, error) {
+	chain := []string{}
+
+	for {
+		backing, err := ImageBackingFile(path)
+		if err != nil || backing == "" {
+			return chain, err
+		}
+
+		if !filepath.IsAbs(backing) {
+			backing = filepath.Join(filepath.Dir(path), backing)
+		}
+
+		if len(chain) == qcow2MaxChain {
+			return chain, fmt.Errorf("%v: backing chain longer than %d images", chain[0], qcow2MaxChain)
+		}
+
+		chain = append(chain, backing)
+		path = backing
+	}
+}
+
+// SetImageBackingFile changes the backing file name of a qcow2 overlay in
+// place, as qemu-img rebase -u does. The new name has to fit in the header
+// cluster, after the current one.
+func SetImageBackingFile(path, backing string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0) // nolint: gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The cluster bits are the uint32 at offset 20
+	header := make([]byte, 24) // nolint: gomnd
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header[:4], []byte(qcow2Magic)) {
+		return fmt.Errorf("%v is not a qcow2 image", path)
+	}
+
+	offset := binary.BigEndian.Uint64(header[8:])
+	if offset == 0 {
+		return fmt.Errorf("%v is not an overlay", path)
+	}
+
+	clusterSize := uint64(1) << binary.BigEndian.Uint32(header[20:])
+	if len(backing) > qcow2MaxBackingFile || offset+uint64(len(backing)) > clusterSize {
+		return fmt.Errorf("%v: the backing file name %v doesn't fit in the header", path, backing)
+	}
+
+	if _, err := f.WriteAt([]byte(backing), int64(offset)); err != nil {
+		return err
+	}
+
+	size := make([]byte, 4) // nolint: gomnd
+	binary.BigEndian.PutUint32(size, uint32(len(backing)))
+
+	if _, err := f.WriteAt(size, 16); err != nil { // nolint: gomnd
+		return err
+	}
+
+	return f.Sync()
+}
+
+// ImageSnapshot is an internal snapshot of a qcow2 image
+type ImageSnapshot struct {
+	ID   string
+	Name string
+	Date time.Time
+	// VMStateSize is the size of the RAM and device state saved with the
+	// snapshot, zero for disk only snapshots
+	VMStateSize int64
+}
+
+// ImageSnapshots reads the snapshot table of a qcow2 image, in creation
+// order. Any other image has no snapshots.
+func ImageSnapshots(path string) ([]ImageSnapshot, error) {
+	snapshots := []ImageSnapshot{}
+
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return snapshots, err
+	}
+	defer f.Close()
+
+	// The number of snapshots is the uint32 at offset 60, the offset of
+	// their table the uint64 at offset 64
+	header := make([]byte, 72) // nolint: gomnd
+	if _, err := io.ReadFull(f, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return snapshots, nil
+	} else if err != nil {
+		return snapshots, err
+	}
+
+	if !bytes.Equal(header[:4], []byte(qcow2Magic)) {
+		return snapshots, nil
+	}
+
+	count := binary.BigEndian.Uint32(header[60:])
+	if count > qcow2MaxSnapshots {
+		return snapshots, fmt.Errorf("%v: corrupted snapshot table (%d snapshots)", path, count)
+	}
+
+	if _, err := f.Seek(int64(binary.BigEndian.Uint64(header[64:])), io.SeekStart); err != nil {
+		return snapshots, err
+	}
+
+	r := bufio.NewReader(f)
+
+	for i := uint32(0); i < count; i++ {
+		snapshot, err := readSnapshot(r)
+		if err != nil {
+			return snapshots, fmt.Errorf("%v: reading snapshot %d: %w", path, i, err)
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// readSnapshot reads a qcow2 snapshot table entry, padding included
+func readSnapshot(r io.Reader) (ImageSnapshot, error) {
+	snapshot := ImageSnapshot{}
+
+	entry := make([]byte, 40) // nolint: gomnd
+	if _, err := io.ReadFull(r, entry); err != nil {
+		return snapshot, err
+	}
+
+	idSize := int(binary.BigEndian.Uint16(entry[12:]))
+	nameSize := int(binary.BigEndian.Uint16(entry[14:]))
+	extraSize := int(binary.BigEndian.Uint32(entry[36:]))
+
+	snapshot.Date = time.Unix(int64(binary.BigEndian.Uint32(entry[16:])),
+		int64(binary.BigEndian.Uint32(entry[20:]))).UTC()
+	snapshot.VMStateSize = int64(binary.BigEndian.Uint32(entry[32:]))
+
+	// Extra data, id, name and padding to a multiple of 8 bytes
+	size := len(entry) + extraSize + idSize + nameSize
+	rest := make([]byte, extraSize+idSize+nameSize+(8-size%8)%8) // nolint: gomnd
+
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return snapshot, err
+	}
+
+	// Version 3 images keep the 64 bits state size in the extra data
+	if extraSize >= 8 { // nolint: gomnd
+		snapshot.VMStateSize = int64(binary.BigEndian.Uint64(rest))
+	}
+
+	snapshot.ID = string(rest[extraSize : extraSize+idSize])
+	snapshot.Name = string(rest[extraSize+idSize : extraSize+idSize+nameSize])
+
+	return snapshot, nil
+}
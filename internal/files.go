@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -38,13 +41,102 @@ func CheckFilePath(path string) (string, error) {
 	return filepath.Abs(path)
 }
 
-// GetUserHomePath gets the users Home Path
+// GetUserHomePath gets the users Home Path, falling back to $HOME when the
+// current user cannot be looked up
 func GetUserHomePath() string {
 	currentUser, err := user.Current()
 	if err != nil {
-		log.Warn("Unable to determine $HOME")
-		log.Error("Please specify -workdir and -pubkey")
+		log.Warn("Unable to determine the current user, using $HOME")
+		log.Warn("Please specify --workdir and --sshkey if it is not set")
+
+		return os.Getenv("HOME")
 	}
 
 	return currentUser.HomeDir
 }
+
+// copyBlock is the unit CopyFile looks for holes with
+const copyBlock = 1 << 20
+
+// CopyFile copies the file src to dst, keeping its permissions. Runs of zeros
+// are left as holes, so sparse disk images stay sparse.
+func CopyFile(dst, src string) (err error) {
+	in, err := os.Open(src) // nolint: gosec
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if _, err := CopySparse(out, in); err != nil {
+		return err
+	}
+
+	// Trailing holes are not written
+	return out.Truncate(info.Size())
+}
+
+// CopySparse copies src to the current offset of dst, seeking over the
+// blocks of zeros instead of writing them. Callers truncate dst to its final
+// size, as trailing holes are not written.
+func CopySparse(dst *os.File, src io.Reader) (written int64, err error) {
+	buf := make([]byte, copyBlock)
+	zeros := make([]byte, copyBlock)
+
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return written, readErr
+		}
+
+		if bytes.Equal(buf[:n], zeros[:n]) {
+			_, err = dst.Seek(int64(n), io.SeekCurrent)
+		} else {
+			_, err = dst.Write(buf[:n])
+		}
+
+		if err != nil {
+			return written, err
+		}
+
+		written += int64(n)
+
+		if readErr != nil {
+			return written, nil
+		}
+	}
+}
+
+// ContextReader returns a reader of r that fails once ctx is done, so long
+// copies can be cancelled
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
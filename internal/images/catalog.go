@@ -0,0 +1,76 @@
+package images
+
+import (
+	// Embeds the default catalog
+	_ "embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// CatalogFile is the name of the user catalog, next to the govm
+// configuration file. It is YAML, or JSON.
+const CatalogFile = "images.yml"
+
+// defaultCatalog holds the aliases shipped with govm
+//
+//go:embed catalog.yml
+var defaultCatalog []byte // nolint: gochecknoglobals
+
+// Alias describes where to get an image and how to boot it
+type Alias struct {
+	// URL, Checksum, Sums and Signature are given to Pull, see PullOptions
+	URL       string `yaml:"url" json:"url"`
+	Checksum  string `yaml:"checksum,omitempty" json:"checksum,omitempty"`
+	Sums      string `yaml:"sums,omitempty" json:"sums,omitempty"`
+	Signature string `yaml:"signature,omitempty" json:"signature,omitempty"`
+	// User is the default SSH login of the image
+	User string `yaml:"user,omitempty" json:"user,omitempty"`
+	// Flavor is the default size of its VMs
+	Flavor string `yaml:"flavor,omitempty" json:"flavor,omitempty"`
+	// Cloud and Efi are set for cloud images and images booting with EFI
+	Cloud bool `yaml:"cloud,omitempty" json:"cloud,omitempty"`
+	Efi   bool `yaml:"efi,omitempty" json:"efi,omitempty"`
+}
+
+// Catalog maps aliases, e.g. ubuntu:22.04, to images
+type Catalog map[string]Alias
+
+// LoadCatalog returns the default catalog, with its aliases replaced or
+// extended by the ones of the user catalog at path. A missing user catalog is
+// not an error.
+func LoadCatalog(path string) (Catalog, error) {
+	catalog := Catalog{}
+	if err := yaml.UnmarshalStrict(defaultCatalog, &catalog); err != nil {
+		return nil, fmt.Errorf("default catalog: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return catalog, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	user := Catalog{}
+	if err := yaml.UnmarshalStrict(data, &user); err != nil {
+		return nil, fmt.Errorf("catalog %v: %w", path, err)
+	}
+
+	for name, alias := range user {
+		if !ValidName(name) {
+			return nil, fmt.Errorf("catalog %v: invalid alias %q", path, name)
+		}
+
+		if alias.URL == "" {
+			return nil, fmt.Errorf("catalog %v: %v has no url", path, name)
+		}
+
+		catalog[name] = alias
+	}
+
+	return catalog, nil
+}
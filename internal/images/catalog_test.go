@@ -0,0 +1,51 @@
+package images
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestLoadCatalog(t *testing.T) {
+	dir := t.TempDir()
+
+	catalog, err := LoadCatalog(filepath.Join(dir, CatalogFile))
+	assert.NilError(t, err)
+
+	ubuntu, ok := catalog["ubuntu:22.04"]
+	assert.Assert(t, ok)
+	assert.Equal(t, ubuntu.User, "ubuntu")
+	assert.Assert(t, ubuntu.Cloud)
+
+	for name, alias := range catalog {
+		assert.Check(t, ValidName(name), name)
+		assert.Check(t, alias.URL != "" && alias.Sums != "", name)
+	}
+
+	// JSON catalogs are YAML too
+	user := filepath.Join(dir, CatalogFile)
+	assert.NilError(t, ioutil.WriteFile(user, []byte(`{
+		"ubuntu:22.04": {"url": "https://mirror.example.com/jammy.img", "checksum": "sha256:1234"},
+		"alpine:3.18": {"url": "file:///srv/alpine.qcow2", "flavor": "micro", "efi": true}
+	}`), 0644))
+
+	catalog, err = LoadCatalog(user)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, catalog["ubuntu:22.04"], Alias{URL: "https://mirror.example.com/jammy.img", Checksum: "sha256:1234"})
+	assert.DeepEqual(t, catalog["alpine:3.18"], Alias{URL: "file:///srv/alpine.qcow2", Flavor: "micro", Efi: true})
+	assert.Assert(t, catalog["ubuntu:20.04"].URL != "")
+
+	for content, err := range map[string]string{
+		"jammy:\n  uri: https://example.com\n":    "field uri not found",
+		"jammy:\n  user: ubuntu\n":                "jammy has no url",
+		"../jammy:\n  url: https://example.com\n": `invalid alias "../jammy"`,
+	} {
+		assert.NilError(t, ioutil.WriteFile(user, []byte(content), 0644))
+
+		_, loadErr := LoadCatalog(user)
+		assert.Check(t, is.ErrorContains(loadErr, err))
+	}
+}
@@ -0,0 +1,428 @@
+// Package images manages the image store of a govm working directory.
+// Images are kept read-only in <workdir>/images/sha256/<digest>, so an image
+// added twice is stored once, and are named by <workdir>/images/<name>.json
+// records holding their metadata.
+package images
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/govm-project/govm/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Dir is the directory of the working directory holding the store
+	Dir = "images"
+	// blobDir is the directory of the store holding the image files
+	blobDir = "sha256"
+	// recordExt is the extension of the image records
+	recordExt = ".json"
+)
+
+var (
+	// ErrNotFound is returned when no image of the store has a name
+	ErrNotFound = errors.New("image not found")
+	// ErrExists is returned when adding an image under a name in use
+	ErrExists = errors.New("image already exists")
+)
+
+// nolint: gochecknoglobals
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._:-]*$`)
+
+// ValidName reports whether name can name an image. Names are made of
+// letters, digits, '.', ':', '-' and '_', e.g. ubuntu:22.04.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Image is an image of the store
+type Image struct {
+	Name string `yaml:"name" json:"name"`
+	// Digest is the SHA-256 of the image file, as sha256:<hex>
+	Digest string `yaml:"digest" json:"digest"`
+	// Format is qcow2 or raw
+	Format string `yaml:"format" json:"format"`
+	// VirtualSize is the size of the disk held by the image, Size the
+	// space its file takes on the host, both in bytes
+	VirtualSize int64 `yaml:"virtual-size" json:"virtual-size"`
+	Size        int64 `yaml:"size" json:"size"`
+	// Source is where the image comes from, e.g. the file it was added from
+	Source string `yaml:"source" json:"source"`
+	// Checksum is the verified sum of the download of pulled images
+	Checksum string `yaml:"checksum,omitempty" json:"checksum,omitempty"`
+	// Signer is the trusted key the image, or its sums file, was verified
+	// with
+	Signer string    `yaml:"signer,omitempty" json:"signer,omitempty"`
+	Added  time.Time `yaml:"added" json:"added"`
+	// Hints is the sizing of the appliance an image was imported from
+	Hints *Hints `yaml:"hints,omitempty" json:"hints,omitempty"`
+	// Path is the image file within the store
+	Path string `yaml:"path" json:"path"`
+	// Backing is the file the image is an overlay of, for the frozen disks
+	// of linked clones. Records name the images of the store relative to
+	// it, as Path.
+	Backing string `yaml:"backing,omitempty" json:"backing,omitempty"`
+}
+
+// Hints is the sizing recommended for the VMs of an image
+type Hints struct {
+	Cpus int `yaml:"cpus,omitempty" json:"cpus,omitempty"`
+	// RAM is in MB
+	RAM int `yaml:"ram,omitempty" json:"ram,omitempty"`
+}
+
+// AddOptions tunes the addition of an image to the store
+type AddOptions struct {
+	// Source is recorded as the origin of the image
+	Source string
+	// Checksum is recorded as the verified sum of the image download
+	Checksum string
+	// Signer is recorded as the trusted key the image was verified with
+	Signer string
+	// Hints is recorded as the sizing of the image VMs
+	Hints *Hints
+	// Move moves the file into the store instead of copying it
+	Move bool
+	// Link hard links the file into the store instead of copying it, when
+	// both are on the same filesystem. The file becomes read-only.
+	Link bool
+	// Overlay accepts a qcow2 overlay, whose backing file the caller makes
+	// sure never changes. Relative backing file names are images of the
+	// store, see BackingName.
+	Overlay bool
+}
+
+// Store reads and writes the images of a working directory
+type Store struct {
+	dir string
+}
+
+// New returns the image store of the given govm working directory
+func New(workdir string) *Store {
+	return &Store{dir: filepath.Join(workdir, Dir)}
+}
+
+// Add stores the disk image src under name. Overlays are refused unless
+// opts.Overlay is set, as their backing file could change under the store.
+// nolint: funlen
+func (s *Store) Add(ctx context.Context, name, src string, opts AddOptions) (img Image, err error) {
+	if !ValidName(name) {
+		return img, fmt.Errorf("invalid image name %q: names are made of letters, digits, '.', ':', '-' and '_'",
+			name)
+	}
+
+	if _, err := s.Get(name); err == nil {
+		return img, fmt.Errorf("%w: %v", ErrExists, name)
+	}
+
+	backing, err := internal.ImageBackingFile(src)
+	if err != nil {
+		return img, err
+	}
+
+	if backing != "" && !opts.Overlay {
+		return img, fmt.Errorf("%v is an overlay of %v, flatten it first", src, backing)
+	}
+
+	if backing != "" && !filepath.IsAbs(backing) {
+		backing = filepath.Join(s.dir, blobDir, backing)
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.dir, blobDir), 0750); err != nil {
+		return img, err
+	}
+
+	tmp := src
+	if !opts.Move {
+		if opts.Link {
+			tmp, err = s.link(ctx, src)
+		} else {
+			tmp, err = s.copy(ctx, src)
+		}
+
+		if err != nil {
+			return img, err
+		}
+
+		defer os.Remove(tmp) // nolint: errcheck
+	}
+
+	digest, err := fileDigest(ctx, tmp)
+	if err != nil {
+		return img, err
+	}
+
+	img = Image{
+		Name:     name,
+		Digest:   "sha256:" + digest,
+		Source:   opts.Source,
+		Checksum: opts.Checksum,
+		Signer:   opts.Signer,
+		Hints:    opts.Hints,
+		Backing:  backing,
+		Added:    time.Now().UTC(),
+		Path:     filepath.Join(s.dir, blobDir, digest),
+	}
+
+	// Identical images share their file
+	if _, err := os.Stat(img.Path); err == nil {
+		if opts.Move {
+			err = os.Remove(tmp)
+		}
+	} else {
+		err = os.Rename(tmp, img.Path)
+	}
+
+	if err != nil {
+		return img, err
+	}
+
+	if err := os.Chmod(img.Path, 0444); err != nil {
+		return img, err
+	}
+
+	if img.Format, err = internal.ImageFormat(img.Path); err != nil {
+		return img, err
+	}
+
+	if img.VirtualSize, img.Size, err = internal.ImageSize(img.Path); err != nil {
+		return img, err
+	}
+
+	return img, s.put(img)
+}
+
+// BackingName returns the name qcow2 overlays of the store give file as
+// backing file: relative for the images of the store, so that they survive
+// moving the working directory, file itself otherwise
+func (s *Store) BackingName(file string) string {
+	if filepath.Dir(file) == filepath.Join(s.dir, blobDir) {
+		return filepath.Base(file)
+	}
+
+	return file
+}
+
+// link hard links src to a temporary file of the store, or copies it across
+// filesystems
+func (s *Store) link(ctx context.Context, src string) (string, error) {
+	tmp := filepath.Join(s.dir, fmt.Sprintf(".link-%d", time.Now().UnixNano()))
+	if err := os.Link(src, tmp); err != nil {
+		return s.copy(ctx, src)
+	}
+
+	return tmp, nil
+}
+
+// copy copies src to a temporary file of the store, keeping it sparse
+func (s *Store) copy(ctx context.Context, src string) (string, error) {
+	in, err := os.Open(src) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ioutil.TempFile(s.dir, ".add-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = internal.CopySparse(out, internal.ContextReader(ctx, in))
+	if err == nil {
+		err = out.Truncate(info.Size())
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", err
+	}
+
+	return out.Name(), nil
+}
+
+// fileDigest returns the hex SHA-256 of a file
+func fileDigest(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, internal.ContextReader(ctx, f)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// put writes the record of an image
+func (s *Store) put(img Image) error {
+	img.Backing = s.BackingName(img.Backing)
+
+	data, err := json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn record
+	tmp, err := ioutil.TempFile(s.dir, ".record-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, img.Name+recordExt))
+}
+
+// Get returns the image of the given name
+func (s *Store) Get(name string) (Image, error) {
+	img := Image{}
+
+	if !ValidName(name) {
+		return img, fmt.Errorf("%w: %v", ErrNotFound, name)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name+recordExt))
+	if os.IsNotExist(err) {
+		return img, fmt.Errorf("%w: %v", ErrNotFound, name)
+	} else if err != nil {
+		return img, err
+	}
+
+	if err := json.Unmarshal(data, &img); err != nil {
+		return img, fmt.Errorf("image %v: %w", name, err)
+	}
+
+	// The store may have moved along with its working directory
+	img.Name = name
+	img.Path = filepath.Join(s.dir, blobDir, strings.TrimPrefix(img.Digest, "sha256:"))
+
+	if img.Backing != "" && !filepath.IsAbs(img.Backing) {
+		img.Backing = filepath.Join(s.dir, blobDir, img.Backing)
+	}
+
+	return img, nil
+}
+
+// List returns every readable image of the store sorted by name
+func (s *Store) List() ([]Image, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+recordExt))
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Image{}
+
+	for _, file := range files {
+		img, err := s.Get(strings.TrimSuffix(filepath.Base(file), recordExt))
+		if err != nil {
+			log.Warnf("Skipping %v: %v", file, err)
+			continue
+		}
+
+		list = append(list, img)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+// Remove deletes an image from the store. Its file goes away with the last
+// image sharing it, which can't be the backing file of other images.
+func (s *Store) Remove(name string) error {
+	img, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	list, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	shares, overlays := false, []string{}
+
+	for _, other := range list {
+		switch {
+		case other.Name == img.Name:
+		case other.Digest == img.Digest:
+			shares = true
+		case other.Backing == img.Path:
+			overlays = append(overlays, other.Name)
+		}
+	}
+
+	if !shares && len(overlays) > 0 {
+		return fmt.Errorf("the image backs the stored images %v", strings.Join(overlays, ", "))
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, name+recordExt)); err != nil {
+		return err
+	}
+
+	shared, err := s.Shared(img)
+	if err != nil || len(shared) > 0 {
+		return err
+	}
+
+	err = os.Remove(img.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Shared returns the other images of the store sharing the file of img
+func (s *Store) Shared(img Image) ([]Image, error) {
+	list, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	shared := []Image{}
+
+	for _, other := range list {
+		if other.Digest == img.Digest && other.Name != img.Name {
+			shared = append(shared, other)
+		}
+	}
+
+	return shared, nil
+}
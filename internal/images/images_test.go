@@ -0,0 +1,157 @@
+package images
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/govm-project/govm/internal"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// qcow2Image writes a qcow2 header of the given virtual size, an overlay of
+// backing if set
+func qcow2Image(t *testing.T, size uint64, backing string) string {
+	header := make([]byte, 512)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint64(header[24:], size)
+
+	if backing != "" {
+		binary.BigEndian.PutUint64(header[8:], 256)
+		binary.BigEndian.PutUint32(header[16:], uint32(len(backing)))
+		copy(header[256:], backing)
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	assert.NilError(t, ioutil.WriteFile(path, header, 0644))
+
+	return path
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	s := New(t.TempDir())
+
+	list, err := s.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 0)
+
+	src := qcow2Image(t, 10<<30, "")
+
+	img, err := s.Add(ctx, "ubuntu:22.04", src, AddOptions{Source: src})
+	assert.NilError(t, err)
+	assert.Equal(t, img.Format, "qcow2")
+	assert.Equal(t, img.VirtualSize, int64(10<<30))
+	assert.Equal(t, img.Source, src)
+	assert.Equal(t, filepath.Base(img.Path), img.Digest[len("sha256:"):])
+
+	info, err := os.Stat(img.Path)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0444))
+
+	got, err := s.Get("ubuntu:22.04")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, img)
+
+	_, err = s.Add(ctx, "ubuntu:22.04", src, AddOptions{})
+	assert.Assert(t, errors.Is(err, ErrExists), "got %v", err)
+
+	_, err = s.Add(ctx, "../escape", src, AddOptions{})
+	assert.Assert(t, is.ErrorContains(err, `invalid image name "../escape"`))
+
+	// Identical images share their file, moved ones are consumed
+	_, err = s.Add(ctx, "jammy", src, AddOptions{Move: true})
+	assert.NilError(t, err)
+
+	_, err = os.Stat(src)
+	assert.Assert(t, os.IsNotExist(err))
+
+	raw := filepath.Join(t.TempDir(), "disk.img")
+	assert.NilError(t, ioutil.WriteFile(raw, []byte("raw"), 0644))
+
+	other, err := s.Add(ctx, "raw", raw, AddOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, other.Format, "raw")
+	assert.Assert(t, other.Path != img.Path)
+
+	list, err = s.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 3)
+	assert.Equal(t, list[0].Name, "jammy")
+
+	shared, err := s.Shared(img)
+	assert.NilError(t, err)
+	assert.Equal(t, len(shared), 1)
+	assert.Equal(t, shared[0].Name, "jammy")
+
+	assert.NilError(t, s.Remove("ubuntu:22.04"))
+	_, err = os.Stat(img.Path)
+	assert.NilError(t, err)
+
+	assert.NilError(t, s.Remove("jammy"))
+	_, err = os.Stat(img.Path)
+	assert.Assert(t, os.IsNotExist(err))
+
+	err = s.Remove("jammy")
+	assert.Assert(t, errors.Is(err, ErrNotFound), "got %v", err)
+}
+
+func TestAddOverlay(t *testing.T) {
+	workdir := filepath.Join(t.TempDir(), "workdir")
+	s := New(workdir)
+
+	_, err := s.Add(context.Background(), "overlay", qcow2Image(t, 1<<30, "/images/base.img"), AddOptions{})
+	assert.Assert(t, is.ErrorContains(err, "is an overlay of /images/base.img, flatten it first"))
+
+	list, err := s.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 0)
+
+	// Frozen overlays of stored images, as linked clones make
+	base, err := s.Add(context.Background(), "base", qcow2Image(t, 1<<30, ""), AddOptions{})
+	assert.NilError(t, err)
+
+	frozen, err := s.Add(context.Background(), "frozen", qcow2Image(t, 1<<30, base.Path), AddOptions{Overlay: true})
+	assert.NilError(t, err)
+	assert.Equal(t, frozen.Backing, base.Path)
+
+	relative, err := s.Add(context.Background(), "relative", qcow2Image(t, 2<<30, s.BackingName(base.Path)),
+		AddOptions{Overlay: true})
+	assert.NilError(t, err)
+	assert.Equal(t, relative.Backing, base.Path)
+
+	// Both follow the store when the working directory moves
+	moved := filepath.Join(filepath.Dir(workdir), "moved")
+	assert.NilError(t, os.Rename(workdir, moved))
+	s = New(moved)
+
+	base, err = s.Get("base")
+	assert.NilError(t, err)
+
+	for _, name := range []string{"frozen", "relative"} {
+		img, err := s.Get(name)
+		assert.NilError(t, err)
+		assert.Equal(t, img.Backing, base.Path, name)
+	}
+
+	relative, err = s.Get("relative")
+	assert.NilError(t, err)
+
+	chain, err := internal.ImageBackingChain(relative.Path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, chain, []string{base.Path})
+
+	err = s.Remove("base")
+	assert.Assert(t, is.ErrorContains(err, "the image backs the stored images frozen, relative"))
+
+	assert.NilError(t, s.Remove("relative"))
+
+	assert.NilError(t, s.Remove("frozen"))
+	assert.NilError(t, s.Remove("base"))
+}
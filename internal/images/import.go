@@ -0,0 +1,317 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/govm-project/govm/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+// QemuImgBinary is the command converting images to qcow2
+var QemuImgBinary = "qemu-img" // nolint: gochecknoglobals
+
+// ImportFormats are the disk image formats Import converts
+var ImportFormats = []string{"raw", "qcow2", "vmdk", "vdi", "vhdx", "vpc"} // nolint: gochecknoglobals
+
+// OVF resource types of the virtual hardware items read by Import
+const (
+	ovfProcessor = 3
+	ovfMemory    = 4
+)
+
+// ImportOptions tunes the import of an image
+type ImportOptions struct {
+	// Format is the format of the disk image, probed by qemu-img if empty
+	Format string
+	// Signer is the trusted key the source file was verified with
+	Signer string
+}
+
+// Import converts the disk image src into a qcow2 image stored under name,
+// so that every VM of the image gets a copy-on-write overlay. OVA archives
+// and OVF descriptors are imported with their first disk, the CPUs and RAM
+// of the appliance being kept as the sizing hints of the image.
+// nolint: funlen
+func (s *Store) Import(ctx context.Context, name, src string, opts ImportOptions) (img Image, err error) {
+	if !ValidName(name) {
+		return img, fmt.Errorf("invalid image name %q: names are made of letters, digits, '.', ':', '-' and '_'",
+			name)
+	}
+
+	if opts.Format != "" && !supportedFormat(opts.Format) {
+		return img, fmt.Errorf("unsupported image format %v, use one of %v", opts.Format,
+			strings.Join(ImportFormats, ", "))
+	}
+
+	if _, err := s.Get(name); err == nil {
+		return img, fmt.Errorf("%w: %v", ErrExists, name)
+	}
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return img, err
+	}
+
+	disk := src
+
+	var hints *Hints
+
+	switch strings.ToLower(filepath.Ext(src)) {
+	case ".ova":
+		dir, err := s.unpackOVA(ctx, src)
+		if err != nil {
+			return img, err
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+
+		descriptors, err := filepath.Glob(filepath.Join(dir, "*.ovf"))
+		if err != nil {
+			return img, err
+		}
+
+		if len(descriptors) == 0 {
+			return img, fmt.Errorf("%v holds no OVF descriptor", src)
+		}
+
+		if disk, hints, err = readOVF(descriptors[0]); err != nil {
+			return img, err
+		}
+	case ".ovf":
+		if disk, hints, err = readOVF(src); err != nil {
+			return img, err
+		}
+	}
+
+	// OVF disks may be gzip compressed
+	unpacked, err := s.decompress(ctx, disk)
+	if err != nil {
+		return img, err
+	}
+
+	if unpacked != disk {
+		defer os.Remove(unpacked) // nolint: errcheck
+	}
+
+	out, err := ioutil.TempFile(s.dir, ".import-*.qcow2")
+	if err != nil {
+		return img, err
+	}
+
+	_ = out.Close()
+	defer os.Remove(out.Name()) // nolint: errcheck
+
+	if err := convert(ctx, opts.Format, unpacked, out.Name()); err != nil {
+		return img, fmt.Errorf("converting %v: %w", src, err)
+	}
+
+	return s.Add(ctx, name, out.Name(), AddOptions{Source: src, Signer: opts.Signer, Hints: hints, Move: true})
+}
+
+// supportedFormat reports whether format is one of ImportFormats
+func supportedFormat(format string) bool {
+	for _, supported := range ImportFormats {
+		if format == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Flatten writes the overlay src, merged with its backing files, to the
+// standalone qcow2 image dst, e.g. to copy it to another host
+func Flatten(ctx context.Context, src, dst string) error {
+	if err := convert(ctx, "", src, dst); err != nil {
+		return fmt.Errorf("flattening %v: %w", src, err)
+	}
+
+	return nil
+}
+
+// convert converts src to the qcow2 image dst with qemu-img
+func convert(ctx context.Context, format, src, dst string) error {
+	args := []string{"convert", "-O", "qcow2"}
+	if format != "" {
+		args = append(args, "-f", format)
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, QemuImgBinary, append(args, src, dst)...) // nolint: gosec
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("%v convert: %w: %s", QemuImgBinary, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// unpackOVA extracts the files of an OVA archive into a temporary directory
+// of the store
+func (s *Store) unpackOVA(ctx context.Context, file string) (dir string, err error) {
+	f, err := os.Open(file) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if dir, err = ioutil.TempDir(s.dir, ".ova-"); err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	archive := tar.NewReader(internal.ContextReader(ctx, f))
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return dir, nil
+		} else if err != nil {
+			return dir, fmt.Errorf("reading %v: %w", file, err)
+		}
+
+		// The files of an OVA are flat, never extract out of dir
+		name := filepath.Base(header.Name)
+		if header.Typeflag != tar.TypeReg || name == "." || name == ".." {
+			continue
+		}
+
+		if err := extract(archive, filepath.Join(dir, name)); err != nil {
+			return dir, fmt.Errorf("extracting %v from %v: %w", name, file, err)
+		}
+	}
+}
+
+// extract writes the current file of an archive to path, keeping it sparse
+func extract(archive io.Reader, path string) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) // nolint: gosec
+	if err != nil {
+		return err
+	}
+
+	size, err := internal.CopySparse(out, archive)
+	if err == nil {
+		err = out.Truncate(size)
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ovfEnvelope is the part of an OVF descriptor read by Import
+type ovfEnvelope struct {
+	Files []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+	Disks []struct {
+		ID      string `xml:"diskId,attr"`
+		FileRef string `xml:"fileRef,attr"`
+	} `xml:"DiskSection>Disk"`
+	Items []struct {
+		ResourceType    int    `xml:"ResourceType"`
+		AllocationUnits string `xml:"AllocationUnits"`
+		VirtualQuantity int64  `xml:"VirtualQuantity"`
+	} `xml:"VirtualSystem>VirtualHardwareSection>Item"`
+}
+
+// readOVF returns the first disk of an OVF descriptor, next to it, and the
+// sizing of the appliance
+func readOVF(file string) (string, *Hints, error) {
+	data, err := ioutil.ReadFile(file) // nolint: gosec
+	if err != nil {
+		return "", nil, err
+	}
+
+	envelope := ovfEnvelope{}
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return "", nil, fmt.Errorf("OVF descriptor %v: %w", file, err)
+	}
+
+	if len(envelope.Disks) == 0 {
+		return "", nil, fmt.Errorf("OVF descriptor %v has no disk", file)
+	}
+
+	if len(envelope.Disks) > 1 {
+		log.Warnf("Only importing the first of the %d disks of %v", len(envelope.Disks), file)
+	}
+
+	href := ""
+
+	for _, ref := range envelope.Files {
+		if ref.ID == envelope.Disks[0].FileRef {
+			href = ref.Href
+		}
+	}
+
+	if href == "" || strings.Contains(href, "://") || strings.Contains(href, "..") {
+		return "", nil, fmt.Errorf("OVF descriptor %v: disk %v has no local file", file, envelope.Disks[0].ID)
+	}
+
+	hints := &Hints{}
+
+	for _, item := range envelope.Items {
+		switch item.ResourceType {
+		case ovfProcessor:
+			hints.Cpus = int(item.VirtualQuantity)
+		case ovfMemory:
+			unit, err := ovfUnit(item.AllocationUnits)
+			if err != nil {
+				return "", nil, fmt.Errorf("OVF descriptor %v: %w", file, err)
+			}
+
+			hints.RAM = int(item.VirtualQuantity * unit >> 20) // nolint: gomnd
+		}
+	}
+
+	if *hints == (Hints{}) {
+		hints = nil
+	}
+
+	return filepath.Join(filepath.Dir(file), href), hints, nil
+}
+
+// ovfUnit returns the bytes of an OVF allocation unit, e.g. byte * 2^20.
+// Memory is in MB by default.
+func ovfUnit(units string) (int64, error) {
+	switch normalized := strings.ToLower(strings.ReplaceAll(units, " ", "")); normalized {
+	case "", "megabytes", "mb":
+		return 1 << 20, nil
+	case "byte", "bytes":
+		return 1, nil
+	case "kilobytes", "kb":
+		return 1 << 10, nil
+	case "gigabytes", "gb":
+		return 1 << 30, nil
+	default:
+		exp, err := strconv.Atoi(strings.TrimPrefix(normalized, "byte*2^"))
+		if err != nil || !strings.HasPrefix(normalized, "byte*2^") || exp < 0 || exp > 40 {
+			return 0, fmt.Errorf("unsupported allocation units %q", units)
+		}
+
+		return 1 << exp, nil
+	}
+}
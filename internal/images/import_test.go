@@ -0,0 +1,178 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeQemuImg records its arguments and writes a qcow2 header, followed by
+// the content of the converted file
+const fakeQemuImg = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/qemu-img.calls"
+for arg; do src=$last; last=$arg; done
+{ printf 'QFI\373'; cat "$src"; } > "$last"
+`
+
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData">
+  <References>
+    <File ovf:id="file1" ovf:href="appliance-disk1.vmdk" ovf:compression="gzip"/>
+    <File ovf:id="file2" ovf:href="appliance-disk2.vmdk"/>
+  </References>
+  <DiskSection>
+    <Disk ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:capacity="10737418240"/>
+    <Disk ovf:diskId="vmdisk2" ovf:fileRef="file2" ovf:capacity="10737418240"/>
+  </DiskSection>
+  <VirtualSystem ovf:id="appliance">
+    <VirtualHardwareSection>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:ElementName>2 virtual CPU(s)</rasd:ElementName>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>2</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^30</rasd:AllocationUnits>
+        <rasd:ElementName>2 GB of memory</rasd:ElementName>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>2</rasd:VirtualQuantity>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+func fakeConverter(t *testing.T) string {
+	dir := t.TempDir()
+
+	binary := QemuImgBinary
+	QemuImgBinary = filepath.Join(dir, "qemu-img")
+	t.Cleanup(func() { QemuImgBinary = binary })
+
+	assert.NilError(t, ioutil.WriteFile(QemuImgBinary, []byte(fakeQemuImg), 0755))
+
+	return filepath.Join(dir, "qemu-img.calls")
+}
+
+func writeOVA(t *testing.T, file string, files map[string][]byte) {
+	var buf bytes.Buffer
+
+	archive := tar.NewWriter(&buf)
+
+	// The descriptor comes first
+	names := []string{}
+	for name := range files {
+		if strings.HasSuffix(name, ".ovf") {
+			names = append([]string{name}, names...)
+		} else {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		assert.NilError(t, archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}))
+		_, err := archive.Write(files[name])
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, archive.Close())
+	assert.NilError(t, ioutil.WriteFile(file, buf.Bytes(), 0644))
+}
+
+func TestImport(t *testing.T) {
+	calls := fakeConverter(t)
+	ctx := context.Background()
+	s := New(t.TempDir())
+
+	raw := filepath.Join(t.TempDir(), "disk.img")
+	assert.NilError(t, ioutil.WriteFile(raw, []byte("raw disk"), 0644))
+
+	img, err := s.Import(ctx, "disk", raw, ImportOptions{Format: "raw"})
+	assert.NilError(t, err)
+	assertImage(t, img, []byte("QFI\xfbraw disk"))
+	assert.Equal(t, img.Format, "qcow2")
+	assert.Equal(t, img.Source, raw)
+	assert.Assert(t, img.Hints == nil)
+
+	data, err := ioutil.ReadFile(calls)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(string(data), "convert -O qcow2 -f raw "+raw+" "+s.dir+"/.import-"))
+
+	// The first disk of an OVA, gzip compressed, with the appliance sizing
+	ova := filepath.Join(t.TempDir(), "appliance.ova")
+	writeOVA(t, ova, map[string][]byte{
+		"appliance.ovf":        []byte(testOVF),
+		"appliance-disk1.vmdk": gzipData(t, []byte("vmdk disk")),
+		"appliance-disk2.vmdk": []byte("second disk"),
+	})
+
+	img, err = s.Import(ctx, "appliance", ova, ImportOptions{})
+	assert.NilError(t, err)
+	assertImage(t, img, []byte("QFI\xfbvmdk disk"))
+	assert.DeepEqual(t, img.Hints, &Hints{Cpus: 2, RAM: 2048})
+
+	got, err := s.Get("appliance")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, img)
+
+	_, err = s.Import(ctx, "appliance", ova, ImportOptions{})
+	assert.Assert(t, errors.Is(err, ErrExists), "got %v", err)
+
+	// Only the images are left
+	entries, err := ioutil.ReadDir(s.dir)
+	assert.NilError(t, err)
+	for _, entry := range entries {
+		assert.Assert(t, !strings.HasPrefix(entry.Name(), "."), entry.Name())
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	fakeConverter(t)
+	ctx := context.Background()
+	s := New(t.TempDir())
+	dir := t.TempDir()
+
+	_, err := s.Import(ctx, "disk", filepath.Join(dir, "disk.img"), ImportOptions{Format: "iso"})
+	assert.Assert(t, is.ErrorContains(err, "unsupported image format iso"))
+
+	ova := filepath.Join(dir, "disk.ova")
+	writeOVA(t, ova, map[string][]byte{"disk.vmdk": []byte("disk")})
+
+	_, err = s.Import(ctx, "disk", ova, ImportOptions{})
+	assert.Assert(t, is.ErrorContains(err, ova+" holds no OVF descriptor"))
+
+	for ovf, want := range map[string]string{
+		`<Envelope/>`: "has no disk",
+		`<Envelope><References><File id="f" href="../disk.vmdk"/></References>` +
+			`<DiskSection><Disk diskId="d" fileRef="f"/></DiskSection></Envelope>`: "disk d has no local file",
+		strings.Replace(testOVF, "byte * 2^30", "pages", 1): `unsupported allocation units "pages"`,
+	} {
+		file := filepath.Join(dir, "appliance.ovf")
+		assert.NilError(t, ioutil.WriteFile(file, []byte(ovf), 0644))
+
+		_, err := s.Import(ctx, "appliance", file, ImportOptions{})
+		assert.Check(t, is.ErrorContains(err, want))
+	}
+
+	QemuImgBinary = "false"
+
+	disk := filepath.Join(dir, "disk.vdi")
+	assert.NilError(t, ioutil.WriteFile(disk, []byte("disk"), 0644))
+
+	_, err = s.Import(ctx, "disk", disk, ImportOptions{})
+	assert.Assert(t, is.ErrorContains(err, "converting "+disk+": false convert: exit status 1"))
+
+	_, err = s.Get("disk")
+	assert.Assert(t, errors.Is(err, ErrNotFound), "got %v", err)
+}
@@ -0,0 +1,566 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/govm-project/govm/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+// XzBinary is the command decompressing xz images
+var XzBinary = "xz" // nolint: gochecknoglobals
+
+// ErrChecksum is returned when a download doesn't match its checksum
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Magic numbers of the compressed downloads
+const (
+	gzipMagic = "\x1f\x8b"
+	xzMagic   = "\xfd7zXZ\x00"
+)
+
+// maxFetch is the largest sums or signature file fetched
+const maxFetch = 16 << 20
+
+// PullOptions tunes the download of an image
+type PullOptions struct {
+	// Checksum is the expected sum of the download, as sha256:<hex> or
+	// sha512:<hex>. A bare hex sum is told apart by its length.
+	Checksum string
+	// SumsURL locates a SHA256SUMS, SHA512SUMS or CHECKSUM file listing the
+	// sum of the download, used when Checksum is empty
+	SumsURL string
+	// SignatureURL locates the detached minisign or OpenPGP signature of the
+	// sums file when the sum is looked up in it, of the download otherwise.
+	// Clearsigned sums files need none.
+	SignatureURL string
+	// Keyring holds the keys signatures are verified against. Without any,
+	// signatures are only checked given RequireSigned.
+	Keyring *Keyring
+	// RequireSigned refuses downloads not verified by a trusted key
+	RequireSigned bool
+	// Client does the HTTP requests, http.DefaultClient if nil
+	Client *http.Client
+	// Progress is called with the bytes downloaded so far and the total,
+	// -1 when unknown
+	Progress func(done, total int64)
+}
+
+// unverified reports whether signatures go unchecked, given no trusted keys
+// to check them against nor the requirement to
+func (o PullOptions) unverified() bool {
+	return o.Keyring.Empty() && !o.RequireSigned
+}
+
+// Pull downloads the image at the http(s) or file URL rawURL into the store
+// under name. The download is verified against its checksum, if any, and
+// decompressed from xz or gzip. Interrupted downloads resume where they
+// stopped.
+// nolint: funlen
+func (s *Store) Pull(ctx context.Context, name, rawURL string, opts PullOptions) (img Image, err error) {
+	if !ValidName(name) {
+		return img, fmt.Errorf("invalid image name %q: names are made of letters, digits, '.', ':', '-' and '_'",
+			name)
+	}
+
+	if _, err := s.Get(name); err == nil {
+		return img, fmt.Errorf("%w: %v", ErrExists, name)
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	checksum, signer := opts.Checksum, ""
+	if checksum == "" && opts.SumsURL != "" {
+		if checksum, signer, err = lookupSum(ctx, opts, rawURL); err != nil {
+			return img, err
+		}
+	} else if opts.RequireSigned && opts.SignatureURL == "" {
+		return img, fmt.Errorf("%w: no signature of %v given", ErrUnsigned, rawURL)
+	}
+
+	var sum hash.Hash
+	if checksum != "" {
+		if sum, checksum, err = parseChecksum(checksum); err != nil {
+			return img, err
+		}
+	}
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return img, err
+	}
+
+	// Keyed by URL, so that pulling it again resumes the download
+	key := sha256.Sum256([]byte(rawURL))
+	partial := filepath.Join(s.dir, ".pull-"+hex.EncodeToString(key[:8])+".partial")
+
+	if err := download(ctx, opts, rawURL, partial); err != nil {
+		return img, err
+	}
+
+	if sum != nil {
+		got, err := fileSum(ctx, partial, sum)
+		if err != nil {
+			return img, err
+		}
+
+		if got != checksum {
+			_ = os.Remove(partial)
+			return img, fmt.Errorf("%w for %v: got %v, want %v", ErrChecksum, rawURL, got, checksum)
+		}
+	}
+
+	// The signature is of the download itself unless its sums file was signed
+	if signer == "" && opts.SignatureURL != "" && (opts.Checksum != "" || opts.SumsURL == "") {
+		if signer, err = verifyDownload(ctx, opts, partial); err != nil {
+			_ = os.Remove(partial)
+			return img, err
+		}
+	}
+
+	image, err := s.decompress(ctx, partial)
+	if err != nil {
+		return img, err
+	}
+
+	if image != partial {
+		defer os.Remove(image) // nolint: errcheck
+	}
+
+	img, err = s.Add(ctx, name, image, AddOptions{Source: rawURL, Checksum: checksum, Signer: signer, Move: true})
+	if err != nil {
+		return img, err
+	}
+
+	_ = os.Remove(partial)
+
+	return img, nil
+}
+
+// parseChecksum returns the hash matching a checksum and its hex sum,
+// prefixed with the hash name
+func parseChecksum(checksum string) (hash.Hash, string, error) {
+	algo, sum := "", checksum
+	if i := strings.Index(checksum, ":"); i >= 0 {
+		algo, sum = strings.ToLower(checksum[:i]), checksum[i+1:]
+	}
+
+	sum = strings.ToLower(sum)
+	if _, err := hex.DecodeString(sum); err != nil {
+		return nil, "", fmt.Errorf("invalid checksum %v: %w", checksum, err)
+	}
+
+	switch {
+	case (algo == "" || algo == "sha256") && len(sum) == sha256.Size*2:
+		return sha256.New(), "sha256:" + sum, nil
+	case (algo == "" || algo == "sha512") && len(sum) == sha512.Size*2:
+		return sha512.New(), "sha512:" + sum, nil
+	}
+
+	return nil, "", fmt.Errorf("invalid checksum %v: expected a SHA-256 or SHA-512 sum", checksum)
+}
+
+// lookupSum finds the sum of the file at rawURL in the sums file of opts,
+// verified against its signature, and returns it with its signer. Both the
+// GNU (<sum> [*]<file>) and BSD (SHA256 (<file>) = <sum>) layouts are read.
+func lookupSum(ctx context.Context, opts PullOptions, rawURL string) (sum, signer string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	file := path.Base(u.Path)
+
+	data, err := fetch(ctx, opts.Client, opts.SumsURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case opts.SignatureURL != "" && opts.unverified():
+		log.Warnf("Not verifying %v: no trusted keys", opts.SumsURL)
+	case opts.SignatureURL != "":
+		sig, err := fetch(ctx, opts.Client, opts.SignatureURL)
+		if err != nil {
+			return "", "", err
+		}
+
+		if signer, err = opts.Keyring.Verify(bytes.NewReader(data), sig); err != nil {
+			return "", "", fmt.Errorf("%v: %w", opts.SumsURL, err)
+		}
+	case bytes.HasPrefix(data, []byte(pgpSigned)):
+		plain, clearSigner, err := opts.Keyring.VerifyClearsigned(data)
+		if plain == nil || (err != nil && !opts.unverified()) {
+			return "", "", fmt.Errorf("%v: %w", opts.SumsURL, err)
+		} else if err != nil {
+			log.Warnf("Not verifying %v: no trusted keys", opts.SumsURL)
+		}
+
+		data, signer = plain, clearSigner
+	case opts.RequireSigned:
+		return "", "", fmt.Errorf("%w: no signature of %v given", ErrUnsigned, opts.SumsURL)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		switch {
+		case len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == file:
+			return fields[0], signer, nil
+		case len(fields) == 4 && fields[1] == "("+file+")" && fields[2] == "=":
+			return strings.ToLower(fields[0]) + ":" + fields[3], signer, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	return "", "", fmt.Errorf("%v is not listed in %v", file, opts.SumsURL)
+}
+
+// verifyDownload checks a download against the signature of opts and
+// returns its signer
+func verifyDownload(ctx context.Context, opts PullOptions, file string) (string, error) {
+	if opts.unverified() {
+		log.Warnf("Not verifying the download against %v: no trusted keys", opts.SignatureURL)
+		return "", nil
+	}
+
+	sig, err := fetch(ctx, opts.Client, opts.SignatureURL)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(file) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	signer, err := opts.Keyring.Verify(internal.ContextReader(ctx, f), sig)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", opts.SignatureURL, err)
+	}
+
+	return signer, nil
+}
+
+// fetch returns the content of the small file at rawURL, e.g. a sums file
+func fetch(ctx context.Context, client *http.Client, rawURL string) ([]byte, error) {
+	body, _, err := open(ctx, client, rawURL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %v: %w", rawURL, err)
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxFetch+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %v: %w", rawURL, err)
+	}
+
+	if len(data) > maxFetch {
+		return nil, fmt.Errorf("fetching %v: larger than %d bytes", rawURL, maxFetch)
+	}
+
+	return data, nil
+}
+
+// download fetches rawURL into the partial file, resuming it if it exists
+func download(ctx context.Context, opts PullOptions, rawURL, partial string) error {
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	body, total, err := open(ctx, opts.Client, rawURL, offset)
+	if errors.Is(err, errRangeIgnored) {
+		offset = 0
+	} else if err != nil {
+		if offset == 0 {
+			_ = os.Remove(partial)
+		}
+
+		return fmt.Errorf("fetching %v: %w", rawURL, err)
+	}
+	defer body.Close()
+
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := out.Truncate(offset); err != nil {
+		return err
+	}
+
+	var r io.Reader = internal.ContextReader(ctx, body)
+	if opts.Progress != nil {
+		r = &progressReader{r: r, done: offset, total: total, progress: opts.Progress}
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("fetching %v: %w", rawURL, err)
+	}
+
+	return out.Close()
+}
+
+// errRangeIgnored is returned with the whole content when a server can't
+// resume a download
+var errRangeIgnored = errors.New("range ignored")
+
+// open opens rawURL from offset and returns its total size, -1 if unknown
+func open(ctx context.Context, client *http.Client, rawURL string, offset int64) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return openFile(u.Path, offset)
+	case "http", "https":
+	default:
+		return nil, 0, fmt.Errorf("unsupported URL scheme %q, use http, https or file", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent && total >= 0 {
+		total += offset
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, total, nil
+	case resp.StatusCode == http.StatusOK && offset > 0:
+		return resp.Body, total, errRangeIgnored
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, total, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+
+		// The partial file is complete, or longer than the content
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			return ioutil.NopCloser(&bytes.Buffer{}), offset, nil
+		}
+
+		return openRestart(ctx, client, rawURL)
+	}
+
+	resp.Body.Close()
+
+	return nil, 0, fmt.Errorf("unexpected HTTP status %v", resp.Status)
+}
+
+// openRestart opens rawURL from its start
+func openRestart(ctx context.Context, client *http.Client, rawURL string) (io.ReadCloser, int64, error) {
+	body, total, err := open(ctx, client, rawURL, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, total, errRangeIgnored
+}
+
+// openFile opens a local file from offset
+func openFile(file string, offset int64) (io.ReadCloser, int64, error) {
+	f, err := os.Open(file) // nolint: gosec
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	if offset > info.Size() {
+		return f, info.Size(), errRangeIgnored
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+// fileSum returns the sum of a file, prefixed with the hash name
+func fileSum(ctx context.Context, file string, sum hash.Hash) (string, error) {
+	f, err := os.Open(file) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(sum, internal.ContextReader(ctx, f)); err != nil {
+		return "", err
+	}
+
+	algo := "sha256"
+	if sum.Size() == sha512.Size {
+		algo = "sha512"
+	}
+
+	return algo + ":" + hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// decompress unpacks a gzip or xz download into a temporary file of the
+// store. Other files are returned as is.
+func (s *Store) decompress(ctx context.Context, file string) (string, error) {
+	in, err := os.Open(file) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	magic := make([]byte, len(xzMagic))
+	n, err := io.ReadFull(in, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	magic = magic[:n]
+
+	if !bytes.HasPrefix(magic, []byte(gzipMagic)) && !bytes.HasPrefix(magic, []byte(xzMagic)) {
+		return file, nil
+	}
+
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	out, err := ioutil.TempFile(s.dir, ".unpack-*")
+	if err != nil {
+		return "", err
+	}
+
+	if bytes.HasPrefix(magic, []byte(gzipMagic)) {
+		err = gunzip(ctx, out, in)
+	} else {
+		err = unxz(ctx, out, in)
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", fmt.Errorf("decompressing %v: %w", file, err)
+	}
+
+	return out.Name(), nil
+}
+
+// gunzip decompresses in into out, keeping it sparse
+func gunzip(ctx context.Context, out *os.File, in io.Reader) error {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	size, err := internal.CopySparse(out, internal.ContextReader(ctx, gz))
+	if err != nil {
+		return err
+	}
+
+	return out.Truncate(size)
+}
+
+// unxz decompresses in into out with the xz command, keeping it sparse
+func unxz(ctx context.Context, out *os.File, in io.Reader) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, XzBinary, "-d", "-c") // nolint: gosec
+	cmd.Stdin = in
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%v: %w", XzBinary, err)
+	}
+
+	size, copyErr := internal.CopySparse(out, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("%v: %w: %s", XzBinary, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if copyErr != nil {
+		return copyErr
+	}
+
+	return out.Truncate(size)
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.done += int64(n)
+	r.progress(r.done, r.total)
+
+	return n, err
+}
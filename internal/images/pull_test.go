@@ -0,0 +1,309 @@
+package images
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// testServer serves files, honouring ranges unless noRanges is set, and
+// records the ranges asked for
+type testServer struct {
+	*httptest.Server
+	files    map[string][]byte
+	noRanges bool
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newTestServer(t *testing.T, files map[string][]byte) *testServer {
+	s := &testServer{files: files}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+
+		if s.noRanges {
+			r.Header.Del("Range")
+		}
+
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	assert.NilError(t, err)
+	assert.NilError(t, gz.Close())
+
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func assertImage(t *testing.T, img Image, content []byte) {
+	data, err := ioutil.ReadFile(img.Path)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(data, content), "got %d bytes", len(data))
+}
+
+// nolint: funlen
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("cloud image "), 100000)
+	compressed := gzipData(t, content)
+
+	srv := newTestServer(t, map[string][]byte{
+		"/jammy.img.gz": compressed,
+		"/SHA256SUMS":   []byte(sha256Hex(content) + " *jammy.img\n" + sha256Hex(compressed) + " *jammy.img.gz\n"),
+		"/CHECKSUM":     []byte("SHA256 (jammy.img.gz) = " + sha256Hex(compressed) + "\n"),
+	})
+
+	s := New(t.TempDir())
+
+	progress := int64(0)
+	img, err := s.Pull(ctx, "jammy", srv.URL+"/jammy.img.gz", PullOptions{
+		SumsURL:  srv.URL + "/SHA256SUMS",
+		Progress: func(done, total int64) { progress = done },
+	})
+	assert.NilError(t, err)
+	assertImage(t, img, content)
+	assert.Equal(t, img.Source, srv.URL+"/jammy.img.gz")
+	assert.Equal(t, img.Checksum, "sha256:"+sha256Hex(compressed))
+	assert.Equal(t, img.Digest, "sha256:"+sha256Hex(content))
+	assert.Equal(t, progress, int64(len(compressed)))
+
+	got, err := s.Get("jammy")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, img)
+
+	_, err = s.Pull(ctx, "jammy", srv.URL+"/jammy.img.gz", PullOptions{})
+	assert.Assert(t, errors.Is(err, ErrExists), "got %v", err)
+
+	// BSD style sums files
+	img, err = s.Pull(ctx, "fedora", srv.URL+"/jammy.img.gz", PullOptions{SumsURL: srv.URL + "/CHECKSUM"})
+	assert.NilError(t, err)
+	assertImage(t, img, content)
+
+	_, err = s.Pull(ctx, "other", srv.URL+"/other.img", PullOptions{SumsURL: srv.URL + "/SHA256SUMS"})
+	assert.Assert(t, is.ErrorContains(err, "other.img is not listed in "+srv.URL+"/SHA256SUMS"))
+
+	_, err = s.Pull(ctx, "missing", srv.URL+"/missing.img", PullOptions{})
+	assert.Assert(t, is.ErrorContains(err, "unexpected HTTP status 404 Not Found"))
+
+	// Local files, verified against a SHA-512 sum
+	file := filepath.Join(t.TempDir(), "disk.img")
+	assert.NilError(t, ioutil.WriteFile(file, content, 0644))
+
+	sum := sha512.Sum512(content)
+	img, err = s.Pull(ctx, "local", "file://"+file, PullOptions{Checksum: hex.EncodeToString(sum[:])})
+	assert.NilError(t, err)
+	assertImage(t, img, content)
+	assert.Equal(t, img.Checksum, "sha512:"+hex.EncodeToString(sum[:]))
+
+	_, err = s.Pull(ctx, "ftp", "ftp://example.com/disk.img", PullOptions{})
+	assert.Assert(t, is.ErrorContains(err, `unsupported URL scheme "ftp"`))
+
+	// Only the images are left
+	entries, err := ioutil.ReadDir(s.dir)
+	assert.NilError(t, err)
+	for _, entry := range entries {
+		assert.Assert(t, !strings.HasPrefix(entry.Name(), "."), entry.Name())
+	}
+}
+
+func TestPullChecksumMismatch(t *testing.T) {
+	srv := newTestServer(t, map[string][]byte{"/disk.img": []byte("tampered")})
+	s := New(t.TempDir())
+
+	_, err := s.Pull(context.Background(), "disk", srv.URL+"/disk.img",
+		PullOptions{Checksum: "sha256:" + sha256Hex([]byte("genuine"))})
+	assert.Assert(t, errors.Is(err, ErrChecksum), "got %v", err)
+	assert.Assert(t, is.ErrorContains(err, "got sha256:"+sha256Hex([]byte("tampered"))))
+
+	_, err = s.Pull(context.Background(), "disk", srv.URL+"/disk.img", PullOptions{Checksum: "md5:1234"})
+	assert.Assert(t, is.ErrorContains(err, "invalid checksum md5:1234"))
+
+	// Neither the image nor the download are kept
+	entries, err := ioutil.ReadDir(s.dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestPullResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+
+	for _, noRanges := range []bool{false, true} {
+		t.Run(fmt.Sprintf("noRanges=%v", noRanges), func(t *testing.T) {
+			srv := newTestServer(t, map[string][]byte{"/disk.img": content})
+			srv.noRanges = noRanges
+
+			s := New(t.TempDir())
+			url := srv.URL + "/disk.img"
+
+			// The download of a previous pull stopped half way
+			key := sha256.Sum256([]byte(url))
+			partial := filepath.Join(s.dir, ".pull-"+hex.EncodeToString(key[:8])+".partial")
+			assert.NilError(t, os.MkdirAll(s.dir, 0750))
+			assert.NilError(t, ioutil.WriteFile(partial, content[:len(content)/2], 0600))
+
+			img, err := s.Pull(context.Background(), "disk", url, PullOptions{Checksum: sha256Hex(content)})
+			assert.NilError(t, err)
+			assertImage(t, img, content)
+			assert.DeepEqual(t, srv.ranges, []string{fmt.Sprintf("bytes=%d-", len(content)/2)})
+
+			_, err = os.Stat(partial)
+			assert.Assert(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestPullXz(t *testing.T) {
+	if _, err := exec.LookPath(XzBinary); err != nil {
+		t.Skip("xz is not installed")
+	}
+
+	content := bytes.Repeat([]byte("cloud image "), 100000)
+
+	cmd := exec.Command(XzBinary, "-c")
+	cmd.Stdin = bytes.NewReader(content)
+	compressed, err := cmd.Output()
+	assert.NilError(t, err)
+
+	srv := newTestServer(t, map[string][]byte{"/disk.img.xz": compressed})
+
+	img, err := New(t.TempDir()).Pull(context.Background(), "disk", srv.URL+"/disk.img.xz", PullOptions{})
+	assert.NilError(t, err)
+	assertImage(t, img, content)
+}
+
+func TestPullCancel(t *testing.T) {
+	srv := newTestServer(t, map[string][]byte{"/disk.img": []byte("image")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := New(t.TempDir()).Pull(ctx, "disk", srv.URL+"/disk.img", PullOptions{})
+	assert.Assert(t, errors.Is(err, context.Canceled), "got %v", err)
+}
+
+// nolint: funlen
+func TestPullSigned(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("cloud image")
+	sums := []byte(sha256Hex(content) + " *disk.img\n")
+
+	keys := t.TempDir()
+	minisign := newMinisignKey(t, keys, "team")
+	pgp := newPGPKey(t, keys, "release")
+	untrusted := newPGPKey(t, t.TempDir(), "other")
+
+	keyring, err := LoadKeyring(keys)
+	assert.NilError(t, err)
+
+	srv := newTestServer(t, map[string][]byte{
+		"/disk.img":         content,
+		"/disk.img.minisig": minisign.sign(content, true),
+		"/SHA256SUMS":       sums,
+		"/SHA256SUMS.gpg":   pgpSign(t, pgp, sums),
+		"/CHECKSUM":         pgpClearsign(t, pgp, sums),
+		"/BADSUMS.gpg":      pgpSign(t, pgp, []byte("other")),
+		"/BADCHECKSUM":      pgpClearsign(t, untrusted, sums),
+	})
+
+	s := New(t.TempDir())
+	required := PullOptions{Keyring: keyring, RequireSigned: true}
+
+	// Signed sums files, detached or clearsigned, and signed downloads
+	for name, opts := range map[string]PullOptions{
+		"detached":    {SumsURL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/SHA256SUMS.gpg"},
+		"clearsigned": {SumsURL: srv.URL + "/CHECKSUM"},
+		"download":    {SignatureURL: srv.URL + "/disk.img.minisig"},
+	} {
+		opts.Keyring, opts.RequireSigned = keyring, true
+
+		img, err := s.Pull(ctx, name, srv.URL+"/disk.img", opts)
+		assert.NilError(t, err, name)
+		assertImage(t, img, content)
+
+		want := "Release Team <release@example.com> (" + pgp.PrimaryKey.KeyIdString() + ")"
+		if name == "download" {
+			want = "team.pub"
+		}
+
+		assert.Equal(t, img.Signer, want, name)
+	}
+
+	_, err = s.Pull(ctx, "unsigned", srv.URL+"/disk.img", required)
+	assert.Assert(t, errors.Is(err, ErrUnsigned), "got %v", err)
+
+	required.SumsURL = srv.URL + "/SHA256SUMS"
+	_, err = s.Pull(ctx, "unsigned", srv.URL+"/disk.img", required)
+	assert.Assert(t, errors.Is(err, ErrUnsigned), "got %v", err)
+
+	// Bad signatures are refused, required or not
+	_, err = s.Pull(ctx, "bad", srv.URL+"/disk.img", PullOptions{
+		Keyring: keyring, SumsURL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/BADSUMS.gpg"})
+	assert.Assert(t, errors.Is(err, ErrSignature), "got %v", err)
+
+	_, err = s.Pull(ctx, "bad", srv.URL+"/disk.img", PullOptions{
+		Keyring: keyring, SignatureURL: srv.URL + "/BADSUMS.gpg"})
+	assert.Assert(t, errors.Is(err, ErrSignature), "got %v", err)
+
+	_, err = s.Pull(ctx, "bad", srv.URL+"/disk.img", PullOptions{
+		Keyring: keyring, SumsURL: srv.URL + "/BADCHECKSUM"})
+	assert.Assert(t, errors.Is(err, ErrSignature), "got %v", err)
+
+	// Without trusted keys signatures aren't checked, unless required
+	for name, opts := range map[string]PullOptions{
+		"detached":    {SumsURL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/BADSUMS.gpg"},
+		"clearsigned": {SumsURL: srv.URL + "/BADCHECKSUM"},
+		"download":    {SignatureURL: srv.URL + "/BADSUMS.gpg"},
+	} {
+		img, err := s.Pull(ctx, "untrusted-"+name, srv.URL+"/disk.img", opts)
+		assert.NilError(t, err, name)
+		assert.Equal(t, img.Signer, "", name)
+
+		opts.RequireSigned = true
+		_, err = s.Pull(ctx, "bad", srv.URL+"/disk.img", opts)
+		assert.Assert(t, errors.Is(err, ErrSignature), "%v: got %v", name, err)
+	}
+
+	_, err = s.Get("bad")
+	assert.Assert(t, errors.Is(err, ErrNotFound), "got %v", err)
+}
@@ -0,0 +1,331 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/govm-project/govm/internal"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"           // nolint: staticcheck
+	"golang.org/x/crypto/openpgp/clearsign" // nolint: staticcheck
+)
+
+// TrustDir is the directory of the trusted signing keys, next to the govm
+// configuration file. It holds minisign public keys (*.pub) and OpenPGP
+// public keys (*.asc, *.gpg).
+const TrustDir = "trusted-keys"
+
+// SignatureExts are the extensions of the detached signatures looked for
+// next to image files, in that order
+var SignatureExts = []string{".minisig", ".sig", ".asc", ".gpg"} // nolint: gochecknoglobals
+
+var (
+	// ErrUnsigned is returned when an image has no signature
+	ErrUnsigned = errors.New("image is not signed")
+	// ErrSignature is returned when a signature doesn't verify against the
+	// trusted keys
+	ErrSignature = errors.New("signature verification failed")
+)
+
+const (
+	// minisignAlg and minisignHashedAlg start the signatures of whole
+	// files and of their BLAKE2b-512 hash
+	minisignAlg       = "Ed"
+	minisignHashedAlg = "ED"
+	// minisignMaxLegacy is the largest file verified against a signature of
+	// the whole file, which needs it in memory
+	minisignMaxLegacy = 64 << 20
+	// minisignComment prefixes the comment lines of minisign files
+	minisignComment = "untrusted comment:"
+	trustedComment  = "trusted comment: "
+	pgpSigned       = "-----BEGIN PGP SIGNED MESSAGE-----"
+	pgpArmored      = "-----BEGIN PGP"
+)
+
+// minisignKey is a trusted minisign public key
+type minisignKey struct {
+	name string
+	key  ed25519.PublicKey
+}
+
+// Keyring holds the keys images are verified against
+type Keyring struct {
+	dir      string
+	minisign map[uint64]minisignKey
+	pgp      openpgp.EntityList
+}
+
+// LoadKeyring reads the trusted keys of dir. A missing directory is an
+// empty keyring.
+func LoadKeyring(dir string) (*Keyring, error) {
+	k := &Keyring{dir: dir, minisign: map[uint64]minisignKey{}}
+
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+
+		switch filepath.Ext(file.Name()) {
+		case ".pub":
+			err = k.addMinisign(path)
+		case ".asc", ".gpg":
+			err = k.addPGP(path)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("trusted key %v: %w", path, err)
+		}
+	}
+
+	return k, nil
+}
+
+// addMinisign adds a minisign public key, the base64 line following its
+// comment
+func (k *Keyring) addMinisign(path string) error {
+	data, err := os.ReadFile(path) // nolint: gosec
+	if err != nil {
+		return err
+	}
+
+	lines := minisignLines(data)
+	if len(lines) != 1 {
+		return errors.New("not a minisign public key")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != minisignAlg {
+		return errors.New("not a minisign public key")
+	}
+
+	id := binary.LittleEndian.Uint64(raw[2:10])
+	k.minisign[id] = minisignKey{name: filepath.Base(path), key: ed25519.PublicKey(raw[10:])}
+
+	return nil
+}
+
+// addPGP adds the OpenPGP public keys of a file, armored or not
+func (k *Keyring) addPGP(path string) error {
+	data, err := os.ReadFile(path) // nolint: gosec
+	if err != nil {
+		return err
+	}
+
+	var entities openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(pgpArmored)) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	k.pgp = append(k.pgp, entities...)
+
+	return nil
+}
+
+// Empty reports whether the keyring holds no key. A nil keyring is empty.
+func (k *Keyring) Empty() bool {
+	return k == nil || len(k.minisign) == 0 && len(k.pgp) == 0
+}
+
+// noKeys is the error of signatures checked against an empty keyring
+func (k *Keyring) noKeys() error {
+	if k == nil || k.dir == "" {
+		return fmt.Errorf("%w: no trusted keys", ErrSignature)
+	}
+
+	return fmt.Errorf("%w: no trusted keys in %v", ErrSignature, k.dir)
+}
+
+// Verify checks the detached minisign or OpenPGP signature sig of the data
+// read from r and returns the trusted key it was made with
+func (k *Keyring) Verify(r io.Reader, sig []byte) (string, error) {
+	if k.Empty() {
+		return "", k.noKeys()
+	}
+
+	if bytes.HasPrefix(sig, []byte(minisignComment)) {
+		return k.verifyMinisign(r, sig)
+	}
+
+	var (
+		signer *openpgp.Entity
+		err    error
+	)
+
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte(pgpArmored)) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(k.pgp, r, bytes.NewReader(sig))
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(k.pgp, r, bytes.NewReader(sig))
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+
+	return pgpName(signer), nil
+}
+
+// verifyMinisign checks a minisign signature, made of the signature of the
+// data and of the signature of the trusted comment
+func (k *Keyring) verifyMinisign(r io.Reader, sig []byte) (string, error) {
+	lines := minisignLines(sig)
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], trustedComment) {
+		return "", fmt.Errorf("%w: malformed minisign signature", ErrSignature)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return "", fmt.Errorf("%w: malformed minisign signature", ErrSignature)
+	}
+
+	global, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return "", fmt.Errorf("%w: malformed minisign signature", ErrSignature)
+	}
+
+	id := binary.LittleEndian.Uint64(raw[2:10])
+
+	key, ok := k.minisign[id]
+	if !ok {
+		return "", fmt.Errorf("%w: signed with the untrusted minisign key %016X", ErrSignature, id)
+	}
+
+	var message []byte
+
+	switch string(raw[:2]) {
+	case minisignHashedAlg:
+		hash, _ := blake2b.New512(nil)
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", err
+		}
+
+		message = hash.Sum(nil)
+	case minisignAlg:
+		if message, err = io.ReadAll(io.LimitReader(r, minisignMaxLegacy+1)); err != nil {
+			return "", err
+		}
+
+		if len(message) > minisignMaxLegacy {
+			return "", fmt.Errorf("%w: file too large for a legacy minisign signature, sign it with minisign -H",
+				ErrSignature)
+		}
+	default:
+		return "", fmt.Errorf("%w: unsupported minisign algorithm %q", ErrSignature, raw[:2])
+	}
+
+	if !ed25519.Verify(key.key, message, raw[10:]) {
+		return "", fmt.Errorf("%w: invalid minisign signature of %v", ErrSignature, key.name)
+	}
+
+	comment := strings.TrimPrefix(lines[1], trustedComment)
+	signed := append(append([]byte{}, raw[10:]...), comment...)
+	if !ed25519.Verify(key.key, signed, global) {
+		return "", fmt.Errorf("%w: invalid minisign trusted comment of %v", ErrSignature, key.name)
+	}
+
+	return key.name, nil
+}
+
+// VerifyClearsigned checks an OpenPGP clearsigned document, e.g. a Fedora
+// CHECKSUM file, and returns its content and signer
+func (k *Keyring) VerifyClearsigned(data []byte) ([]byte, string, error) {
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("%w: malformed clearsigned document", ErrSignature)
+	}
+
+	if k.Empty() {
+		return block.Plaintext, "", k.noKeys()
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(k.pgp, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return block.Plaintext, "", fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+
+	return block.Plaintext, pgpName(signer), nil
+}
+
+// VerifyFile checks file against the first of its detached signatures,
+// <file>.minisig, <file>.sig, <file>.asc or <file>.gpg, and returns its
+// signer. Files without signature are ErrUnsigned.
+func (k *Keyring) VerifyFile(ctx context.Context, file string) (string, error) {
+	for _, ext := range SignatureExts {
+		sig, err := os.ReadFile(file + ext)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		f, err := os.Open(file) // nolint: gosec
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		signer, err := k.Verify(internal.ContextReader(ctx, f), sig)
+		if err != nil {
+			return "", fmt.Errorf("%v%v: %w", file, ext, err)
+		}
+
+		return signer, nil
+	}
+
+	return "", fmt.Errorf("%w: %v has no %v signature", ErrUnsigned, file, strings.Join(SignatureExts, ", "))
+}
+
+// minisignLines returns the lines of a minisign file, but its untrusted
+// comment and blank lines
+func minisignLines(data []byte) []string {
+	lines := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, minisignComment) {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// pgpName names an OpenPGP key after its first identity and key ID
+func pgpName(entity *openpgp.Entity) string {
+	names := []string{}
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return entity.PrimaryKey.KeyIdString()
+	}
+
+	return names[0] + " (" + entity.PrimaryKey.KeyIdString() + ")"
+}
@@ -0,0 +1,184 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"           // nolint: staticcheck
+	"golang.org/x/crypto/openpgp/armor"     // nolint: staticcheck
+	"golang.org/x/crypto/openpgp/clearsign" // nolint: staticcheck
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// testMinisignKey is a minisign key pair
+type testMinisignKey struct {
+	id   []byte
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+}
+
+// newMinisignKey writes the public key of a new minisign key pair to
+// <dir>/<name>.pub
+func newMinisignKey(t *testing.T, dir, name string) testMinisignKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+
+	key := testMinisignKey{id: make([]byte, 8), pub: pub, priv: priv}
+	_, err = rand.Read(key.id)
+	assert.NilError(t, err)
+
+	if dir != "" {
+		raw := append(append([]byte(minisignAlg), key.id...), pub...)
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name+".pub"),
+			[]byte("untrusted comment: minisign public key\n"+base64.StdEncoding.EncodeToString(raw)+"\n"), 0644))
+	}
+
+	return key
+}
+
+// sign returns the minisign signature of data, of its hash if hashed is set
+func (k testMinisignKey) sign(data []byte, hashed bool) []byte {
+	alg, message := minisignAlg, data
+	if hashed {
+		sum := blake2b.Sum512(data)
+		alg, message = minisignHashedAlg, sum[:]
+	}
+
+	sig := ed25519.Sign(k.priv, message)
+	comment := "timestamp:1700000000\tfile:disk.img"
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), comment...))
+
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), k.id...), sig...)) + "\n" +
+		trustedComment + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+// newPGPKey writes the armored public key of a new OpenPGP key to
+// <dir>/<name>.asc
+func newPGPKey(t *testing.T, dir, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("Release Team", "", "release@example.com", nil)
+	assert.NilError(t, err)
+
+	var buf bytes.Buffer
+
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, entity.Serialize(w))
+	assert.NilError(t, w.Close())
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name+".asc"), buf.Bytes(), 0644))
+
+	return entity
+}
+
+func pgpSign(t *testing.T, entity *openpgp.Entity, data []byte) []byte {
+	var buf bytes.Buffer
+	assert.NilError(t, openpgp.ArmoredDetachSign(&buf, entity, bytes.NewReader(data), nil))
+
+	return buf.Bytes()
+}
+
+func pgpClearsign(t *testing.T, entity *openpgp.Entity, data []byte) []byte {
+	var buf bytes.Buffer
+
+	w, err := clearsign.Encode(&buf, entity.PrivateKey, nil)
+	assert.NilError(t, err)
+	_, err = w.Write(data)
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+// nolint: funlen
+func TestKeyring(t *testing.T) {
+	dir := t.TempDir()
+	minisign := newMinisignKey(t, dir, "team")
+	pgp := newPGPKey(t, dir, "release")
+	untrusted := newMinisignKey(t, "", "")
+
+	keyring, err := LoadKeyring(dir)
+	assert.NilError(t, err)
+	assert.Assert(t, !keyring.Empty())
+
+	data := []byte("disk image")
+	pgpName := "Release Team <release@example.com> (" + pgp.PrimaryKey.KeyIdString() + ")"
+
+	for _, sig := range [][]byte{minisign.sign(data, true), minisign.sign(data, false)} {
+		signer, err := keyring.Verify(bytes.NewReader(data), sig)
+		assert.NilError(t, err)
+		assert.Equal(t, signer, "team.pub")
+	}
+
+	signer, err := keyring.Verify(bytes.NewReader(data), pgpSign(t, pgp, data))
+	assert.NilError(t, err)
+	assert.Equal(t, signer, pgpName)
+
+	plain, signer, err := keyring.VerifyClearsigned(pgpClearsign(t, pgp, []byte("sums\n")))
+	assert.NilError(t, err)
+	assert.Equal(t, string(plain), "sums\n")
+	assert.Equal(t, signer, pgpName)
+
+	tampered := minisign.sign(data, true)
+	tampered = bytes.Replace(tampered, []byte("disk.img"), []byte("evil.img"), 1)
+
+	for sig, want := range map[string]string{
+		string(minisign.sign([]byte("other"), true)): "invalid minisign signature of team.pub",
+		string(tampered):                         "invalid minisign trusted comment of team.pub",
+		string(untrusted.sign(data, true)):       "signed with the untrusted minisign key",
+		"untrusted comment: nothing\nRWQ=\n":     "malformed minisign signature",
+		string(pgpSign(t, pgp, []byte("other"))): "signature verification failed",
+	} {
+		_, err := keyring.Verify(bytes.NewReader(data), []byte(sig))
+		assert.Assert(t, errors.Is(err, ErrSignature), "got %v", err)
+		assert.Check(t, is.ErrorContains(err, want))
+	}
+
+	// Missing directories are empty keyrings
+	empty, err := LoadKeyring(filepath.Join(dir, "missing"))
+	assert.NilError(t, err)
+	assert.Assert(t, empty.Empty())
+
+	_, err = empty.Verify(bytes.NewReader(data), minisign.sign(data, true))
+	assert.Assert(t, is.ErrorContains(err, "no trusted keys in "+filepath.Join(dir, "missing")))
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "broken.pub"), []byte("key"), 0644))
+	_, err = LoadKeyring(dir)
+	assert.Assert(t, is.ErrorContains(err, "broken.pub: not a minisign public key"))
+}
+
+func TestVerifyFile(t *testing.T) {
+	keys := t.TempDir()
+	minisign := newMinisignKey(t, keys, "team")
+
+	keyring, err := LoadKeyring(keys)
+	assert.NilError(t, err)
+
+	file := filepath.Join(t.TempDir(), "disk.img")
+	assert.NilError(t, ioutil.WriteFile(file, []byte("disk image"), 0644))
+
+	_, err = keyring.VerifyFile(context.Background(), file)
+	assert.Assert(t, errors.Is(err, ErrUnsigned), "got %v", err)
+
+	assert.NilError(t, ioutil.WriteFile(file+".minisig", minisign.sign([]byte("disk image"), true), 0644))
+
+	signer, err := keyring.VerifyFile(context.Background(), file)
+	assert.NilError(t, err)
+	assert.Equal(t, signer, "team.pub")
+
+	assert.NilError(t, ioutil.WriteFile(file, []byte("evil image"), 0644))
+
+	_, err = keyring.VerifyFile(context.Background(), file)
+	assert.Assert(t, errors.Is(err, ErrSignature), "got %v", err)
+	assert.Assert(t, strings.HasPrefix(err.Error(), file+".minisig: "), err.Error())
+}
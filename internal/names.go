@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"crypto/rand"
 	"fmt"
 	"os"
 	"os/user"
@@ -51,8 +52,9 @@ func RandomName() string {
 	return namesgenerator.GetRandomName(0)
 }
 
-// GetDefaultWorkDir returns the default working directory
-func GetDefaultWorkDir() string {
+// GetDefaultWorkDir returns the default working directory, creating it if
+// it does not exist yet
+func GetDefaultWorkDir() (string, error) {
 	homeDir := GetUserHomePath()
 	workDir := fmt.Sprintf("%v/vms", homeDir)
 	_, err := os.Stat(workDir)
@@ -66,16 +68,30 @@ func GetDefaultWorkDir() string {
 
 		err = os.MkdirAll(workDir+"/data", 0755) // nolint: gas
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 
-		fmt.Printf("Creating %s", workDir+"/images")
-		err = os.Mkdir(workDir+"/images", 0755) // nolint: gas
+		log.WithField("workdir", workDir+"/images").Info(
+			"Creating images directory")
 
+		err = os.Mkdir(workDir+"/images", 0755) // nolint: gas
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 	}
 
-	return workDir
+	return workDir, nil
+}
+
+// NewUUID returns a random, version 4, UUID
+func NewUUID() (string, error) {
+	b := make([]byte, 16) // nolint: gomnd
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40 // nolint: gomnd
+	b[8] = b[8]&0x3f | 0x80 // nolint: gomnd
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
@@ -1,32 +1,45 @@
 package internal
 
 import (
+	"crypto/rand"
+	"fmt"
 	"net"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // FindAvailablePort helps to find a tcp port
-func FindAvailablePort() int {
+func FindAvailablePort() (int, error) {
 	log.Debug("Looking for an available port for VNC")
 
 	address, err := net.ResolveTCPAddr("tcp", "0.0.0.0:0")
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	listen, err := net.ListenTCP("tcp", address)
 	if err != nil {
-		log.WithField("error", err.Error).Fatal("Cannot find port")
+		return 0, fmt.Errorf("cannot find an available port: %w", err)
 	}
 
 	defer func() {
 		err = listen.Close()
 		if err != nil {
 			log.WithField("error",
-				err.Error).Warn("Failed to close port lister")
+				err.Error()).Warn("Failed to close port lister")
 		}
 	}()
 
-	return listen.Addr().(*net.TCPAddr).Port
+	return listen.Addr().(*net.TCPAddr).Port, nil
+}
+
+// RandomMAC returns a random MAC address from the locally administered
+// 52:54:00 range QEMU uses
+func RandomMAC() (string, error) {
+	b := make([]byte, 3) // nolint: gomnd
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", b[0], b[1], b[2]), nil
 }
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/govm-project/govm/pkg/homedir"
+	"github.com/govm-project/govm/pkg/termutil"
+)
+
+// SSHShell opens an interactive ssh session on address (host:port) and
+// attaches it to the given terminal until the remote shell exits or ctx is
+// done.
+// nolint: funlen
+func SSHShell(ctx context.Context, address, user, key string, term *termutil.Terminal) error {
+	conn, err := sshDial(ctx, address, user, key)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sess, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+
+	defer sess.Close()
+
+	sess.Stdin = term.In()
+	sess.Stdout = term.Out()
+	sess.Stderr = term.Err()
+
+	sz, err := term.GetWinsize()
+	if err != nil {
+		return err
+	}
+
+	err = term.MakeRaw()
+	if err != nil {
+		return err
+	}
+
+	defer handleError(term.Restore())
+
+	err = sess.RequestPty(os.Getenv("TERM"), int(sz.Height), int(sz.Width), nil)
+	if err != nil {
+		return err
+	}
+
+	err = sess.Shell()
+	if err != nil {
+		return err
+	}
+
+	// If our terminal window changes, signal the ssh connection
+	stopch := make(chan struct{})
+	defer close(stopch)
+
+	go func() {
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, syscall.SIGWINCH)
+
+		defer signal.Stop(sigch)
+		defer close(sigch)
+	outer:
+		for {
+			select {
+			case <-sigch:
+				sz, err := term.GetWinsize()
+				if err == nil {
+					handleError(sess.WindowChange(int(sz.Height), int(sz.Width)))
+				}
+			case <-ctx.Done():
+				conn.Close()
+				break outer
+			case <-stopch:
+				break outer
+			}
+		}
+	}()
+
+	err = sess.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// SSHRun runs command through ssh on address (host:port) and returns its
+// combined output. The session is closed when ctx is done.
+func SSHRun(ctx context.Context, address, user, key, command string) ([]byte, error) {
+	conn, err := sshDial(ctx, address, user, key)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	out, err := sess.CombinedOutput(command)
+	if ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+
+	return out, err
+}
+
+// sshDial connects to the ssh server on address with the given private key
+func sshDial(ctx context.Context, address, user, key string) (*ssh.Client, error) {
+	keyPath := homedir.ExpandPath(key)
+
+	privateKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // nolint: gosec
+	}
+	config.SetDefaults()
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, address, &config)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+func handleError(err error) {
+	if err != nil {
+		log.Error(err)
+	}
+}
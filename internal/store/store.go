@@ -0,0 +1,226 @@
+// Package store persists the resolved spec of every VM next to its data, in
+// <workdir>/data/<name>/spec.json, so it outlives the engine resources
+// (container labels, QEMU state) and can be used to inspect, recreate or
+// export a VM.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/govm-project/govm/vm"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SpecFile is the name of the VM record within its data directory
+	SpecFile = "spec.json"
+	// Version is the schema version of the records written by this govm
+	Version = 1
+)
+
+// ErrNotFound is returned when a VM has no record in the store
+var ErrNotFound = errors.New("VM record not found")
+
+// Record is the persisted description of a VM
+type Record struct {
+	// Version is the schema version the record was written with
+	Version int `json:"version"`
+	// Engine is the name of the engine managing the VM
+	Engine string `json:"engine"`
+	// Spec is the resolved instance spec. Its Status and Created fields
+	// track the VM lifecycle.
+	Spec vm.Instance `json:"spec"`
+	// Saves lists the files the VM was saved to with govm save
+	Saves []string `json:"saves,omitempty"`
+	// Updated is the time of the last change to the record
+	Updated time.Time `json:"updated"`
+}
+
+// migration upgrades a raw record to the next schema version
+type migration func(raw map[string]interface{}) error
+
+// migrations holds the upgrade from version i+1 to i+2 at index i. Append a
+// function here whenever the Record layout changes and bump Version.
+// nolint: gochecknoglobals
+var migrations = []migration{}
+
+// Store reads and writes the VM records of a working directory
+type Store struct {
+	workdir string
+}
+
+// New returns the store of the given govm working directory
+func New(workdir string) *Store {
+	return &Store{workdir: workdir}
+}
+
+// Put writes a record into the data directory of its VM
+func (s *Store) Put(rec *Record) error {
+	if rec.Spec.Name == "" {
+		return errors.New("cannot store a VM record without name")
+	}
+
+	rec.Version = Version
+	rec.Updated = time.Now().UTC()
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.workdir, "data", rec.Spec.Name)
+	if err := os.MkdirAll(dir, 0740); err != nil { // nolint: gas
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn record
+	tmp, err := ioutil.TempFile(dir, SpecFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, SpecFile))
+}
+
+// Get returns the record of a VM by name or ID prefix within a namespace
+func (s *Store) Get(namespace, ref string) (*Record, error) {
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range records {
+		if rec.Spec.Namespace != namespace {
+			continue
+		}
+
+		if rec.Spec.Name == ref || (len(ref) >= 6 && strings.HasPrefix(rec.Spec.ID, ref)) {
+			return rec, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v in namespace %v", ErrNotFound, ref, namespace)
+}
+
+// Update applies fn to the record of a VM and saves it
+func (s *Store) Update(namespace, ref string, fn func(rec *Record) error) error {
+	rec, err := s.Get(namespace, ref)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(rec); err != nil {
+		return err
+	}
+
+	return s.Put(rec)
+}
+
+// Delete removes the record of a VM. Deleting a missing record is not an
+// error.
+func (s *Store) Delete(namespace, ref string) error {
+	rec, err := s.Get(namespace, ref)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(s.workdir, "data", rec.Spec.Name, SpecFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// List returns every readable record of the working directory sorted by name
+func (s *Store) List() ([]*Record, error) {
+	files, err := filepath.Glob(filepath.Join(s.workdir, "data", "*", SpecFile))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*Record{}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Warnf("Skipping %v: %v", file, err)
+			continue
+		}
+
+		rec, err := decode(data, Version, migrations)
+		if err != nil {
+			log.Warnf("Skipping %v: %v", file, err)
+			continue
+		}
+
+		records = append(records, rec)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Spec.Name < records[j].Spec.Name
+	})
+
+	return records, nil
+}
+
+// decode reads a record of any known schema version, migrating it up to
+// version
+func decode(data []byte, version int, migrations []migration) (*Record, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	v, ok := raw["version"].(float64)
+	if !ok || v < 1 {
+		return nil, errors.New("missing or invalid record version")
+	}
+
+	if int(v) > version {
+		return nil, fmt.Errorf("record version %v is newer than the supported %v", v, version)
+	}
+
+	for i := int(v); i < version; i++ {
+		if err := migrations[i-1](raw); err != nil {
+			return nil, fmt.Errorf("migrating record from version %v: %w", i, err)
+		}
+
+		raw["version"] = float64(i + 1)
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestStore(t *testing.T) {
+	workdir := t.TempDir()
+	s := New(workdir)
+
+	spec := vm.Instance{
+		ID:          "0123456789abcdef",
+		Name:        "vm",
+		Namespace:   "tester",
+		ParentImage: "/images/focal.img",
+		Size:        vm.NewSize("qemu64", 1, 1, 1, 1, 1024, 10),
+		Shares:      []string{"/srv:/mnt/srv"},
+		Status:      vm.StatusCreated,
+	}
+	assert.NilError(t, s.Put(&Record{Engine: "docker", Spec: spec}))
+
+	_, err := os.Stat(filepath.Join(workdir, "data", "vm", SpecFile))
+	assert.NilError(t, err)
+
+	rec, err := s.Get("tester", "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Version, Version)
+	assert.Equal(t, rec.Engine, "docker")
+	assert.DeepEqual(t, rec.Spec, spec)
+	assert.Assert(t, !rec.Updated.IsZero())
+
+	// By ID prefix, only within the namespace
+	_, err = s.Get("tester", "012345")
+	assert.NilError(t, err)
+
+	_, err = s.Get("other", "vm")
+	assert.Assert(t, errors.Is(err, ErrNotFound), "got %v", err)
+
+	assert.NilError(t, s.Update("tester", "vm", func(rec *Record) error {
+		rec.Spec.Status = vm.StatusRunning
+		return nil
+	}))
+
+	rec, err = s.Get("tester", "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Status, vm.StatusRunning)
+
+	err = s.Update("tester", "missing", func(*Record) error { return nil })
+	assert.Assert(t, errors.Is(err, ErrNotFound), "got %v", err)
+
+	assert.NilError(t, s.Delete("tester", "vm"))
+	assert.NilError(t, s.Delete("tester", "vm"))
+
+	records, err := s.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(records), 0)
+
+	// The VM data is left to the engine
+	_, err = os.Stat(filepath.Join(workdir, "data", "vm"))
+	assert.NilError(t, err)
+}
+
+func TestListSkipsUnreadableRecords(t *testing.T) {
+	workdir := t.TempDir()
+	s := New(workdir)
+
+	assert.NilError(t, s.Put(&Record{Spec: vm.Instance{Name: "good", Namespace: "tester"}}))
+
+	for name, content := range map[string]string{
+		"garbage": "{",
+		"newer":   `{"version": 99, "spec": {"name": "newer"}}`,
+		"legacy":  `{"spec": {"name": "legacy"}}`,
+	} {
+		dir := filepath.Join(workdir, "data", name)
+		assert.NilError(t, os.MkdirAll(dir, 0755))
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, SpecFile), []byte(content), 0644))
+	}
+
+	records, err := s.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, records[0].Spec.Name, "good")
+}
+
+func TestDecodeMigrations(t *testing.T) {
+	data := []byte(`{"version": 1, "engine": "docker", "spec": {"name": "vm", "image": "/old.img"}}`)
+
+	migrations := []migration{
+		// v1 to v2 renames the engine
+		func(raw map[string]interface{}) error {
+			raw["engine"] = "qemu"
+			return nil
+		},
+		// v2 to v3 moves the image
+		func(raw map[string]interface{}) error {
+			raw["spec"].(map[string]interface{})["image"] = "/new.img"
+			return nil
+		},
+	}
+
+	rec, err := decode(data, 3, migrations)
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Version, 3)
+	assert.Equal(t, rec.Engine, "qemu")
+	assert.Equal(t, rec.Spec.ParentImage, "/new.img")
+
+	migrations[1] = func(map[string]interface{}) error { return errors.New("boom") }
+	_, err = decode(data, 3, migrations)
+	assert.Assert(t, is.ErrorContains(err, "migrating record from version 2: boom"))
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/govm-project/govm/pkg/cli"
 	clilib "github.com/urfave/cli/v2"
@@ -22,9 +25,14 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = cmd.Run(os.Args)
+	// Cancel the running engine operation on Ctrl-C or termination
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	err = cmd.RunContext(ctx, os.Args)
+	stop()
+
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/govm-project/govm/vm"
+	"github.com/intel/tfortools"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var checkpointCommand = cli.Command{
+	Name:  "checkpoint",
+	Usage: "Save and restore the full state, memory included, of a GoVM Instance",
+	Subcommands: []*cli.Command{
+		&checkpointCreateCommand,
+		&checkpointRestoreCommand,
+		&checkpointListCommand,
+		&checkpointDeleteCommand,
+	},
+}
+
+// nolint: gochecknoglobals
+var checkpointCreateCommand = cli.Command{
+	Name:      "create",
+	Usage:     "Checkpoint a running GoVM Instance",
+	ArgsUsage: "[name] [checkpoint]",
+	Description: "The guest is paused while its memory and disks are saved into the VM\n" +
+		"data directory, it then carries on from where it was.",
+	Action: func(c *cli.Context) error {
+		name, checkpoint, err := pairArgs(c, "checkpoint create", "checkpoint")
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		cp, err := engine.CreateCheckpoint(ctx, c.String("namespace"), name, checkpoint)
+		if err != nil {
+			return fmt.Errorf("error when checkpointing the GoVM Instance %v: %w", name, err)
+		}
+
+		log.Printf("Checkpoint %v of GoVM Instance %v has been successfully created (%v)",
+			cp.Name, name, formatSize(cp.Size))
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var checkpointRestoreCommand = cli.Command{
+	Name:      "restore",
+	Usage:     "Bring a GoVM Instance back to one of its checkpoints",
+	ArgsUsage: "[name] [checkpoint]",
+	Description: "The current state of the VM is lost. The VM is running from the checkpoint\n" +
+		"state once restored, even if it was stopped.",
+	Action: func(c *cli.Context) error {
+		name, checkpoint, err := pairArgs(c, "checkpoint restore", "checkpoint")
+		if err != nil {
+			return err
+		}
+
+		namespace := c.String("namespace")
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		err = engine.RestoreCheckpoint(ctx, namespace, name, checkpoint)
+		if err != nil {
+			return fmt.Errorf("error when restoring the GoVM Instance %v: %w", name, err)
+		}
+		recordStatus(c.String("workdir"), namespace, name, vm.StatusRunning)
+
+		log.Printf("GoVM Instance %v has been successfully restored to %v", name, checkpoint)
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var checkpointListCommand = cli.Command{
+	Name:      "list",
+	Aliases:   []string{"ls"},
+	Usage:     "List the checkpoints of a GoVM Instance",
+	ArgsUsage: "[name]",
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm checkpoint list [name]")
+		}
+
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		checkpoints, err := engine.ListCheckpoints(ctx, c.String("namespace"), name)
+		if err != nil {
+			return fmt.Errorf("error when listing the checkpoints of the GoVM Instance %v: %w", name, err)
+		}
+
+		type outCheckpoint struct {
+			Name    string
+			Created string
+			Size    string
+		}
+
+		out := []outCheckpoint{}
+		for _, cp := range checkpoints {
+			out = append(out, outCheckpoint{
+				Name:    cp.Name,
+				Created: cp.Created.Local().Format("2006-01-02 15:04:05"),
+				Size:    formatSize(cp.Size),
+			})
+		}
+
+		return tfortools.OutputToTemplate(c.App.Writer, "format", "{{table .}}", out, nil)
+	},
+}
+
+// nolint: gochecknoglobals
+var checkpointDeleteCommand = cli.Command{
+	Name:      "delete",
+	Aliases:   []string{"rm"},
+	Usage:     "Remove a checkpoint of a GoVM Instance",
+	ArgsUsage: "[name] [checkpoint]",
+	Action: func(c *cli.Context) error {
+		name, checkpoint, err := pairArgs(c, "checkpoint delete", "checkpoint")
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		err = engine.DeleteCheckpoint(ctx, c.String("namespace"), name, checkpoint)
+		if err != nil {
+			return fmt.Errorf("error when deleting the checkpoint of the GoVM Instance %v: %w", name, err)
+		}
+
+		log.Printf("Checkpoint %v of GoVM Instance %v has been successfully deleted", checkpoint, name)
+
+		return nil
+	},
+}
+
+// pairArgs returns the instance name and the name of one of its
+// checkpoints or snapshots given to a subcommand
+func pairArgs(c *cli.Context, command, object string) (string, string, error) {
+	if c.NArg() != 2 { // nolint: gomnd
+		return "", "", usageError("expected a GoVM Instance name and a " + object + " name\n" +
+			"USAGE:\n govm " + command + " [name] [" + object + "]")
+	}
+
+	return c.Args().Get(0), c.Args().Get(1), nil
+}
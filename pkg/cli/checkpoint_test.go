@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCheckpoint(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm", "--ram", "1024")
+	assert.NilError(t, err)
+
+	for _, name := range []string{"before-upgrade", "after-upgrade"} {
+		_, err = env.run("checkpoint", "create", "vm", name)
+		assert.NilError(t, err)
+	}
+
+	out, err := env.run("checkpoint", "ls", "vm")
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, len(lines), 3)
+	assert.DeepEqual(t, strings.Fields(lines[0]), []string{"Name", "Created", "Size"})
+	assert.Equal(t, strings.Fields(lines[1])[0], "before-upgrade")
+	assert.Equal(t, strings.Fields(lines[1])[3], "1G")
+
+	_, err = env.run("stop", "--force", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("checkpoint", "restore", "vm", "before-upgrade")
+	assert.NilError(t, err)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ins.Running)
+	assert.DeepEqual(t, ins.Restored, []string{"before-upgrade"})
+
+	rec, err := store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Status, vm.StatusRunning)
+
+	_, err = env.run("checkpoint", "rm", "vm", "after-upgrade")
+	assert.NilError(t, err)
+
+	ins, _ = env.engine.Get(testNamespace, "vm")
+	assert.Equal(t, len(ins.Checkpoints), 1)
+}
+
+func TestCheckpointErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	_, err := env.run("checkpoint", "create", "vm")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+	assert.Assert(t, is.ErrorContains(err, "govm checkpoint create [name] [checkpoint]"))
+
+	_, err = env.run("checkpoint", "list")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	_, err = env.run("checkpoint", "create", "vm", "first")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+
+	_, err = env.run("start", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("checkpoint", "create", "vm", "../first")
+	assert.Equal(t, ExitCode(err), ExitInvalidSpec)
+
+	_, err = env.run("checkpoint", "restore", "vm", "missing")
+	assert.Assert(t, errors.Is(err, engines.ErrCheckpointNotFound), "got %v", err)
+	assert.Assert(t, is.ErrorContains(err, "error when restoring the GoVM Instance vm"))
+
+	_, err = env.run("checkpoint", "ls", "missing")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+}
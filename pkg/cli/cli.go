@@ -1,9 +1,17 @@
 package cli
 
 import (
+	"context"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
 	"github.com/govm-project/govm/pkg/homedir"
 	"github.com/govm-project/govm/pkg/nameutil"
 	cli "github.com/urfave/cli/v2"
+
+	// Register the available VM engines
+	_ "github.com/govm-project/govm/engines/docker"
+	_ "github.com/govm-project/govm/engines/qemu"
 )
 
 // New creates a new command line GoVM application
@@ -28,16 +36,104 @@ func New() (*cli.App, error) {
 				Value: homedir.ExpandPath(VMLauncherWorkdir),
 				Usage: "alternative working directory",
 			},
+			&cli.StringFlag{
+				Name:    "engine",
+				Aliases: []string{"e"},
+				Value:   engines.DefaultEngine,
+				EnvVars: []string{"GOVM_ENGINE"},
+				Usage:   "VM engine to use",
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				EnvVars: []string{"GOVM_TIMEOUT"},
+				Usage:   "abort engine operations taking longer than this (e.g. 5m, 0 for no limit)",
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Value:   internal.GetDefaultConfigFile(),
+				EnvVars: []string{"GOVM_CONFIG"},
+				Usage:   "path to the govm configuration file",
+			},
+			&cli.BoolFlag{
+				Name:    "require-signed",
+				EnvVars: []string{"GOVM_REQUIRE_SIGNED"},
+				Usage:   "refuse images not signed by a key of the trusted-keys directory",
+			},
 		},
+		Before: loadConfig,
 		Commands: []*cli.Command{
 			&createCommand,
 			&listCommand,
+			&inspectCommand,
+			&updateCommand,
+			&diskCommand,
 			&removeCommand,
 			&startCommand,
 			&composeCommand,
 			&sshCommand,
 			&stopCommand,
+			&pauseCommand,
+			&resumeCommand,
+			&checkpointCommand,
+			&snapshotCommand,
 			&saveCommand,
+			&exportCommand,
+			&importCommand,
+			&cloneCommand,
+			&imageCommand,
+			&dfCommand,
 		},
 	}, nil
 }
+
+// loadConfig applies the configuration file settings that were not
+// explicitly set on the command line or the environment
+func loadConfig(c *cli.Context) error {
+	config, err := internal.LoadConfig(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	if config.Engine != "" && !c.IsSet("engine") {
+		if err := c.Set("engine", config.Engine); err != nil {
+			return err
+		}
+	}
+
+	if config.RequireSigned && !c.IsSet("require-signed") {
+		return c.Set("require-signed", "true")
+	}
+
+	return nil
+}
+
+// commandContext returns the context engine operations run with. It is
+// cancelled on SIGINT/SIGTERM (see main) and bounded by the global --timeout.
+func commandContext(c *cli.Context) (context.Context, context.CancelFunc) {
+	if timeout := globalContext(c).Duration("timeout"); timeout > 0 {
+		return context.WithTimeout(c.Context, timeout)
+	}
+
+	return context.WithCancel(c.Context)
+}
+
+// globalContext returns the context of the application itself, whose flags
+// some commands shadow with their own, e.g. stop --timeout
+func globalContext(c *cli.Context) *cli.Context {
+	lineage := c.Lineage()
+
+	for i := len(lineage) - 1; i > 0; i-- {
+		if lineage[i].Command != nil {
+			return lineage[i]
+		}
+	}
+
+	return c
+}
+
+// newEngine returns the VM engine selected with the global --engine flag
+func newEngine(c *cli.Context) (engines.VMEngine, error) {
+	return engines.New(c.String("engine"), engines.Options{
+		Workdir: c.String("workdir"),
+	})
+}
@@ -0,0 +1,169 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/engines/fake"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const testNamespace = "tester"
+
+// testEnv runs the govm application against a fake engine
+type testEnv struct {
+	t       *testing.T
+	engine  *fake.Engine
+	workdir string
+	image   string
+	key     string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	workdir := t.TempDir()
+
+	image := filepath.Join(workdir, "image.qcow2")
+	assert.NilError(t, ioutil.WriteFile(image, []byte("image"), 0644))
+
+	key := filepath.Join(workdir, "id_rsa.pub")
+	assert.NilError(t, ioutil.WriteFile(key, []byte("ssh-rsa AAAA test"), 0644))
+
+	env := &testEnv{
+		t:       t,
+		engine:  fake.New(),
+		workdir: workdir,
+		image:   image,
+		key:     key,
+	}
+	engines.Register(fake.EngineName, env.engine.Factory())
+
+	return env
+}
+
+// run executes govm with the given command line and returns its output
+func (env *testEnv) run(args ...string) (string, error) {
+	app, err := New()
+	assert.NilError(env.t, err)
+
+	out := &bytes.Buffer{}
+	app.Writer = out
+	app.ErrWriter = out
+
+	cmdline := []string{"govm",
+		"--engine", fake.EngineName,
+		"--config", filepath.Join(env.workdir, "config.yml"),
+		"--namespace", testNamespace,
+		"--workdir", env.workdir,
+	}
+
+	err = app.Run(append(cmdline, args...))
+
+	return out.String(), err
+}
+
+func TestUnknownEngine(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("--engine", "missing", "list")
+	assert.Assert(t, is.ErrorContains(err, `unknown engine "missing"`))
+}
+
+func TestConfigFileEngine(t *testing.T) {
+	env := newTestEnv(t)
+
+	config := filepath.Join(env.workdir, "config.yml")
+	assert.NilError(t, ioutil.WriteFile(config, []byte("engine: missing\n"), 0644))
+
+	app, err := New()
+	assert.NilError(t, err)
+
+	err = app.Run([]string{"govm", "--config", config, "list"})
+	assert.Assert(t, is.ErrorContains(err, `unknown engine "missing"`))
+
+	// The command line wins over the configuration file
+	_, err = env.run("list")
+	assert.NilError(t, err)
+}
+
+func TestStartStopSave(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("stop", "vm")
+	assert.NilError(t, err)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, !ins.Running)
+
+	_, err = env.run("start", "vm")
+	assert.NilError(t, err)
+
+	ins, _ = env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ins.Running)
+
+	out := filepath.Join(t.TempDir(), "vm.img")
+
+	_, err = env.run("save", "--out", out, "vm")
+	assert.NilError(t, err)
+
+	ins, _ = env.engine.Get(testNamespace, "vm")
+	assert.DeepEqual(t, ins.Saves, []string{out})
+
+	_, err = env.run("stop")
+	assert.Assert(t, is.ErrorContains(err, "missing GoVM Instance name"))
+
+	_, err = env.run("start", "unknown")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotFound), "got %v", err)
+
+	env.engine.FailOn("StopVM", errors.New("injected"))
+	_, err = env.run("stop", "vm")
+	assert.Assert(t, is.ErrorContains(err, "injected"))
+}
+
+func TestTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+	env.engine.Hang("StopVM")
+
+	_, err := env.run("--timeout", "50ms", "stop", "vm")
+	assert.Assert(t, is.ErrorContains(err, context.DeadlineExceeded.Error()))
+
+	// The stop --timeout for the guest doesn't replace the global one
+	_, err = env.run("--timeout", "50ms", "stop", "--timeout", "1h", "vm")
+	assert.Equal(t, ExitCode(err), ExitTimeout)
+}
+
+func TestStopOptions(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm-a", "")
+	addInstance(env, testNamespace, "vm-b", "")
+
+	_, err := env.run("stop", "vm-a")
+	assert.NilError(t, err)
+
+	opts, ok := env.engine.Stopped(testNamespace, "vm-a")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, opts, engines.StopOptions{Timeout: engines.DefaultStopTimeout})
+
+	_, err = env.run("stop", "--timeout", "5s", "--force", "vm-a")
+	assert.NilError(t, err)
+
+	opts, _ = env.engine.Stopped(testNamespace, "vm-a")
+	assert.DeepEqual(t, opts, engines.StopOptions{Timeout: 5 * time.Second, Force: true})
+
+	_, err = env.run("remove", "--timeout", "10s", "vm-b")
+	assert.NilError(t, err)
+
+	deleted, ok := env.engine.Deleted(testNamespace, "vm-b")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, deleted.StopOptions, engines.StopOptions{Timeout: 10 * time.Second})
+}
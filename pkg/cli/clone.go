@@ -0,0 +1,279 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var cloneCommand = cli.Command{
+	Name:      "clone",
+	Usage:     "Clone a GoVM Instance",
+	ArgsUsage: "[name] [clone]",
+	Description: "The root disk of the VM is frozen into the read-only parent image of the\n" +
+		"clone. Linked clones add a copy of the VM overlay to the image store, backed by\n" +
+		"the VM parent image. Full clones keep a standalone copy in their data directory.\n" +
+		"The clone gets a new MAC address and cloud-init instance ID, so its guest\n" +
+		"regenerates its SSH host keys on first boot.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "linked",
+			Usage: "share a frozen copy of the disk of the VM (default)",
+		},
+		&cli.BoolFlag{
+			Name:  "full",
+			Usage: "give the clone its own copy of the disk of the VM",
+		},
+		&cli.BoolFlag{
+			Name:  "stopvm",
+			Usage: "stop a running VM while its disks are copied",
+		},
+		&cli.BoolFlag{
+			Name:  "start",
+			Usage: "start the clone",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		name, clone, err := pairArgs(c, "clone", "clone")
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("linked") && c.Bool("full") {
+			return usageError("--linked and --full are mutually exclusive")
+		}
+
+		if !vm.ValidName(clone) {
+			return &vm.SpecError{Field: "name", Value: clone,
+				Err: errors.New("names are made of letters, digits, '-' and '_'")}
+		}
+
+		namespace := c.String("namespace")
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		ins, err := engine.InspectVM(ctx, namespace, name)
+		if err != nil {
+			return fmt.Errorf("error when cloning the GoVM Instance %v: %w", name, err)
+		}
+
+		_, err = engine.InspectVM(ctx, namespace, clone)
+		if err == nil {
+			return fmt.Errorf("error when cloning the GoVM Instance %v: %w: %v", name, engines.ErrVMExists, clone)
+		} else if !errors.Is(err, engines.ErrVMNotFound) {
+			return fmt.Errorf("error when cloning the GoVM Instance %v: %w", name, err)
+		}
+
+		spec := withRecord(c.String("workdir"), ins)
+
+		restart, err := stopForCopy(ctx, c, engine, spec)
+		if err != nil {
+			return err
+		}
+		defer restart()
+
+		if err := cloneVM(ctx, c, engine, spec, clone, c.Bool("full")); err != nil {
+			return fmt.Errorf("error when cloning the GoVM Instance %v: %w", name, err)
+		}
+
+		if c.Bool("start") {
+			if err := engine.StartVM(ctx, namespace, clone); err != nil {
+				return fmt.Errorf("error when starting the GoVM Instance %v: %w", clone, err)
+			}
+
+			recordStatus(c.String("workdir"), namespace, clone, vm.StatusRunning)
+		}
+
+		log.Printf("GoVM Instance %v has been successfully cloned into %v", name, clone)
+
+		return nil
+	},
+}
+
+// cloneVM freezes the root disk of a stopped VM, copies its data disks and
+// creates the clone on top of them
+// nolint: funlen
+func cloneVM(ctx context.Context, c *cli.Context, engine engines.VMEngine, spec vm.Instance,
+	name string, full bool) (err error) {
+	workdir := c.String("workdir")
+
+	// The source VM may keep its data in another working directory
+	srcWorkdir := workdir
+	if spec.Workdir != "" {
+		srcWorkdir = spec.Workdir
+	}
+
+	srcDir := filepath.Join(srcWorkdir, "data", spec.Name)
+	overlay := filepath.Join(srcDir, engines.OverlayFile)
+	s := images.New(workdir)
+
+	dataDir := filepath.Join(workdir, "data", name)
+	if _, err := os.Stat(dataDir); err == nil {
+		return fmt.Errorf("%w: the data directory %v is in use", engines.ErrVMExists, dataDir)
+	}
+
+	if _, err := os.Stat(overlay); !full && os.IsNotExist(err) {
+		log.Warnf("VM %v writes straight into its parent image, making a full clone", spec.Name)
+
+		full = true
+	}
+
+	// Full clones own their image, linked ones add it to the image store
+	out := filepath.Join(dataDir, "image.qcow2")
+	if !full {
+		out = filepath.Join(workdir, images.Dir, "."+name+".clone.qcow2")
+	}
+
+	created, stored := false, []string{}
+
+	defer func() {
+		if err != nil && !created {
+			_ = os.RemoveAll(dataDir)
+			_ = os.Remove(out)
+
+			// The frozen overlay goes before its parent
+			for i := len(stored) - 1; i >= 0; i-- {
+				_ = s.Remove(stored[i])
+			}
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Join(dataDir, vm.DisksDir), 0750); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0750); err != nil {
+		return err
+	}
+
+	image := out
+	if full {
+		err = engine.SaveVM(ctx, spec.Namespace, spec.Name, engines.SaveOptions{Output: out})
+		if err == nil {
+			// The overlay of the clone relies on it never changing
+			err = os.Chmod(image, 0444)
+		}
+	} else {
+		frozen := fmt.Sprintf("%v-%v", spec.Name, time.Now().UTC().Format("20060102T150405"))
+
+		var img images.Image
+		img, err = freezeOverlay(ctx, s, srcWorkdir, spec, overlay, out, frozen, &stored)
+		if err == nil {
+			image = img.Path
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range spec.Disks {
+		file := filepath.Join(srcDir, disk.File())
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := internal.CopyFile(filepath.Join(dataDir, disk.File()), file); err != nil {
+			return err
+		}
+	}
+
+	spec.Name, spec.ParentImage, spec.Workdir = name, image, workdir
+	spec.ID, spec.Status, spec.Created, spec.Labels, spec.VNCPort = "", "", time.Time{}, nil, 0
+
+	// A new identity on the network and for cloud-init
+	spec.UUID, spec.NetOpts.IP = "", ""
+	if spec.NetOpts.MAC, err = internal.RandomMAC(); err != nil {
+		return err
+	}
+
+	// The recorded spec holds the key itself, older ones its file
+	if key := spec.SSHPublicKeyFile; key != "" {
+		if _, err := os.Stat(key); err != nil {
+			keyFile := filepath.Join(dataDir, "sshkey.pub")
+			if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+				return err
+			}
+			defer os.Remove(keyFile) // nolint: errcheck
+
+			spec.SSHPublicKeyFile = keyFile
+		}
+	}
+
+	if err := spec.Check(); err != nil {
+		return fmt.Errorf("error on VM Instance pre-check: %w", err)
+	}
+
+	id, err := engine.CreateVM(ctx, spec)
+	if err != nil {
+		return err
+	}
+
+	created = true
+	recordVM(c, spec, id)
+
+	return nil
+}
+
+// freezeOverlay adds a copy of the overlay of a stopped VM to the image
+// store as frozen, rebased onto the VM parent image. Parent images living
+// in a VM data directory, e.g. of full clones, are added to the store too,
+// so that the copy outlives them. The names of the added images are
+// appended to stored.
+func freezeOverlay(ctx context.Context, s *images.Store, workdir string, spec vm.Instance,
+	overlay, out, frozen string, stored *[]string) (images.Image, error) {
+	parent := spec.ParentImage
+
+	if rel, err := filepath.Rel(filepath.Join(workdir, "data"), parent); err == nil && !strings.HasPrefix(rel, "..") {
+		img, err := s.Add(ctx, frozen+"-base", parent, images.AddOptions{
+			Source: "parent image of " + spec.Name,
+			Link:   true,
+		})
+		if err != nil {
+			return img, err
+		}
+
+		*stored = append(*stored, img.Name)
+		parent = img.Path
+	}
+
+	if err := internal.CopyFile(out, overlay); err != nil {
+		return images.Image{}, err
+	}
+
+	// Overlays name their parent as the engine sees it, e.g. in a container,
+	// the frozen copy as the store does
+	if err := internal.SetImageBackingFile(out, s.BackingName(parent)); err != nil {
+		return images.Image{}, err
+	}
+
+	img, err := s.Add(ctx, frozen, out, images.AddOptions{
+		Source:  "clone of " + spec.Name,
+		Move:    true,
+		Overlay: true,
+	})
+	if err == nil {
+		*stored = append(*stored, img.Name)
+	}
+
+	return img, err
+}
@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// metadataUUID reads the cloud-init instance ID of a VM
+func metadataUUID(t *testing.T, workdir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(workdir, "data", name, "meta_data.json"))
+	assert.NilError(t, err)
+
+	meta := vm.ConfigDriveMetaData{}
+	assert.NilError(t, json.Unmarshal(data, &meta))
+
+	return meta.UUID
+}
+
+// writeOverlay writes the header of a qcow2 overlay of backing, as an engine
+// creates for its VMs
+func writeOverlay(t *testing.T, file, backing string) {
+	header := make([]byte, 512)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint64(header[8:], 256)
+	binary.BigEndian.PutUint32(header[16:], uint32(len(backing)))
+	binary.BigEndian.PutUint32(header[20:], 16)
+	binary.BigEndian.PutUint64(header[24:], 10<<30)
+	copy(header[256:], backing)
+
+	assert.NilError(t, ioutil.WriteFile(file, header, 0644))
+}
+
+// nolint: funlen
+func TestClone(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm",
+		"--disk-attach", "data:1G")
+	assert.NilError(t, err)
+
+	srcDir := filepath.Join(env.workdir, "data", "vm")
+	assert.NilError(t, os.MkdirAll(filepath.Join(srcDir, "disks"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(srcDir, "disks", "data.qcow2"), []byte("data"), 0644))
+	writeOverlay(t, filepath.Join(srcDir, engines.OverlayFile), "/image/image")
+
+	_, err = env.run("clone", "vm", "linked")
+	assert.Assert(t, is.ErrorContains(err, "the GoVM Instance vm is running, stop it first or use --stopvm"))
+
+	_, err = env.run("clone", "--stopvm", "vm", "linked")
+	assert.NilError(t, err)
+
+	src, _ := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, src.Running)
+
+	linked, ok := env.engine.Get(testNamespace, "linked")
+	assert.Assert(t, ok)
+	assert.Assert(t, !linked.Running)
+	assert.Equal(t, linked.SSHPublicKeyFile, "ssh-rsa AAAA test")
+	assert.DeepEqual(t, linked.Disks, src.Disks)
+
+	// A fresh identity
+	assert.Assert(t, linked.NetOpts.MAC != "" && linked.NetOpts.MAC != src.NetOpts.MAC)
+	assert.Assert(t, linked.UUID != "" && linked.UUID != src.UUID)
+	assert.Equal(t, metadataUUID(t, env.workdir, "linked"), linked.UUID)
+
+	// Linked clones get a frozen copy of the overlay of the VM, rebased
+	// onto its parent image, from the image store
+	stored, err := images.New(env.workdir).List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(stored), 1)
+	assert.Equal(t, stored[0].Path, linked.ParentImage)
+	assert.Equal(t, stored[0].Source, "clone of vm")
+	assert.Equal(t, stored[0].Backing, env.image)
+
+	backing, err := internal.ImageBackingFile(linked.ParentImage)
+	assert.NilError(t, err)
+	assert.Equal(t, backing, env.image)
+
+	_, err = env.run("image", "rm", stored[0].Name)
+	assert.Assert(t, is.ErrorContains(err, "the image backs the GoVM Instances tester/linked"))
+
+	data, err := ioutil.ReadFile(filepath.Join(env.workdir, "data", "linked", "disks", "data.qcow2"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "data")
+
+	_, err = env.run("clone", "--full", "--start", "linked", "full")
+	assert.NilError(t, err)
+
+	full, _ := env.engine.Get(testNamespace, "full")
+	assert.Assert(t, full.Running)
+	assert.Equal(t, full.ParentImage, filepath.Join(env.workdir, "data", "full", "image.qcow2"))
+	assert.Assert(t, full.UUID != linked.UUID)
+
+	data, err = ioutil.ReadFile(full.ParentImage)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "saved linked")
+
+	// The parent image of a full clone goes with it, linked clones of it
+	// keep theirs in the store
+	writeOverlay(t, filepath.Join(env.workdir, "data", "full", engines.OverlayFile), full.ParentImage)
+
+	_, err = env.run("clone", "--stopvm", "full", "relinked")
+	assert.NilError(t, err)
+
+	relinked, _ := env.engine.Get(testNamespace, "relinked")
+	frozen, err := images.New(env.workdir).List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(frozen), 3)
+
+	// Stored parents are named relative to the store
+	backing, err = internal.ImageBackingFile(relinked.ParentImage)
+	assert.NilError(t, err)
+	assert.Assert(t, !filepath.IsAbs(backing), backing)
+
+	chain, err := internal.ImageBackingChain(relinked.ParentImage)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(chain[0], filepath.Join(env.workdir, images.Dir)), chain[0])
+
+	data, err = ioutil.ReadFile(chain[0])
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "saved linked")
+
+	// Frozen images are pruned with the last clone using them, overlays first
+	_, err = env.run("image", "prune")
+	assert.NilError(t, err)
+
+	_, err = env.run("rm", "relinked")
+	assert.NilError(t, err)
+
+	_, err = env.run("image", "prune")
+	assert.NilError(t, err)
+
+	frozen, err = images.New(env.workdir).List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(frozen), 1)
+	assert.Equal(t, frozen[0].Path, linked.ParentImage)
+
+	_, err = env.run("clone", "vm", "linked")
+	assert.Equal(t, ExitCode(err), ExitVMExists)
+}
+
+func TestCloneErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("clone", "vm")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	_, err = env.run("clone", "--linked", "--full", "vm", "copy")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	_, err = env.run("clone", "vm", "../escape")
+	assert.Equal(t, ExitCode(err), ExitInvalidSpec)
+
+	_, err = env.run("clone", "missing", "copy")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+	writeOverlay(t, filepath.Join(env.workdir, "data", "vm", engines.OverlayFile), env.image)
+
+	// Nothing is left behind
+	env.engine.FailOn("CreateVM", errors.New("injected"))
+	_, err = env.run("clone", "--stopvm", "vm", "copy")
+	assert.Assert(t, is.ErrorContains(err, "error when cloning the GoVM Instance vm: injected"))
+
+	_, err = os.Stat(filepath.Join(env.workdir, "data", "copy"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	entries, err := ioutil.ReadDir(filepath.Join(env.workdir, images.Dir))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Name(), "sha256")
+
+	entries, err = ioutil.ReadDir(filepath.Join(env.workdir, images.Dir, "sha256"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestCloneWorkdir(t *testing.T) {
+	env := newTestEnv(t)
+	other := t.TempDir()
+
+	composeFile := filepath.Join(env.workdir, "compose.yml")
+	content := fmt.Sprintf("vms:\n  - name: vm\n    image: %v\n    sshkey: %v\n    workdir: %v\n"+
+		"    disks:\n      - name: data\n        size: 1\n", env.image, env.key, other)
+	assert.NilError(t, ioutil.WriteFile(composeFile, []byte(content), 0644))
+
+	_, err := env.run("compose", "-f", composeFile)
+	assert.NilError(t, err)
+
+	// The data of the source VM is read from its own working directory
+	srcDir := filepath.Join(other, "data", "vm")
+	assert.NilError(t, os.MkdirAll(filepath.Join(srcDir, "disks"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(srcDir, "disks", "data.qcow2"), []byte("data"), 0644))
+	writeOverlay(t, filepath.Join(srcDir, engines.OverlayFile), env.image)
+
+	_, err = env.run("clone", "--stopvm", "vm", "linked")
+	assert.NilError(t, err)
+
+	stored, err := images.New(env.workdir).List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(stored), 1)
+	assert.Equal(t, stored[0].Backing, env.image)
+
+	data, err := ioutil.ReadFile(filepath.Join(env.workdir, "data", "linked", "disks", "data.qcow2"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "data")
+}
@@ -3,9 +3,7 @@ package cli
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 
-	"github.com/govm-project/govm/engines/docker"
 	"github.com/govm-project/govm/internal"
 	"github.com/govm-project/govm/vm"
 	log "github.com/sirupsen/logrus"
@@ -33,45 +31,79 @@ var composeCommand = cli.Command{
 				return
 			}
 		} else {
-			fmt.Println("Missing compose file")
-			os.Exit(1)
+			return usageError("missing compose file")
+		}
+
+		composeFile, err := ioutil.ReadFile(composeFilePath)
+		if err != nil {
+			return err
 		}
 
-		composeFile, _ := ioutil.ReadFile(composeFilePath)
 		err = yaml.Unmarshal(composeFile, &composeConfig)
 		if err != nil {
-			fmt.Printf("yaml file error: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("yaml file error: %w", err)
 		}
 
-		engine := docker.Engine{}
-		engine.Init()
-		for _, vm := range composeConfig.VMs {
-			if vm.Workdir == "" {
-				vm.Workdir = internal.GetDefaultWorkDir()
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+		for _, spec := range composeConfig.VMs {
+			if spec.Workdir == "" {
+				spec.Workdir = c.String("workdir")
+			}
+
+			if spec.Namespace == "" {
+				spec.Namespace = composeConfig.Namespace
+			}
+
+			if spec.Namespace == "" {
+				spec.Namespace = c.String("namespace")
+			}
+
+			alias, err := pullAlias(ctx, c, spec.ParentImage)
+			if err != nil {
+				return err
+			}
+
+			hints, err := storedHints(c, spec.ParentImage)
+			if err != nil {
+				return err
 			}
 
-			if vm.Namespace == "" {
-				defaultNamespace, err := internal.DefaultNamespace()
-				if err != nil {
-					log.Fatalf("get default namespace: %v", err)
-				}
-				vm.Namespace = defaultNamespace
+			if err := verifyImage(ctx, c, spec.ParentImage); err != nil {
+				return fmt.Errorf("error when verifying the image %v: %w", spec.ParentImage, err)
 			}
 
-			if err := vm.Check(); err != nil {
-				log.Fatalf("Error on VM Instance pre-check: %v", err)
+			sized := spec.Flavor != "" || spec.Size != (vm.Size{})
+
+			if alias != nil {
+				applyAlias(&spec, *alias, sized)
 			}
-			id, err := engine.Create(vm)
+
+			if hints != nil {
+				applyHints(&spec, *hints, sized)
+			}
+
+			if err := spec.Check(); err != nil {
+				return fmt.Errorf("error on VM Instance pre-check: %w", err)
+			}
+			id, err := engine.CreateVM(ctx, spec)
 			if err != nil {
-				log.Fatalf("Error when creating the new VM: %v", err)
+				return fmt.Errorf("error when creating the new VM: %w", err)
 			}
-			err = engine.Start(vm.Namespace, id)
+			recordVM(c, spec, id)
+
+			err = engine.StartVM(ctx, spec.Namespace, id)
 			if err != nil {
-				log.Fatalf("Error when starting the new VM: %v", err)
+				return fmt.Errorf("error when starting the new VM: %w", err)
 			}
+			recordStatus(c.String("workdir"), spec.Namespace, spec.Name, vm.StatusRunning)
 
-			log.Printf("GoVM Instance %v has been successfully created", vm.Name)
+			log.Printf("GoVM Instance %v has been successfully created", spec.Name)
 		}
 		return nil
 	},
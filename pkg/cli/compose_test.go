@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const composeTemplate = `---
+vms:
+  - name: vmOne
+    image: %[1]v
+    cloud: true
+    sshkey: %[2]v
+    flavor: micro
+  - name: vmTwo
+    namespace: other
+    image: %[1]v
+    sshkey: %[2]v
+    size:
+      cpu-model: qemu64
+      sockets: 1
+      cpus: 1
+      cores: 1
+      threads: 1
+      ram: 512
+      disk: 10
+    disks:
+      - name: data
+        size: 20
+        keep: true
+`
+
+func TestCompose(t *testing.T) {
+	env := newTestEnv(t)
+
+	composeFile := filepath.Join(env.workdir, "compose.yml")
+	content := fmt.Sprintf(composeTemplate, env.image, env.key)
+	assert.NilError(t, ioutil.WriteFile(composeFile, []byte(content), 0644))
+
+	_, err := env.run("compose", "-f", composeFile)
+	assert.NilError(t, err)
+
+	one, ok := env.engine.Get(testNamespace, "vmOne")
+	assert.Assert(t, ok)
+	assert.Assert(t, one.Running)
+	assert.Assert(t, one.Cloud)
+	assert.Equal(t, one.Workdir, env.workdir)
+	assert.Equal(t, one.Size.RAM, 512)
+
+	two, ok := env.engine.Get("other", "vmTwo")
+	assert.Assert(t, ok)
+	assert.Assert(t, two.Running)
+	assert.Equal(t, two.Size.DISK, 10)
+	assert.DeepEqual(t, two.Disks, []vm.Disk{{Name: "data", Size: 20, Format: "qcow2", Bus: "virtio", Keep: true}})
+}
+
+func TestComposeWorkdir(t *testing.T) {
+	env := newTestEnv(t)
+	other := t.TempDir()
+
+	composeFile := filepath.Join(env.workdir, "compose.yml")
+	content := fmt.Sprintf("vms:\n  - name: vm\n    image: %v\n    sshkey: %v\n    workdir: %v\n",
+		env.image, env.key, other)
+	assert.NilError(t, ioutil.WriteFile(composeFile, []byte(content), 0644))
+
+	_, err := env.run("compose", "-f", composeFile)
+	assert.NilError(t, err)
+
+	// The record is where the other commands look for it
+	rec, err := store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Workdir, other)
+	assert.Equal(t, rec.Spec.Status, vm.StatusRunning)
+
+	_, err = store.New(other).Get(testNamespace, "vm")
+	assert.Assert(t, errors.Is(err, store.ErrNotFound), "got %v", err)
+}
+
+func TestComposeErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("compose")
+	assert.Assert(t, is.ErrorContains(err, "missing compose file"))
+
+	composeFile := filepath.Join(env.workdir, "compose.yml")
+	assert.NilError(t, ioutil.WriteFile(composeFile, []byte("vms: [\n"), 0644))
+
+	_, err = env.run("compose", "-f", composeFile)
+	assert.Assert(t, is.ErrorContains(err, "yaml file error"))
+}
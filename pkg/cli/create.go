@@ -2,10 +2,8 @@ package cli
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
-	"github.com/govm-project/govm/engines/docker"
 	"github.com/govm-project/govm/internal"
 	"github.com/govm-project/govm/vm"
 
@@ -23,7 +21,7 @@ var createCommand = cli.Command{
 		&cli.StringFlag{
 			Name:  "image",
 			Value: "",
-			Usage: "Path to image",
+			Usage: "Path to image, name of a stored image or alias of the image catalog",
 		},
 		&cli.StringFlag{
 			Name:  "user-data",
@@ -98,80 +96,136 @@ var createCommand = cli.Command{
 			Name:  "container-env",
 			Usage: "Environment variable. e.g. --container-env http_proxy=$http_proxy",
 		},
+		&cli.StringSliceFlag{
+			Name:  "disk-attach",
+			Usage: "Attach a blank data disk. e.g. --disk-attach data:100G[:qcow2|raw][:virtio|scsi|ide]",
+		},
+		&cli.StringFlag{
+			Name:  "restart",
+			Usage: "Restart policy: no, always, unless-stopped or on-failure (default: always)",
+		},
 	},
-	Action: func(ctx *cli.Context) error {
-		if ctx.Bool("debug") {
+	Action: func(c *cli.Context) error {
+		if c.Bool("debug") {
 			log.SetLevel(log.DebugLevel)
 		}
 
-		if ctx.String("image") == "" {
-			fmt.Println("Missing --image argument")
-			os.Exit(1)
+		if c.String("image") == "" {
+			return usageError("missing --image argument")
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		alias, err := pullAlias(ctx, c, c.String("image"))
+		if err != nil {
+			return err
+		}
+
+		hints, err := storedHints(c, c.String("image"))
+		if err != nil {
+			return err
+		}
+
+		if err := verifyImage(ctx, c, c.String("image")); err != nil {
+			return fmt.Errorf("error when verifying the image %v: %w", c.String("image"), err)
 		}
 
 		// Check if any flavor is provided
 		var size vm.Size
-		if ctx.String("flavor") != "" {
-			size = vm.GetSizeFromFlavor(ctx.String("flavor"))
+		if c.String("flavor") != "" {
+			size = vm.GetSizeFromFlavor(c.String("flavor"))
 		} else {
 			size = vm.NewSize(
-				ctx.String("cpumodel"),
-				ctx.Int("sockets"),
-				ctx.Int("cpus"),
-				ctx.Int("cores"),
-				ctx.Int("threads"),
-				ctx.Int("ram"),
-				ctx.Int("disk"),
+				c.String("cpumodel"),
+				c.Int("sockets"),
+				c.Int("cpus"),
+				c.Int("cores"),
+				c.Int("threads"),
+				c.Int("ram"),
+				c.Int("disk"),
 			)
 		}
 
 		// Check if there are any shares and validate the format.
 		// They must be separated by the ":" characted as docker does
-		if len(ctx.StringSlice("share")) > 0 {
-			for _, dir := range ctx.StringSlice("share") {
+		if len(c.StringSlice("share")) > 0 {
+			for _, dir := range c.StringSlice("share") {
 				share := strings.Split(dir, ":")
 				if len(share) != 2 {
-					log.Fatal("Wrong share format: " + dir +
-						"\nUsage: --share /host/path:/guest/path")
-
+					return usageError(fmt.Sprintf("wrong share format: %v"+
+						"\nUsage: --share /host/path:/guest/path", dir))
 				}
 
 			}
 		}
 
-		workDir := ctx.String("workdir")
+		disks := []vm.Disk{}
+		for _, value := range c.StringSlice("disk-attach") {
+			disk, err := parseDisk(value)
+			if err != nil {
+				return err
+			}
+
+			disks = append(disks, disk)
+		}
+
+		workDir := c.String("workdir")
 		if workDir == "" {
-			workDir = internal.GetDefaultWorkDir()
+			var err error
+			if workDir, err = internal.GetDefaultWorkDir(); err != nil {
+				return err
+			}
 		}
 		newVM := vm.Instance{
-			Name:             ctx.String("name"),
-			Namespace:        ctx.String("namespace"),
-			ParentImage:      ctx.String("image"),
+			Name:             c.String("name"),
+			Namespace:        c.String("namespace"),
+			ParentImage:      c.String("image"),
 			Workdir:          workDir,
-			SSHPublicKeyFile: ctx.String("key"),
-			UserData:         ctx.String("user-data"),
+			SSHPublicKeyFile: c.String("key"),
+			UserData:         c.String("user-data"),
 			Size:             size,
-			Cloud:            ctx.Bool("cloud"),
-			Efi:              ctx.Bool("efi"),
+			Cloud:            c.Bool("cloud"),
+			Efi:              c.Bool("efi"),
 			NetOpts:          vm.NetworkingOptions{},
-			Shares:           ctx.StringSlice("share"),
-			ContainerEnvVars: ctx.StringSlice("container-env"),
+			Shares:           c.StringSlice("share"),
+			ContainerEnvVars: c.StringSlice("container-env"),
+			RestartPolicy:    c.String("restart"),
+			Disks:            disks,
+		}
+
+		sized := false
+		for _, flag := range []string{"flavor", "cpumodel", "sockets", "cpus", "cores", "threads", "ram", "disk"} {
+			sized = sized || c.IsSet(flag)
+		}
+
+		if alias != nil {
+			applyAlias(&newVM, *alias, sized)
+		}
+
+		if hints != nil {
+			applyHints(&newVM, *hints, sized)
 		}
 
 		if err := newVM.Check(); err != nil {
-			log.Fatalf("Error on VM Instance pre-check: %v", err)
+			return fmt.Errorf("error on VM Instance pre-check: %w", err)
 		}
 
-		engine := docker.Engine{}
-		engine.Init()
-		id, err := engine.Create(newVM)
+		engine, err := newEngine(c)
 		if err != nil {
-			log.Fatalf("Error when creating the new VM: %v", err)
+			return err
 		}
-		err = engine.Start(newVM.Namespace, id)
+		id, err := engine.CreateVM(ctx, newVM)
+		if err != nil {
+			return fmt.Errorf("error when creating the new VM: %w", err)
+		}
+		recordVM(c, newVM, id)
+
+		err = engine.StartVM(ctx, newVM.Namespace, id)
 		if err != nil {
-			log.Fatalf("Error when starting the new VM: %v", err)
+			return fmt.Errorf("error when starting the new VM: %w", err)
 		}
+		recordStatus(c.String("workdir"), newVM.Namespace, newVM.Name, vm.StatusRunning)
 
 		log.Printf("GoVM Instance %v has been successfully created", newVM.Name)
 
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCreate(t *testing.T) {
+	env := newTestEnv(t)
+	share := t.TempDir()
+
+	_, err := env.run("create",
+		"--image", env.image,
+		"--key", env.key,
+		"--name", "vm",
+		"--cpumodel", "qemu64",
+		"--ram", "2048",
+		"--disk", "20",
+		"--share", share+":/mnt/share",
+		"--container-env", "http_proxy=http://proxy:3128",
+		"--cloud",
+	)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, env.engine.Calls(), []string{"CreateVM", "StartVM"})
+
+	ins, ok := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ok)
+	assert.Assert(t, ins.Running)
+	assert.Equal(t, ins.ParentImage, env.image)
+	assert.Equal(t, ins.Workdir, env.workdir)
+	assert.Assert(t, ins.Cloud)
+	assert.DeepEqual(t, ins.Size, vm.NewSize("qemu64", 1, 1, 2, 2, 2048, 20))
+	assert.DeepEqual(t, ins.Shares, []string{share + ":/mnt/share"})
+	assert.DeepEqual(t, ins.ContainerEnvVars, []string{"http_proxy=http://proxy:3128"})
+	assert.Equal(t, ins.SSHPublicKeyFile, "ssh-rsa AAAA test")
+}
+
+func TestCreateFlavor(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key,
+		"--name", "vm", "--flavor", "small")
+	assert.NilError(t, err)
+
+	ins, ok := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, ins.Size, vm.GetSizeFromFlavor("small"))
+}
+
+func TestCreateDisks(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm",
+		"--disk-attach", "data:100G",
+		"--disk-attach", "logs:512M:raw:scsi")
+	assert.NilError(t, err)
+
+	ins, ok := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, ins.Disks, []vm.Disk{
+		{Name: "data", Size: 100, Format: "qcow2", Bus: "virtio"},
+		{Name: "logs", Size: 1, Format: "raw", Bus: "scsi"},
+	})
+
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "vm2",
+		"--disk-attach", "data")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "vm2",
+		"--disk-attach", "data:10G:vmdk")
+	assert.Equal(t, ExitCode(err), ExitInvalidSpec)
+}
+
+func TestCreateErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--key", env.key)
+	assert.Assert(t, is.ErrorContains(err, "missing --image argument"))
+
+	_, err = env.run("create", "--image", env.image, "--key", env.key,
+		"--share", "/only/host/path")
+	assert.Assert(t, is.ErrorContains(err, "wrong share format"))
+
+	_, err = env.run("create", "--image", env.workdir+"/missing.img", "--key", env.key)
+	assert.Assert(t, is.ErrorContains(err, "pre-check"))
+
+	env.engine.FailOn("CreateVM", errors.New("injected create failure"))
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.Assert(t, is.ErrorContains(err, "injected create failure"))
+
+	env.engine.FailOn("CreateVM", nil)
+	env.engine.FailOn("StartVM", errors.New("injected start failure"))
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.Assert(t, is.ErrorContains(err, "injected start failure"))
+
+	ins, ok := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ok)
+	assert.Assert(t, !ins.Running)
+}
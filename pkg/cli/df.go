@@ -0,0 +1,442 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/engines/qemu"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"github.com/intel/tfortools"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// dfTemplate is the default output of govm df
+const dfTemplate = `IMAGES
+{{table .Images}}
+VMS
+{{table .VMs}}
+{{- if .Saves}}
+SAVES
+{{table .Saves}}
+{{- end}}
+{{- if .Orphans}}
+ORPHANED DATA
+{{table .Orphans}}
+{{- end}}
+TOTAL {{.Total}}, RECLAIMABLE {{.Reclaimable}} (govm image prune)
+`
+
+// nolint: gochecknoglobals
+var dfCommand = cli.Command{
+	Name:  "df",
+	Usage: "Show the disk usage of the images and VMs of the working directory",
+	Description: "Sizes are the space taken on the host: sparse overlays only count the blocks\n" +
+		"their VM wrote. Images backing no VM and the data left by VMs removed outside of\n" +
+		"govm are reclaimable with govm image prune.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "string containing the template code to execute",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		scan, err := scanWorkdir(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		format := c.String("format")
+		if format == "" {
+			format = dfTemplate
+		}
+
+		return tfortools.OutputToTemplate(c.App.Writer, "format", format, scan.report(), nil)
+	},
+}
+
+// vmFiles mark the data directory of a VM even when no engine listed it, e.g.
+// of another engine without record: its record and the QEMU engine state
+// nolint: gochecknoglobals
+var vmFiles = []string{store.SpecFile, qemu.StateFile}
+
+// workdirScan holds the images and VM data of a working directory, and the
+// VMs their engines know about
+type workdirScan struct {
+	workdir string
+	images  []images.Image
+	// records are the VM records by name, as their data directories
+	records map[string]*store.Record
+	// vms are the VMs of every namespace and engine in use
+	vms []vm.Instance
+	// dataDirs are the directory names of <workdir>/data
+	dataDirs []string
+}
+
+// scanWorkdir lists the images, the VM data directories and the VMs of the
+// engines recorded for them, the current one included. An engine failing to
+// list its VMs fails the scan, so their data is never taken as orphaned.
+func scanWorkdir(ctx context.Context, c *cli.Context) (*workdirScan, error) {
+	scan := &workdirScan{workdir: c.String("workdir"), records: map[string]*store.Record{}}
+
+	var err error
+	if scan.images, err = images.New(scan.workdir).List(); err != nil {
+		return nil, err
+	}
+
+	records, err := store.New(scan.workdir).List()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{c.String("engine"): true}
+	for _, rec := range records {
+		scan.records[rec.Spec.Name] = rec
+		if rec.Engine != "" {
+			names[rec.Engine] = true
+		}
+	}
+
+	for name := range names {
+		engine, err := engines.New(name, engines.Options{Workdir: scan.workdir})
+		if err != nil {
+			return nil, err
+		}
+
+		instances, err := engine.ListVM(ctx, "", true)
+		if err != nil {
+			return nil, fmt.Errorf("error when listing the GoVM Instances of the %v engine: %w", name, err)
+		}
+
+		scan.vms = append(scan.vms, instances...)
+	}
+
+	sort.Slice(scan.vms, func(i, j int) bool {
+		if scan.vms[i].Namespace != scan.vms[j].Namespace {
+			return scan.vms[i].Namespace < scan.vms[j].Namespace
+		}
+
+		return scan.vms[i].Name < scan.vms[j].Name
+	})
+
+	dirs, err := ioutil.ReadDir(filepath.Join(scan.workdir, "data"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			scan.dataDirs = append(scan.dataDirs, dir.Name())
+		}
+	}
+
+	return scan, nil
+}
+
+// dataDir returns the data directory of a VM
+func (s *workdirScan) dataDir(name string) string {
+	return filepath.Join(s.workdir, "data", name)
+}
+
+// parentImage returns the parent image of a VM, as recorded on create
+func (s *workdirScan) parentImage(ins vm.Instance) string {
+	if rec, ok := s.records[ins.Name]; ok && rec.Spec.ParentImage != "" {
+		return rec.Spec.ParentImage
+	}
+
+	return ins.ParentImage
+}
+
+// users returns the VMs, as namespace/name, by parent image and by the
+// backing files it is an overlay of, e.g. for linked clones. The VMs of
+// unlisted data directories are named by directory.
+func (s *workdirScan) users() map[string][]string {
+	users := map[string][]string{}
+
+	for _, ins := range s.vms {
+		image := s.parentImage(ins)
+		chain, _ := internal.ImageBackingChain(image)
+
+		for _, file := range append([]string{image}, chain...) {
+			users[file] = append(users[file], ins.Namespace+"/"+ins.Name)
+		}
+	}
+
+	for _, dir := range s.unlisted() {
+		chain, _ := internal.ImageBackingChain(filepath.Join(s.dataDir(dir), engines.OverlayFile))
+
+		for _, file := range chain {
+			users[file] = append(users[file], dir)
+		}
+	}
+
+	return users
+}
+
+// orphans returns the data directories whose VM no longer exists
+func (s *workdirScan) orphans() []string {
+	orphans, _ := s.splitDataDirs()
+	return orphans
+}
+
+// unlisted returns the data directories of VMs no scanned engine listed but
+// whose record or engine state is left. They are never taken as orphaned.
+func (s *workdirScan) unlisted() []string {
+	_, unlisted := s.splitDataDirs()
+	return unlisted
+}
+
+// splitDataDirs sorts the data directories of the VMs no engine listed into
+// orphaned and unlisted ones
+func (s *workdirScan) splitDataDirs() (orphans, unlisted []string) {
+	live := map[string]bool{}
+	for _, ins := range s.vms {
+		live[ins.Name] = true
+	}
+
+	orphans, unlisted = []string{}, []string{}
+
+	for _, dir := range s.dataDirs {
+		switch {
+		case live[dir]:
+		case s.hasVMFile(dir):
+			unlisted = append(unlisted, dir)
+		default:
+			orphans = append(orphans, dir)
+		}
+	}
+
+	return orphans, unlisted
+}
+
+// hasVMFile reports whether a data directory holds a file marking a VM
+func (s *workdirScan) hasVMFile(dir string) bool {
+	for _, file := range vmFiles {
+		if _, err := os.Stat(filepath.Join(s.dataDir(dir), file)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneData removes the data directory of a removed VM, but its data disks
+// unless disks is set
+func pruneData(dir string, disks bool) error {
+	if disks {
+		return os.RemoveAll(dir)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Name() == vm.DisksDir {
+			log.Infof("Kept the data disks of %v", filepath.Join(dir, vm.DisksDir))
+
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unused returns the stored images backing no VM, overlays before the
+// images they are backed by
+func (s *workdirScan) unused() []images.Image {
+	users := s.users()
+	unused := []images.Image{}
+	depth := map[string]int{}
+
+	for _, img := range s.images {
+		if len(users[img.Path]) == 0 {
+			chain, _ := internal.ImageBackingChain(img.Path)
+			depth[img.Name] = len(chain)
+			unused = append(unused, img)
+		}
+	}
+
+	sort.SliceStable(unused, func(i, j int) bool {
+		return depth[unused[i].Name] > depth[unused[j].Name]
+	})
+
+	return unused
+}
+
+// dfImage is a row of the images of govm df
+type dfImage struct {
+	Name        string
+	Size        string
+	VirtualSize string
+	UsedBy      string
+}
+
+// dfVM is a row of the VMs of govm df
+type dfVM struct {
+	Namespace   string
+	Name        string
+	Image       string
+	Overlay     string
+	VirtualSize string
+	Disks       string
+	Snapshots   int
+	Checkpoints string
+	Total       string
+}
+
+// dfSave is a row of the save outputs of govm df
+type dfSave struct {
+	VM   string
+	File string
+	Size string
+}
+
+// dfOrphan is a row of the orphaned data directories of govm df
+type dfOrphan struct {
+	Name  string
+	Size  string
+	Disks string
+}
+
+// dfReport is the output of govm df
+type dfReport struct {
+	Images      []dfImage
+	VMs         []dfVM
+	Saves       []dfSave
+	Orphans     []dfOrphan
+	Total       string
+	Reclaimable string
+}
+
+// report sums up the disk usage of the scanned working directory
+// nolint: funlen
+func (s *workdirScan) report() dfReport {
+	report := dfReport{Images: []dfImage{}, VMs: []dfVM{}, Saves: []dfSave{}, Orphans: []dfOrphan{}}
+	users := s.users()
+	names := map[string]string{}
+	blobs := map[string]bool{}
+	total, reclaimable := int64(0), int64(0)
+
+	for _, img := range s.images {
+		if _, ok := names[img.Path]; !ok {
+			names[img.Path] = img.Name
+		}
+
+		size := internal.DiskUsage(img.Path)
+
+		// Names sharing a file only count once
+		if !blobs[img.Path] {
+			blobs[img.Path] = true
+			total += size
+
+			if len(users[img.Path]) == 0 {
+				reclaimable += size
+			}
+		}
+
+		report.Images = append(report.Images, dfImage{img.Name, formatSize(size), formatSize(img.VirtualSize),
+			usedBy(users[img.Path])})
+	}
+
+	// Parent images out of the store are listed along
+	files := []string{}
+	for image := range users {
+		if _, ok := names[image]; !ok && image != "" {
+			files = append(files, image)
+		}
+	}
+
+	sort.Strings(files)
+
+	for _, file := range files {
+		virtual, size, err := internal.ImageSize(file)
+		if err != nil {
+			continue
+		}
+
+		report.Images = append(report.Images, dfImage{file, formatSize(size), formatSize(virtual),
+			usedBy(users[file])})
+	}
+
+	for _, ins := range s.vms {
+		dir := s.dataDir(ins.Name)
+		overlay := filepath.Join(dir, engines.OverlayFile)
+
+		virtual, _, _ := internal.ImageSize(overlay)
+		snapshots, _ := internal.ImageSnapshots(overlay)
+		size := internal.DiskUsage(dir)
+		total += size
+
+		image := s.parentImage(ins)
+		if name, ok := names[image]; ok {
+			image = name
+		}
+
+		report.VMs = append(report.VMs, dfVM{
+			Namespace:   ins.Namespace,
+			Name:        ins.Name,
+			Image:       image,
+			Overlay:     formatSize(internal.DiskUsage(overlay)),
+			VirtualSize: formatSize(virtual),
+			Disks:       formatSize(internal.DiskUsage(filepath.Join(dir, vm.DisksDir))),
+			Snapshots:   len(snapshots),
+			Checkpoints: formatSize(internal.DiskUsage(filepath.Join(dir, engines.CheckpointsDir))),
+			Total:       formatSize(size),
+		})
+
+		if rec, ok := s.records[ins.Name]; ok {
+			for _, file := range rec.Saves {
+				if _, err := os.Stat(file); err != nil {
+					continue
+				}
+
+				size := internal.DiskUsage(file)
+				total += size
+
+				report.Saves = append(report.Saves, dfSave{ins.Namespace + "/" + ins.Name, file, formatSize(size)})
+			}
+		}
+	}
+
+	// The data disks of removed VMs are kept on purpose, see prune --disks
+	for _, name := range s.orphans() {
+		dir := s.dataDir(name)
+		size, disks := internal.DiskUsage(dir), internal.DiskUsage(filepath.Join(dir, vm.DisksDir))
+		total += size
+		reclaimable += size - disks
+
+		report.Orphans = append(report.Orphans, dfOrphan{name, formatSize(size), formatSize(disks)})
+	}
+
+	report.Total, report.Reclaimable = formatSize(total), formatSize(reclaimable)
+
+	return report
+}
+
+// usedBy joins the VMs using an image, - for none
+func usedBy(vms []string) string {
+	if len(vms) == 0 {
+		return "-"
+	}
+
+	return strings.Join(vms, ",")
+}
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/engines/qemu"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// dfEnv has the VM vm of the stored image base, the unused image unused
+// of another content, and the data of the removed VM gone, with a kept data disk
+func dfEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t)
+
+	other := filepath.Join(t.TempDir(), "other.qcow2")
+	assert.NilError(t, ioutil.WriteFile(other, []byte("other"), 0644))
+
+	_, err := env.run("image", "add", "--name", "base", env.image)
+	assert.NilError(t, err)
+
+	_, err = env.run("image", "add", "--name", "unused", other)
+	assert.NilError(t, err)
+
+	_, err = env.run("create", "--image", "base", "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+
+	disks := filepath.Join(env.workdir, "data", "gone", vm.DisksDir)
+	assert.NilError(t, os.MkdirAll(disks, 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(disks, "data.qcow2"), []byte("disk"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(disks, "..", "cow_image.qcow2"), []byte("overlay"), 0644))
+
+	return env
+}
+
+func TestDf(t *testing.T) {
+	env := dfEnv(t)
+
+	save := filepath.Join(t.TempDir(), "vm.qcow2")
+	assert.NilError(t, ioutil.WriteFile(save, []byte("saved"), 0644))
+
+	_, err := env.run("save", "--out", save, "vm")
+	assert.NilError(t, err)
+
+	out, err := env.run("df", "--format",
+		"{{range .Images}}{{.Name}} {{.UsedBy}}\n{{end}}"+
+			"{{range .VMs}}{{.Namespace}}/{{.Name}} {{.Image}}\n{{end}}"+
+			"{{range .Saves}}{{.VM}} {{.File}}\n{{end}}"+
+			"{{range .Orphans}}{{.Name}}\n{{end}}")
+	assert.NilError(t, err)
+	assert.Equal(t, out, "base tester/vm\nunused -\ntester/vm base\ntester/vm "+save+"\ngone\n")
+
+	out, err = env.run("df")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "ORPHANED DATA"))
+	assert.Check(t, is.Contains(out, "RECLAIMABLE"))
+
+	env.engine.FailOn("ListVM", errors.New("engine down"))
+
+	_, err = env.run("df")
+	assert.Assert(t, is.ErrorContains(err, "error when listing the GoVM Instances of the fake engine: engine down"))
+}
+
+func TestImagePrune(t *testing.T) {
+	env := dfEnv(t)
+	gone := filepath.Join(env.workdir, "data", "gone")
+
+	// Nothing goes away on dry runs, nor when the VMs can't be listed
+	_, err := env.run("image", "prune", "--dry-run")
+	assert.NilError(t, err)
+
+	env.engine.FailOn("ListVM", errors.New("engine down"))
+
+	_, err = env.run("image", "prune")
+	assert.Assert(t, is.ErrorContains(err, "engine down"))
+
+	env.engine.FailOn("ListVM", nil)
+
+	out, err := env.run("image", "ls", "--format", "{{range .}}{{.Name}} {{end}}")
+	assert.NilError(t, err)
+	assert.Equal(t, out, "base unused ")
+
+	_, err = env.run("image", "prune")
+	assert.NilError(t, err)
+
+	out, err = env.run("image", "ls", "--format", "{{range .}}{{.Name}} {{end}}")
+	assert.NilError(t, err)
+	assert.Equal(t, out, "base ")
+
+	// The data disks of the removed VM are kept
+	files := []string{}
+	assert.NilError(t, filepath.Walk(gone, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, strings.TrimPrefix(path, gone+"/"))
+		}
+
+		return err
+	}))
+	assert.DeepEqual(t, files, []string{"disks/data.qcow2"})
+
+	_, err = env.run("image", "prune", "--disks")
+	assert.NilError(t, err)
+
+	_, err = os.Stat(gone)
+	assert.Assert(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(env.workdir, "data", "vm"))
+	assert.NilError(t, err)
+}
+
+func TestImagePruneUnlisted(t *testing.T) {
+	env := dfEnv(t)
+
+	unused, err := images.New(env.workdir).Get("unused")
+	assert.NilError(t, err)
+
+	// The data of VMs no engine listed, e.g. of another engine without
+	// record, is kept along with their images
+	unlisted := filepath.Join(env.workdir, "data", "unlisted")
+	assert.NilError(t, os.MkdirAll(unlisted, 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(unlisted, qemu.StateFile), []byte("{}"), 0644))
+	writeOverlay(t, filepath.Join(unlisted, engines.OverlayFile), unused.Path)
+
+	out, err := env.run("df", "--format", "{{range .Orphans}}{{.Name}}\n{{end}}")
+	assert.NilError(t, err)
+	assert.Equal(t, out, "gone\n")
+
+	_, err = env.run("image", "prune", "--disks")
+	assert.NilError(t, err)
+
+	_, err = os.Stat(filepath.Join(unlisted, engines.OverlayFile))
+	assert.NilError(t, err)
+
+	out, err = env.run("image", "ls", "--format", "{{range .}}{{.Name}} {{end}}")
+	assert.NilError(t, err)
+	assert.Equal(t, out, "base unused ")
+}
@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/vm"
+	"github.com/intel/tfortools"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var diskCommand = cli.Command{
+	Name:  "disk",
+	Usage: "Manage the disks of a GoVM Instance",
+	Subcommands: []*cli.Command{
+		&diskResizeCommand,
+	},
+}
+
+// nolint: gochecknoglobals
+var diskResizeCommand = cli.Command{
+	Name:      "resize",
+	Usage:     "Grow the root disk of a GoVM Instance",
+	ArgsUsage: "[name]",
+	Description: "The disk of a running VM is resized live. Its partitions are grown with\n" +
+		"--growpart over ssh, stopped cloud VMs grow them on their next boot.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "size",
+			Usage: "new disk size, e.g. 200G or 512M (GB when no unit is given)",
+		},
+		&cli.BoolFlag{
+			Name:  "growpart",
+			Usage: "grow the guest root partition and filesystem",
+		},
+		&cli.StringFlag{
+			Name:    "user",
+			Aliases: []string{"u"},
+			Usage:   "ssh login user for --growpart",
+		},
+		&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "ssh private key file for --growpart",
+			Value:   "~/.ssh/id_rsa",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm disk resize [command options] [name]")
+		}
+
+		if !c.IsSet("size") {
+			return usageError("--size argument required")
+		}
+
+		size, err := parseSize(c.String("size"))
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("growpart") && c.String("user") == "" {
+			return usageError("--growpart requires --user")
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		resize, err := engine.ResizeDisk(ctx, namespace, name, engines.ResizeOptions{
+			Size:     size,
+			GrowPart: c.Bool("growpart"),
+			User:     c.String("user"),
+			Key:      c.String("key"),
+		})
+		if err != nil {
+			return fmt.Errorf("error when resizing the disk of the GoVM Instance %v: %w", name, err)
+		}
+		recordDiskSize(c.String("workdir"), namespace, name, vm.DiskSizeGB(size))
+
+		type outSize struct {
+			Disk    string
+			Virtual string
+			Actual  string
+		}
+
+		sizes := []outSize{
+			{"before", formatSize(resize.Before.Virtual), formatSize(resize.Before.Actual)},
+			{"after", formatSize(resize.After.Virtual), formatSize(resize.After.Actual)},
+		}
+
+		if err := tfortools.OutputToTemplate(c.App.Writer, "format", "{{table .}}", sizes, nil); err != nil {
+			return err
+		}
+
+		log.Printf("The disk of GoVM Instance %v has been successfully resized", name)
+
+		return nil
+	},
+}
+
+// parseDisk parses a --disk-attach value, name:size[:format][:bus]. Sizes
+// are rounded up to GB.
+func parseDisk(value string) (vm.Disk, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) < 2 || len(fields) > 4 {
+		return vm.Disk{}, usageError(fmt.Sprintf("wrong disk format: %v"+
+			"\nUsage: --disk-attach name:size[:format][:bus]", value))
+	}
+
+	size, err := parseSize(fields[1])
+	if err != nil {
+		return vm.Disk{}, err
+	}
+
+	disk := vm.Disk{Name: fields[0], Size: vm.DiskSizeGB(size)}
+
+	if len(fields) > 2 {
+		disk.Format = fields[2]
+	}
+
+	if len(fields) > 3 {
+		disk.Bus = fields[3]
+	}
+
+	return disk, nil
+}
+
+// sizeUnits are the binary size suffixes accepted by parseSize
+// nolint: gochecknoglobals
+var sizeUnits = []string{"", "K", "M", "G", "T"}
+
+// parseSize parses a size such as 200G, 512MiB or 1T into bytes. Sizes
+// without unit are in GB, like the --disk create flag.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B"), "I")
+
+	shift := 30
+	for i, unit := range sizeUnits {
+		if unit != "" && strings.HasSuffix(s, unit) {
+			s = strings.TrimSuffix(s, unit)
+			shift = 10 * i
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, usageError(fmt.Sprintf("invalid size %q, use e.g. 200G", size))
+	}
+
+	return n << shift, nil
+}
+
+// formatSize returns a human readable binary size, e.g. 1.5G
+func formatSize(bytes int64) string {
+	i := 0
+	value := float64(bytes)
+
+	for value >= 1024 && i < len(sizeUnits)-1 {
+		value /= 1024
+		i++
+	}
+
+	if value == float64(int64(value)) {
+		return fmt.Sprintf("%d%v", int64(value), sizeUnits[i])
+	}
+
+	return fmt.Sprintf("%.1f%v", value, sizeUnits[i])
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDiskResize(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm", "--disk", "50")
+	assert.NilError(t, err)
+
+	out, err := env.run("disk", "resize", "--size", "200G", "vm")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "before  50G     50G"))
+	assert.Check(t, is.Contains(out, "after   200G    200G"))
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Equal(t, ins.Size.DISK, 200)
+
+	rec, err := store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Size.DISK, 200)
+
+	// Disks never shrink
+	_, err = env.run("disk", "resize", "--size", "100", "vm")
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+	assert.Equal(t, ExitCode(err), ExitInvalidSpec)
+}
+
+func TestDiskResizeErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--size", "200G"}, "missing GoVM Instance name"},
+		{[]string{"vm"}, "--size argument required"},
+		{[]string{"--size", "huge", "vm"}, `invalid size "huge"`},
+		{[]string{"--size", "-5G", "vm"}, `invalid size "-5G"`},
+		{[]string{"--size", "200G", "--growpart", "vm"}, "--growpart requires --user"},
+	}
+
+	for _, tc := range tests {
+		_, err := env.run(append([]string{"disk", "resize"}, tc.args...)...)
+		assert.Check(t, is.ErrorContains(err, tc.err), tc.args)
+		assert.Check(t, ExitCode(err) == ExitUsage, tc.args)
+	}
+
+	_, err := env.run("disk", "resize", "--size", "200G", "missing")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		bytes int64
+	}{
+		{"200G", 200 << 30},
+		{"200", 200 << 30},
+		{"512M", 512 << 20},
+		{"512MiB", 512 << 20},
+		{"1t", 1 << 40},
+		{"64KB", 64 << 10},
+	}
+
+	for _, tc := range tests {
+		bytes, err := parseSize(tc.size)
+		assert.NilError(t, err, tc.size)
+		assert.Equal(t, bytes, tc.bytes, tc.size)
+	}
+
+	assert.Equal(t, formatSize(200<<30), "200G")
+	assert.Equal(t, formatSize(1536<<20), "1.5G")
+	assert.Equal(t, formatSize(4096), "4K")
+	assert.Equal(t, formatSize(100), "100")
+}
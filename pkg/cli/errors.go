@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"context"
+	"errors"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+)
+
+// Exit codes returned by govm, see ExitCode
+const (
+	ExitOK                = 0
+	ExitFailure           = 1
+	ExitUsage             = 2
+	ExitInvalidSpec       = 3
+	ExitVMNotFound        = 4
+	ExitVMExists          = 5
+	ExitEngineUnavailable = 6
+	ExitUntrustedImage    = 7
+	ExitTimeout           = 124
+	ExitInterrupted       = 130
+)
+
+// usageError is returned when a command is called with wrong arguments
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// ExitCode returns the process exit code matching the error returned by the
+// application, so scripts can tell failures apart without parsing messages
+func ExitCode(err error) int {
+	var usage usageError
+
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.Is(err, vm.ErrInvalidSpec):
+		return ExitInvalidSpec
+	case errors.Is(err, engines.ErrVMNotFound), errors.Is(err, images.ErrNotFound):
+		return ExitVMNotFound
+	case errors.Is(err, engines.ErrVMExists), errors.Is(err, images.ErrExists):
+		return ExitVMExists
+	case errors.Is(err, engines.ErrEngineUnavailable):
+		return ExitEngineUnavailable
+	case errors.Is(err, images.ErrUnsigned), errors.Is(err, images.ErrSignature):
+		return ExitUntrustedImage
+	case errors.Is(err, context.DeadlineExceeded):
+		return ExitTimeout
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	}
+
+	return ExitFailure
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	wrap := func(err error) error {
+		return fmt.Errorf("error when starting the GoVM Instance vm: %w", err)
+	}
+
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, ExitOK},
+		{errors.New("boom"), ExitFailure},
+		{usageError("missing GoVM Instance name"), ExitUsage},
+		{wrap(&vm.SpecError{Field: "image", Err: errors.New("missing")}), ExitInvalidSpec},
+		{wrap(engines.ErrVMNotFound), ExitVMNotFound},
+		{wrap(engines.ErrVMExists), ExitVMExists},
+		{wrap(images.ErrNotFound), ExitVMNotFound},
+		{wrap(images.ErrExists), ExitVMExists},
+		{wrap(engines.ErrEngineUnavailable), ExitEngineUnavailable},
+		{wrap(context.DeadlineExceeded), ExitTimeout},
+		{wrap(context.Canceled), ExitInterrupted},
+	}
+
+	for _, tc := range tests {
+		assert.Check(t, ExitCode(tc.err) == tc.code, "%v: got %d, want %d", tc.err, ExitCode(tc.err), tc.code)
+	}
+}
+
+func TestCommandExitCodes(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"start"}, ExitUsage},
+		{[]string{"start", "unknown"}, ExitVMNotFound},
+		{[]string{"create", "--image", "/nonexistent.img"}, ExitInvalidSpec},
+		{[]string{"create", "--image", env.image, "--key", env.key, "--name", "vm"}, ExitVMExists},
+		{[]string{"--engine", "missing", "list"}, ExitEngineUnavailable},
+	}
+
+	for _, tc := range tests {
+		_, err := env.run(tc.args...)
+		assert.Check(t, ExitCode(err) == tc.code, "%v: %v: got %d, want %d", tc.args, err, ExitCode(err), tc.code)
+	}
+}
@@ -0,0 +1,506 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/internal/bundle"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// Members of the bundles written by govm export, next to the disks
+const (
+	bundleSpec     = "spec.json"
+	bundleImage    = "image"
+	bundleOverlay  = "overlay.qcow2"
+	bundleUserData = "user_data"
+	bundleSSHKey   = "sshkey.pub"
+)
+
+// nolint: gochecknoglobals
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "Export a GoVM Instance into a portable bundle",
+	ArgsUsage: "[name]",
+	Description: "The bundle holds the disks, the spec and the cloud-init files of the VM along\n" +
+		"with their checksums. It is zstd or gzip compressed after its .zst or .gz\n" +
+		"extension. The disks are flattened into a single image unless --overlay is set.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "out",
+			Aliases: []string{"o"},
+			Usage:   "bundle file (default: <name>.tar.zst)",
+		},
+		&cli.BoolFlag{
+			Name:  "overlay",
+			Usage: "keep the parent image and the VM overlay apart instead of flattening them",
+		},
+		&cli.BoolFlag{
+			Name:  "stopvm",
+			Usage: "stop a running VM during the export",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm export [command options] [name]")
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		out := c.String("out")
+		if out == "" {
+			out = name + ".tar.zst"
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		ins, err := engine.InspectVM(ctx, namespace, name)
+		if err != nil {
+			return fmt.Errorf("error when exporting the GoVM Instance %v: %w", name, err)
+		}
+
+		spec := withRecord(c.String("workdir"), ins)
+
+		restart, err := stopForCopy(ctx, c, engine, spec)
+		if err != nil {
+			return err
+		}
+		defer restart()
+
+		manifest := bundle.Manifest{
+			Name:      spec.Name,
+			Namespace: namespace,
+			Engine:    c.String("engine"),
+			Created:   time.Now().UTC(),
+		}
+
+		err = exportBundle(ctx, engine, c.String("workdir"), spec, out, manifest, c.Bool("overlay"))
+		if err != nil {
+			return fmt.Errorf("error when exporting the GoVM Instance %v: %w", name, err)
+		}
+
+		log.Printf("GoVM Instance %v has been successfully exported to %v", name, out)
+
+		return nil
+	},
+}
+
+// stopForCopy stops a running or paused VM whose disks are about to be
+// copied, if --stopvm allows it. The returned function starts it again.
+func stopForCopy(ctx context.Context, c *cli.Context, engine engines.VMEngine, ins vm.Instance) (func(), error) {
+	if ins.Status != vm.StatusRunning && ins.Status != vm.StatusPaused {
+		return func() {}, nil
+	}
+
+	if !c.Bool("stopvm") {
+		return nil, fmt.Errorf("the GoVM Instance %v is %v, stop it first or use --stopvm", ins.Name, ins.Status)
+	}
+
+	if err := engine.StopVM(ctx, ins.Namespace, ins.Name, engines.StopOptions{}); err != nil {
+		return nil, fmt.Errorf("error when stopping the GoVM Instance %v: %w", ins.Name, err)
+	}
+
+	return func() {
+		// Restart even if ctx has been cancelled meanwhile
+		if err := engine.StartVM(context.Background(), ins.Namespace, ins.Name); err != nil {
+			log.Errorf("Couldn't start the GoVM Instance %v again: %v", ins.Name, err)
+			return
+		}
+
+		recordStatus(c.String("workdir"), ins.Namespace, ins.Name, vm.StatusRunning)
+	}, nil
+}
+
+// exportBundle writes the disks, cloud-init files and spec of a stopped VM
+// into a bundle
+// nolint: funlen
+func exportBundle(ctx context.Context, engine engines.VMEngine, workdir string, spec vm.Instance,
+	out string, manifest bundle.Manifest, overlay bool) error {
+	out, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+
+	w, err := bundle.Create(ctx, out)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+
+	dataDir := filepath.Join(workdir, "data", spec.Name)
+	manifest.Spec = bundleSpec
+
+	if overlay {
+		image, err := standaloneImage(ctx, spec.ParentImage, filepath.Dir(out))
+		if err != nil {
+			return err
+		}
+
+		if image != spec.ParentImage {
+			defer os.Remove(image) // nolint: errcheck
+		}
+
+		manifest.Image = bundleImage + filepath.Ext(image)
+		if err := w.Add(manifest.Image, image); err != nil {
+			return err
+		}
+
+		// VMs running a raw parent image directly have no overlay
+		disk := filepath.Join(dataDir, engines.OverlayFile)
+		if _, err := os.Stat(disk); err == nil {
+			manifest.Overlay = bundleOverlay
+			if err := w.Add(manifest.Overlay, disk); err != nil {
+				return err
+			}
+		}
+	} else {
+		tmp, err := ioutil.TempDir(filepath.Dir(out), ".govm-export-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		manifest.Image = bundleImage + "." + engines.FormatQcow2
+		image := filepath.Join(tmp, manifest.Image)
+
+		err = engine.SaveVM(ctx, spec.Namespace, spec.Name, engines.SaveOptions{Output: image})
+		if err != nil {
+			return err
+		}
+
+		if err := w.Add(manifest.Image, image); err != nil {
+			return err
+		}
+	}
+
+	for _, disk := range spec.Disks {
+		file := filepath.Join(dataDir, disk.File())
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := w.Add(filepath.ToSlash(disk.File()), file); err != nil {
+			return err
+		}
+	}
+
+	// The spec refers to the bundle members instead of host files
+	if spec.UserData != "" {
+		data, err := ioutil.ReadFile(spec.UserData)
+		if err != nil {
+			return err
+		}
+
+		if err := w.AddData(bundleUserData, data); err != nil {
+			return err
+		}
+
+		spec.UserData = bundleUserData
+	}
+
+	// The recorded spec holds the key itself, older ones its file
+	if key := spec.SSHPublicKeyFile; key != "" {
+		if data, err := ioutil.ReadFile(key); err == nil {
+			key = string(data)
+		}
+
+		if err := w.AddData(bundleSSHKey, []byte(key)); err != nil {
+			return err
+		}
+
+		spec.SSHPublicKeyFile = bundleSSHKey
+	}
+
+	spec.ID, spec.Workdir, spec.ParentImage = "", "", manifest.Image
+	spec.Status, spec.Created, spec.Labels, spec.VNCPort = "", time.Time{}, nil, 0
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := w.AddData(manifest.Spec, data); err != nil {
+		return err
+	}
+
+	return w.Close(manifest)
+}
+
+// standaloneImage returns the parent image of a VM if it stands alone, or
+// a flattened copy of it in dir when it is an overlay whose backing files
+// are host paths, e.g. for linked clones. Copies are for the caller to
+// remove.
+func standaloneImage(ctx context.Context, image, dir string) (string, error) {
+	backing, err := internal.ImageBackingFile(image)
+	if err != nil || backing == "" {
+		return image, err
+	}
+
+	out, err := ioutil.TempFile(dir, ".govm-export-*."+engines.FormatQcow2)
+	if err != nil {
+		return "", err
+	}
+
+	_ = out.Close()
+
+	if err := images.Flatten(ctx, image, out.Name()); err != nil {
+		_ = os.Remove(out.Name())
+		return "", err
+	}
+
+	return out.Name(), nil
+}
+
+// nolint: gochecknoglobals
+var importCommand = cli.Command{
+	Name:      "import",
+	Usage:     "Create a GoVM Instance from an exported bundle",
+	ArgsUsage: "[bundle]",
+	Description: "The bundle is checked against its manifest before the VM is created in the\n" +
+		"selected namespace. Its disks are kept in the VM data directory. The shares\n" +
+		"and container environment of the bundle come from another host, they are\n" +
+		"dropped unless --keep-shares and --keep-container-env are set. VMs imported\n" +
+		"under another name get a new identity.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "name of the new VM (default: the name of the exported VM)",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-shares",
+			Usage: "keep the shares of the bundle whose host directory exists",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-container-env",
+			Usage: "keep the container environment variables of the bundle",
+		},
+		&cli.BoolFlag{
+			Name:  "start",
+			Usage: "start the VM once imported",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return usageError("missing bundle file\n" +
+				"USAGE:\n govm import [command options] [bundle]")
+		}
+
+		path := c.Args().First()
+		workdir := c.String("workdir")
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(workdir, 0750); err != nil {
+			return err
+		}
+
+		// Next to the data directories, so that the disks are moved in place
+		tmp, err := ioutil.TempDir(workdir, ".govm-import-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		manifest, err := bundle.Extract(ctx, path, tmp)
+		if err != nil {
+			return fmt.Errorf("error when reading the bundle %v: %w", path, err)
+		}
+
+		spec, err := importSpec(c, tmp, manifest)
+		if err != nil {
+			return err
+		}
+
+		if _, err := engine.InspectVM(ctx, spec.Namespace, spec.Name); err == nil {
+			return fmt.Errorf("error when importing the GoVM Instance %v: %w: %v in namespace %v",
+				spec.Name, engines.ErrVMExists, spec.Name, spec.Namespace)
+		} else if !errors.Is(err, engines.ErrVMNotFound) {
+			return fmt.Errorf("error when importing the GoVM Instance %v: %w", spec.Name, err)
+		}
+
+		if err := importBundle(ctx, c, engine, tmp, manifest, spec); err != nil {
+			return fmt.Errorf("error when importing the GoVM Instance %v: %w", spec.Name, err)
+		}
+
+		if c.Bool("start") {
+			if err := engine.StartVM(ctx, spec.Namespace, spec.Name); err != nil {
+				return fmt.Errorf("error when starting the GoVM Instance %v: %w", spec.Name, err)
+			}
+
+			recordStatus(workdir, spec.Namespace, spec.Name, vm.StatusRunning)
+		}
+
+		log.Printf("GoVM Instance %v has been successfully imported", spec.Name)
+
+		return nil
+	},
+}
+
+// importSpec reads the spec of an extracted bundle and points it to the
+// extracted files
+func importSpec(c *cli.Context, dir string, manifest bundle.Manifest) (vm.Instance, error) {
+	spec := vm.Instance{}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(manifest.Spec)))
+	if err != nil {
+		return spec, err
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return spec, fmt.Errorf("%w: %v: %v", bundle.ErrCorrupt, manifest.Spec, err)
+	}
+
+	// A copy next to the exported VM needs its own network and cloud-init
+	// identity, as clones get
+	if name := c.String("name"); name != "" && name != spec.Name {
+		spec.Name, spec.UUID, spec.NetOpts.IP = name, "", ""
+		if spec.NetOpts.MAC, err = internal.RandomMAC(); err != nil {
+			return spec, err
+		}
+	}
+
+	if !vm.ValidName(spec.Name) {
+		return spec, &vm.SpecError{Field: "name", Value: spec.Name,
+			Err: errors.New("names are made of letters, digits, '-' and '_'")}
+	}
+
+	spec.Namespace = c.String("namespace")
+	spec.Workdir = c.String("workdir")
+	spec.ParentImage = filepath.Join(dir, filepath.FromSlash(manifest.Image))
+
+	if spec.UserData != "" {
+		spec.UserData = filepath.Join(dir, bundleUserData)
+	}
+
+	if spec.SSHPublicKeyFile != "" {
+		spec.SSHPublicKeyFile = filepath.Join(dir, bundleSSHKey)
+	}
+
+	// Shares expose host directories to the guest and the environment
+	// reaches the privileged launcher container: neither is trusted from
+	// another host unless asked for
+	if len(spec.ContainerEnvVars) > 0 && !c.Bool("keep-container-env") {
+		log.Warnf("Dropping the container environment %v of the bundle, use --keep-container-env to keep it",
+			strings.Join(spec.ContainerEnvVars, " "))
+
+		spec.ContainerEnvVars = nil
+	}
+
+	if len(spec.Shares) > 0 && !c.Bool("keep-shares") {
+		log.Warnf("Dropping the shares %v of the bundle, use --keep-shares to keep them",
+			strings.Join(spec.Shares, ", "))
+
+		spec.Shares = nil
+	}
+
+	// Shares are host directories, missing ones are dropped
+	shares := []string{}
+	for _, share := range spec.Shares {
+		if _, err := os.Stat(strings.Split(share, ":")[0]); err != nil {
+			log.Warnf("Dropping the share %v: %v", share, err)
+			continue
+		}
+
+		shares = append(shares, share)
+	}
+
+	spec.Shares = shares
+
+	return spec, spec.CheckDisks()
+}
+
+// importBundle moves the disks of an extracted bundle into the data
+// directory of a new VM and creates it
+func importBundle(ctx context.Context, c *cli.Context, engine engines.VMEngine, dir string,
+	manifest bundle.Manifest, spec vm.Instance) (err error) {
+	dataDir := filepath.Join(spec.Workdir, "data", spec.Name)
+	if _, err := os.Stat(dataDir); err == nil {
+		return fmt.Errorf("%w: the data directory %v is in use", engines.ErrVMExists, dataDir)
+	}
+
+	created := false
+
+	defer func() {
+		if err != nil && !created {
+			_ = os.RemoveAll(dataDir)
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Join(dataDir, vm.DisksDir), 0750); err != nil {
+		return err
+	}
+
+	// The root disk goes with the VM data, the engines reuse the data disks
+	image := filepath.Join(dataDir, filepath.Base(spec.ParentImage))
+	if err := os.Rename(spec.ParentImage, image); err != nil {
+		return err
+	}
+
+	spec.ParentImage = image
+
+	for _, disk := range spec.Disks {
+		file := filepath.Join(dir, disk.File())
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := os.Rename(file, filepath.Join(dataDir, disk.File())); err != nil {
+			return err
+		}
+	}
+
+	if err := spec.Check(); err != nil {
+		return fmt.Errorf("error on VM Instance pre-check: %w", err)
+	}
+
+	id, err := engine.CreateVM(ctx, spec)
+	if err != nil {
+		return err
+	}
+
+	created = true
+	recordVM(c, spec, id)
+
+	if manifest.Overlay == "" {
+		return nil
+	}
+
+	err = engine.ImportOverlay(ctx, spec.Namespace, spec.Name, filepath.Join(dir, filepath.FromSlash(manifest.Overlay)))
+	if err != nil {
+		// The VM is useless without its disk
+		opts := engines.DeleteOptions{StopOptions: engines.StopOptions{Force: true}}
+		if err := engine.DeleteVM(context.Background(), spec.Namespace, spec.Name, opts); err != nil {
+			log.Warnf("Couldn't remove the GoVM Instance %v: %v", spec.Name, err)
+		}
+
+		forgetVM(c.String("workdir"), spec.Namespace, spec.Name)
+	}
+
+	return err
+}
@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal/bundle"
+	"github.com/govm-project/govm/internal/images"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// nolint: funlen
+func TestExportImport(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm",
+		"--disk-attach", "data:1G", "--share", env.workdir+":/mnt/host", "--container-env", "EXTRA_QEMU_OPTS=-s")
+	assert.NilError(t, err)
+
+	dataDir := filepath.Join(env.workdir, "data", "vm")
+	assert.NilError(t, os.MkdirAll(filepath.Join(dataDir, "disks"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dataDir, "disks", "data.qcow2"), []byte("data"), 0644))
+
+	out := filepath.Join(t.TempDir(), "vm.tar.gz")
+
+	_, err = env.run("export", "-o", out, "vm")
+	assert.Assert(t, is.ErrorContains(err, "the GoVM Instance vm is running, stop it first or use --stopvm"))
+
+	_, err = env.run("export", "-o", out, "--stopvm", "vm")
+	assert.NilError(t, err)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ins.Running)
+	assert.Equal(t, len(ins.Saves), 1)
+
+	// Into another namespace, under another name and identity, with the
+	// host details of the bundle on request
+	_, err = env.run("--namespace", "other", "import", "--name", "copy", "--keep-shares", "--keep-container-env", out)
+	assert.NilError(t, err)
+
+	copied, ok := env.engine.Get("other", "copy")
+	assert.Assert(t, ok)
+	assert.Assert(t, !copied.Running)
+	assert.Equal(t, copied.SSHPublicKeyFile, "ssh-rsa AAAA test")
+	assert.DeepEqual(t, copied.Shares, []string{env.workdir + ":/mnt/host"})
+	assert.DeepEqual(t, copied.ContainerEnvVars, []string{"EXTRA_QEMU_OPTS=-s"})
+	assert.DeepEqual(t, copied.Disks, ins.Disks)
+	assert.Assert(t, copied.NetOpts.MAC != "" && copied.NetOpts.MAC != ins.NetOpts.MAC)
+	assert.Assert(t, copied.UUID != "" && copied.UUID != ins.UUID)
+	assert.Equal(t, metadataUUID(t, env.workdir, "copy"), copied.UUID)
+
+	copyDir := filepath.Join(env.workdir, "data", "copy")
+	assert.Equal(t, copied.ParentImage, filepath.Join(copyDir, "image.qcow2"))
+
+	for file, content := range map[string]string{"image.qcow2": "saved vm", "disks/data.qcow2": "data"} {
+		data, err := ioutil.ReadFile(filepath.Join(copyDir, file))
+		assert.NilError(t, err)
+		assert.Equal(t, string(data), content)
+	}
+
+	// The extracted bundle is gone
+	entries, err := ioutil.ReadDir(env.workdir)
+	assert.NilError(t, err)
+	for _, entry := range entries {
+		assert.Assert(t, entry.Name()[0] != '.', entry.Name())
+	}
+
+	_, err = env.run("--namespace", "other", "import", "--name", "copy", out)
+	assert.Equal(t, ExitCode(err), ExitVMExists)
+
+	// The data directories are shared by the namespaces
+	_, err = env.run("--namespace", "other", "import", out)
+	assert.Equal(t, ExitCode(err), ExitVMExists)
+	assert.Assert(t, is.ErrorContains(err, "the data directory "+dataDir+" is in use"))
+
+	// Parent image and overlay are kept apart on request
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dataDir, engines.OverlayFile), []byte("overlay"), 0644))
+	assert.NilError(t, os.RemoveAll(filepath.Join(dataDir, "disks")))
+
+	out = filepath.Join(t.TempDir(), "vm.tar")
+	_, err = env.run("export", "-o", out, "--overlay", "--stopvm", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("import", "--name", "layered", "--start", out)
+	assert.NilError(t, err)
+
+	layered, _ := env.engine.Get(testNamespace, "layered")
+	assert.Assert(t, layered.Running)
+	assert.Equal(t, len(layered.Overlays), 1)
+	assert.Equal(t, len(layered.Shares), 0)
+	assert.Equal(t, len(layered.ContainerEnvVars), 0)
+
+	data, err := ioutil.ReadFile(layered.Overlays[0])
+	assert.Assert(t, os.IsNotExist(err), "the extracted overlay is left behind: %s", data)
+	assert.Equal(t, layered.ParentImage, filepath.Join(env.workdir, "data", "layered", "image.qcow2"))
+}
+
+func TestExportLinkedClone(t *testing.T) {
+	env := newTestEnv(t)
+
+	binary := images.QemuImgBinary
+	images.QemuImgBinary = filepath.Join(t.TempDir(), "qemu-img")
+	t.Cleanup(func() { images.QemuImgBinary = binary })
+
+	assert.NilError(t, ioutil.WriteFile(images.QemuImgBinary, []byte(`#!/bin/sh
+for arg; do src=$last; last=$arg; done
+{ printf 'flattened '; cat "$src"; } > "$last"
+`), 0755))
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+	writeOverlay(t, filepath.Join(env.workdir, "data", "vm", engines.OverlayFile), env.image)
+
+	_, err = env.run("clone", "--stopvm", "vm", "linked")
+	assert.NilError(t, err)
+
+	// The frozen overlay the clone runs is flattened, the bundle stands alone
+	out := filepath.Join(t.TempDir(), "linked.tar")
+	_, err = env.run("export", "-o", out, "--overlay", "linked")
+	assert.NilError(t, err)
+
+	_, err = env.run("import", "--name", "copy", out)
+	assert.NilError(t, err)
+
+	copied, _ := env.engine.Get(testNamespace, "copy")
+	assert.Equal(t, copied.ParentImage, filepath.Join(env.workdir, "data", "copy", "image.qcow2"))
+
+	data, err := ioutil.ReadFile(copied.ParentImage)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(string(data), "flattened QFI"), "%q", data)
+
+	// The flattened copy is gone
+	entries, err := ioutil.ReadDir(filepath.Dir(out))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+}
+
+func TestImportErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("import")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	corrupt := filepath.Join(t.TempDir(), "vm.tar")
+	assert.NilError(t, ioutil.WriteFile(corrupt, []byte("not a bundle"), 0644))
+
+	_, err = env.run("import", "--name", "vm", corrupt)
+	assert.Assert(t, errors.Is(err, bundle.ErrCorrupt), "got %v", err)
+
+	// Nothing is left behind
+	_, err = os.Stat(filepath.Join(env.workdir, "data", "vm"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(env.workdir, "data", "vm", engines.OverlayFile), nil, 0644))
+
+	out := filepath.Join(t.TempDir(), "vm.tar")
+	_, err = env.run("export", "--stopvm", "--overlay", "-o", out, "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("import", "--name", "../escape", out)
+	assert.Equal(t, ExitCode(err), ExitInvalidSpec)
+
+	// VMs whose overlay can't be imported are removed
+	env.engine.FailOn("ImportOverlay", errors.New("injected"))
+	_, err = env.run("import", "--name", "broken", out)
+	assert.Assert(t, is.ErrorContains(err, "error when importing the GoVM Instance broken: injected"))
+
+	_, ok := env.engine.Get(testNamespace, "broken")
+	assert.Assert(t, !ok)
+
+	_, err = env.run("export", "missing")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+}
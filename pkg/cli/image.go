@@ -0,0 +1,770 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/vm"
+	"github.com/intel/tfortools"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var imageCommand = cli.Command{
+	Name:  "image",
+	Usage: "Manage the images of the working directory",
+	Description: "Stored images can be given by name to --image. They are kept read-only,\n" +
+		"once per content, in <workdir>/" + images.Dir + ".",
+	Subcommands: []*cli.Command{
+		&imageAddCommand,
+		&imagePullCommand,
+		&imageImportCommand,
+		&imageListCommand,
+		&imageCatalogCommand,
+		&imageInspectCommand,
+		&imageRemoveCommand,
+		&imagePruneCommand,
+	},
+}
+
+// nolint: gochecknoglobals
+var imageAddCommand = cli.Command{
+	Name:      "add",
+	Usage:     "Copy a disk image into the store",
+	ArgsUsage: "[file]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "image name (default: the file name without its extensions)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return usageError("missing image file\n" +
+				"USAGE:\n govm image add [command options] [file]")
+		}
+
+		file, err := filepath.Abs(c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		name := c.String("name")
+		if name == "" {
+			name = imageName(file)
+		}
+
+		if !images.ValidName(name) {
+			return usageError(fmt.Sprintf("invalid image name %q, use --name", name))
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		signer, err := fileSigner(ctx, c, file)
+		if err != nil {
+			return fmt.Errorf("error when verifying the image %v: %w", file, err)
+		}
+
+		img, err := images.New(c.String("workdir")).Add(ctx, name, file,
+			images.AddOptions{Source: file, Signer: signer})
+		if err != nil {
+			return fmt.Errorf("error when adding the image %v: %w", name, err)
+		}
+
+		log.Printf("Image %v has been successfully added as %v", name, img.Digest)
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var imagePullCommand = cli.Command{
+	Name:      "pull",
+	Usage:     "Download a disk image into the store",
+	ArgsUsage: "[url|alias]",
+	Description: "Images are fetched from http, https or file URLs and verified against\n" +
+		"--checksum or the --sums file listing them. xz and gzip compressed images are\n" +
+		"decompressed. Interrupted downloads resume when pulled again. Aliases of the\n" +
+		"image catalog, e.g. ubuntu:22.04, are pulled under their name.\n\n" +
+		"The --sums file, or the download, is verified against --signature, or its own\n" +
+		"clearsigned signature, with the keys of the " + images.TrustDir + " directory next to the\n" +
+		"configuration file, if any. Unsigned downloads are refused with --require-signed.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "image name (default: the file name without its extensions)",
+		},
+		&cli.StringFlag{
+			Name:  "checksum",
+			Usage: "SHA-256 or SHA-512 sum of the download, e.g. sha256:<hex>",
+		},
+		&cli.StringFlag{
+			Name:  "sums",
+			Usage: "URL of a SHA256SUMS, SHA512SUMS or CHECKSUM file listing the download",
+		},
+		&cli.StringFlag{
+			Name:  "signature",
+			Usage: "URL of the minisign or OpenPGP signature of the --sums file, or of the download",
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Usage:   "don't report the progress",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return usageError("missing image URL\n" +
+				"USAGE:\n govm image pull [command options] [url|alias]")
+		}
+
+		rawURL := c.Args().First()
+		name := c.String("name")
+		opts := images.PullOptions{
+			Checksum:     c.String("checksum"),
+			SumsURL:      c.String("sums"),
+			SignatureURL: c.String("signature"),
+		}
+
+		// Catalog aliases stand for their URL and checksum
+		catalog, err := images.LoadCatalog(catalogFile(c))
+		if err != nil {
+			return err
+		}
+
+		if alias, ok := catalog[rawURL]; ok {
+			if name == "" {
+				name = rawURL
+			}
+
+			if opts.Checksum == "" && opts.SumsURL == "" {
+				opts.Checksum, opts.SumsURL = alias.Checksum, alias.Sums
+
+				if opts.SignatureURL == "" {
+					opts.SignatureURL = alias.Signature
+				}
+			}
+
+			rawURL = alias.URL
+		}
+
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return usageError(fmt.Sprintf("invalid image URL %v: %v", rawURL, err))
+		}
+
+		if name == "" {
+			name = imageName(u.Path)
+		}
+
+		if !images.ValidName(name) {
+			return usageError(fmt.Sprintf("invalid image name %q, use --name", name))
+		}
+
+		if opts.Checksum == "" && opts.SumsURL == "" {
+			log.Warnf("No --checksum nor --sums given, %v won't be verified", rawURL)
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		img, err := pullImage(ctx, c, name, rawURL, opts, c.Bool("quiet"))
+		if err != nil {
+			return fmt.Errorf("error when pulling the image %v: %w", name, err)
+		}
+
+		if img.Signer != "" {
+			log.Printf("Image %v is signed by %v", name, img.Signer)
+		}
+
+		log.Printf("Image %v has been successfully pulled as %v", name, img.Digest)
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var imageImportCommand = cli.Command{
+	Name:      "import",
+	Usage:     "Convert a disk image or appliance into a qcow2 image of the store",
+	ArgsUsage: "[file]",
+	Description: "raw, vmdk, vdi, vhdx and vhd images are converted to qcow2 with qemu-img, so\n" +
+		"that every VM of the image writes to its own copy-on-write overlay. OVA archives\n" +
+		"and OVF descriptors are imported with their first disk, their CPUs and RAM being\n" +
+		"the default size of the image VMs.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "image name (default: the file name without its extensions)",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "image format: " + strings.Join(images.ImportFormats, ", ") + " (default: probed)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return usageError("missing image file\n" +
+				"USAGE:\n govm image import [command options] [file]")
+		}
+
+		file, err := filepath.Abs(c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		name := c.String("name")
+		if name == "" {
+			name = imageName(file)
+		}
+
+		if !images.ValidName(name) {
+			return usageError(fmt.Sprintf("invalid image name %q, use --name", name))
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		signer, err := fileSigner(ctx, c, file)
+		if err != nil {
+			return fmt.Errorf("error when verifying the image %v: %w", file, err)
+		}
+
+		img, err := images.New(c.String("workdir")).Import(ctx, name, file,
+			images.ImportOptions{Format: c.String("format"), Signer: signer})
+		if err != nil {
+			return fmt.Errorf("error when importing the image %v: %w", name, err)
+		}
+
+		if img.Hints != nil {
+			log.Printf("Image %v VMs default to %d CPUs and %d MB of RAM", name, img.Hints.Cpus, img.Hints.RAM)
+		}
+
+		log.Printf("Image %v has been successfully imported as %v", name, img.Digest)
+
+		return nil
+	},
+}
+
+// pullImage pulls an image into the store, reporting the progress unless
+// quiet is set
+func pullImage(ctx context.Context, c *cli.Context, name, rawURL string, opts images.PullOptions,
+	quiet bool) (images.Image, error) {
+	keyring, err := loadKeyring(c)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	opts.Keyring, opts.RequireSigned = keyring, c.Bool("require-signed")
+
+	reported := ""
+	if !quiet {
+		opts.Progress = func(done, total int64) {
+			status := formatSize(done)
+			if total > 0 {
+				status = fmt.Sprintf("%3d%%", done*100/total)
+			}
+
+			if status != reported {
+				reported = status
+				fmt.Fprintf(c.App.ErrWriter, "\rPulling %v: %v", name, status)
+			}
+		}
+	}
+
+	img, err := images.New(c.String("workdir")).Pull(ctx, name, rawURL, opts)
+	if reported != "" {
+		fmt.Fprintln(c.App.ErrWriter)
+	}
+
+	return img, err
+}
+
+// catalogFile returns the user catalog of image aliases, next to the
+// configuration file
+func catalogFile(c *cli.Context) string {
+	return filepath.Join(filepath.Dir(c.String("config")), images.CatalogFile)
+}
+
+// loadKeyring returns the trusted signing keys, kept next to the
+// configuration file
+func loadKeyring(c *cli.Context) (*images.Keyring, error) {
+	return images.LoadKeyring(filepath.Join(filepath.Dir(c.String("config")), images.TrustDir))
+}
+
+// fileSigner verifies an image file against its detached signature, if
+// any, and returns its signer. Unsigned files are only refused with
+// --require-signed, and only checked at all given trusted keys or the flag.
+func fileSigner(ctx context.Context, c *cli.Context, file string) (string, error) {
+	keyring, err := loadKeyring(c)
+	if err != nil {
+		return "", err
+	}
+
+	required := c.Bool("require-signed")
+	if keyring.Empty() && !required {
+		return "", nil
+	}
+
+	signer, err := keyring.VerifyFile(ctx, file)
+	if errors.Is(err, images.ErrUnsigned) && !required {
+		return "", nil
+	}
+
+	return signer, err
+}
+
+// verifyImage checks the parent image of a new VM: files against their
+// detached signature, stored images by the signer recorded when they were
+// added
+func verifyImage(ctx context.Context, c *cli.Context, image string) error {
+	if path, err := internal.CheckFilePath(image); err == nil {
+		_, err = fileSigner(ctx, c, path)
+		return err
+	}
+
+	// Missing images are reported by the VM checks
+	img, err := images.New(c.String("workdir")).Get(image)
+	if err != nil {
+		return nil
+	}
+
+	if img.Signer == "" && c.Bool("require-signed") {
+		return fmt.Errorf("%w: the stored image %v was not verified when added", images.ErrUnsigned, image)
+	}
+
+	return nil
+}
+
+// pullAlias pulls the image of a catalog alias into the store on first use
+// and returns the alias. Files are never taken as aliases.
+func pullAlias(ctx context.Context, c *cli.Context, image string) (*images.Alias, error) {
+	if _, err := internal.CheckFilePath(image); err == nil {
+		return nil, nil
+	}
+
+	catalog, err := images.LoadCatalog(catalogFile(c))
+	if err != nil {
+		return nil, err
+	}
+
+	alias, ok := catalog[image]
+	if !ok {
+		return nil, nil
+	}
+
+	_, err = images.New(c.String("workdir")).Get(image)
+	if errors.Is(err, images.ErrNotFound) {
+		log.Printf("Pulling %v from %v", image, alias.URL)
+
+		opts := images.PullOptions{Checksum: alias.Checksum, SumsURL: alias.Sums, SignatureURL: alias.Signature}
+		_, err = pullImage(ctx, c, image, alias.URL, opts, false)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error when pulling the image %v: %w", image, err)
+	}
+
+	return &alias, nil
+}
+
+// applyAlias fills in the defaults of a catalog alias left unset by a spec.
+// Its flavor is only used by specs without a size.
+func applyAlias(ins *vm.Instance, alias images.Alias, sized bool) {
+	ins.Cloud = ins.Cloud || alias.Cloud
+	ins.Efi = ins.Efi || alias.Efi
+
+	if ins.SSHUser == "" {
+		ins.SSHUser = alias.User
+	}
+
+	if !sized && alias.Flavor != "" {
+		ins.Flavor, ins.Size = alias.Flavor, vm.Size{}
+	}
+}
+
+// storedHints returns the sizing hints of a stored image, nil for files and
+// images without hints
+func storedHints(c *cli.Context, image string) (*images.Hints, error) {
+	if _, err := internal.CheckFilePath(image); err == nil {
+		return nil, nil
+	}
+
+	img, err := images.New(c.String("workdir")).Get(image)
+	if errors.Is(err, images.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return img.Hints, nil
+}
+
+// applyHints sizes the VMs of an imported appliance after it, unless sized
+func applyHints(ins *vm.Instance, hints images.Hints, sized bool) {
+	if sized {
+		return
+	}
+
+	// The appliance CPUs are all cores of a single socket
+	sockets, cores, threads := 0, 0, 0
+	if hints.Cpus > 0 {
+		sockets, cores, threads = 1, hints.Cpus, 1
+	}
+
+	ins.Flavor = ""
+	ins.Size = vm.NewSize("", sockets, hints.Cpus, cores, threads, hints.RAM, 0)
+}
+
+// imageName names an image after its file, without the image and
+// compression extensions
+func imageName(file string) string {
+	name := path.Base(file)
+
+	for _, ext := range []string{".xz", ".gz", ".img", ".qcow2", ".raw", ".ova", ".ovf", ".vmdk", ".vdi", ".vhdx",
+		".vhd"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	return name
+}
+
+// nolint: gochecknoglobals
+var imageListCommand = cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "List the stored images",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "string containing the template code to execute",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		list, err := images.New(c.String("workdir")).List()
+		if err != nil {
+			return err
+		}
+
+		type outImage struct {
+			Name        string
+			Digest      string
+			Format      string
+			VirtualSize string
+			Size        string
+			Added       string
+		}
+
+		out := []outImage{}
+		for _, img := range list {
+			out = append(out, outImage{
+				Name:        img.Name,
+				Digest:      shortDigest(img.Digest),
+				Format:      img.Format,
+				VirtualSize: formatSize(img.VirtualSize),
+				Size:        formatSize(img.Size),
+				Added:       img.Added.Local().Format("2006-01-02 15:04:05"),
+			})
+		}
+
+		format := c.String("format")
+		if format == "" {
+			format = `{{table .}}`
+		}
+
+		return tfortools.OutputToTemplate(c.App.Writer, "format", format, out, nil)
+	},
+}
+
+// nolint: gochecknoglobals
+var imageCatalogCommand = cli.Command{
+	Name:  "catalog",
+	Usage: "List the image aliases --image accepts",
+	Description: "The aliases shipped with govm are replaced or extended by the ones of the\n" +
+		images.CatalogFile + " file next to the configuration file. Their images are pulled on\n" +
+		"first use.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "string containing the template code to execute",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		catalog, err := images.LoadCatalog(catalogFile(c))
+		if err != nil {
+			return err
+		}
+
+		s := images.New(c.String("workdir"))
+
+		type outAlias struct {
+			Alias  string
+			Pulled bool
+			User   string
+			Cloud  bool
+			URL    string
+		}
+
+		out := []outAlias{}
+		for name, alias := range catalog {
+			_, err := s.Get(name)
+			out = append(out, outAlias{name, err == nil, alias.User, alias.Cloud, alias.URL})
+		}
+
+		sort.Slice(out, func(i, j int) bool {
+			return out[i].Alias < out[j].Alias
+		})
+
+		format := c.String("format")
+		if format == "" {
+			format = `{{table .}}`
+		}
+
+		return tfortools.OutputToTemplate(c.App.Writer, "format", format, out, nil)
+	},
+}
+
+// nolint: gochecknoglobals
+var imageInspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     "Show the details of a stored image",
+	ArgsUsage: "[name]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "json",
+			Usage:   "output format: json or yaml",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return usageError("missing image name\n" +
+				"USAGE:\n govm image inspect [command options] [name]")
+		}
+
+		marshal, err := marshaler(c)
+		if err != nil {
+			return err
+		}
+
+		name := c.Args().First()
+
+		img, err := images.New(c.String("workdir")).Get(name)
+		if err != nil {
+			return fmt.Errorf("error when inspecting the image %v: %w", name, err)
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		users, err := imageUsers(ctx, c, img)
+		if err != nil {
+			return err
+		}
+
+		out, err := marshal(struct {
+			images.Image `yaml:",inline"`
+			// UsedBy lists the VMs whose overlay the image backs
+			UsedBy []string `yaml:"used-by" json:"used-by"`
+		}{img, users})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(c.App.Writer, string(out))
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var imageRemoveCommand = cli.Command{
+	Name:      "remove",
+	Aliases:   []string{"rm"},
+	Usage:     "Remove stored images",
+	ArgsUsage: "[name...]",
+	Description: "Images backing the disk of a VM are kept, unless another name refers to the\n" +
+		"same content.",
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing image name\n" +
+				"USAGE:\n govm image remove [name...]")
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		s := images.New(c.String("workdir"))
+
+		for _, name := range c.Args().Slice() {
+			if err := removeImage(ctx, c, s, name); err != nil {
+				return fmt.Errorf("error when removing the image %v: %w", name, err)
+			}
+
+			log.Printf("Image %v has been successfully removed", name)
+		}
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var imagePruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "Remove the unused images and the data left by removed VMs",
+	Description: "Stored images backing no VM of any namespace are removed, as are the data\n" +
+		"directories of VMs that no longer exist. Their data disks are kept unless\n" +
+		"--disks is set. Data directories holding a VM record or engine state are\n" +
+		"always kept.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "dry-run",
+			Aliases: []string{"n"},
+			Usage:   "only show what would be removed",
+		},
+		&cli.BoolFlag{
+			Name:  "disks",
+			Usage: "also remove the data disks of the removed VMs",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		scan, err := scanWorkdir(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		dryRun, reclaimed := c.Bool("dry-run"), int64(0)
+
+		for _, name := range scan.orphans() {
+			dir := scan.dataDir(name)
+			size := internal.DiskUsage(dir)
+
+			if !c.Bool("disks") {
+				size -= internal.DiskUsage(filepath.Join(dir, vm.DisksDir))
+			}
+
+			reclaimed += size
+
+			if dryRun {
+				log.Printf("Would remove the data of %v (%v)", name, formatSize(size))
+
+				continue
+			}
+
+			if err := pruneData(dir, c.Bool("disks")); err != nil {
+				return fmt.Errorf("error when removing the data of %v: %w", name, err)
+			}
+
+			log.Printf("Removed the data of %v (%v)", name, formatSize(size))
+		}
+
+		s := images.New(scan.workdir)
+		freed := map[string]bool{}
+
+		for _, img := range scan.unused() {
+			// Unused names sharing a file are all removed, the file once
+			if !freed[img.Path] {
+				freed[img.Path] = true
+				reclaimed += internal.DiskUsage(img.Path)
+			}
+
+			if dryRun {
+				log.Printf("Would remove the image %v", img.Name)
+
+				continue
+			}
+
+			if err := s.Remove(img.Name); err != nil {
+				return fmt.Errorf("error when removing the image %v: %w", img.Name, err)
+			}
+
+			log.Printf("Image %v has been successfully removed", img.Name)
+		}
+
+		if dryRun {
+			log.Printf("Would reclaim %v", formatSize(reclaimed))
+		} else {
+			log.Printf("Reclaimed %v", formatSize(reclaimed))
+		}
+
+		return nil
+	},
+}
+
+// removeImage removes an image from the store unless its file backs a VM
+func removeImage(ctx context.Context, c *cli.Context, s *images.Store, name string) error {
+	img, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	shared, err := s.Shared(img)
+	if err != nil {
+		return err
+	}
+
+	users, err := imageUsers(ctx, c, img)
+	if err != nil {
+		return err
+	}
+
+	if len(shared) == 0 && len(users) > 0 {
+		return fmt.Errorf("the image backs the GoVM Instances %v", strings.Join(users, ", "))
+	}
+
+	return s.Remove(name)
+}
+
+// imageUsers returns the VMs, as namespace/name, whose disk img backs, be it
+// their parent image or a file it is an overlay of. The overlays of the data
+// directories of VMs no engine lists, e.g. of an engine they have no record
+// of, are checked too, naming their VM by directory.
+func imageUsers(ctx context.Context, c *cli.Context, img images.Image) ([]string, error) {
+	scan, err := scanWorkdir(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	users := append([]string{}, scan.users()[img.Path]...)
+
+	for _, dir := range scan.orphans() {
+		chain, _ := internal.ImageBackingChain(filepath.Join(scan.dataDir(dir), engines.OverlayFile))
+
+		for _, file := range chain {
+			if file == img.Path {
+				users = append(users, dir)
+
+				break
+			}
+		}
+	}
+
+	return users, nil
+}
+
+// shortDigest returns the first 12 hex digits of a digest, as docker does
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 { // nolint: gomnd
+		return digest[:12]
+	}
+
+	return digest
+}
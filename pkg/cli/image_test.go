@@ -0,0 +1,332 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal/images"
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"golang.org/x/crypto/openpgp" // nolint: staticcheck
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestImage(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("image", "add", env.image)
+	assert.NilError(t, err)
+
+	_, err = env.run("image", "add", "--name", "base", env.image)
+	assert.NilError(t, err)
+
+	_, err = env.run("image", "add", env.image)
+	assert.Equal(t, ExitCode(err), ExitVMExists)
+
+	_, err = env.run("image", "add", "--name", "../escape", env.image)
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	out, err := env.run("image", "ls", "--format", "{{range .}}{{.Name}} {{.Format}} {{.VirtualSize}}\n{{end}}")
+	assert.NilError(t, err)
+	assert.Equal(t, out, "base raw 5\nimage raw 5\n")
+
+	// Stored images are given to --image by name
+	_, err = env.run("create", "--image", "base", "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+
+	out, err = env.run("image", "inspect", "base")
+	assert.NilError(t, err)
+
+	info := struct {
+		Path   string
+		Source string
+		UsedBy []string `json:"used-by"`
+	}{}
+	assert.NilError(t, json.Unmarshal([]byte(out), &info))
+	assert.Equal(t, info.Source, env.image)
+	assert.DeepEqual(t, info.UsedBy, []string{"tester/vm"})
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Equal(t, ins.ParentImage, info.Path)
+
+	// Both names share the file, the last one can't go while in use
+	_, err = env.run("image", "rm", "image")
+	assert.NilError(t, err)
+
+	_, err = env.run("image", "rm", "base")
+	assert.Assert(t, is.ErrorContains(err, "error when removing the image base: the image backs the GoVM Instances tester/vm"))
+
+	// VMs are found without their record, as are the overlays of data
+	// directories no engine lists
+	assert.NilError(t, store.New(env.workdir).Delete(testNamespace, "vm"))
+
+	leftover := filepath.Join(env.workdir, "data", "leftover")
+	assert.NilError(t, os.MkdirAll(leftover, 0755))
+	writeOverlay(t, filepath.Join(leftover, engines.OverlayFile), info.Path)
+
+	_, err = env.run("image", "rm", "base")
+	assert.Assert(t, is.ErrorContains(err, "the image backs the GoVM Instances tester/vm, leftover"))
+
+	out, err = env.run("image", "inspect", "base")
+	assert.NilError(t, err)
+	assert.NilError(t, json.Unmarshal([]byte(out), &info))
+	assert.DeepEqual(t, info.UsedBy, []string{"tester/vm", "leftover"})
+
+	assert.NilError(t, os.RemoveAll(leftover))
+
+	_, err = env.run("rm", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("image", "rm", "base")
+	assert.NilError(t, err)
+
+	_, err = os.Stat(info.Path)
+	assert.Assert(t, os.IsNotExist(err))
+
+	_, err = env.run("image", "inspect", "base")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+}
+
+func TestImagePull(t *testing.T) {
+	env := newTestEnv(t)
+
+	// sha256 of "image"
+	const sum = "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"
+
+	out, err := env.run("image", "pull", "--checksum", "sha256:"+sum, "file://"+env.image)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Contains(out, "Pulling image: 100%"))
+
+	out, err = env.run("image", "inspect", "image")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Contains(out, `"checksum": "sha256:`+sum+`"`))
+	assert.Assert(t, is.Contains(out, `"source": "file://`+env.image+`"`))
+
+	_, err = env.run("image", "pull", "-q", "--name", "tampered", "--checksum", strings.Repeat("0", 64),
+		"file://"+env.image)
+	assert.Assert(t, errors.Is(err, images.ErrChecksum), "got %v", err)
+
+	_, err = env.run("image", "pull")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+}
+
+func TestImageCatalog(t *testing.T) {
+	env := newTestEnv(t)
+
+	// sha256 of "image"
+	const sum = "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"
+
+	sums := filepath.Join(env.workdir, "SHA256SUMS")
+	assert.NilError(t, ioutil.WriteFile(sums, []byte(sum+" *image.qcow2\n"), 0644))
+	assert.NilError(t, ioutil.WriteFile(sums+".gpg", []byte("signature"), 0644))
+
+	catalog := filepath.Join(env.workdir, images.CatalogFile)
+	assert.NilError(t, ioutil.WriteFile(catalog, []byte(`
+"tiny:1.0":
+  url: file://`+env.image+`
+  checksum: sha256:`+sum+`
+  user: cirros
+  flavor: micro
+  cloud: true
+"signed:1.0":
+  url: file://`+env.image+`
+  sums: file://`+sums+`
+  signature: file://`+sums+`.gpg
+`), 0644))
+
+	out, err := env.run("image", "catalog", "--format", `{{range .}}{{.Alias}} {{.Pulled}}{{"\n"}}{{end}}`)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Contains(out, "tiny:1.0 false\n"))
+	assert.Assert(t, is.Contains(out, "ubuntu:22.04 false\n"))
+
+	// Aliases are pulled on first use and give the VM defaults
+	out, err = env.run("create", "--image", "tiny:1.0", "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Contains(out, "Pulling tiny:1.0: 100%"))
+
+	img, err := images.New(env.workdir).Get("tiny:1.0")
+	assert.NilError(t, err)
+	assert.Equal(t, img.Checksum, "sha256:"+sum)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Equal(t, ins.ParentImage, img.Path)
+	assert.Assert(t, ins.Cloud)
+	assert.Equal(t, ins.SSHUser, "cirros")
+	assert.Equal(t, ins.Flavor, "micro")
+	assert.DeepEqual(t, ins.Size, vm.GetSizeFromFlavor("micro"))
+
+	// Explicit sizes win over the flavor of the alias
+	out, err = env.run("create", "--image", "tiny:1.0", "--key", env.key, "--name", "sized", "--ram", "2048")
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(out, "Pulling"), out)
+
+	sized, _ := env.engine.Get(testNamespace, "sized")
+	assert.Equal(t, sized.Flavor, "")
+	assert.Equal(t, sized.Size.RAM, 2048)
+
+	compose := filepath.Join(t.TempDir(), "compose.yml")
+	assert.NilError(t, ioutil.WriteFile(compose, []byte(fmt.Sprintf(composeTemplate, "tiny:1.0", env.key)), 0644))
+
+	_, err = env.run("compose", "-f", compose)
+	assert.NilError(t, err)
+
+	two, _ := env.engine.Get("other", "vmTwo")
+	assert.Equal(t, two.ParentImage, img.Path)
+	assert.Assert(t, two.Cloud)
+	assert.Equal(t, two.Size.RAM, 512)
+
+	// Signed aliases are pulled without trusted keys, only checked with some
+	_, err = env.run("image", "pull", "signed:1.0")
+	assert.NilError(t, err)
+
+	_, err = env.run("--require-signed", "image", "pull", "--name", "required", "signed:1.0")
+	assert.Equal(t, ExitCode(err), ExitUntrustedImage)
+
+	assert.NilError(t, ioutil.WriteFile(catalog, []byte("broken: {"), 0644))
+	_, err = env.run("create", "--image", "ubuntu:22.04", "--key", env.key)
+	assert.Assert(t, is.ErrorContains(err, "catalog "+catalog))
+}
+
+func TestImageImport(t *testing.T) {
+	env := newTestEnv(t)
+
+	binary := images.QemuImgBinary
+	images.QemuImgBinary = filepath.Join(t.TempDir(), "qemu-img")
+	t.Cleanup(func() { images.QemuImgBinary = binary })
+
+	assert.NilError(t, ioutil.WriteFile(images.QemuImgBinary, []byte(`#!/bin/sh
+for arg; do src=$last; last=$arg; done
+{ printf 'QFI\373'; cat "$src"; } > "$last"
+`), 0755))
+
+	dir := t.TempDir()
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "disk1.vmdk"), []byte("disk"), 0644))
+
+	ovf := filepath.Join(dir, "appliance.ovf")
+	assert.NilError(t, ioutil.WriteFile(ovf, []byte(`<Envelope>
+  <References><File id="file1" href="disk1.vmdk"/></References>
+  <DiskSection><Disk diskId="vmdisk1" fileRef="file1"/></DiskSection>
+  <VirtualSystem><VirtualHardwareSection>
+    <Item><ResourceType>3</ResourceType><VirtualQuantity>4</VirtualQuantity></Item>
+    <Item><AllocationUnits>MegaBytes</AllocationUnits><ResourceType>4</ResourceType><VirtualQuantity>1024</VirtualQuantity></Item>
+  </VirtualHardwareSection></VirtualSystem>
+</Envelope>`), 0644))
+
+	_, err := env.run("image", "import", ovf)
+	assert.NilError(t, err)
+
+	img, err := images.New(env.workdir).Get("appliance")
+	assert.NilError(t, err)
+	assert.Equal(t, img.Format, "qcow2")
+	assert.DeepEqual(t, img.Hints, &images.Hints{Cpus: 4, RAM: 1024})
+
+	// Imported appliances keep their sizing, unless given another
+	_, err = env.run("create", "--image", "appliance", "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Equal(t, ins.ParentImage, img.Path)
+	assert.Equal(t, ins.Size.Cpus, 4)
+	assert.Equal(t, ins.Size.Sockets*ins.Size.Cores*ins.Size.Threads, 4)
+	assert.Equal(t, ins.Size.RAM, 1024)
+
+	_, err = env.run("create", "--image", "appliance", "--key", env.key, "--name", "small", "--flavor", "micro")
+	assert.NilError(t, err)
+
+	small, _ := env.engine.Get(testNamespace, "small")
+	assert.DeepEqual(t, small.Size, vm.GetSizeFromFlavor("micro"))
+
+	_, err = env.run("image", "import", "--name", "disk", "--format", "iso", env.image)
+	assert.Assert(t, is.ErrorContains(err, "unsupported image format iso"))
+}
+
+// trustPGPKey writes the public key of a new OpenPGP key to the trusted keys
+// of env and returns the key
+func trustPGPKey(t *testing.T, env *testEnv) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("Release Team", "", "release@example.com", nil)
+	assert.NilError(t, err)
+
+	dir := filepath.Join(env.workdir, images.TrustDir)
+	assert.NilError(t, os.MkdirAll(dir, 0750))
+
+	f, err := os.Create(filepath.Join(dir, "release.gpg"))
+	assert.NilError(t, err)
+	assert.NilError(t, entity.Serialize(f))
+	assert.NilError(t, f.Close())
+
+	return entity
+}
+
+func signFile(t *testing.T, entity *openpgp.Entity, file string) {
+	data, err := ioutil.ReadFile(file)
+	assert.NilError(t, err)
+
+	sig, err := os.Create(file + ".asc")
+	assert.NilError(t, err)
+	assert.NilError(t, openpgp.ArmoredDetachSign(sig, entity, bytes.NewReader(data), nil))
+	assert.NilError(t, sig.Close())
+}
+
+func TestImageSigned(t *testing.T) {
+	env := newTestEnv(t)
+
+	// Without trusted keys nor policy, images are not verified
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("--require-signed", "create", "--image", env.image, "--key", env.key, "--name", "unsigned")
+	assert.Assert(t, errors.Is(err, images.ErrUnsigned), "got %v", err)
+	assert.Equal(t, ExitCode(err), ExitUntrustedImage)
+
+	entity := trustPGPKey(t, env)
+	signFile(t, entity, env.image)
+
+	_, err = env.run("--require-signed", "create", "--image", env.image, "--key", env.key, "--name", "signed")
+	assert.NilError(t, err)
+
+	// Stored images keep the key they were verified with
+	_, err = env.run("image", "add", "--name", "signed", env.image)
+	assert.NilError(t, err)
+
+	img, err := images.New(env.workdir).Get("signed")
+	assert.NilError(t, err)
+	assert.Equal(t, img.Signer, "Release Team <release@example.com> ("+entity.PrimaryKey.KeyIdString()+")")
+
+	unsigned := filepath.Join(t.TempDir(), "unsigned.qcow2")
+	assert.NilError(t, ioutil.WriteFile(unsigned, []byte("unsigned image"), 0644))
+
+	_, err = env.run("image", "add", unsigned)
+	assert.NilError(t, err)
+
+	// The policy may come from the configuration file
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(env.workdir, "config.yml"), []byte("require-signed: true\n"), 0644))
+
+	_, err = env.run("create", "--image", "signed", "--key", env.key, "--name", "stored")
+	assert.NilError(t, err)
+
+	_, err = env.run("create", "--image", "unsigned", "--key", env.key, "--name", "stored-unsigned")
+	assert.Assert(t, is.ErrorContains(err, "the stored image unsigned was not verified when added"))
+
+	_, err = env.run("image", "pull", "--name", "pulled", "file://"+unsigned)
+	assert.Assert(t, errors.Is(err, images.ErrUnsigned), "got %v", err)
+
+	// Bad signatures are refused, required or not
+	assert.NilError(t, os.Remove(filepath.Join(env.workdir, "config.yml")))
+	assert.NilError(t, ioutil.WriteFile(env.image, []byte("tampered"), 0644))
+
+	_, err = env.run("create", "--image", env.image, "--key", env.key, "--name", "tampered")
+	assert.Assert(t, errors.Is(err, images.ErrSignature), "got %v", err)
+	assert.Equal(t, ExitCode(err), ExitUntrustedImage)
+
+	_, ok := env.engine.Get(testNamespace, "tampered")
+	assert.Assert(t, !ok)
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+
+	cli "github.com/urfave/cli/v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// nolint: gochecknoglobals
+var inspectCommand = cli.Command{
+	Name:      "inspect",
+	Aliases:   []string{"info"},
+	Usage:     "Show the details of a GoVM Instance",
+	ArgsUsage: "[name]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "json",
+			Usage:   "output format: json or yaml",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm inspect [command options] [name]")
+		}
+
+		marshal, err := marshaler(c)
+		if err != nil {
+			return err
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		instance, err := engine.InspectVM(ctx, namespace, name)
+		if err != nil {
+			return fmt.Errorf("error when inspecting the GoVM Instance %v: %w", name, err)
+		}
+
+		out, err := marshal(withRecord(c.String("workdir"), instance))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(c.App.Writer, string(out))
+
+		return nil
+	},
+}
+
+// marshaler returns the function encoding values in the --output format
+func marshaler(c *cli.Context) (func(interface{}) ([]byte, error), error) {
+	switch c.String("output") {
+	case "json":
+		return func(v interface{}) ([]byte, error) {
+			return json.MarshalIndent(v, "", "  ")
+		}, nil
+	case "yaml":
+		return yaml.Marshal, nil
+	default:
+		return nil, usageError(fmt.Sprintf("unknown output format %q, use json or yaml", c.String("output")))
+	}
+}
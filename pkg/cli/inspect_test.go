@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	yaml "gopkg.in/yaml.v2"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestInspect(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm",
+		"--flavor", "small", "--share", env.workdir+":/mnt/host")
+	assert.NilError(t, err)
+
+	out, err := env.run("inspect", "vm")
+	assert.NilError(t, err)
+
+	ins := vm.Instance{}
+	assert.NilError(t, json.Unmarshal([]byte(out), &ins))
+	assert.Equal(t, ins.Name, "vm")
+	assert.Equal(t, ins.Status, vm.StatusRunning)
+	assert.Equal(t, ins.ParentImage, env.image)
+	assert.Equal(t, ins.Size, vm.GetSizeFromFlavor("small"))
+	assert.DeepEqual(t, ins.Shares, []string{env.workdir + ":/mnt/host"})
+
+	out, err = env.run("inspect", "-o", "yaml", "vm")
+	assert.NilError(t, err)
+
+	ins = vm.Instance{}
+	assert.NilError(t, yaml.Unmarshal([]byte(out), &ins))
+	assert.Equal(t, ins.Name, "vm")
+	assert.Equal(t, ins.Status, vm.StatusRunning)
+}
+
+func TestInspectErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	_, err := env.run("inspect")
+	assert.Assert(t, is.ErrorContains(err, "missing GoVM Instance name"))
+
+	_, err = env.run("inspect", "-o", "xml", "vm")
+	assert.Assert(t, is.ErrorContains(err, `unknown output format "xml"`))
+
+	_, err = env.run("inspect", "missing")
+	assert.Assert(t, is.ErrorContains(err, "error when inspecting the GoVM Instance missing"))
+}
+
+func TestSpecRecord(t *testing.T) {
+	env := newTestEnv(t)
+	records := store.New(env.workdir)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm",
+		"--container-env", "http_proxy=http://proxy:3128")
+	assert.NilError(t, err)
+
+	rec, err := records.Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Engine, "fake")
+	assert.Equal(t, rec.Spec.ID, "fake000001")
+	assert.Equal(t, rec.Spec.Status, vm.StatusRunning)
+	assert.Equal(t, rec.Spec.ParentImage, env.image)
+	assert.DeepEqual(t, rec.Spec.ContainerEnvVars, []string{"http_proxy=http://proxy:3128"})
+
+	_, err = env.run("stop", "vm")
+	assert.NilError(t, err)
+
+	rec, err = records.Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Status, vm.StatusStopped)
+
+	// inspect reports the recorded spec with the engine runtime state
+	assert.NilError(t, records.Update(testNamespace, "vm", func(rec *store.Record) error {
+		rec.Spec.Flavor = "recorded"
+		rec.Spec.Status = vm.StatusRunning
+		return nil
+	}))
+
+	out, err := env.run("inspect", "vm")
+	assert.NilError(t, err)
+
+	ins := vm.Instance{}
+	assert.NilError(t, json.Unmarshal([]byte(out), &ins))
+	assert.Equal(t, ins.Flavor, "recorded")
+	assert.Equal(t, ins.Status, vm.StatusStopped)
+
+	_, err = env.run("remove", "vm")
+	assert.NilError(t, err)
+
+	_, err = records.Get(testNamespace, "vm")
+	assert.Assert(t, errors.Is(err, store.ErrNotFound), "got %v", err)
+}
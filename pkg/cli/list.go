@@ -2,9 +2,6 @@ package cli
 
 import (
 	"fmt"
-	"os"
-
-	"github.com/govm-project/govm/engines/docker"
 
 	"github.com/intel/tfortools"
 	cli "github.com/urfave/cli/v2"
@@ -28,11 +25,15 @@ var listCommand = cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) error {
+		ctx, cancel := commandContext(c)
+		defer cancel()
 
-		engine := docker.Engine{}
-		engine.Init()
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
 
-		result, err := engine.List(c.String("namespace"), c.Bool("all"))
+		result, err := engine.ListVM(ctx, c.String("namespace"), c.Bool("all"))
 		if err != nil {
 			return err
 		}
@@ -43,12 +44,14 @@ var listCommand = cli.Command{
 			ID        string
 			Name      string
 			Namespace string
+			Status    string
 			IP        string
 		}
 
 		instances := []outInstance{}
 		for _, elem := range result {
-			instances = append(instances, outInstance{elem.ID, elem.Name, elem.Namespace, elem.NetOpts.IP})
+			instances = append(instances, outInstance{elem.ID, elem.Name, elem.Namespace,
+				string(elem.Status), elem.NetOpts.IP})
 		}
 
 		format := c.String("format")
@@ -56,10 +59,10 @@ var listCommand = cli.Command{
 			format = `{{table .}}`
 		}
 
-		err = tfortools.OutputToTemplate(os.Stdout, "format", format, instances, nil)
+		err = tfortools.OutputToTemplate(c.App.Writer, "format", format, instances, nil)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, tfortools.GenerateUsageDecorated("format", instances, nil))
-			return fmt.Errorf("unable to execute template : %v", err)
+			fmt.Fprintln(c.App.ErrWriter, tfortools.GenerateUsageDecorated("format", instances, nil))
+			return fmt.Errorf("unable to execute template : %w", err)
 		}
 
 		return nil
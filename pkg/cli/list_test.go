@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines/fake"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func addInstance(env *testEnv, namespace, name, ip string) {
+	env.engine.Add(fake.Instance{Instance: vm.Instance{
+		Name:      name,
+		Namespace: namespace,
+		NetOpts:   vm.NetworkingOptions{IP: ip},
+	}})
+}
+
+func TestList(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm-a", "172.17.0.2")
+	addInstance(env, testNamespace, "vm-b", "172.17.0.3")
+	addInstance(env, "other", "vm-c", "172.17.0.4")
+
+	out, err := env.run("list")
+	assert.NilError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, len(lines), 3)
+	assert.DeepEqual(t, strings.Fields(lines[0]), []string{"ID", "Name", "Namespace", "Status", "IP"})
+	assert.DeepEqual(t, strings.Fields(lines[1]), []string{"fake000001", "vm-a", testNamespace, "stopped", "172.17.0.2"})
+	assert.DeepEqual(t, strings.Fields(lines[2]), []string{"fake000002", "vm-b", testNamespace, "stopped", "172.17.0.3"})
+
+	out, err = env.run("list", "--all", "-f", `{{range .}}{{.Name}}={{.IP}} {{end}}`)
+	assert.NilError(t, err)
+	assert.Equal(t, out, "vm-a=172.17.0.2 vm-b=172.17.0.3 vm-c=172.17.0.4 ")
+
+	out, err = env.run("list", "-f", `{{select (filterRegexp . "Name" "vm-b") "IP"}}`)
+	assert.NilError(t, err)
+	assert.Equal(t, strings.TrimSpace(out), "172.17.0.3")
+
+	_, err = env.run("start", "vm-b")
+	assert.NilError(t, err)
+
+	out, err = env.run("list", "-f", `{{range .}}{{.Name}}={{.Status}} {{end}}`)
+	assert.NilError(t, err)
+	assert.Equal(t, out, "vm-a=stopped vm-b=running ")
+}
+
+func TestListErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("list", "-f", "{{.Missing}}")
+	assert.Assert(t, is.ErrorContains(err, "unable to execute template"))
+
+	env.engine.FailOn("ListVM", errors.New("injected"))
+	_, err = env.run("list")
+	assert.Assert(t, is.ErrorContains(err, "injected"))
+}
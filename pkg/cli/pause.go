@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var pauseCommand = cli.Command{
+	Name:  "pause",
+	Usage: "Freeze a running GoVM Instance, keeping its memory",
+	Flags: []cli.Flag{},
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm pause [command options] [name]")
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+		err = engine.PauseVM(ctx, namespace, name)
+		if err != nil {
+			return fmt.Errorf("error when pausing the GoVM Instance %v: %w", name, err)
+		}
+		recordStatus(c.String("workdir"), namespace, name, vm.StatusPaused)
+
+		log.Printf("GoVM Instance %v has been successfully paused", name)
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var resumeCommand = cli.Command{
+	Name:  "resume",
+	Usage: "Resume a paused GoVM Instance",
+	Flags: []cli.Flag{},
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm resume [command options] [name]")
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+		err = engine.ResumeVM(ctx, namespace, name)
+		if err != nil {
+			return fmt.Errorf("error when resuming the GoVM Instance %v: %w", name, err)
+		}
+		recordStatus(c.String("workdir"), namespace, name, vm.StatusRunning)
+
+		log.Printf("GoVM Instance %v has been successfully resumed", name)
+
+		return nil
+	},
+}
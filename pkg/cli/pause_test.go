@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPauseResume(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("pause", "vm")
+	assert.NilError(t, err)
+
+	out, err := env.run("list")
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, strings.Fields(lines[1])[3], "paused")
+
+	out, err = env.run("inspect", "vm")
+	assert.NilError(t, err)
+
+	ins := vm.Instance{}
+	assert.NilError(t, json.Unmarshal([]byte(out), &ins))
+	assert.Equal(t, ins.Status, vm.StatusPaused)
+
+	rec, err := store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Status, vm.StatusPaused)
+
+	_, err = env.run("resume", "vm")
+	assert.NilError(t, err)
+
+	stored, ok := env.engine.Get(testNamespace, "vm")
+	assert.Assert(t, ok)
+	assert.Assert(t, stored.Running && !stored.Paused)
+
+	rec, err = store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.Status, vm.StatusRunning)
+}
+
+func TestPauseErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	_, err := env.run("pause")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+
+	_, err = env.run("pause", "vm")
+	assert.Assert(t, errors.Is(err, engines.ErrVMNotRunning), "got %v", err)
+	assert.Assert(t, is.ErrorContains(err, "error when pausing the GoVM Instance vm"))
+
+	_, err = env.run("resume", "missing")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+}
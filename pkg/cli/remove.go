@@ -1,11 +1,9 @@
 package cli
 
 import (
-	"errors"
 	"fmt"
-	"os"
 
-	"github.com/govm-project/govm/engines/docker"
+	"github.com/govm-project/govm/engines"
 	cli "github.com/urfave/cli/v2"
 
 	log "github.com/sirupsen/logrus"
@@ -16,30 +14,37 @@ var removeCommand = cli.Command{
 	Name:    "remove",
 	Aliases: []string{"delete", "rm", "del"},
 	Usage:   "Remove VMs",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.BoolFlag{
 			Name:    "all",
 			Aliases: []string{"a"},
-			Usage:   "Remove all VMs",
+			Usage:   "Remove all VMs from the namespace",
 		},
-	},
+		&cli.BoolFlag{
+			Name:  "keep-disks",
+			Usage: "Keep every data disk, not only the ones flagged with keep",
+		},
+	}, stopFlags()...),
 	Action: func(c *cli.Context) error {
 		if c.NArg() <= 0 && !c.Bool("all") {
-			err := errors.New("missing VM name")
-			fmt.Println(err)
-			fmt.Printf("USAGE:\n govm remove [command options] [name]\n")
-			os.Exit(1)
+			return usageError("missing VM name\n" +
+				"USAGE:\n govm remove [command options] [name]")
 		}
 
 		namespace := c.String("namespace")
-		engine := docker.Engine{}
-		engine.Init()
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
 
 		names := []string{}
-		if all := c.Bool("all"); all {
-			instances, err := engine.List(namespace, all)
+		if c.Bool("all") {
+			instances, err := engine.ListVM(ctx, namespace, false)
 			if err != nil {
-				log.Fatalf("Error when listing current GoVM instances: %v", err)
+				return fmt.Errorf("error when listing current GoVM instances: %w", err)
 			}
 			for _, instance := range instances {
 				names = append(names, instance.Name)
@@ -49,10 +54,14 @@ var removeCommand = cli.Command{
 		}
 
 		for _, name := range names {
-			err := engine.Delete(namespace, name)
+			err := engine.DeleteVM(ctx, namespace, name, engines.DeleteOptions{
+				StopOptions: stopOptions(c),
+				KeepDisks:   c.Bool("keep-disks"),
+			})
 			if err != nil {
-				log.Fatalf("Error when removing the VM %v: %v", name, err)
+				return fmt.Errorf("error when removing the VM %v: %w", name, err)
 			}
+			forgetVM(c.String("workdir"), namespace, name)
 
 			log.Printf("GoVM Instance %v has been successfully removed", name)
 		}
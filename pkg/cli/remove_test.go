@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRemove(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm-a", "")
+	addInstance(env, testNamespace, "vm-b", "")
+
+	_, err := env.run("remove", "vm-a")
+	assert.NilError(t, err)
+
+	_, ok := env.engine.Get(testNamespace, "vm-a")
+	assert.Assert(t, !ok)
+
+	_, ok = env.engine.Get(testNamespace, "vm-b")
+	assert.Assert(t, ok)
+
+	_, err = env.run("remove")
+	assert.Assert(t, is.ErrorContains(err, "missing VM name"))
+}
+
+func TestRemoveKeepDisks(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm-a", "")
+	addInstance(env, testNamespace, "vm-b", "")
+
+	_, err := env.run("remove", "--keep-disks", "vm-a")
+	assert.NilError(t, err)
+
+	opts, ok := env.engine.Deleted(testNamespace, "vm-a")
+	assert.Assert(t, ok)
+	assert.Assert(t, opts.KeepDisks)
+
+	_, err = env.run("remove", "vm-b")
+	assert.NilError(t, err)
+
+	opts, ok = env.engine.Deleted(testNamespace, "vm-b")
+	assert.Assert(t, ok)
+	assert.Assert(t, !opts.KeepDisks)
+}
+
+func TestRemoveAll(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm-a", "")
+	addInstance(env, testNamespace, "vm-b", "")
+	addInstance(env, "other", "vm-c", "")
+
+	_, err := env.run("rm", "--all")
+	assert.NilError(t, err)
+
+	for _, name := range []string{"vm-a", "vm-b"} {
+		_, ok := env.engine.Get(testNamespace, name)
+		assert.Assert(t, !ok, name)
+	}
+
+	// VMs from other namespaces are left alone
+	_, ok := env.engine.Get("other", "vm-c")
+	assert.Assert(t, ok)
+}
+
+func TestRemoveAllFailure(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm-a", "")
+
+	env.engine.FailOn("DeleteVM", errors.New("injected"))
+
+	_, err := env.run("remove", "--all")
+	assert.Assert(t, is.ErrorContains(err, "error when removing the VM vm-a: injected"))
+}
@@ -1,53 +1,94 @@
 package cli
 
 import (
-	"errors"
 	"fmt"
-	"os"
+	"path/filepath"
 
-	"github.com/govm-project/govm/engines/docker"
+	"github.com/govm-project/govm/engines"
 	log "github.com/sirupsen/logrus"
 	cli "github.com/urfave/cli/v2"
 )
 
 // nolint: gochecknoglobals
 var saveCommand = cli.Command{
-	Name:    "save",
-	Aliases: []string{"snapshot"},
-	Usage:   "Saves a GoVM Instance",
+	Name:  "save",
+	Usage: "Saves a GoVM Instance",
+	Description: "Flattens the disk of the VM and its parent image into a standalone image.\n" +
+		"The image is checked before it replaces the output file.",
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "out",
 			Value: "backup.img",
 			Usage: "Path to backup file",
 		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: engines.FormatQcow2,
+			Usage: "image format, qcow2 or raw",
+		},
+		&cli.BoolFlag{
+			Name:  "compress",
+			Usage: "compress the qcow2 image",
+		},
 		&cli.BoolFlag{
 			Name:  "stopvm",
 			Value: false,
-			Usage: "Stop the VM during snapshot",
+			Usage: "Stop the VM during the save",
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Usage:   "don't report the progress",
 		},
 	},
-	Action: func(ctx *cli.Context) error {
-		if ctx.NArg() <= 0 {
-			err := errors.New("missing GoVM Instance name")
-			fmt.Println(err)
-			fmt.Printf("USAGE:\n govm stop [command options] [name]\n")
-			os.Exit(1)
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm save [command options] [name]")
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
 		}
 
-		namespace := ctx.String("namespace")
-		name := ctx.Args().First()
-		backupFile := ctx.String("out")
-		stopVM := ctx.Bool("stopvm")
+		opts := engines.SaveOptions{
+			Output:   c.String("out"),
+			Format:   c.String("format"),
+			Compress: c.Bool("compress"),
+			Stop:     c.Bool("stopvm"),
+		}
+
+		reported := -1
+		if !c.Bool("quiet") {
+			opts.Progress = func(percent float64) {
+				if int(percent) != reported {
+					reported = int(percent)
+					fmt.Fprintf(c.App.ErrWriter, "\rSaving %v: %3d%%", name, reported)
+				}
+			}
+		}
+
+		err = engine.SaveVM(ctx, namespace, name, opts)
+		if reported >= 0 {
+			fmt.Fprintln(c.App.ErrWriter)
+		}
 
-		engine := docker.Engine{}
-		engine.Init()
-		err := engine.Save(namespace, name, backupFile, stopVM)
 		if err != nil {
-			log.Fatalf("Error when saving the GoVM Instance %v: %v", name, err)
+			return fmt.Errorf("error when saving the GoVM Instance %v: %w", name, err)
+		}
+
+		if out, err := filepath.Abs(c.String("out")); err == nil {
+			recordSave(c.String("workdir"), namespace, name, out)
 		}
 
-		log.Printf("GoVM Instance %v has been successfully stopped", name)
+		log.Printf("GoVM Instance %v has been successfully saved to %v", name, c.String("out"))
 
 		return nil
 	},
@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSave(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	out := filepath.Join(t.TempDir(), "vm.raw")
+
+	stdout, err := env.run("save", "--out", out, "--format", "raw", "vm")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(stdout, "Saving vm: 100%\n"))
+
+	stdout, err = env.run("save", "--out", out, "--quiet", "vm")
+	assert.NilError(t, err)
+	assert.Check(t, !strings.Contains(stdout, "Saving vm"), stdout)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.DeepEqual(t, ins.Saves, []string{out, out})
+}
+
+func TestSaveErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	tests := []struct {
+		args []string
+		err  string
+		code int
+	}{
+		{[]string{"--out", "vm.img"}, "missing GoVM Instance name", ExitUsage},
+		{[]string{"--format", "vmdk", "vm"}, "supported formats are qcow2 and raw", ExitInvalidSpec},
+		{[]string{"--format", "raw", "--compress", "vm"}, "only qcow2 images can be compressed", ExitInvalidSpec},
+		{[]string{"--out", "/nonexistent/vm.img", "vm"}, "output directory", ExitFailure},
+		{[]string{"missing"}, "VM not found", ExitVMNotFound},
+	}
+
+	for _, tc := range tests {
+		_, err := env.run(append([]string{"save"}, tc.args...)...)
+		assert.Check(t, is.ErrorContains(err, tc.err), tc.args)
+		assert.Check(t, ExitCode(err) == tc.code, tc.args)
+	}
+}
@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/intel/tfortools"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var snapshotCommand = cli.Command{
+	Name:  "snapshot",
+	Usage: "Manage the disk snapshots of a GoVM Instance",
+	Subcommands: []*cli.Command{
+		&snapshotCreateCommand,
+		&snapshotListCommand,
+		&snapshotRevertCommand,
+		&snapshotDeleteCommand,
+	},
+}
+
+// nolint: gochecknoglobals
+var snapshotCreateCommand = cli.Command{
+	Name:      "create",
+	Usage:     "Take a named snapshot of the disk of a GoVM Instance",
+	ArgsUsage: "[name] [snapshot]",
+	Description: "Snapshots live inside the copy-on-write disk. The RAM of a running VM is\n" +
+		"saved along with its disk, stopped VMs get disk only snapshots.",
+	Action: func(c *cli.Context) error {
+		name, snapshot, err := pairArgs(c, "snapshot create", "snapshot")
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		_, err = engine.CreateSnapshot(ctx, c.String("namespace"), name, snapshot)
+		if err != nil {
+			return fmt.Errorf("error when snapshotting the GoVM Instance %v: %w", name, err)
+		}
+
+		log.Printf("Snapshot %v of GoVM Instance %v has been successfully created", snapshot, name)
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var snapshotListCommand = cli.Command{
+	Name:      "list",
+	Aliases:   []string{"ls"},
+	Usage:     "List the disk snapshots of a GoVM Instance",
+	ArgsUsage: "[name]",
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm snapshot list [name]")
+		}
+
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := engine.ListSnapshots(ctx, c.String("namespace"), name)
+		if err != nil {
+			return fmt.Errorf("error when listing the snapshots of the GoVM Instance %v: %w", name, err)
+		}
+
+		type outSnapshot struct {
+			Name    string
+			Created string
+			VMSize  string
+		}
+
+		out := []outSnapshot{}
+		for _, snapshot := range snapshots {
+			out = append(out, outSnapshot{
+				Name:    snapshot.Name,
+				Created: snapshot.Created.Local().Format("2006-01-02 15:04:05"),
+				VMSize:  formatSize(snapshot.VMStateSize),
+			})
+		}
+
+		return tfortools.OutputToTemplate(c.App.Writer, "format", "{{table .}}", out, nil)
+	},
+}
+
+// nolint: gochecknoglobals
+var snapshotRevertCommand = cli.Command{
+	Name:      "revert",
+	Usage:     "Bring the disk of a GoVM Instance back to one of its snapshots",
+	ArgsUsage: "[name] [snapshot]",
+	Description: "Running VMs get their RAM back as well, which needs a snapshot taken while\n" +
+		"the VM was running. Changes made since the snapshot are lost.",
+	Action: func(c *cli.Context) error {
+		name, snapshot, err := pairArgs(c, "snapshot revert", "snapshot")
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		err = engine.RevertSnapshot(ctx, c.String("namespace"), name, snapshot)
+		if err != nil {
+			return fmt.Errorf("error when reverting the GoVM Instance %v: %w", name, err)
+		}
+
+		log.Printf("GoVM Instance %v has been successfully reverted to %v", name, snapshot)
+
+		return nil
+	},
+}
+
+// nolint: gochecknoglobals
+var snapshotDeleteCommand = cli.Command{
+	Name:      "delete",
+	Aliases:   []string{"rm"},
+	Usage:     "Remove a disk snapshot of a GoVM Instance",
+	ArgsUsage: "[name] [snapshot]",
+	Action: func(c *cli.Context) error {
+		name, snapshot, err := pairArgs(c, "snapshot delete", "snapshot")
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		err = engine.DeleteSnapshot(ctx, c.String("namespace"), name, snapshot)
+		if err != nil {
+			return fmt.Errorf("error when deleting the snapshot of the GoVM Instance %v: %w", name, err)
+		}
+
+		log.Printf("Snapshot %v of GoVM Instance %v has been successfully deleted", snapshot, name)
+
+		return nil
+	},
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/govm-project/govm/engines"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSnapshot(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm", "--ram", "2048")
+	assert.NilError(t, err)
+
+	_, err = env.run("snapshot", "create", "vm", "live")
+	assert.NilError(t, err)
+
+	_, err = env.run("stop", "--force", "vm")
+	assert.NilError(t, err)
+
+	_, err = env.run("snapshot", "create", "vm", "offline")
+	assert.NilError(t, err)
+
+	out, err := env.run("snapshot", "ls", "vm")
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, len(lines), 3)
+	assert.DeepEqual(t, strings.Fields(lines[0]), []string{"Name", "Created", "VMSize"})
+	assert.Equal(t, strings.Fields(lines[1])[0], "live")
+	assert.Equal(t, strings.Fields(lines[1])[3], "2G")
+	assert.Equal(t, strings.Fields(lines[2])[3], "0")
+
+	_, err = env.run("snapshot", "revert", "vm", "offline")
+	assert.NilError(t, err)
+
+	_, err = env.run("snapshot", "rm", "vm", "live")
+	assert.NilError(t, err)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.DeepEqual(t, ins.Reverted, []string{"offline"})
+	assert.Equal(t, len(ins.Snapshots), 1)
+	assert.Equal(t, ins.Snapshots[0].Name, "offline")
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	_, err := env.run("snapshot", "revert", "vm")
+	assert.Equal(t, ExitCode(err), ExitUsage)
+	assert.Assert(t, is.ErrorContains(err, "govm snapshot revert [name] [snapshot]"))
+
+	_, err = env.run("snapshot", "create", "vm", "no/slash")
+	assert.Equal(t, ExitCode(err), ExitInvalidSpec)
+
+	_, err = env.run("snapshot", "rm", "vm", "missing")
+	assert.Assert(t, errors.Is(err, engines.ErrSnapshotNotFound), "got %v", err)
+	assert.Assert(t, is.ErrorContains(err, "error when deleting the snapshot of the GoVM Instance vm"))
+
+	_, err = env.run("snapshot", "ls", "missing")
+	assert.Equal(t, ExitCode(err), ExitVMNotFound)
+}
@@ -3,7 +3,6 @@ package cli
 import (
 	"fmt"
 
-	"github.com/govm-project/govm/engines/docker"
 	"github.com/govm-project/govm/pkg/termutil"
 	cli "github.com/urfave/cli/v2"
 )
@@ -16,7 +15,7 @@ var sshCommand = cli.Command{
 		&cli.StringFlag{
 			Name:    "user",
 			Aliases: []string{"u"},
-			Usage:   "login as this username",
+			Usage:   "login as this username (default: the user of the image catalog)",
 		},
 		&cli.StringFlag{
 			Name:    "key",
@@ -27,20 +26,36 @@ var sshCommand = cli.Command{
 	},
 	Action: func(c *cli.Context) error {
 		if c.Args().Len() != 1 {
-			return fmt.Errorf("VM name required")
+			return usageError("VM name required")
 		}
 		name := c.Args().First()
 		namespace := c.String("namespace")
+		key := c.String("key")
+		term := termutil.StdTerminal()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		// The image catalog may have recorded the login of the VM
 		user := c.String("user")
 		if user == "" {
-			return fmt.Errorf("--user argument required")
+			ins, err := engine.InspectVM(ctx, namespace, name)
+			if err != nil {
+				return fmt.Errorf("error when connecting to the GoVM Instance %v: %w", name, err)
+			}
+
+			user = withRecord(c.String("workdir"), ins).SSHUser
 		}
-		key := c.String("key")
-		term := termutil.StdTerminal()
 
-		engine := docker.Engine{}
-		engine.Init()
+		if user == "" {
+			return usageError("--user argument required")
+		}
 
-		return engine.SSHVM(namespace, name, user, key, term)
+		return engine.SSHVM(ctx, namespace, name, user, key, term)
 	},
 }
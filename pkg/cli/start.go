@@ -1,11 +1,9 @@
 package cli
 
 import (
-	"errors"
 	"fmt"
-	"os"
 
-	"github.com/govm-project/govm/engines/docker"
+	"github.com/govm-project/govm/vm"
 	log "github.com/sirupsen/logrus"
 	cli "github.com/urfave/cli/v2"
 )
@@ -18,21 +16,25 @@ var startCommand = cli.Command{
 	Flags:   []cli.Flag{},
 	Action: func(c *cli.Context) error {
 		if c.NArg() <= 0 {
-			err := errors.New("missing GoVM Instance name")
-			fmt.Println(err)
-			fmt.Printf("USAGE:\n govm start [command options] [name]\n")
-			os.Exit(1)
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm start [command options] [name]")
 		}
 
 		namespace := c.String("namespace")
 		name := c.Args().First()
 
-		engine := docker.Engine{}
-		engine.Init()
-		err := engine.Start(namespace, name)
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+		err = engine.StartVM(ctx, namespace, name)
 		if err != nil {
-			log.Fatalf("Error when starting the GoVM Instance %v: %v", name, err)
+			return fmt.Errorf("error when starting the GoVM Instance %v: %w", name, err)
 		}
+		recordStatus(c.String("workdir"), namespace, name, vm.StatusRunning)
 
 		log.Printf("GoVM Instance %v has been successfully started", name)
 
@@ -1,11 +1,10 @@
 package cli
 
 import (
-	"errors"
 	"fmt"
-	"os"
 
-	"github.com/govm-project/govm/engines/docker"
+	"github.com/govm-project/govm/engines"
+	"github.com/govm-project/govm/vm"
 	log "github.com/sirupsen/logrus"
 	cli "github.com/urfave/cli/v2"
 )
@@ -15,27 +14,56 @@ var stopCommand = cli.Command{
 	Name:    "stop",
 	Aliases: []string{"down", "d"},
 	Usage:   "Stop a GoVM Instance",
-	Flags:   []cli.Flag{},
+	Description: "The guest is asked to power off through ACPI and stopped the hard way if\n" +
+		"it hasn't halted after --timeout.",
+	Flags: stopFlags(),
 	Action: func(c *cli.Context) error {
 		if c.NArg() <= 0 {
-			err := errors.New("missing GoVM Instance name")
-			fmt.Println(err)
-			fmt.Printf("USAGE:\n govm stop [command options] [name]\n")
-			os.Exit(1)
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm stop [command options] [name]")
 		}
 
 		namespace := c.String("namespace")
 		name := c.Args().First()
 
-		engine := docker.Engine{}
-		engine.Init()
-		err := engine.Stop(namespace, name)
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+		err = engine.StopVM(ctx, namespace, name, stopOptions(c))
 		if err != nil {
-			log.Fatalf("Error when stopping the GoVM Instance %v: %v", name, err)
+			return fmt.Errorf("error when stopping the GoVM Instance %v: %w", name, err)
 		}
+		recordStatus(c.String("workdir"), namespace, name, vm.StatusStopped)
 
 		log.Printf("GoVM Instance %v has been successfully stopped", name)
 
 		return nil
 	},
 }
+
+// stopFlags are the flags of the commands stopping a running VM
+func stopFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Value: engines.DefaultStopTimeout,
+			Usage: "how long the guest gets to power off before being stopped",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "stop right away, without asking the guest to power off",
+		},
+	}
+}
+
+// stopOptions returns the stop options set with stopFlags
+func stopOptions(c *cli.Context) engines.StopOptions {
+	return engines.StopOptions{
+		Timeout: c.Duration("timeout"),
+		Force:   c.Bool("force"),
+	}
+}
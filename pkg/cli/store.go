@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"errors"
+	"time"
+
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// recordVM stores the spec of a VM the engine has just created. The VM is
+// usable without its record, so failures are only logged. Records live in
+// the --workdir every command looks them up in, whatever the spec workdir.
+func recordVM(c *cli.Context, spec vm.Instance, id string) {
+	spec.ID = id
+	spec.Status = vm.StatusCreated
+	spec.Created = time.Now().UTC()
+
+	rec := &store.Record{
+		Engine: c.String("engine"),
+		Spec:   spec,
+	}
+
+	if err := store.New(c.String("workdir")).Put(rec); err != nil {
+		log.Warnf("Couldn't record the spec of %v: %v", spec.Name, err)
+	}
+}
+
+// recordSpec saves the updated spec of a VM, creating its record if it had
+// none
+func recordSpec(c *cli.Context, namespace, ref string, spec vm.Instance) {
+	records := store.New(c.String("workdir"))
+
+	rec, err := records.Get(namespace, ref)
+	if err != nil {
+		rec = &store.Record{Engine: c.String("engine")}
+	} else {
+		spec.ID = rec.Spec.ID
+		spec.Status = rec.Spec.Status
+		spec.Created = rec.Spec.Created
+	}
+
+	rec.Spec = spec
+
+	if err := records.Put(rec); err != nil {
+		log.Warnf("Couldn't record the spec of %v: %v", spec.Name, err)
+	}
+}
+
+// recordStatus saves the new lifecycle status of a VM into its record, if
+// it has one
+func recordStatus(workdir, namespace, ref string, status vm.Status) {
+	err := store.New(workdir).Update(namespace, ref, func(rec *store.Record) error {
+		rec.Spec.Status = status
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Warnf("Couldn't record the status of %v: %v", ref, err)
+	}
+}
+
+// recordDiskSize saves the new root disk size, in GB, of a VM into its
+// record, if it has one
+func recordDiskSize(workdir, namespace, ref string, size int) {
+	err := store.New(workdir).Update(namespace, ref, func(rec *store.Record) error {
+		rec.Spec.Size.DISK = size
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Warnf("Couldn't record the disk size of %v: %v", ref, err)
+	}
+}
+
+// recordSave adds the output of govm save to the record of a VM, if it has
+// one, so that govm df reports it
+func recordSave(workdir, namespace, ref, file string) {
+	err := store.New(workdir).Update(namespace, ref, func(rec *store.Record) error {
+		for _, save := range rec.Saves {
+			if save == file {
+				return nil
+			}
+		}
+
+		rec.Saves = append(rec.Saves, file)
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Warnf("Couldn't record the save of %v: %v", ref, err)
+	}
+}
+
+// withRecord completes the instance reported by the engine with the spec
+// recorded on create. The engine stays authoritative for the runtime state.
+func withRecord(workdir string, ins vm.Instance) vm.Instance {
+	rec, err := store.New(workdir).Get(ins.Namespace, ins.Name)
+	if err != nil {
+		return ins
+	}
+
+	spec := rec.Spec
+	spec.Status = ins.Status
+	spec.VNCPort = ins.VNCPort
+	spec.Labels = ins.Labels
+
+	if ins.NetOpts.IP != "" {
+		spec.NetOpts.IP = ins.NetOpts.IP
+	}
+
+	return spec
+}
+
+// forgetVM deletes the record of a removed VM
+func forgetVM(workdir, namespace, ref string) {
+	if err := store.New(workdir).Delete(namespace, ref); err != nil {
+		log.Warnf("Couldn't delete the record of %v: %v", ref, err)
+	}
+}
@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// nolint: gochecknoglobals
+var updateCommand = cli.Command{
+	Name:      "update",
+	Usage:     "Change the size or configuration of an existing VM",
+	ArgsUsage: "[name]",
+	Description: "The VM is recreated from its updated spec. Its disk and cloud-init data are kept,\n" +
+		"a running VM is restarted.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "flavor",
+			Usage: "VM specs descriptor, the root disk size is kept",
+		},
+		&cli.StringFlag{
+			Name:  "cpumodel",
+			Usage: "Model of the virtual cpu. See: qemu-system-x86_64 -cpu help",
+		},
+		&cli.IntFlag{
+			Name:  "sockets",
+			Usage: "Number of sockets",
+		},
+		&cli.IntFlag{
+			Name:  "cpus",
+			Usage: "Number of cpus",
+		},
+		&cli.IntFlag{
+			Name:  "cores",
+			Usage: "Number of cores",
+		},
+		&cli.IntFlag{
+			Name:  "threads",
+			Usage: "Number of threads",
+		},
+		&cli.IntFlag{
+			Name:  "ram",
+			Usage: "Allocated RAM in MB",
+		},
+		&cli.StringSliceFlag{
+			Name:  "share",
+			Usage: "Replace the shared directories. e.g. --share /host/path:/guest/path",
+		},
+		&cli.BoolFlag{
+			Name:  "clear-shares",
+			Usage: "Remove every shared directory",
+		},
+		&cli.StringSliceFlag{
+			Name:  "container-env",
+			Usage: "Replace the container environment. e.g. --container-env http_proxy=$http_proxy",
+		},
+		&cli.BoolFlag{
+			Name:  "clear-container-env",
+			Usage: "Remove every container environment variable",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "Replace the DNS servers",
+		},
+		&cli.StringFlag{
+			Name:  "restart",
+			Usage: "Restart policy: no, always, unless-stopped or on-failure",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() <= 0 {
+			return usageError("missing GoVM Instance name\n" +
+				"USAGE:\n govm update [command options] [name]")
+		}
+
+		namespace := c.String("namespace")
+		name := c.Args().First()
+
+		ctx, cancel := commandContext(c)
+		defer cancel()
+
+		engine, err := newEngine(c)
+		if err != nil {
+			return err
+		}
+
+		// The recorded spec is complete, the engine only knows what it
+		// could rebuild from its own resources
+		var spec vm.Instance
+		if rec, err := store.New(c.String("workdir")).Get(namespace, name); err == nil {
+			spec = rec.Spec
+		} else if spec, err = engine.InspectVM(ctx, namespace, name); err != nil {
+			return fmt.Errorf("error when updating the GoVM Instance %v: %w", name, err)
+		}
+
+		if err := applyUpdates(c, &spec); err != nil {
+			return err
+		}
+
+		if err := spec.CheckShares(); err != nil {
+			return fmt.Errorf("error on VM Instance pre-check: %w", err)
+		}
+
+		if err := spec.CheckRestartPolicy(); err != nil {
+			return fmt.Errorf("error on VM Instance pre-check: %w", err)
+		}
+
+		err = engine.UpdateVM(ctx, namespace, name, spec)
+		if err != nil {
+			return fmt.Errorf("error when updating the GoVM Instance %v: %w", name, err)
+		}
+		recordSpec(c, namespace, name, spec)
+
+		log.Printf("GoVM Instance %v has been successfully updated", name)
+
+		return nil
+	},
+}
+
+// applyUpdates changes the spec fields set on the update command line
+// nolint: gocyclo
+func applyUpdates(c *cli.Context, spec *vm.Instance) error {
+	updated := false
+
+	if c.IsSet("flavor") {
+		disk := spec.Size.DISK
+		spec.Flavor = c.String("flavor")
+		spec.Size = vm.GetSizeFromFlavor(spec.Flavor)
+		spec.Size.DISK = disk
+		updated = true
+	}
+
+	if c.IsSet("cpumodel") {
+		spec.Size.CPUModel = c.String("cpumodel")
+		updated = true
+	}
+
+	for flag, field := range map[string]*int{
+		"sockets": &spec.Size.Sockets,
+		"cpus":    &spec.Size.Cpus,
+		"cores":   &spec.Size.Cores,
+		"threads": &spec.Size.Threads,
+		"ram":     &spec.Size.RAM,
+	} {
+		if !c.IsSet(flag) {
+			continue
+		}
+
+		if c.Int(flag) <= 0 {
+			return usageError(fmt.Sprintf("--%v must be greater than 0", flag))
+		}
+
+		*field = c.Int(flag)
+		updated = true
+	}
+
+	if c.Bool("clear-shares") {
+		spec.Shares = nil
+		updated = true
+	}
+
+	if c.IsSet("share") {
+		spec.Shares = c.StringSlice("share")
+		updated = true
+	}
+
+	if c.Bool("clear-container-env") {
+		spec.ContainerEnvVars = nil
+		updated = true
+	}
+
+	if c.IsSet("container-env") {
+		spec.ContainerEnvVars = c.StringSlice("container-env")
+		updated = true
+	}
+
+	if c.IsSet("dns") {
+		spec.NetOpts.DNS = c.StringSlice("dns")
+		updated = true
+	}
+
+	if c.IsSet("restart") {
+		spec.RestartPolicy = c.String("restart")
+		updated = true
+	}
+
+	if !updated {
+		return usageError("nothing to update\n" +
+			"USAGE:\n govm update [command options] [name]")
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/govm-project/govm/internal/store"
+	"github.com/govm-project/govm/vm"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestUpdate(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.run("create", "--image", env.image, "--key", env.key, "--name", "vm",
+		"--disk", "30", "--share", env.workdir+":/mnt/host")
+	assert.NilError(t, err)
+
+	_, err = env.run("update", "--flavor", "large", "--ram", "12288", "--dns", "1.1.1.1",
+		"--clear-shares", "--restart", "unless-stopped", "vm")
+	assert.NilError(t, err)
+
+	size := vm.GetSizeFromFlavor("large")
+	size.RAM = 12288
+	size.DISK = 30
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.Equal(t, ins.ID, "fake000001")
+	assert.Assert(t, ins.Running)
+	assert.Equal(t, ins.Flavor, "large")
+	assert.Equal(t, ins.Size, size)
+	assert.DeepEqual(t, ins.NetOpts.DNS, []string{"1.1.1.1"})
+	assert.Equal(t, len(ins.Shares), 0)
+	assert.Equal(t, ins.RestartPolicy, "unless-stopped")
+	assert.Equal(t, ins.ParentImage, env.image)
+
+	rec, err := store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Spec.ID, "fake000001")
+	assert.Equal(t, rec.Spec.Status, vm.StatusRunning)
+	assert.Equal(t, rec.Spec.Size, size)
+}
+
+func TestUpdateWithoutRecord(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "172.17.0.2")
+
+	_, err := env.run("update", "--container-env", "http_proxy=http://proxy:3128", "vm")
+	assert.NilError(t, err)
+
+	ins, _ := env.engine.Get(testNamespace, "vm")
+	assert.DeepEqual(t, ins.ContainerEnvVars, []string{"http_proxy=http://proxy:3128"})
+
+	// The VM has a record from now on
+	rec, err := store.New(env.workdir).Get(testNamespace, "vm")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rec.Spec.ContainerEnvVars, []string{"http_proxy=http://proxy:3128"})
+}
+
+func TestUpdateErrors(t *testing.T) {
+	env := newTestEnv(t)
+	addInstance(env, testNamespace, "vm", "")
+
+	_, err := env.run("update", "--ram", "2048")
+	assert.Assert(t, is.ErrorContains(err, "missing GoVM Instance name"))
+
+	_, err = env.run("update", "vm")
+	assert.Assert(t, is.ErrorContains(err, "nothing to update"))
+
+	_, err = env.run("update", "--ram", "0", "vm")
+	assert.Assert(t, is.ErrorContains(err, "--ram must be greater than 0"))
+
+	_, err = env.run("update", "--restart", "sometimes", "vm")
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+
+	_, err = env.run("update", "--share", "/nonexistent:/mnt", "vm")
+	assert.Assert(t, errors.Is(err, vm.ErrInvalidSpec), "got %v", err)
+
+	_, err = env.run("update", "--ram", "2048", "missing")
+	assert.Assert(t, is.ErrorContains(err, "error when updating the GoVM Instance missing"))
+}
@@ -0,0 +1,319 @@
+// Package qmp is a client for the QEMU Machine Protocol, the JSON monitor
+// every GoVM instance exposes on a unix socket of its data directory.
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// EventBuffer is the number of events a client keeps until they are read.
+// Newer events are dropped once it is full.
+const EventBuffer = 64
+
+// ErrClosed is returned by the commands of a client whose connection is
+// closed
+var ErrClosed = errors.New("QMP connection closed")
+
+// Error is an error reply of the QMP server
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Class, e.Desc)
+}
+
+// Event is an asynchronous QMP event, e.g. STOP or SHUTDOWN
+type Event struct {
+	Name string          `json:"event"`
+	Data json.RawMessage `json:"data"`
+	Time time.Time       `json:"-"`
+}
+
+// Version is the QEMU version announced in the QMP greeting
+type Version struct {
+	QEMU struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Micro int `json:"micro"`
+	} `json:"qemu"`
+	Package string `json:"package"`
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.QEMU.Major, v.QEMU.Minor, v.QEMU.Micro)
+}
+
+// message is any message sent by a QMP server: the greeting, a command
+// reply or an event
+type message struct {
+	Greeting *struct {
+		Version Version `json:"version"`
+	} `json:"QMP"`
+	ID        *uint64         `json:"id"`
+	Return    json.RawMessage `json:"return"`
+	Error     *Error          `json:"error"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+type request struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        uint64      `json:"id"`
+}
+
+// Client is a QMP connection. Its commands can be run concurrently.
+type Client struct {
+	conn    net.Conn
+	version Version
+	events  chan Event
+	done    chan struct{}
+
+	writeMu sync.Mutex
+	encoder *json.Encoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *message
+	err     error
+}
+
+// Dial connects to the QMP monitor listening on socket and negotiates the
+// capabilities
+func Dial(ctx context.Context, socket string) (*Client, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(ctx, conn)
+}
+
+// NewClient runs the QMP handshake over conn. The connection is owned by the
+// client and closed on failure.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:    conn,
+		events:  make(chan Event, EventBuffer),
+		done:    make(chan struct{}),
+		encoder: json.NewEncoder(conn),
+		pending: map[uint64]chan *message{},
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// The greeting is read before the reader loop starts
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	greeting, err := read(reader)
+	close(stop)
+
+	if err == nil && greeting.Greeting == nil {
+		err = errors.New("unexpected QMP greeting")
+	}
+
+	if err != nil {
+		conn.Close()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	c.version = greeting.Greeting.Version
+
+	go c.readLoop(reader)
+
+	if err := c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Version returns the version of the QEMU process on the other end
+func (c *Client) Version() Version {
+	return c.version
+}
+
+// Events returns the events sent by the server. The channel is closed with
+// the connection.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Done is closed once the connection is lost or closed, e.g. when QEMU exits
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Execute runs command with the given arguments and decodes its return value
+// into result, unless it is nil
+func (c *Client) Execute(ctx context.Context, command string, arguments, result interface{}) error {
+	reply := make(chan *message, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	err := c.encoder.Encode(request{Execute: command, Arguments: arguments, ID: id})
+	c.writeMu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("QMP %v: %w", command, err)
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Error != nil {
+			return fmt.Errorf("QMP %v: %w", command, msg.Error)
+		}
+
+		if result == nil || msg.Return == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(msg.Return, result); err != nil {
+			return fmt.Errorf("QMP %v: unexpected reply: %w", command, err)
+		}
+
+		return nil
+	case <-c.done:
+		return fmt.Errorf("QMP %v: %w", command, c.closeErr())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+
+	return err
+}
+
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// readLoop dispatches the replies to the pending commands and queues the
+// events until the connection is closed
+func (c *Client) readLoop(reader *bufio.Reader) {
+	var err error
+
+	for {
+		var msg *message
+
+		if msg, err = read(reader); err != nil {
+			break
+		}
+
+		if msg.Event != "" {
+			event := Event{
+				Name: msg.Event,
+				Data: msg.Data,
+				Time: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000),
+			}
+
+			select {
+			case c.events <- event:
+			default:
+			}
+
+			continue
+		}
+
+		if msg.ID == nil {
+			continue
+		}
+
+		c.mu.Lock()
+		reply, ok := c.pending[*msg.ID]
+		c.mu.Unlock()
+
+		if ok {
+			reply <- msg
+		}
+	}
+
+	c.mu.Lock()
+	c.err = ErrClosed
+	if !errors.Is(err, net.ErrClosed) {
+		c.err = fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+	c.mu.Unlock()
+
+	c.conn.Close()
+	close(c.events)
+	close(c.done)
+}
+
+// read reads the next newline delimited QMP message
+func read(reader *bufio.Reader) (*message, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &message{}
+	if err := json.Unmarshal(line, msg); err != nil {
+		return nil, fmt.Errorf("malformed QMP message: %w", err)
+	}
+
+	return msg, nil
+}
+
+// Command connects to the QMP monitor listening on socket, runs a single
+// command and decodes its return value into result, unless it is nil
+func Command(ctx context.Context, socket, command string, arguments, result interface{}) error {
+	c, err := Dial(ctx, socket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Execute(ctx, command, arguments, result)
+}
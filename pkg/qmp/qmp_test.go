@@ -0,0 +1,199 @@
+package qmp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/govm-project/govm/pkg/qmp"
+	"github.com/govm-project/govm/pkg/qmp/qmptest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newTestServer(t *testing.T) *qmptest.Server {
+	server, err := qmptest.NewServer(filepath.Join(t.TempDir(), "qmp"))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func dial(t *testing.T, server *qmptest.Server) *qmp.Client {
+	client, err := qmp.Dial(context.Background(), server.Socket)
+	assert.NilError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestExecute(t *testing.T) {
+	server := newTestServer(t)
+	server.Reply("query-status", map[string]interface{}{"status": "running", "running": true})
+	server.Handle("block_resize", func(args json.RawMessage) (interface{}, error) {
+		return nil, nil
+	})
+
+	client := dial(t, server)
+	assert.Equal(t, client.Version().String(), "6.2.0")
+
+	var status struct {
+		Status  string `json:"status"`
+		Running bool   `json:"running"`
+	}
+	assert.NilError(t, client.Execute(context.Background(), "query-status", nil, &status))
+	assert.Equal(t, status.Status, "running")
+	assert.Assert(t, status.Running)
+
+	args := map[string]interface{}{"device": "data", "size": 1 << 30}
+	assert.NilError(t, client.Execute(context.Background(), "block_resize", args, nil))
+
+	commands := server.Commands()
+	assert.Equal(t, len(commands), 3)
+	assert.Equal(t, commands[0].Name, "qmp_capabilities")
+	assert.Equal(t, commands[2].Name, "block_resize")
+	assert.Equal(t, string(commands[2].Arguments), `{"device":"data","size":1073741824}`)
+}
+
+func TestExecuteError(t *testing.T) {
+	server := newTestServer(t)
+	server.Fail("cont", "GenericError", "Resetting the Virtual Machine is required")
+	server.Handle("stop", func(json.RawMessage) (interface{}, error) {
+		return nil, errors.New("injected")
+	})
+
+	client := dial(t, server)
+
+	err := client.Execute(context.Background(), "cont", nil, nil)
+	assert.Assert(t, is.ErrorContains(err, "QMP cont: GenericError: Resetting the Virtual Machine is required"))
+
+	var qmpErr *qmp.Error
+	assert.Assert(t, errors.As(err, &qmpErr))
+	assert.Equal(t, qmpErr.Class, "GenericError")
+
+	err = client.Execute(context.Background(), "stop", nil, nil)
+	assert.Assert(t, is.ErrorContains(err, "GenericError: injected"))
+
+	err = client.Execute(context.Background(), "missing", nil, nil)
+	assert.Assert(t, is.ErrorContains(err, "CommandNotFound"))
+
+	// Failed commands don't break the connection
+	assert.NilError(t, client.Execute(context.Background(), "qmp_capabilities", nil, nil))
+}
+
+func TestEvents(t *testing.T) {
+	server := newTestServer(t)
+	release := make(chan struct{})
+	server.Handle("system_powerdown", func(json.RawMessage) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	client := dial(t, server)
+
+	// Events sent while a command runs don't get mixed with its reply
+	received := server.Received()
+	done := make(chan error)
+	go func() { done <- client.Execute(context.Background(), "system_powerdown", nil, nil) }()
+
+	<-received
+	server.Emit("POWERDOWN", nil)
+	server.Emit("SHUTDOWN", map[string]interface{}{"guest": true, "reason": "guest-shutdown"})
+	close(release)
+	assert.NilError(t, <-done)
+
+	event := <-client.Events()
+	assert.Equal(t, event.Name, "POWERDOWN")
+	assert.Assert(t, time.Since(event.Time) < time.Minute, "time %v", event.Time)
+
+	event = <-client.Events()
+	assert.Equal(t, event.Name, "SHUTDOWN")
+	assert.Equal(t, string(event.Data), `{"guest":true,"reason":"guest-shutdown"}`)
+
+	// QEMU exiting closes the events and fails the next commands
+	server.Close()
+
+	_, ok := <-client.Events()
+	assert.Assert(t, !ok)
+	<-client.Done()
+
+	err := client.Execute(context.Background(), "query-status", nil, nil)
+	assert.Assert(t, errors.Is(err, qmp.ErrClosed), "got %v", err)
+}
+
+func TestConcurrentExecute(t *testing.T) {
+	server := newTestServer(t)
+	server.Handle("echo", func(args json.RawMessage) (interface{}, error) {
+		return args, nil
+	})
+
+	client := dial(t, server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			var n int
+			assert.Check(t, client.Execute(context.Background(), "echo", i, &n))
+			assert.Check(t, is.Equal(n, i))
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestExecuteCancel(t *testing.T) {
+	server := newTestServer(t)
+	server.Handle("hang", func(json.RawMessage) (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	server.Reply("query-status", map[string]string{"status": "running"})
+
+	client := dial(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := client.Execute(ctx, "hang", nil, nil)
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+
+	// The late reply isn't taken for the one of the next command
+	var status struct{ Status string }
+	assert.NilError(t, client.Execute(context.Background(), "query-status", nil, &status))
+	assert.Equal(t, status.Status, "running")
+}
+
+func TestCommand(t *testing.T) {
+	server := newTestServer(t)
+	server.Reply("query-name", map[string]string{"name": "vm"})
+
+	var name struct{ Name string }
+	assert.NilError(t, qmp.Command(context.Background(), server.Socket, "query-name", nil, &name))
+	assert.Equal(t, name.Name, "vm")
+
+	err := qmp.Command(context.Background(), filepath.Join(t.TempDir(), "missing"), "query-name", nil, nil)
+	assert.Assert(t, err != nil)
+}
+
+func TestDialTimeout(t *testing.T) {
+	// A monitor that never greets, e.g. QEMU still starting
+	socket := filepath.Join(t.TempDir(), "qmp")
+	l, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = qmp.Dial(ctx, socket)
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+}
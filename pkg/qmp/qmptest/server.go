@@ -0,0 +1,254 @@
+// Package qmptest provides a scripted QMP server for tests. It speaks the
+// protocol over a unix socket, like the monitor of a GoVM instance.
+package qmptest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/govm-project/govm/pkg/qmp"
+)
+
+// Handler returns the reply of a command: a value encoded as its return, or
+// an error. A *qmp.Error keeps its class, other errors are GenericError.
+type Handler func(arguments json.RawMessage) (interface{}, error)
+
+// Command is a command received by the server
+type Command struct {
+	Name      string
+	Arguments json.RawMessage
+}
+
+// Server is a fake QMP monitor. Commands without handler are answered with
+// CommandNotFound, except qmp_capabilities.
+type Server struct {
+	// Socket is the path the server listens on
+	Socket string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	commands []Command
+	conns    map[net.Conn]*json.Encoder
+	received chan struct{}
+	exitOn   map[string]bool
+}
+
+// NewServer starts a server listening on socket
+func NewServer(socket string) (*Server, error) {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Socket:   socket,
+		listener: l,
+		handlers: map[string]Handler{},
+		conns:    map[net.Conn]*json.Encoder{},
+		received: make(chan struct{}),
+		exitOn:   map[string]bool{},
+	}
+
+	s.Reply("qmp_capabilities", struct{}{})
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Handle scripts the replies of command
+func (s *Server) Handle(command string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[command] = handler
+}
+
+// Reply makes command always return ret
+func (s *Server) Reply(command string, ret interface{}) {
+	s.Handle(command, func(json.RawMessage) (interface{}, error) {
+		return ret, nil
+	})
+}
+
+// Fail makes command always fail with the given error class and description
+func (s *Server) Fail(command, class, desc string) {
+	s.Handle(command, func(json.RawMessage) (interface{}, error) {
+		return nil, &qmp.Error{Class: class, Desc: desc}
+	})
+}
+
+// ExitOn makes the server close once it has replied to command, the way
+// QEMU exits after quit or a guest power off
+func (s *Server) ExitOn(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.exitOn[command] = true
+}
+
+// Emit sends an event to every connected client
+func (s *Server) Emit(event string, data interface{}) {
+	now := time.Now()
+	msg := map[string]interface{}{
+		"event": event,
+		"timestamp": map[string]int64{
+			"seconds":      now.Unix(),
+			"microseconds": int64(now.Nanosecond() / 1000),
+		},
+	}
+
+	if data != nil {
+		msg["data"] = data
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, encoder := range s.conns {
+		_ = encoder.Encode(msg)
+	}
+}
+
+// Commands returns the commands received so far, qmp_capabilities included
+func (s *Server) Commands() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Command{}, s.commands...)
+}
+
+// Received returns a channel closed on the next command received
+func (s *Server) Received() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.received
+}
+
+// Close stops the server and drops its connections
+func (s *Server) Close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+
+	s.mu.Lock()
+	s.conns[conn] = encoder
+	_ = encoder.Encode(map[string]interface{}{
+		"QMP": map[string]interface{}{
+			"version": map[string]interface{}{
+				"qemu":    map[string]int{"major": 6, "minor": 2, "micro": 0},
+				"package": "qmptest",
+			},
+			"capabilities": []string{},
+		},
+	})
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+			ID        json.RawMessage `json:"id"`
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return
+		}
+
+		reply := s.run(req.Execute, req.Arguments)
+		if req.ID != nil {
+			reply["id"] = req.ID
+		}
+
+		s.mu.Lock()
+		_ = encoder.Encode(reply)
+		exit := s.exitOn[req.Execute]
+		s.mu.Unlock()
+
+		if exit {
+			go s.Close()
+			return
+		}
+	}
+}
+
+// run records a command and returns its reply
+func (s *Server) run(command string, arguments json.RawMessage) map[string]interface{} {
+	s.mu.Lock()
+	s.commands = append(s.commands, Command{Name: command, Arguments: arguments})
+	handler, ok := s.handlers[command]
+	close(s.received)
+	s.received = make(chan struct{})
+	s.mu.Unlock()
+
+	if !ok {
+		return errorReply(&qmp.Error{
+			Class: "CommandNotFound",
+			Desc:  fmt.Sprintf("The command %v has not been found", command),
+		})
+	}
+
+	ret, err := handler(arguments)
+	if err != nil {
+		var qmpErr *qmp.Error
+		if !errors.As(err, &qmpErr) {
+			qmpErr = &qmp.Error{Class: "GenericError", Desc: err.Error()}
+		}
+
+		return errorReply(qmpErr)
+	}
+
+	if ret == nil {
+		ret = struct{}{}
+	}
+
+	return map[string]interface{}{"return": ret}
+}
+
+func errorReply(err *qmp.Error) map[string]interface{} {
+	return map[string]interface{}{"error": err}
+}
@@ -25,3 +25,8 @@ const (
 
 // DiskDefaultSizeGB is the default size of qcow2 root disk in GB.
 const DiskDefaultSizeGB = 50
+
+// RestartPolicies are the accepted VM restart policies. The empty policy
+// lets the engine pick its default.
+// nolint: gochecknoglobals
+var RestartPolicies = []string{"", "no", "always", "unless-stopped", "on-failure"}
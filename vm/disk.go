@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DisksDir is the directory of the VM data directory holding the data disks
+const DisksDir = "disks"
+
+// Data disk defaults
+const (
+	DefaultDiskFormat = "qcow2"
+	DefaultDiskBus    = "virtio"
+)
+
+// Accepted data disk formats and buses
+// nolint: gochecknoglobals
+var (
+	DiskFormats = []string{"qcow2", "raw"}
+	DiskBuses   = []string{"virtio", "scsi", "ide"}
+)
+
+// nolint: gochecknoglobals
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// ValidName reports whether name can name a disk, a checkpoint or a snapshot.
+// Names are made of letters, digits, '-' and '_'.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Disk is a blank data disk attached to a VM next to its root disk
+type Disk struct {
+	Name string `yaml:"name" json:"name"`
+	// Size is the disk size in GB
+	Size   int    `yaml:"size" json:"size"`
+	Format string `yaml:"format" json:"format,omitempty"`
+	Bus    string `yaml:"bus" json:"bus,omitempty"`
+	// Keep leaves the disk behind when the VM is removed. A new VM with the
+	// same name and disk gets it attached again.
+	Keep bool `yaml:"keep" json:"keep,omitempty"`
+}
+
+// File returns the path of the disk image relative to the VM data directory
+func (d Disk) File() string {
+	return filepath.Join(DisksDir, d.Name+"."+d.Format)
+}
+
+// CheckDisks validates the VM data disks and fills their defaults
+func (ins *Instance) CheckDisks() error {
+	names := map[string]bool{}
+
+	for i := range ins.Disks {
+		disk := &ins.Disks[i]
+
+		if disk.Format == "" {
+			disk.Format = DefaultDiskFormat
+		}
+
+		if disk.Bus == "" {
+			disk.Bus = DefaultDiskBus
+		}
+
+		switch {
+		case !ValidName(disk.Name):
+			return specError("disks", disk.Name,
+				errors.New("names are made of letters, digits, '-' and '_'"))
+		case names[disk.Name]:
+			return specError("disks", disk.Name, errors.New("duplicated disk name"))
+		case disk.Size <= 0:
+			return specError("disks", disk.Name, fmt.Errorf("invalid size %d GB", disk.Size))
+		case !contains(DiskFormats, disk.Format):
+			return specError("disks", disk.Name,
+				fmt.Errorf("format expected one of %v", strings.Join(DiskFormats, ", ")))
+		case !contains(DiskBuses, disk.Bus):
+			return specError("disks", disk.Name,
+				fmt.Errorf("bus expected one of %v", strings.Join(DiskBuses, ", ")))
+		}
+
+		names[disk.Name] = true
+	}
+
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, elem := range list {
+		if elem == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidSpec is matched by every SpecError, check it with errors.Is
+var ErrInvalidSpec = errors.New("invalid VM spec")
+
+// SpecError reports an Instance field that failed validation
+type SpecError struct {
+	// Field is the spec field name, as written in compose files
+	Field string
+	// Value is the offending value
+	Value string
+	// Err is the reason the value was rejected
+	Err error
+}
+
+func (e *SpecError) Error() string {
+	return fmt.Sprintf("invalid %v %q: %v", e.Field, e.Value, e.Err)
+}
+
+// Unwrap returns the underlying reason
+func (e *SpecError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrInvalidSpec) hold for every SpecError
+func (e *SpecError) Is(target error) bool {
+	return target == ErrInvalidSpec
+}
+
+func specError(field, value string, err error) error {
+	return &SpecError{Field: field, Value: value, Err: err}
+}
@@ -0,0 +1,32 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/govm-project/govm/internal"
+	"github.com/govm-project/govm/internal/images"
+)
+
+// CheckImage resolves the parent image, a file or the name of an image of the
+// store of the working directory, to an absolute path. Files come first.
+func (ins *Instance) CheckImage() error {
+	image := ins.ParentImage
+
+	path, err := internal.CheckFilePath(image)
+	if err == nil {
+		ins.ParentImage = path
+		return nil
+	}
+
+	stored, storeErr := images.New(ins.Workdir).Get(image)
+	if errors.Is(storeErr, images.ErrNotFound) {
+		return specError("image", image, fmt.Errorf("%w, nor is it a stored image", err))
+	} else if storeErr != nil {
+		return specError("image", image, storeErr)
+	}
+
+	ins.ParentImage = stored.Path
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package vm
+
+// Status is the lifecycle state of a VM as reported by its engine
+type Status string
+
+// VM lifecycle states
+const (
+	StatusCreated    Status = "created"
+	StatusRunning    Status = "running"
+	StatusPaused     Status = "paused"
+	StatusRestarting Status = "restarting"
+	StatusStopped    Status = "stopped"
+	StatusUnknown    Status = "unknown"
+)
@@ -3,11 +3,13 @@ package vm
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/govm-project/govm/internal"
 
@@ -16,13 +18,13 @@ import (
 
 // Size specifies all custome VM size fields
 type Size struct {
-	CPUModel string `yaml:"cpu-model"`
-	Sockets  int    `yaml:"sockets"`
-	Cpus     int    `yaml:"cpus"`
-	Cores    int    `yaml:"cores"`
-	Threads  int    `yaml:"threads"`
-	RAM      int    `yaml:"ram"`
-	DISK     int    `yaml:"disk"`
+	CPUModel string `yaml:"cpu-model" json:"cpu-model"`
+	Sockets  int    `yaml:"sockets" json:"sockets"`
+	Cpus     int    `yaml:"cpus" json:"cpus"`
+	Cores    int    `yaml:"cores" json:"cores"`
+	Threads  int    `yaml:"threads" json:"threads"`
+	RAM      int    `yaml:"ram" json:"ram"`
+	DISK     int    `yaml:"disk" json:"disk"`
 }
 
 //ConfigDriveMetaData stands for cloud images config drive
@@ -38,10 +40,10 @@ type ConfigDriveMetaData struct {
 
 //NetworkingOptions specifies network details for new VM
 type NetworkingOptions struct {
-	IP    string   `yaml:"ip"`
-	MAC   string   `yaml:"mac"`
-	NetID string   `yaml:"net-id"`
-	DNS   []string `yaml:"dns"`
+	IP    string   `yaml:"ip" json:"ip,omitempty"`
+	MAC   string   `yaml:"mac" json:"mac,omitempty"`
+	NetID string   `yaml:"net-id" json:"net-id,omitempty"`
+	DNS   []string `yaml:"dns" json:"dns,omitempty"`
 }
 
 // ComposeConfig defines a VMs orchestration template
@@ -52,29 +54,41 @@ type ComposeConfig struct {
 
 //Instance contains all VM's attributes
 type Instance struct {
-	ID               string            `yaml:"id"`
-	Name             string            `yaml:"name"`
-	Namespace        string            `yaml:"namespace"`
-	ParentImage      string            `yaml:"image"`
-	Flavor           string            `yaml:"flavor"`
-	Size             Size              `yaml:"size"`
-	Workdir          string            `yaml:"workdir"`
-	SSHPublicKeyFile string            `yaml:"sshkey"`
-	UserData         string            `yaml:"user-data"`
-	Cloud            bool              `yaml:"cloud"`
-	Efi              bool              `yaml:"efi"`
-	VNCPort          int64             `yaml:"vnc-port"`
-	NetOpts          NetworkingOptions `yaml:"network"`
-	Shares           []string          `yaml:"shares"`
-	ContainerEnvVars []string          `yaml:"ContainerEnvVars"`
+	ID               string            `yaml:"id" json:"id"`
+	Name             string            `yaml:"name" json:"name"`
+	Namespace        string            `yaml:"namespace" json:"namespace"`
+	ParentImage      string            `yaml:"image" json:"image,omitempty"`
+	Flavor           string            `yaml:"flavor" json:"flavor,omitempty"`
+	Size             Size              `yaml:"size" json:"size"`
+	Workdir          string            `yaml:"workdir" json:"workdir,omitempty"`
+	SSHPublicKeyFile string            `yaml:"sshkey" json:"sshkey,omitempty"`
+	UserData         string            `yaml:"user-data" json:"user-data,omitempty"`
+	Cloud            bool              `yaml:"cloud" json:"cloud"`
+	Efi              bool              `yaml:"efi" json:"efi"`
+	VNCPort          int64             `yaml:"vnc-port" json:"vnc-port,omitempty"`
+	NetOpts          NetworkingOptions `yaml:"network" json:"network"`
+	Shares           []string          `yaml:"shares" json:"shares,omitempty"`
+	ContainerEnvVars []string          `yaml:"ContainerEnvVars" json:"ContainerEnvVars,omitempty"`
+	RestartPolicy    string            `yaml:"restart-policy" json:"restart-policy,omitempty"`
+	Disks            []Disk            `yaml:"disks" json:"disks,omitempty"`
+	// UUID is the cloud-init instance ID, generated by Check. cloud-init
+	// runs its first boot modules again, e.g. new SSH host keys, whenever
+	// it changes.
+	UUID string `yaml:"uuid" json:"uuid,omitempty"`
+	// SSHUser is the default login of govm ssh, e.g. from the image catalog
+	SSHUser string `yaml:"ssh-user" json:"ssh-user,omitempty"`
+
+	// Runtime details filled by the engines, ignored on create
+	Status  Status            `yaml:"status,omitempty" json:"status,omitempty"`
+	Created time.Time         `yaml:"created,omitempty" json:"created,omitempty"`
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
 }
 
 // Check validates and fixes VMs values
 // nolint: gocyclo, funlen, gocognit
 func (ins *Instance) Check() (err error) {
-	ins.ParentImage, err = internal.CheckFilePath(ins.ParentImage)
-	if err != nil {
-		return
+	if err := ins.CheckImage(); err != nil {
+		return err
 	}
 
 	if ins.Name == "" {
@@ -90,7 +104,8 @@ func (ins *Instance) Check() (err error) {
 
 	// Check if user data is provided
 	if ins.UserData != "" {
-		ins.UserData, err = internal.CheckFilePath(ins.UserData)
+		userDataFile := ins.UserData
+		ins.UserData, err = internal.CheckFilePath(userDataFile)
 		if err == nil {
 			// Look for a script verifying the shebang
 			var validShebang bool
@@ -112,18 +127,19 @@ func (ins *Instance) Check() (err error) {
 			}
 
 			if !validShebang {
-				err = fmt.Errorf("unable to determine the user data content")
-				return err
+				return specError("user-data", userDataFile,
+					errors.New("unable to determine the user data content"))
 			}
 
 			err = ioutil.WriteFile(vmDataDirectory+"/user_data",
 				userData, 0664)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 
 			ins.UserData = vmDataDirectory + "/user_data"
-
+		} else {
+			return specError("user-data", userDataFile, err)
 		}
 	}
 
@@ -132,9 +148,10 @@ func (ins *Instance) Check() (err error) {
 	}
 
 	if ins.SSHPublicKeyFile != "" {
-		ins.SSHPublicKeyFile, err = internal.CheckFilePath(ins.SSHPublicKeyFile)
+		keyFile := ins.SSHPublicKeyFile
+		ins.SSHPublicKeyFile, err = internal.CheckFilePath(keyFile)
 		if err != nil {
-			return
+			return specError("sshkey", keyFile, err)
 		}
 	} else {
 		homeDir := internal.GetUserHomePath()
@@ -143,29 +160,26 @@ func (ins *Instance) Check() (err error) {
 
 	key, err := ioutil.ReadFile(ins.SSHPublicKeyFile)
 	if err != nil {
-		log.Fatal(err)
+		return specError("sshkey", ins.SSHPublicKeyFile, err)
 	}
 
 	ins.SSHPublicKeyFile = string(key)
 
-	// Check if there are any VM Shares (shared directories) and validate them
-	if len(ins.Shares) > 0 {
-		for _, dir := range ins.Shares {
-			share := strings.Split(dir, ":")
-			// Validate if the host share exists
-			stat, err := os.Stat(share[0])
-			if err != nil {
-				log.WithFields(log.Fields{
-					"share": share[0],
-				}).Fatal("Host directory does not exists.")
-			}
+	if err := ins.CheckShares(); err != nil {
+		return err
+	}
 
-			// Validate if it's a directory
-			if !stat.IsDir() {
-				log.WithFields(log.Fields{
-					"share": share[0],
-				}).Fatal("Host field is not a directory.")
-			}
+	if err := ins.CheckRestartPolicy(); err != nil {
+		return err
+	}
+
+	if err := ins.CheckDisks(); err != nil {
+		return err
+	}
+
+	if ins.UUID == "" {
+		if ins.UUID, err = internal.NewUUID(); err != nil {
+			return err
 		}
 	}
 
@@ -184,7 +198,7 @@ func (ins *Instance) Check() (err error) {
 		PublicKeys: map[string]string{
 			"mykey": ins.SSHPublicKeyFile,
 		},
-		UUID: "0",
+		UUID: ins.UUID,
 	}
 
 	metaDataJSON, err := json.Marshal(metaData)
@@ -202,6 +216,44 @@ func (ins *Instance) Check() (err error) {
 	return nil
 }
 
+// CheckShares validates the VM shares (shared directories)
+func (ins *Instance) CheckShares() error {
+	for _, dir := range ins.Shares {
+		share := strings.Split(dir, ":")
+		if len(share) != 2 {
+			return specError("shares", dir,
+				errors.New("expected <host-dir>:<guest-dir>"))
+		}
+
+		// Validate if the host share exists
+		stat, err := os.Stat(share[0])
+		if err != nil {
+			return specError("shares", dir,
+				errors.New("host directory does not exist"))
+		}
+
+		// Validate if it's a directory
+		if !stat.IsDir() {
+			return specError("shares", dir,
+				errors.New("host field is not a directory"))
+		}
+	}
+
+	return nil
+}
+
+// CheckRestartPolicy validates the VM restart policy
+func (ins *Instance) CheckRestartPolicy() error {
+	for _, policy := range RestartPolicies {
+		if ins.RestartPolicy == policy {
+			return nil
+		}
+	}
+
+	return specError("restart-policy", ins.RestartPolicy,
+		fmt.Errorf("expected one of %v", strings.Join(RestartPolicies[1:], ", ")))
+}
+
 //NewSize creates a new VMSize specification
 func NewSize(model string, sockets, cpus, cores, threads, ram, disk int) Size {
 	var vmSize Size
@@ -251,6 +303,14 @@ func NewSize(model string, sockets, cpus, cores, threads, ram, disk int) Size {
 	return vmSize
 }
 
+// DiskSizeGB returns the Size.DISK value, in GB rounded up, of a disk of the
+// given size in bytes
+func DiskSizeGB(bytes int64) int {
+	const gb = 1 << 30
+
+	return int((bytes + gb - 1) / gb)
+}
+
 //GetSizeFromFlavor gets default set of values from a given flavor
 func GetSizeFromFlavor(flavor string) (size Size) {
 	var cpuModel string
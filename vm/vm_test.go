@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/govm-project/govm/internal/images"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newTestInstance(t *testing.T) Instance {
+	workdir := t.TempDir()
+
+	image := filepath.Join(workdir, "image.qcow2")
+	assert.NilError(t, ioutil.WriteFile(image, []byte("image"), 0644))
+
+	key := filepath.Join(workdir, "id_rsa.pub")
+	assert.NilError(t, ioutil.WriteFile(key, []byte("ssh-rsa AAAA test"), 0644))
+
+	return Instance{
+		Name:             "vm",
+		Namespace:        "tester",
+		ParentImage:      image,
+		Workdir:          workdir,
+		SSHPublicKeyFile: key,
+		Size:             NewSize("qemu64", 1, 1, 1, 1, 1024, 10),
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ins := newTestInstance(t)
+	ins.Disks = []Disk{{Name: "data", Size: 100}}
+	assert.NilError(t, ins.Check())
+
+	assert.Equal(t, ins.SSHPublicKeyFile, "ssh-rsa AAAA test")
+	assert.Equal(t, ins.NetOpts.NetID, "bridge")
+	assert.DeepEqual(t, ins.Disks, []Disk{{Name: "data", Size: 100, Format: "qcow2", Bus: "virtio"}})
+	assert.Equal(t, ins.Disks[0].File(), "disks/data.qcow2")
+
+	data, err := ioutil.ReadFile(filepath.Join(ins.Workdir, "data", "vm", MedatataFile))
+	assert.NilError(t, err)
+
+	// The cloud-init instance ID is generated unless set
+	metaData := ConfigDriveMetaData{}
+	assert.NilError(t, json.Unmarshal(data, &metaData))
+	assert.Assert(t, is.Len(ins.UUID, 36))
+	assert.Equal(t, metaData.UUID, ins.UUID)
+
+	clone := newTestInstance(t)
+	clone.UUID = ins.UUID
+	assert.NilError(t, clone.Check())
+	assert.Equal(t, clone.UUID, ins.UUID)
+}
+
+func TestCheckStoredImage(t *testing.T) {
+	ins := newTestInstance(t)
+
+	img, err := images.New(ins.Workdir).Add(context.Background(), "base", ins.ParentImage, images.AddOptions{})
+	assert.NilError(t, err)
+
+	ins.ParentImage = "base"
+	assert.NilError(t, ins.Check())
+	assert.Equal(t, ins.ParentImage, img.Path)
+}
+
+func TestCheckInvalidSpec(t *testing.T) {
+	share := t.TempDir()
+	notADir := filepath.Join(share, "file")
+	assert.NilError(t, ioutil.WriteFile(notADir, []byte{}, 0644))
+
+	badUserData := filepath.Join(share, "user-data")
+	assert.NilError(t, ioutil.WriteFile(badUserData, []byte("hello\n"), 0644))
+
+	tests := []struct {
+		name  string
+		field string
+		edit  func(*Instance)
+	}{
+		{"missing image", "image", func(ins *Instance) { ins.ParentImage = "/nonexistent.img" }},
+		{"missing key", "sshkey", func(ins *Instance) { ins.SSHPublicKeyFile = "/nonexistent.pub" }},
+		{"missing user data", "user-data", func(ins *Instance) { ins.UserData = "/nonexistent" }},
+		{"bad user data", "user-data", func(ins *Instance) { ins.UserData = badUserData }},
+		{"share format", "shares", func(ins *Instance) { ins.Shares = []string{share} }},
+		{"missing share", "shares", func(ins *Instance) { ins.Shares = []string{"/nonexistent:/mnt"} }},
+		{"share not a dir", "shares", func(ins *Instance) { ins.Shares = []string{notADir + ":/mnt"} }},
+		{"disk name", "disks", func(ins *Instance) { ins.Disks = []Disk{{Name: "../data", Size: 1}} }},
+		{"disk size", "disks", func(ins *Instance) { ins.Disks = []Disk{{Name: "data"}} }},
+		{"disk format", "disks", func(ins *Instance) { ins.Disks = []Disk{{Name: "data", Size: 1, Format: "vmdk"}} }},
+		{"disk bus", "disks", func(ins *Instance) { ins.Disks = []Disk{{Name: "data", Size: 1, Bus: "usb"}} }},
+		{"duplicated disk", "disks", func(ins *Instance) {
+			ins.Disks = []Disk{{Name: "data", Size: 1}, {Name: "data", Size: 2}}
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ins := newTestInstance(t)
+			tc.edit(&ins)
+
+			err := ins.Check()
+			assert.Assert(t, errors.Is(err, ErrInvalidSpec), "got %v", err)
+
+			var specErr *SpecError
+			assert.Assert(t, errors.As(err, &specErr))
+			assert.Check(t, is.Equal(specErr.Field, tc.field))
+		})
+	}
+}